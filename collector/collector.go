@@ -0,0 +1,84 @@
+package collector
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/RedHatInsights/host-metering/hostinfo"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Metric is a single value of a named series.
+type Metric struct {
+	Name string
+	// Additional labels of the series, without __name__.
+	Labels []prompb.Label
+	Value  float64
+}
+
+// TimeSeries converts the metric to a series with a single sample.
+// Labels are sorted by name as required by remote write.
+func (m *Metric) TimeSeries(timestamp int64) prompb.TimeSeries {
+	labels := make([]prompb.Label, 0, len(m.Labels)+1)
+	labels = append(labels, prompb.Label{Name: "__name__", Value: m.Name})
+	labels = append(labels, m.Labels...)
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+	return prompb.TimeSeries{
+		Labels:  labels,
+		Samples: []prompb.Sample{{Value: m.Value, Timestamp: timestamp}},
+	}
+}
+
+type Collector interface {
+	// Name under which the collector is enabled in the configuration.
+	Name() string
+	// Collect returns current values. A collector which is not applicable
+	// on the host returns no metrics.
+	Collect(hostInfo *hostinfo.HostInfo) ([]Metric, error)
+}
+
+// Paths to filesystems the collectors read from.
+type Paths struct {
+	Proc string
+	Sys  string
+}
+
+var DefaultPaths = Paths{
+	Proc: "/proc",
+	Sys:  "/sys",
+}
+
+type Factory func(paths Paths) Collector
+
+var registry = map[string]Factory{}
+
+// Register makes the collector available under the given name.
+func Register(name string, factory Factory) {
+	registry[name] = factory
+}
+
+// Names returns sorted names of all registered collectors.
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the collectors registered under the given names.
+func New(names []string, paths Paths) ([]Collector, error) {
+	collectors := make([]Collector, 0, len(names))
+	for _, name := range names {
+		factory, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown collector '%s', available: %s",
+				name, strings.Join(Names(), ", "))
+		}
+		collectors = append(collectors, factory(paths))
+	}
+	return collectors, nil
+}
@@ -0,0 +1,111 @@
+package collector
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/RedHatInsights/host-metering/hostinfo"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestNew(t *testing.T) {
+	collectors, err := New([]string{CpuLogicalCount, MemoryTotalBytes}, DefaultPaths)
+	checkError(t, err, "failed to create collectors")
+	if len(collectors) != 2 || collectors[0].Name() != CpuLogicalCount || collectors[1].Name() != MemoryTotalBytes {
+		t.Fatalf("unexpected collectors: %v", collectors)
+	}
+
+	_, err = New([]string{"unknown"}, DefaultPaths)
+	checkExpectedError(t, err, "unknown collector 'unknown', available: "+
+		"system_cpu_core_count, system_cpu_entitlement, system_cpu_logical_count, "+
+		"system_cpu_online_count, system_cpu_socket_count, system_memory_total_bytes")
+}
+
+func TestMetricTimeSeries(t *testing.T) {
+	metric := &Metric{
+		Name: "test_metric",
+		Labels: []prompb.Label{
+			{Name: "b", Value: "2"},
+			{Name: "a", Value: "1"},
+		},
+		Value: 3,
+	}
+
+	series := metric.TimeSeries(1000)
+	expectedLabels := []string{"__name__", "a", "b"}
+	for idx, label := range series.Labels {
+		if label.Name != expectedLabels[idx] {
+			t.Fatalf("unexpected labels: %v", series.Labels)
+		}
+	}
+	if series.Labels[0].Value != "test_metric" {
+		t.Fatalf("unexpected metric name: %s", series.Labels[0].Value)
+	}
+	if len(series.Samples) != 1 || series.Samples[0].Value != 3 || series.Samples[0].Timestamp != 1000 {
+		t.Fatalf("unexpected samples: %v", series.Samples)
+	}
+}
+
+// Test that all registered metrics are described
+func TestMetadata(t *testing.T) {
+	for _, name := range Names() {
+		metadata, ok := MetadataOf(name)
+		if !ok || metadata.Type == "" || metadata.Help == "" {
+			t.Fatalf("missing metadata of %s: %v", name, metadata)
+		}
+	}
+
+	if _, ok := MetadataOf("unknown"); ok {
+		t.Fatalf("unexpected metadata of unknown metric")
+	}
+}
+
+func TestCpuLogicalCollector(t *testing.T) {
+	c := &cpuLogicalCollector{}
+	checkCollected(t, c, &hostinfo.HostInfo{CpuCount: 4}, 4)
+
+	_, err := c.Collect(nil)
+	checkExpectedError(t, err, "missing internal HostInfo")
+}
+
+// Helpers
+
+func checkCollected(t *testing.T, c Collector, hostInfo *hostinfo.HostInfo, expected ...float64) {
+	t.Helper()
+	metrics, err := c.Collect(hostInfo)
+	checkError(t, err, "failed to collect "+c.Name())
+	if len(metrics) != len(expected) {
+		t.Fatalf("expected %d metric(s), got %v", len(expected), metrics)
+	}
+	for idx, metric := range metrics {
+		if metric.Name != c.Name() || metric.Value != expected[idx] {
+			t.Fatalf("unexpected metric %s: %f != %f", metric.Name, metric.Value, expected[idx])
+		}
+	}
+}
+
+func createFile(t *testing.T, path string, content string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	checkError(t, err, "failed to create directory")
+	err = os.WriteFile(path, []byte(content), 0600)
+	checkError(t, err, "failed to create file")
+}
+
+func checkError(t *testing.T, err error, message string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", message, err)
+	}
+}
+
+func checkExpectedError(t *testing.T, err error, message string) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("expected error with message: %s", message)
+	}
+	if err.Error() != message {
+		t.Fatalf("unexpected error message: '%s' != '%s'", err.Error(), message)
+	}
+}
@@ -0,0 +1,148 @@
+package collector
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/RedHatInsights/host-metering/hostinfo"
+	"github.com/prometheus/procfs/sysfs"
+)
+
+const (
+	CpuLogicalCount = "system_cpu_logical_count"
+	CpuOnlineCount  = "system_cpu_online_count"
+	CpuCoreCount    = "system_cpu_core_count"
+	CpuSocketCount  = "system_cpu_socket_count"
+	CpuEntitlement  = "system_cpu_entitlement"
+)
+
+func init() {
+	Register(CpuLogicalCount, func(paths Paths) Collector { return &cpuLogicalCollector{} })
+	Register(CpuOnlineCount, func(paths Paths) Collector { return &cpuOnlineCollector{paths} })
+	Register(CpuCoreCount, func(paths Paths) Collector { return &cpuTopologyCollector{CpuCoreCount, paths} })
+	Register(CpuSocketCount, func(paths Paths) Collector { return &cpuTopologyCollector{CpuSocketCount, paths} })
+	Register(CpuEntitlement, func(paths Paths) Collector { return &cpuEntitlementCollector{paths} })
+
+	Describe(CpuLogicalCount, Metadata{Type: MetricTypeGauge, Help: "Number of logical CPUs of the host."})
+	Describe(CpuOnlineCount, Metadata{Type: MetricTypeGauge, Help: "Number of online CPUs of the host."})
+	Describe(CpuCoreCount, Metadata{Type: MetricTypeGauge, Help: "Number of physical CPU cores of the host."})
+	Describe(CpuSocketCount, Metadata{Type: MetricTypeGauge, Help: "Number of CPU sockets of the host."})
+	Describe(CpuEntitlement, Metadata{Type: MetricTypeGauge, Help: "Entitled processor capacity of the partition."})
+}
+
+// Logical CPU count is refreshed in HostInfo by the HostInfoProvider
+// before collection.
+type cpuLogicalCollector struct{}
+
+func (c *cpuLogicalCollector) Name() string {
+	return CpuLogicalCount
+}
+
+func (c *cpuLogicalCollector) Collect(hostInfo *hostinfo.HostInfo) ([]Metric, error) {
+	if hostInfo == nil {
+		return nil, fmt.Errorf("missing internal HostInfo")
+	}
+	return []Metric{{Name: CpuLogicalCount, Value: float64(hostInfo.CpuCount)}}, nil
+}
+
+type cpuOnlineCollector struct {
+	paths Paths
+}
+
+func (c *cpuOnlineCollector) Name() string {
+	return CpuOnlineCount
+}
+
+func (c *cpuOnlineCollector) Collect(hostInfo *hostinfo.HostInfo) ([]Metric, error) {
+	counter := &hostinfo.CPUCounter{Mode: hostinfo.CPUCountModeOnline, ProcPath: c.paths.Proc, SysPath: c.paths.Sys}
+	count, err := counter.Count()
+	if err != nil {
+		return nil, err
+	}
+	return []Metric{{Name: CpuOnlineCount, Value: float64(count)}}, nil
+}
+
+// cpuTopologyCollector counts physical cores or sockets of online CPUs.
+type cpuTopologyCollector struct {
+	name  string
+	paths Paths
+}
+
+func (c *cpuTopologyCollector) Name() string {
+	return c.name
+}
+
+func (c *cpuTopologyCollector) Collect(hostInfo *hostinfo.HostInfo) ([]Metric, error) {
+	fs, err := sysfs.NewFS(c.paths.Sys)
+	if err != nil {
+		return nil, err
+	}
+	cpus, err := fs.CPUs()
+	if err != nil {
+		return nil, err
+	}
+
+	cores := map[string]bool{}
+	sockets := map[string]bool{}
+	for _, cpu := range cpus {
+		topology, err := cpu.Topology()
+		if os.IsNotExist(err) {
+			// Offline CPUs don't have topology
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sockets[topology.PhysicalPackageID] = true
+		cores[topology.PhysicalPackageID+":"+topology.CoreID] = true
+	}
+
+	if len(sockets) == 0 {
+		return nil, fmt.Errorf("no CPU topology found")
+	}
+	count := len(cores)
+	if c.name == CpuSocketCount {
+		count = len(sockets)
+	}
+	return []Metric{{Name: c.name, Value: float64(count)}}, nil
+}
+
+// cpuEntitlementCollector reports entitled processor capacity of a PowerVM
+// logical partition. Other hosts don't report it.
+type cpuEntitlementCollector struct {
+	paths Paths
+}
+
+func (c *cpuEntitlementCollector) Name() string {
+	return CpuEntitlement
+}
+
+func (c *cpuEntitlementCollector) Collect(hostInfo *hostinfo.HostInfo) ([]Metric, error) {
+	file, err := os.Open(filepath.Join(c.paths.Proc, "powerpc/lparcfg"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		if !found || key != "partition_entitled_capacity" {
+			continue
+		}
+		// The capacity is in hundredths of a processor
+		capacity, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid partition_entitled_capacity: %w", err)
+		}
+		return []Metric{{Name: CpuEntitlement, Value: float64(capacity) / 100}}, nil
+	}
+	return nil, scanner.Err()
+}
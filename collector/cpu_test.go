@@ -0,0 +1,63 @@
+package collector
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCpuOnlineCollector(t *testing.T) {
+	paths := Paths{Sys: t.TempDir()}
+	c := &cpuOnlineCollector{paths}
+
+	createFile(t, paths.Sys+"/devices/system/cpu/online", "0-3,5,7-8\n")
+	checkCollected(t, c, nil, 7)
+
+	createFile(t, paths.Sys+"/devices/system/cpu/online", "0\n")
+	checkCollected(t, c, nil, 1)
+
+	createFile(t, paths.Sys+"/devices/system/cpu/online", "3-1\n")
+	_, err := c.Collect(nil)
+	checkExpectedError(t, err, paths.Sys+"/devices/system/cpu/online: invalid CPU list \"3-1\"")
+}
+
+func TestCpuTopologyCollectors(t *testing.T) {
+	paths := Paths{Sys: t.TempDir()}
+	cores := &cpuTopologyCollector{CpuCoreCount, paths}
+	sockets := &cpuTopologyCollector{CpuSocketCount, paths}
+
+	_, err := cores.Collect(nil)
+	checkExpectedError(t, err, "no CPU topology found")
+
+	// 2 sockets, 2 cores per socket, 2 threads per core
+	for cpu := 0; cpu < 8; cpu++ {
+		createCPUTopology(t, paths, cpu, cpu/4, (cpu/2)%2)
+	}
+	// Offline CPU without topology
+	createFile(t, paths.Sys+"/devices/system/cpu/cpu8/online", "0\n")
+
+	checkCollected(t, cores, nil, 4)
+	checkCollected(t, sockets, nil, 2)
+}
+
+func TestCpuEntitlementCollector(t *testing.T) {
+	paths := Paths{Proc: t.TempDir()}
+	c := &cpuEntitlementCollector{paths}
+
+	// Not a PowerVM partition
+	checkCollected(t, c, nil)
+
+	createFile(t, paths.Proc+"/powerpc/lparcfg", "lparcfg 1.9\n"+
+		"partition_id=4\n"+
+		"partition_entitled_capacity=150\n"+
+		"shared_processor_mode=1\n")
+	checkCollected(t, c, nil, 1.5)
+}
+
+func createCPUTopology(t *testing.T, paths Paths, cpu int, socket int, core int) {
+	t.Helper()
+	dir := fmt.Sprintf("%s/devices/system/cpu/cpu%d/topology/", paths.Sys, cpu)
+	createFile(t, dir+"physical_package_id", fmt.Sprintf("%d\n", socket))
+	createFile(t, dir+"core_id", fmt.Sprintf("%d\n", core))
+	createFile(t, dir+"core_siblings_list", "0-7\n")
+	createFile(t, dir+"thread_siblings_list", "0-1\n")
+}
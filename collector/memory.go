@@ -0,0 +1,38 @@
+package collector
+
+import (
+	"fmt"
+
+	"github.com/RedHatInsights/host-metering/hostinfo"
+	"github.com/prometheus/procfs"
+)
+
+const MemoryTotalBytes = "system_memory_total_bytes"
+
+func init() {
+	Register(MemoryTotalBytes, func(paths Paths) Collector { return &memoryTotalCollector{paths} })
+	Describe(MemoryTotalBytes, Metadata{Type: MetricTypeGauge, Unit: "bytes", Help: "Total usable memory of the host."})
+}
+
+type memoryTotalCollector struct {
+	paths Paths
+}
+
+func (c *memoryTotalCollector) Name() string {
+	return MemoryTotalBytes
+}
+
+func (c *memoryTotalCollector) Collect(hostInfo *hostinfo.HostInfo) ([]Metric, error) {
+	fs, err := procfs.NewFS(c.paths.Proc)
+	if err != nil {
+		return nil, err
+	}
+	meminfo, err := fs.Meminfo()
+	if err != nil {
+		return nil, err
+	}
+	if meminfo.MemTotalBytes == nil {
+		return nil, fmt.Errorf("missing MemTotal in meminfo")
+	}
+	return []Metric{{Name: MemoryTotalBytes, Value: float64(*meminfo.MemTotalBytes)}}, nil
+}
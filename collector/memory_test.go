@@ -0,0 +1,14 @@
+package collector
+
+import (
+	"testing"
+)
+
+func TestMemoryTotalCollector(t *testing.T) {
+	paths := Paths{Proc: t.TempDir()}
+	c := &memoryTotalCollector{paths}
+
+	createFile(t, paths.Proc+"/meminfo", "MemTotal:       16384 kB\n"+
+		"MemFree:         1024 kB\n")
+	checkCollected(t, c, nil, 16384*1024)
+}
@@ -0,0 +1,27 @@
+package collector
+
+// Types of metrics as defined by OpenMetrics.
+const (
+	MetricTypeCounter = "counter"
+	MetricTypeGauge   = "gauge"
+)
+
+// Metadata describes a metric to the receiving server.
+type Metadata struct {
+	Type string
+	Unit string
+	Help string
+}
+
+var metadata = map[string]Metadata{}
+
+// Describe sets metadata of the metric with the given name.
+func Describe(name string, m Metadata) {
+	metadata[name] = m
+}
+
+// MetadataOf returns metadata of the metric with the given name.
+func MetadataOf(name string) (Metadata, bool) {
+	m, ok := metadata[name]
+	return m, ok
+}
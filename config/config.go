@@ -2,6 +2,7 @@ package config
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strconv"
@@ -14,21 +15,61 @@ const (
 	SendHostnameNo  = "no"
 )
 
+const (
+	HostInfoSourceFiles  = "files"                // RHSM files, subscription-manager for missing values
+	HostInfoSourceDBus   = "dbus"                 // D-Bus API of rhsm.service
+	HostInfoSourceSubMan = "subscription-manager" // output of subscription-manager commands
+)
+
+const (
+	CpuCountModePresent = "present" // CPUs present in the host
+	CpuCountModeOnline  = "online"  // CPUs which are online
+	CpuCountModeCpuset  = "cpuset"  // CPUs of the cgroup cpuset of host-metering
+	CpuCountModeQuota   = "quota"   // vCPUs of the cgroup CPU quota of host-metering
+)
+
+const (
+	LabelModeSend = "send" // the label is sent as is
+	LabelModeDrop = "drop" // the label is not sent
+	LabelModeHash = "hash" // the label is sent as a keyed HMAC digest of its value
+)
+
+const (
+	WriteProtocolPrometheus   = "prometheus"    // Prometheus remote write 1.0
+	WriteProtocolPrometheusV2 = "prometheus-v2" // Prometheus remote write 2.0
+	WriteProtocolOTLP         = "otlp"          // OpenTelemetry protocol over HTTP
+)
+
 const (
 	DefaultConfigPath           = "/etc/host-metering.conf"
 	DefaultWriteUrl             = "http://localhost:9090/api/v1/write"
+	DefaultWriteProtocol        = WriteProtocolPrometheus
 	DefaultWriteInterval        = 600 * time.Second
+	DefaultWriteSplay           = DefaultWriteInterval
 	DefaultCertPath             = "/etc/pki/consumer/cert.pem"
 	DefaultKeyPath              = "/etc/pki/consumer/key.pem"
 	DefaultCollectInterval      = 0 * time.Second
 	DefaultLabelRefreshInterval = 86400 * time.Second
 	DefaultSendHostname         = SendHostnameYes
+	DefaultHostInfoSource       = HostInfoSourceSubMan
+	DefaultSubManTimeout        = 30 * time.Second
+	DefaultSubManCacheTTL       = 172800 * time.Second
+	DefaultHostInfoMaxStaleness = 172800 * time.Second
+	DefaultCpuCountMode         = CpuCountModeOnline
+	DefaultBillingModel         = ""
+	DefaultLabelHashKeyPath     = "/var/lib/host-metering/label-hash.key"
 	DefaultWriteRetryAttempts   = 8
 	DefaultWriteRetryMinInt     = 1 * time.Second
 	DefaultWriteRetryMaxInt     = 10 * time.Second
 	DefaultWriteTimeout         = 60 * time.Second
+	DefaultWriteMaxSamples      = 2000
+	DefaultWriteMaxBytes        = 1048576
 	DefaultMetricsMaxAge        = 5400 * time.Second
 	DefaultMetricsWALPath       = "/var/run/host-metering/metrics"
+	DefaultStatePath            = "/var/lib/host-metering/state.json"
+	DefaultControlSocketPath    = "/var/run/host-metering/control.sock"
+	DefaultShutdownGracePeriod  = 10 * time.Second
+	DefaultCollectors           = "system_cpu_logical_count"
 	DefaultLogLevel             = "INFO"
 	DefaultLogPath              = "" //Default to stderr, will be logged in journal.
 	DefaultInstanceID           = ""
@@ -36,18 +77,40 @@ const (
 
 type Config struct {
 	WriteUrl             string
+	WriteProtocol        string
 	WriteInterval        time.Duration
+	WriteSplay           time.Duration // maximum random delay of the first periodic write
 	CollectInterval      time.Duration
 	LabelRefreshInterval time.Duration
 	SendHostname         string
+	HostInfoSource       string
+	SubManTimeout        time.Duration // timeout of a subscription-manager command, 0 for no timeout
+	SubManCacheTTL       time.Duration // how long outputs of subscription-manager are reused on failure
+	HostInfoMaxStaleness time.Duration // how long values which fail to refresh are kept
+	CpuCountMode         string
+	BillingModel         string // billing model of hosts which are not on a marketplace
+	Marketplaces         []Marketplace
+	Labels               map[string]string // static labels of every series
+	LabelsAllow          []string          // only these labels are sent if set
+	LabelsDeny           []string          // labels which are not sent
+	Relabels             []Relabel
+	LabelModes           map[string]string // mode of labels by name, labels are sent by default
+	LabelHashKeyPath     string            // key of hashed labels, readable only by its owner
 	HostCertPath         string
 	HostCertKeyPath      string
 	WriteRetryAttempts   uint
 	WriteRetryMinInt     time.Duration
 	WriteRetryMaxInt     time.Duration
 	WriteTimeout         time.Duration
+	WriteMaxSamples      uint // maximum number of samples in a request, 0 for no limit
+	WriteMaxBytes        uint // maximum size of a request before compression, 0 for no limit
 	MetricsMaxAge        time.Duration
 	MetricsWALPath       string
+	StatePath            string
+	ControlSocketPath    string
+	ShutdownGracePeriod  time.Duration // time for the final flush on shutdown
+	Collectors           []string
+	Endpoints            []Endpoint
 	LogLevel             string // one of "ERROR", "WARN", "INFO", "DEBUG"
 	LogPath              string
 	InstanceID           string
@@ -56,18 +119,33 @@ type Config struct {
 func NewConfig() *Config {
 	return &Config{
 		WriteUrl:             DefaultWriteUrl,
+		WriteProtocol:        DefaultWriteProtocol,
 		WriteInterval:        DefaultWriteInterval,
+		WriteSplay:           DefaultWriteSplay,
 		HostCertPath:         DefaultCertPath,
 		HostCertKeyPath:      DefaultKeyPath,
 		CollectInterval:      DefaultCollectInterval,
 		LabelRefreshInterval: DefaultLabelRefreshInterval,
 		SendHostname:         DefaultSendHostname,
+		HostInfoSource:       DefaultHostInfoSource,
+		SubManTimeout:        DefaultSubManTimeout,
+		SubManCacheTTL:       DefaultSubManCacheTTL,
+		HostInfoMaxStaleness: DefaultHostInfoMaxStaleness,
+		CpuCountMode:         DefaultCpuCountMode,
+		BillingModel:         DefaultBillingModel,
+		LabelHashKeyPath:     DefaultLabelHashKeyPath,
 		WriteRetryAttempts:   DefaultWriteRetryAttempts,
 		WriteRetryMinInt:     DefaultWriteRetryMinInt,
 		WriteRetryMaxInt:     DefaultWriteRetryMaxInt,
 		WriteTimeout:         DefaultWriteTimeout,
+		WriteMaxSamples:      DefaultWriteMaxSamples,
+		WriteMaxBytes:        DefaultWriteMaxBytes,
 		MetricsMaxAge:        DefaultMetricsMaxAge,
 		MetricsWALPath:       DefaultMetricsWALPath,
+		StatePath:            DefaultStatePath,
+		ControlSocketPath:    DefaultControlSocketPath,
+		ShutdownGracePeriod:  DefaultShutdownGracePeriod,
+		Collectors:           parseList(DefaultCollectors),
 		LogLevel:             DefaultLogLevel,
 		LogPath:              DefaultLogPath,
 		InstanceID:           DefaultInstanceID,
@@ -79,24 +157,124 @@ func (c *Config) String() string {
 		[]string{
 			"Config:",
 			fmt.Sprintf("|  WriteUrl: %s", c.WriteUrl),
+			fmt.Sprintf("|  WriteProtocol: %s", c.WriteProtocol),
 			fmt.Sprintf("|  WriteIntervalSec: %.0f", c.WriteInterval.Seconds()),
+			fmt.Sprintf("|  WriteSplaySec: %.0f", c.WriteSplay.Seconds()),
 			fmt.Sprintf("|  HostCertPath: %s", c.HostCertPath),
 			fmt.Sprintf("|  HostCertKeyPath: %s", c.HostCertKeyPath),
 			fmt.Sprintf("|  CollectIntervalSec: %.0f", c.CollectInterval.Seconds()),
 			fmt.Sprintf("|  LabelRefreshIntervalSec: %.0f", c.LabelRefreshInterval.Seconds()),
 			fmt.Sprintf("|  SendHostname: %s", c.SendHostname),
+			fmt.Sprintf("|  HostInfoSource: %s", c.HostInfoSource),
+			fmt.Sprintf("|  SubManTimeoutSec: %.0f", c.SubManTimeout.Seconds()),
+			fmt.Sprintf("|  SubManCacheTTLSec: %.0f", c.SubManCacheTTL.Seconds()),
+			fmt.Sprintf("|  HostInfoMaxStalenessSec: %.0f", c.HostInfoMaxStaleness.Seconds()),
+			fmt.Sprintf("|  CpuCountMode: %s", c.CpuCountMode),
+			fmt.Sprintf("|  BillingModel: %s", c.BillingModel),
+			fmt.Sprintf("|  Marketplaces: %s", c.marketplacesString()),
+			fmt.Sprintf("|  Labels: %s", c.labelsString()),
+			fmt.Sprintf("|  LabelsAllow: %s", strings.Join(c.LabelsAllow, ",")),
+			fmt.Sprintf("|  LabelsDeny: %s", strings.Join(c.LabelsDeny, ",")),
+			fmt.Sprintf("|  Relabels: %s", c.relabelsString()),
+			fmt.Sprintf("|  LabelModes: %s", c.labelModesString()),
+			fmt.Sprintf("|  LabelHashKeyPath: %s", c.LabelHashKeyPath),
 			fmt.Sprintf("|  WriteRetryAttempts: %d", c.WriteRetryAttempts),
 			fmt.Sprintf("|  WriteRetryMinIntSec: %.0f", c.WriteRetryMinInt.Seconds()),
 			fmt.Sprintf("|  WriteRetryMaxIntSec: %.0f", c.WriteRetryMaxInt.Seconds()),
 			fmt.Sprintf("|  WriteTimeoutSec: %.0f", c.WriteTimeout.Seconds()),
+			fmt.Sprintf("|  WriteMaxSamples: %d", c.WriteMaxSamples),
+			fmt.Sprintf("|  WriteMaxBytes: %d", c.WriteMaxBytes),
 			fmt.Sprintf("|  MetricsMaxAgeSec: %.0f", c.MetricsMaxAge.Seconds()),
 			fmt.Sprintf("|  MetricsWALPath: %s", c.MetricsWALPath),
+			fmt.Sprintf("|  StatePath: %s", c.StatePath),
+			fmt.Sprintf("|  ControlSocketPath: %s", c.ControlSocketPath),
+			fmt.Sprintf("|  ShutdownGracePeriodSec: %.0f", c.ShutdownGracePeriod.Seconds()),
+			fmt.Sprintf("|  Collectors: %s", strings.Join(c.Collectors, ",")),
+			fmt.Sprintf("|  Endpoints: %s", c.endpointsString()),
 			fmt.Sprintf("|  LogLevel: %s", c.LogLevel),
 			fmt.Sprintf("|  LogPath: %s", c.LogPath),
 			fmt.Sprintf("|  InstanceID: %s", c.InstanceID),
 		}, "\n")
 }
 
+func (c *Config) endpointsString() string {
+	endpoints := make([]string, 0, len(c.Endpoints))
+	for _, endpoint := range c.Endpoints {
+		endpoints = append(endpoints, endpoint.String())
+	}
+	return strings.Join(endpoints, ",")
+}
+
+func (c *Config) endpointsMap() map[string]map[string]string {
+	endpoints := make(map[string]map[string]string, len(c.Endpoints))
+	for _, endpoint := range c.Endpoints {
+		endpoints[endpoint.Name] = endpoint.Options
+	}
+	return endpoints
+}
+
+// Diff lists options which differ in the other configuration,
+// one "Name: old -> new" item per option.
+func (c *Config) Diff(other *Config) []string {
+	var changes []string
+	lines := strings.Split(c.String(), "\n")
+	otherLines := strings.Split(other.String(), "\n")
+	for idx := 1; idx < len(lines) && idx < len(otherLines); idx++ {
+		if lines[idx] == otherLines[idx] {
+			continue
+		}
+		name, value, _ := strings.Cut(strings.TrimPrefix(lines[idx], "|  "), ": ")
+		_, otherValue, _ := strings.Cut(strings.TrimPrefix(otherLines[idx], "|  "), ": ")
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", name, value, otherValue))
+	}
+	return changes
+}
+
+// MarshalJSON encodes the configuration using the names of the configuration
+// file options.
+func (c *Config) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"write_url":                          c.WriteUrl,
+		"write_protocol":                     c.WriteProtocol,
+		"write_interval_sec":                 c.WriteInterval.Seconds(),
+		"write_splay_sec":                    c.WriteSplay.Seconds(),
+		"host_cert_path":                     c.HostCertPath,
+		"host_cert_key_path":                 c.HostCertKeyPath,
+		"collect_interval_sec":               c.CollectInterval.Seconds(),
+		"label_refresh_interval_sec":         c.LabelRefreshInterval.Seconds(),
+		"send_hostname":                      c.SendHostname,
+		"hostinfo_source":                    c.HostInfoSource,
+		"subscription_manager_timeout_sec":   c.SubManTimeout.Seconds(),
+		"subscription_manager_cache_ttl_sec": c.SubManCacheTTL.Seconds(),
+		"cpu_count_mode":                     c.CpuCountMode,
+		"billing_model":                      c.BillingModel,
+		"marketplaces":                       c.marketplacesMap(),
+		"labels":                             c.Labels,
+		"labels_allow":                       c.LabelsAllow,
+		"labels_deny":                        c.LabelsDeny,
+		"relabels":                           c.relabelsMap(),
+		"label_modes":                        c.LabelModes,
+		"label_hash_key_path":                c.LabelHashKeyPath,
+		"hostinfo_max_staleness_sec":         c.HostInfoMaxStaleness.Seconds(),
+		"write_retry_attempts":               c.WriteRetryAttempts,
+		"write_retry_min_int_sec":            c.WriteRetryMinInt.Seconds(),
+		"write_retry_max_int_sec":            c.WriteRetryMaxInt.Seconds(),
+		"write_timeout_sec":                  c.WriteTimeout.Seconds(),
+		"write_max_samples":                  c.WriteMaxSamples,
+		"write_max_bytes":                    c.WriteMaxBytes,
+		"metrics_max_age_sec":                c.MetricsMaxAge.Seconds(),
+		"metrics_wal_path":                   c.MetricsWALPath,
+		"state_path":                         c.StatePath,
+		"control_socket_path":                c.ControlSocketPath,
+		"shutdown_grace_period_sec":          c.ShutdownGracePeriod.Seconds(),
+		"collectors":                         c.Collectors,
+		"endpoints":                          c.endpointsMap(),
+		"log_level":                          c.LogLevel,
+		"log_path":                           c.LogPath,
+		"instance_id":                        c.InstanceID,
+	})
+}
+
 func (c *Config) UpdateFromEnvVars() error {
 	var err error
 	var multiError MultiError
@@ -104,10 +282,17 @@ func (c *Config) UpdateFromEnvVars() error {
 	if v := os.Getenv("HOST_METERING_WRITE_URL"); v != "" {
 		c.WriteUrl = v
 	}
+	if v := os.Getenv("HOST_METERING_WRITE_PROTOCOL"); v != "" {
+		c.WriteProtocol = v
+	}
 	if v := os.Getenv("HOST_METERING_WRITE_INTERVAL_SEC"); v != "" {
 		c.WriteInterval, err = parseSeconds("HOST_METERING_WRITE_INTERVAL_SEC", v, c.WriteInterval)
 		multiError.Add(err)
 	}
+	if v := os.Getenv("HOST_METERING_WRITE_SPLAY_SEC"); v != "" {
+		c.WriteSplay, err = parseSeconds("HOST_METERING_WRITE_SPLAY_SEC", v, c.WriteSplay)
+		multiError.Add(err)
+	}
 	if v := os.Getenv("HOST_METERING_HOST_CERT_PATH"); v != "" {
 		c.HostCertPath = v
 	}
@@ -125,6 +310,40 @@ func (c *Config) UpdateFromEnvVars() error {
 	if v := os.Getenv("HOST_METERING_SEND_HOSTNAME"); v != "" {
 		c.SendHostname = v
 	}
+	if v := os.Getenv("HOST_METERING_HOSTINFO_SOURCE"); v != "" {
+		c.HostInfoSource = v
+	}
+	if v := os.Getenv("HOST_METERING_SUBSCRIPTION_MANAGER_TIMEOUT_SEC"); v != "" {
+		c.SubManTimeout, err = parseSeconds("HOST_METERING_SUBSCRIPTION_MANAGER_TIMEOUT_SEC", v, c.SubManTimeout)
+		multiError.Add(err)
+	}
+	if v := os.Getenv("HOST_METERING_SUBSCRIPTION_MANAGER_CACHE_TTL_SEC"); v != "" {
+		c.SubManCacheTTL, err = parseSeconds("HOST_METERING_SUBSCRIPTION_MANAGER_CACHE_TTL_SEC", v, c.SubManCacheTTL)
+		multiError.Add(err)
+	}
+	if v := os.Getenv("HOST_METERING_HOSTINFO_MAX_STALENESS_SEC"); v != "" {
+		c.HostInfoMaxStaleness, err = parseSeconds("HOST_METERING_HOSTINFO_MAX_STALENESS_SEC", v, c.HostInfoMaxStaleness)
+		multiError.Add(err)
+	}
+	if v := os.Getenv("HOST_METERING_CPU_COUNT_MODE"); v != "" {
+		c.CpuCountMode = v
+	}
+	if v := os.Getenv("HOST_METERING_BILLING_MODEL"); v != "" {
+		c.BillingModel = v
+	}
+	if v := os.Getenv("HOST_METERING_LABELS_ALLOW"); v != "" {
+		c.LabelsAllow = parseList(v)
+	}
+	if v := os.Getenv("HOST_METERING_LABELS_DENY"); v != "" {
+		c.LabelsDeny = parseList(v)
+	}
+	if v := os.Getenv("HOST_METERING_LABEL_MODES"); v != "" {
+		c.LabelModes, err = parseLabelModes("HOST_METERING_LABEL_MODES", v, c.LabelModes)
+		multiError.Add(err)
+	}
+	if v := os.Getenv("HOST_METERING_LABEL_HASH_KEY_PATH"); v != "" {
+		c.LabelHashKeyPath = v
+	}
 	if v := os.Getenv("HOST_METERING_WRITE_RETRY_ATTEMPTS"); v != "" {
 		c.WriteRetryAttempts, err = parseUint("HOST_METERING_WRITE_RETRY_ATTEMPTS", v, c.WriteRetryAttempts)
 		multiError.Add(err)
@@ -141,6 +360,14 @@ func (c *Config) UpdateFromEnvVars() error {
 		c.WriteTimeout, err = parseSeconds("HOST_METERING_WRITE_TIMEOUT_SEC", v, c.WriteTimeout)
 		multiError.Add(err)
 	}
+	if v := os.Getenv("HOST_METERING_WRITE_MAX_SAMPLES"); v != "" {
+		c.WriteMaxSamples, err = parseUint("HOST_METERING_WRITE_MAX_SAMPLES", v, c.WriteMaxSamples)
+		multiError.Add(err)
+	}
+	if v := os.Getenv("HOST_METERING_WRITE_MAX_BYTES"); v != "" {
+		c.WriteMaxBytes, err = parseUint("HOST_METERING_WRITE_MAX_BYTES", v, c.WriteMaxBytes)
+		multiError.Add(err)
+	}
 	if v := os.Getenv("HOST_METERING_METRICS_MAX_AGE_SEC"); v != "" {
 		c.MetricsMaxAge, err = parseSeconds("HOST_METERING_METRICS_MAX_AGE_SEC", v, c.MetricsMaxAge)
 		multiError.Add(err)
@@ -148,6 +375,19 @@ func (c *Config) UpdateFromEnvVars() error {
 	if v := os.Getenv("HOST_METERING_METRICS_WAL_PATH"); v != "" {
 		c.MetricsWALPath = v
 	}
+	if v := os.Getenv("HOST_METERING_STATE_PATH"); v != "" {
+		c.StatePath = v
+	}
+	if v := os.Getenv("HOST_METERING_CONTROL_SOCKET_PATH"); v != "" {
+		c.ControlSocketPath = v
+	}
+	if v := os.Getenv("HOST_METERING_SHUTDOWN_GRACE_PERIOD_SEC"); v != "" {
+		c.ShutdownGracePeriod, err = parseSeconds("HOST_METERING_SHUTDOWN_GRACE_PERIOD_SEC", v, c.ShutdownGracePeriod)
+		multiError.Add(err)
+	}
+	if v := os.Getenv("HOST_METERING_COLLECTORS"); v != "" {
+		c.Collectors = parseList(v)
+	}
 	if v := os.Getenv("HOST_METERING_LOG_LEVEL"); v != "" {
 		c.LogLevel = v
 	}
@@ -219,62 +459,155 @@ func (c *Config) UpdateFromConfigFile(path string) error {
 
 	// Update config from parsed INI file
 	var multiError MultiError
-	section := "host-metering"
+	multiError.Add(c.updateFromOptions(config["host-metering"]))
+
+	endpoints, err := parseEndpoints(config)
+	multiError.Add(err)
+	if endpoints != nil {
+		c.Endpoints = endpoints
+	}
+
+	marketplaces, err := parseMarketplaces(config)
+	multiError.Add(err)
+	if marketplaces != nil {
+		c.Marketplaces = marketplaces
+	}
+
+	if labels, ok := config[LabelsSection]; ok {
+		c.Labels = labels
+	}
+
+	relabels, err := parseRelabels(config)
+	multiError.Add(err)
+	if relabels != nil {
+		c.Relabels = relabels
+	}
+
+	return multiError.ErrorOrNil()
+}
+
+// updateFromOptions updates the configuration from options of a section
+// of the configuration file.
+func (c *Config) updateFromOptions(options map[string]string) error {
+	var err error
+	var multiError MultiError
 
-	if v, ok := config[section]["write_url"]; ok {
+	if v, ok := options["write_url"]; ok {
 		c.WriteUrl = v
 	}
-	if v, ok := config[section]["write_interval_sec"]; ok {
+	if v, ok := options["write_protocol"]; ok {
+		c.WriteProtocol = v
+	}
+	if v, ok := options["write_interval_sec"]; ok {
 		c.WriteInterval, err = parseSeconds("write_interval_sec", v, c.WriteInterval)
 		multiError.Add(err)
 	}
-	if v, ok := config[section]["host_cert_path"]; ok {
+	if v, ok := options["write_splay_sec"]; ok {
+		c.WriteSplay, err = parseSeconds("write_splay_sec", v, c.WriteSplay)
+		multiError.Add(err)
+	}
+	if v, ok := options["host_cert_path"]; ok {
 		c.HostCertPath = v
 	}
-	if v, ok := config[section]["host_cert_key_path"]; ok {
+	if v, ok := options["host_cert_key_path"]; ok {
 		c.HostCertKeyPath = v
 	}
-	if v, ok := config[section]["collect_interval_sec"]; ok {
+	if v, ok := options["collect_interval_sec"]; ok {
 		c.CollectInterval, err = parseSeconds("collect_interval_sec", v, c.CollectInterval)
 		multiError.Add(err)
 	}
-	if v, ok := config[section]["label_refresh_interval_sec"]; ok {
+	if v, ok := options["label_refresh_interval_sec"]; ok {
 		c.LabelRefreshInterval, err = parseSeconds("label_refresh_interval_sec", v, c.LabelRefreshInterval)
 		multiError.Add(err)
 	}
-	if v, ok := config[section]["send_hostname"]; ok {
+	if v, ok := options["send_hostname"]; ok {
 		c.SendHostname = v
 	}
-	if v, ok := config[section]["write_retry_attempts"]; ok {
+	if v, ok := options["hostinfo_source"]; ok {
+		c.HostInfoSource = v
+	}
+	if v, ok := options["subscription_manager_timeout_sec"]; ok {
+		c.SubManTimeout, err = parseSeconds("subscription_manager_timeout_sec", v, c.SubManTimeout)
+		multiError.Add(err)
+	}
+	if v, ok := options["subscription_manager_cache_ttl_sec"]; ok {
+		c.SubManCacheTTL, err = parseSeconds("subscription_manager_cache_ttl_sec", v, c.SubManCacheTTL)
+		multiError.Add(err)
+	}
+	if v, ok := options["hostinfo_max_staleness_sec"]; ok {
+		c.HostInfoMaxStaleness, err = parseSeconds("hostinfo_max_staleness_sec", v, c.HostInfoMaxStaleness)
+		multiError.Add(err)
+	}
+	if v, ok := options["cpu_count_mode"]; ok {
+		c.CpuCountMode = v
+	}
+	if v, ok := options["billing_model"]; ok {
+		c.BillingModel = v
+	}
+	if v, ok := options["labels_allow"]; ok {
+		c.LabelsAllow = parseList(v)
+	}
+	if v, ok := options["labels_deny"]; ok {
+		c.LabelsDeny = parseList(v)
+	}
+	if v, ok := options["label_modes"]; ok {
+		c.LabelModes, err = parseLabelModes("label_modes", v, c.LabelModes)
+		multiError.Add(err)
+	}
+	if v, ok := options["label_hash_key_path"]; ok {
+		c.LabelHashKeyPath = v
+	}
+	if v, ok := options["write_retry_attempts"]; ok {
 		c.WriteRetryAttempts, err = parseUint("write_retry_attempts", v, c.WriteRetryAttempts)
 		multiError.Add(err)
 	}
-	if v, ok := config[section]["write_retry_min_int_sec"]; ok {
+	if v, ok := options["write_retry_min_int_sec"]; ok {
 		c.WriteRetryMinInt, err = parseSeconds("write_retry_min_int_sec", v, c.WriteRetryMinInt)
 		multiError.Add(err)
 	}
-	if v, ok := config[section]["write_retry_max_int_sec"]; ok {
+	if v, ok := options["write_retry_max_int_sec"]; ok {
 		c.WriteRetryMaxInt, err = parseSeconds("write_retry_max_int_sec", v, c.WriteRetryMaxInt)
 		multiError.Add(err)
 	}
-	if v, ok := config[section]["write_timeout_sec"]; ok {
+	if v, ok := options["write_timeout_sec"]; ok {
 		c.WriteTimeout, err = parseSeconds("write_timeout_sec", v, c.WriteTimeout)
 		multiError.Add(err)
 	}
-	if v, ok := config[section]["metrics_max_age_sec"]; ok {
+	if v, ok := options["write_max_samples"]; ok {
+		c.WriteMaxSamples, err = parseUint("write_max_samples", v, c.WriteMaxSamples)
+		multiError.Add(err)
+	}
+	if v, ok := options["write_max_bytes"]; ok {
+		c.WriteMaxBytes, err = parseUint("write_max_bytes", v, c.WriteMaxBytes)
+		multiError.Add(err)
+	}
+	if v, ok := options["metrics_max_age_sec"]; ok {
 		c.MetricsMaxAge, err = parseSeconds("metrics_max_age_sec", v, c.MetricsMaxAge)
 		multiError.Add(err)
 	}
-	if v, ok := config[section]["metrics_wal_path"]; ok {
+	if v, ok := options["metrics_wal_path"]; ok {
 		c.MetricsWALPath = v
 	}
-	if v, ok := config[section]["log_level"]; ok {
+	if v, ok := options["state_path"]; ok {
+		c.StatePath = v
+	}
+	if v, ok := options["control_socket_path"]; ok {
+		c.ControlSocketPath = v
+	}
+	if v, ok := options["shutdown_grace_period_sec"]; ok {
+		c.ShutdownGracePeriod, err = parseSeconds("shutdown_grace_period_sec", v, c.ShutdownGracePeriod)
+		multiError.Add(err)
+	}
+	if v, ok := options["collectors"]; ok {
+		c.Collectors = parseList(v)
+	}
+	if v, ok := options["log_level"]; ok {
 		c.LogLevel = v
 	}
-	if v, ok := config[section]["log_path"]; ok {
+	if v, ok := options["log_path"]; ok {
 		c.LogPath = v
 	}
-	if v, ok := config[section]["instance_id"]; ok {
+	if v, ok := options["instance_id"]; ok {
 		c.InstanceID = v
 	}
 
@@ -301,11 +634,28 @@ func parseSeconds(name string, value string, defaultValue time.Duration) (time.D
 	return time.Duration(parsedValue) * time.Second, nil
 }
 
+// parseList parses comma separated values, empty values are skipped.
+func parseList(value string) []string {
+	result := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
 type MultiError struct {
 	errors []error
 }
 
 func (e *MultiError) Add(err error) {
+	// Keep the errors flat when merging errors of nested parsers.
+	if multiError, ok := err.(*MultiError); ok {
+		e.errors = append(e.errors, multiError.errors...)
+		return
+	}
 	if err != nil {
 		e.errors = append(e.errors, err)
 	}
@@ -4,6 +4,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestDefaultConfig(t *testing.T) {
@@ -13,18 +14,40 @@ func TestDefaultConfig(t *testing.T) {
 	// Define the expected defaults.
 	expectedCfg := "Config:\n" +
 		"|  WriteUrl: http://localhost:9090/api/v1/write\n" +
+		"|  WriteProtocol: prometheus\n" +
 		"|  WriteIntervalSec: 600\n" +
+		"|  WriteSplaySec: 600\n" +
 		"|  HostCertPath: /etc/pki/consumer/cert.pem\n" +
 		"|  HostCertKeyPath: /etc/pki/consumer/key.pem\n" +
 		"|  CollectIntervalSec: 0\n" +
 		"|  LabelRefreshIntervalSec: 86400\n" +
 		"|  SendHostname: yes\n" +
+		"|  HostInfoSource: subscription-manager\n" +
+		"|  SubManTimeoutSec: 30\n" +
+		"|  SubManCacheTTLSec: 172800\n" +
+		"|  HostInfoMaxStalenessSec: 172800\n" +
+		"|  CpuCountMode: online\n" +
+		"|  BillingModel: \n" +
+		"|  Marketplaces: \n" +
+		"|  Labels: \n" +
+		"|  LabelsAllow: \n" +
+		"|  LabelsDeny: \n" +
+		"|  Relabels: \n" +
+		"|  LabelModes: \n" +
+		"|  LabelHashKeyPath: /var/lib/host-metering/label-hash.key\n" +
 		"|  WriteRetryAttempts: 8\n" +
 		"|  WriteRetryMinIntSec: 1\n" +
 		"|  WriteRetryMaxIntSec: 10\n" +
 		"|  WriteTimeoutSec: 60\n" +
+		"|  WriteMaxSamples: 2000\n" +
+		"|  WriteMaxBytes: 1048576\n" +
 		"|  MetricsMaxAgeSec: 5400\n" +
 		"|  MetricsWALPath: /var/run/host-metering/metrics\n" +
+		"|  StatePath: /var/lib/host-metering/state.json\n" +
+		"|  ControlSocketPath: /var/run/host-metering/control.sock\n" +
+		"|  ShutdownGracePeriodSec: 10\n" +
+		"|  Collectors: system_cpu_logical_count\n" +
+		"|  Endpoints: \n" +
 		"|  LogLevel: INFO\n" +
 		"|  LogPath: \n" +
 		"|  InstanceID: \n"
@@ -61,18 +84,40 @@ func TestConfigFile(t *testing.T) {
 	// Define the expected configuration.
 	expectedCfg := "Config:\n" +
 		"|  WriteUrl: http://test/url\n" +
+		"|  WriteProtocol: prometheus-v2\n" +
 		"|  WriteIntervalSec: 10\n" +
+		"|  WriteSplaySec: 5\n" +
 		"|  HostCertPath: /tmp/cert.pem\n" +
 		"|  HostCertKeyPath: /tmp/key.pem\n" +
 		"|  CollectIntervalSec: 20\n" +
 		"|  LabelRefreshIntervalSec: 300\n" +
 		"|  SendHostname: no\n" +
+		"|  HostInfoSource: dbus\n" +
+		"|  SubManTimeoutSec: 15\n" +
+		"|  SubManCacheTTLSec: 3600\n" +
+		"|  HostInfoMaxStalenessSec: 7200\n" +
+		"|  CpuCountMode: quota\n" +
+		"|  BillingModel: direct\n" +
+		"|  Marketplaces: hetzner[account_fact=hetzner_project_id instance_fact=hetzner_server_id]\n" +
+		"|  Labels: cluster=east,environment=prod\n" +
+		"|  LabelsAllow: _id,display_name\n" +
+		"|  LabelsDeny: display_name\n" +
+		"|  Relabels: shard[action=hashmod modulus=4 regex=(.*) replacement=$1 separator=; source_labels=_id target_label=shard]\n" +
+		"|  LabelModes: billing_marketplace_account:hash,display_name:drop\n" +
+		"|  LabelHashKeyPath: /tmp/label-hash.key\n" +
 		"|  WriteRetryAttempts: 4\n" +
 		"|  WriteRetryMinIntSec: 5\n" +
 		"|  WriteRetryMaxIntSec: 6\n" +
 		"|  WriteTimeoutSec: 6\n" +
+		"|  WriteMaxSamples: 500\n" +
+		"|  WriteMaxBytes: 65536\n" +
 		"|  MetricsMaxAgeSec: 700\n" +
 		"|  MetricsWALPath: /tmp/metrics\n" +
+		"|  StatePath: /tmp/state.json\n" +
+		"|  ControlSocketPath: /tmp/control.sock\n" +
+		"|  ShutdownGracePeriodSec: 30\n" +
+		"|  Collectors: system_cpu_logical_count,system_memory_total_bytes\n" +
+		"|  Endpoints: audit[write_timeout_sec=3 write_url=http://audit/url],prod[write_protocol=otlp]\n" +
 		"|  LogLevel: ERROR\n" +
 		"|  LogPath: /tmp/log\n" +
 		"|  InstanceID: test-instance\n"
@@ -81,22 +126,56 @@ func TestConfigFile(t *testing.T) {
 	fileContent := "[host-metering]\n" +
 		"# Ignore comments and empty lines.\n\n" +
 		"write_url = http://test/url\n" +
+		"write_protocol = prometheus-v2\n" +
 		"write_interval_sec = 10\n" +
+		"write_splay_sec = 5\n" +
 		"host_cert_path = /tmp/cert.pem\n" +
 		"host_cert_key_path = /tmp/key.pem\n" +
 		"collect_interval_sec = 20\n" +
 		"; And also these comments.\n" +
 		"label_refresh_interval_sec = 300\n" +
 		"send_hostname = no\n" +
+		"hostinfo_source = dbus\n" +
+		"subscription_manager_timeout_sec = 15\n" +
+		"subscription_manager_cache_ttl_sec = 3600\n" +
+		"hostinfo_max_staleness_sec = 7200\n" +
+		"cpu_count_mode = quota\n" +
+		"billing_model = direct\n" +
+		"labels_allow = _id, display_name\n" +
+		"labels_deny = display_name\n" +
+		"label_modes = display_name:drop, billing_marketplace_account:hash\n" +
+		"label_hash_key_path = /tmp/label-hash.key\n" +
 		"write_retry_attempts = 4\n" +
 		"write_retry_min_int_sec = 5\n" +
 		"write_retry_max_int_sec = 6\n" +
 		"write_timeout_sec = 6\n" +
+		"write_max_samples = 500\n" +
+		"write_max_bytes = 65536\n" +
 		"metrics_max_age_sec = 700\n" +
 		"metrics_wal_path = /tmp/metrics\n" +
+		"state_path = /tmp/state.json\n" +
+		"control_socket_path = /tmp/control.sock\n" +
+		"shutdown_grace_period_sec = 30\n" +
+		"collectors = system_cpu_logical_count, system_memory_total_bytes\n" +
 		"log_level = ERROR\n" +
 		"log_path = /tmp/log\n" +
-		"instance_id = test-instance\n"
+		"instance_id = test-instance\n" +
+		"[endpoint.prod]\n" +
+		"write_protocol = otlp\n" +
+		"[endpoint.audit]\n" +
+		"write_url = http://audit/url\n" +
+		"write_timeout_sec = 3\n" +
+		"[marketplace.hetzner]\n" +
+		"instance_fact = hetzner_server_id\n" +
+		"account_fact = hetzner_project_id\n" +
+		"[labels]\n" +
+		"environment = prod\n" +
+		"cluster = east\n" +
+		"[relabel.shard]\n" +
+		"action = hashmod\n" +
+		"source_labels = _id\n" +
+		"target_label = shard\n" +
+		"modulus = 4\n"
 
 	c := NewConfig()
 
@@ -109,26 +188,36 @@ func TestConfigFile(t *testing.T) {
 	// Don't update the configuration from a invalid config file.
 	fileContent = "[host-metering]\n" +
 		"write_interval_sec = a\n" +
+		"write_splay_sec = k\n" +
 		"collect_interval_sec = b\n" +
 		"label_refresh_interval_sec = c\n" +
+		"label_modes = display_name\n" +
 		"write_retry_attempts = d\n" +
 		"write_retry_min_int_sec = e\n" +
 		"write_retry_max_int_sec = f\n" +
 		"write_timeout_sec = g\n" +
-		"metrics_max_age_sec = h\n"
+		"write_max_samples = i\n" +
+		"write_max_bytes = j\n" +
+		"metrics_max_age_sec = h\n" +
+		"shutdown_grace_period_sec = l\n"
 
 	createConfigFile(t, path, fileContent)
 	err = c.UpdateFromConfigFile(path)
 
 	expectedMsg := "multiple errors occurred:\n" +
 		"invalid value of 'write_interval_sec': strconv.ParseUint: parsing \"a\": invalid syntax\n" +
+		"invalid value of 'write_splay_sec': strconv.ParseUint: parsing \"k\": invalid syntax\n" +
 		"invalid value of 'collect_interval_sec': strconv.ParseUint: parsing \"b\": invalid syntax\n" +
 		"invalid value of 'label_refresh_interval_sec': strconv.ParseUint: parsing \"c\": invalid syntax\n" +
+		"invalid value of 'label_modes': missing mode of label 'display_name'\n" +
 		"invalid value of 'write_retry_attempts': strconv.ParseUint: parsing \"d\": invalid syntax\n" +
 		"invalid value of 'write_retry_min_int_sec': strconv.ParseUint: parsing \"e\": invalid syntax\n" +
 		"invalid value of 'write_retry_max_int_sec': strconv.ParseUint: parsing \"f\": invalid syntax\n" +
 		"invalid value of 'write_timeout_sec': strconv.ParseUint: parsing \"g\": invalid syntax\n" +
-		"invalid value of 'metrics_max_age_sec': strconv.ParseUint: parsing \"h\": invalid syntax\n"
+		"invalid value of 'write_max_samples': strconv.ParseUint: parsing \"i\": invalid syntax\n" +
+		"invalid value of 'write_max_bytes': strconv.ParseUint: parsing \"j\": invalid syntax\n" +
+		"invalid value of 'metrics_max_age_sec': strconv.ParseUint: parsing \"h\": invalid syntax\n" +
+		"invalid value of 'shutdown_grace_period_sec': strconv.ParseUint: parsing \"l\": invalid syntax\n"
 
 	checkString(t, err.Error(), expectedMsg)
 	checkString(t, c.String(), expectedCfg)
@@ -142,36 +231,76 @@ func TestEnvVariables(t *testing.T) {
 	// Define the expected configuration.
 	expectedCfg := "Config:\n" +
 		"|  WriteUrl: http://test/url\n" +
+		"|  WriteProtocol: prometheus-v2\n" +
 		"|  WriteIntervalSec: 10\n" +
+		"|  WriteSplaySec: 5\n" +
 		"|  HostCertPath: /tmp/cert.pem\n" +
 		"|  HostCertKeyPath: /tmp/key.pem\n" +
 		"|  CollectIntervalSec: 20\n" +
 		"|  LabelRefreshIntervalSec: 300\n" +
 		"|  SendHostname: no\n" +
+		"|  HostInfoSource: dbus\n" +
+		"|  SubManTimeoutSec: 15\n" +
+		"|  SubManCacheTTLSec: 3600\n" +
+		"|  HostInfoMaxStalenessSec: 7200\n" +
+		"|  CpuCountMode: quota\n" +
+		"|  BillingModel: direct\n" +
+		"|  Marketplaces: \n" +
+		"|  Labels: \n" +
+		"|  LabelsAllow: _id,usage\n" +
+		"|  LabelsDeny: display_name\n" +
+		"|  Relabels: \n" +
+		"|  LabelModes: display_name:hash\n" +
+		"|  LabelHashKeyPath: /tmp/label-hash.key\n" +
 		"|  WriteRetryAttempts: 4\n" +
 		"|  WriteRetryMinIntSec: 5\n" +
 		"|  WriteRetryMaxIntSec: 6\n" +
 		"|  WriteTimeoutSec: 6\n" +
+		"|  WriteMaxSamples: 500\n" +
+		"|  WriteMaxBytes: 65536\n" +
 		"|  MetricsMaxAgeSec: 700\n" +
 		"|  MetricsWALPath: /tmp/metrics\n" +
+		"|  StatePath: /tmp/state.json\n" +
+		"|  ControlSocketPath: /tmp/control.sock\n" +
+		"|  ShutdownGracePeriodSec: 30\n" +
+		"|  Collectors: system_cpu_logical_count,system_memory_total_bytes\n" +
+		"|  Endpoints: \n" +
 		"|  LogLevel: ERROR\n" +
 		"|  LogPath: /tmp/log\n" +
 		"|  InstanceID: test-instance\n"
 
 	// Set valid environment variables.
 	t.Setenv("HOST_METERING_WRITE_URL", "http://test/url")
+	t.Setenv("HOST_METERING_WRITE_PROTOCOL", "prometheus-v2")
 	t.Setenv("HOST_METERING_WRITE_INTERVAL_SEC", "10")
+	t.Setenv("HOST_METERING_WRITE_SPLAY_SEC", "5")
 	t.Setenv("HOST_METERING_HOST_CERT_PATH", "/tmp/cert.pem")
 	t.Setenv("HOST_METERING_HOST_CERT_KEY_PATH", "/tmp/key.pem")
 	t.Setenv("HOST_METERING_COLLECT_INTERVAL_SEC", "20")
 	t.Setenv("HOST_METERING_SEND_HOSTNAME", "no")
+	t.Setenv("HOST_METERING_HOSTINFO_SOURCE", "dbus")
+	t.Setenv("HOST_METERING_SUBSCRIPTION_MANAGER_TIMEOUT_SEC", "15")
+	t.Setenv("HOST_METERING_SUBSCRIPTION_MANAGER_CACHE_TTL_SEC", "3600")
+	t.Setenv("HOST_METERING_HOSTINFO_MAX_STALENESS_SEC", "7200")
+	t.Setenv("HOST_METERING_CPU_COUNT_MODE", "quota")
+	t.Setenv("HOST_METERING_BILLING_MODEL", "direct")
+	t.Setenv("HOST_METERING_LABELS_ALLOW", "_id,usage")
+	t.Setenv("HOST_METERING_LABELS_DENY", "display_name")
+	t.Setenv("HOST_METERING_LABEL_MODES", "display_name:hash")
+	t.Setenv("HOST_METERING_LABEL_HASH_KEY_PATH", "/tmp/label-hash.key")
 	t.Setenv("HOST_METERING_LABEL_REFRESH_INTERVAL_SEC", "300")
 	t.Setenv("HOST_METERING_WRITE_RETRY_ATTEMPTS", "4")
 	t.Setenv("HOST_METERING_WRITE_RETRY_MIN_INT_SEC", "5")
 	t.Setenv("HOST_METERING_WRITE_RETRY_MAX_INT_SEC", "6")
 	t.Setenv("HOST_METERING_WRITE_TIMEOUT_SEC", "6")
+	t.Setenv("HOST_METERING_WRITE_MAX_SAMPLES", "500")
+	t.Setenv("HOST_METERING_WRITE_MAX_BYTES", "65536")
 	t.Setenv("HOST_METERING_METRICS_MAX_AGE_SEC", "700")
 	t.Setenv("HOST_METERING_METRICS_WAL_PATH", "/tmp/metrics")
+	t.Setenv("HOST_METERING_STATE_PATH", "/tmp/state.json")
+	t.Setenv("HOST_METERING_CONTROL_SOCKET_PATH", "/tmp/control.sock")
+	t.Setenv("HOST_METERING_SHUTDOWN_GRACE_PERIOD_SEC", "30")
+	t.Setenv("HOST_METERING_COLLECTORS", "system_cpu_logical_count,system_memory_total_bytes")
 	t.Setenv("HOST_METERING_LOG_LEVEL", "ERROR")
 	t.Setenv("HOST_METERING_LOG_PATH", "/tmp/log")
 	t.Setenv("HOST_METERING_INSTANCE_ID", "test-instance")
@@ -185,48 +314,92 @@ func TestEnvVariables(t *testing.T) {
 
 	// Set invalid environment variables.
 	t.Setenv("HOST_METERING_WRITE_INTERVAL_SEC", "a")
+	t.Setenv("HOST_METERING_WRITE_SPLAY_SEC", "k")
 	t.Setenv("HOST_METERING_COLLECT_INTERVAL_SEC", "b")
 	t.Setenv("HOST_METERING_LABEL_REFRESH_INTERVAL_SEC", "c")
 	t.Setenv("HOST_METERING_WRITE_RETRY_ATTEMPTS", "d")
 	t.Setenv("HOST_METERING_WRITE_RETRY_MIN_INT_SEC", "e")
 	t.Setenv("HOST_METERING_WRITE_RETRY_MAX_INT_SEC", "f")
 	t.Setenv("HOST_METERING_WRITE_TIMEOUT_SEC", "g")
+	t.Setenv("HOST_METERING_WRITE_MAX_SAMPLES", "i")
+	t.Setenv("HOST_METERING_WRITE_MAX_BYTES", "j")
 	t.Setenv("HOST_METERING_METRICS_MAX_AGE_SEC", "h")
+	t.Setenv("HOST_METERING_SHUTDOWN_GRACE_PERIOD_SEC", "l")
 
 	// Environment variables are invalid. Keep the previous configuration.
 	err = c.UpdateFromEnvVars()
 
 	expectedMsg := "multiple errors occurred:\n" +
 		"invalid value of 'HOST_METERING_WRITE_INTERVAL_SEC': strconv.ParseUint: parsing \"a\": invalid syntax\n" +
+		"invalid value of 'HOST_METERING_WRITE_SPLAY_SEC': strconv.ParseUint: parsing \"k\": invalid syntax\n" +
 		"invalid value of 'HOST_METERING_COLLECT_INTERVAL_SEC': strconv.ParseUint: parsing \"b\": invalid syntax\n" +
 		"invalid value of 'HOST_METERING_LABEL_REFRESH_INTERVAL_SEC': strconv.ParseUint: parsing \"c\": invalid syntax\n" +
 		"invalid value of 'HOST_METERING_WRITE_RETRY_ATTEMPTS': strconv.ParseUint: parsing \"d\": invalid syntax\n" +
 		"invalid value of 'HOST_METERING_WRITE_RETRY_MIN_INT_SEC': strconv.ParseUint: parsing \"e\": invalid syntax\n" +
 		"invalid value of 'HOST_METERING_WRITE_RETRY_MAX_INT_SEC': strconv.ParseUint: parsing \"f\": invalid syntax\n" +
 		"invalid value of 'HOST_METERING_WRITE_TIMEOUT_SEC': strconv.ParseUint: parsing \"g\": invalid syntax\n" +
-		"invalid value of 'HOST_METERING_METRICS_MAX_AGE_SEC': strconv.ParseUint: parsing \"h\": invalid syntax\n"
+		"invalid value of 'HOST_METERING_WRITE_MAX_SAMPLES': strconv.ParseUint: parsing \"i\": invalid syntax\n" +
+		"invalid value of 'HOST_METERING_WRITE_MAX_BYTES': strconv.ParseUint: parsing \"j\": invalid syntax\n" +
+		"invalid value of 'HOST_METERING_METRICS_MAX_AGE_SEC': strconv.ParseUint: parsing \"h\": invalid syntax\n" +
+		"invalid value of 'HOST_METERING_SHUTDOWN_GRACE_PERIOD_SEC': strconv.ParseUint: parsing \"l\": invalid syntax\n"
 
 	checkString(t, c.String(), expectedCfg)
 	checkString(t, err.Error(), expectedMsg)
 
 }
 
+func TestConfigDiff(t *testing.T) {
+	c := NewConfig()
+	other := NewConfig()
+
+	if changes := c.Diff(other); len(changes) != 0 {
+		t.Fatalf("expected no changes, got: %v", changes)
+	}
+
+	other.WriteUrl = "http://test/url"
+	other.WriteInterval = 10 * time.Second
+	other.LogPath = "/tmp/log"
+
+	expected := "WriteUrl: http://localhost:9090/api/v1/write -> http://test/url\n" +
+		"WriteIntervalSec: 600 -> 10\n" +
+		"LogPath:  -> /tmp/log\n"
+	checkString(t, strings.Join(c.Diff(other), "\n"), expected)
+}
+
 func clearEnvironment() {
 	// Make sure that these environment variables are unset.
 	// WARNING: They won't be restored after the test.
 	_ = os.Unsetenv("HOST_METERING_WRITE_URL")
+	_ = os.Unsetenv("HOST_METERING_WRITE_PROTOCOL")
 	_ = os.Unsetenv("HOST_METERING_WRITE_INTERVAL_SEC")
+	_ = os.Unsetenv("HOST_METERING_WRITE_SPLAY_SEC")
 	_ = os.Unsetenv("HOST_METERING_HOST_CERT_PATH")
 	_ = os.Unsetenv("HOST_METERING_HOST_CERT_KEY_PATH")
 	_ = os.Unsetenv("HOST_METERING_COLLECT_INTERVAL_SEC")
 	_ = os.Unsetenv("HOST_METERING_SEND_HOSTNAME")
+	_ = os.Unsetenv("HOST_METERING_HOSTINFO_SOURCE")
+	_ = os.Unsetenv("HOST_METERING_SUBSCRIPTION_MANAGER_TIMEOUT_SEC")
+	_ = os.Unsetenv("HOST_METERING_SUBSCRIPTION_MANAGER_CACHE_TTL_SEC")
+	_ = os.Unsetenv("HOST_METERING_HOSTINFO_MAX_STALENESS_SEC")
+	_ = os.Unsetenv("HOST_METERING_CPU_COUNT_MODE")
+	_ = os.Unsetenv("HOST_METERING_BILLING_MODEL")
+	_ = os.Unsetenv("HOST_METERING_LABELS_ALLOW")
+	_ = os.Unsetenv("HOST_METERING_LABELS_DENY")
+	_ = os.Unsetenv("HOST_METERING_LABEL_MODES")
+	_ = os.Unsetenv("HOST_METERING_LABEL_HASH_KEY_PATH")
 	_ = os.Unsetenv("HOST_METERING_LABEL_REFRESH_INTERVAL_SEC")
 	_ = os.Unsetenv("HOST_METERING_WRITE_RETRY_ATTEMPTS")
 	_ = os.Unsetenv("HOST_METERING_WRITE_RETRY_MIN_INT_SEC")
 	_ = os.Unsetenv("HOST_METERING_WRITE_RETRY_MAX_INT_SEC")
 	_ = os.Unsetenv("HOST_METERING_WRITE_TIMEOUT_SEC")
+	_ = os.Unsetenv("HOST_METERING_WRITE_MAX_SAMPLES")
+	_ = os.Unsetenv("HOST_METERING_WRITE_MAX_BYTES")
 	_ = os.Unsetenv("HOST_METERING_METRICS_MAX_AGE_SEC")
 	_ = os.Unsetenv("HOST_METERING_METRICS_WAL_PATH")
+	_ = os.Unsetenv("HOST_METERING_STATE_PATH")
+	_ = os.Unsetenv("HOST_METERING_CONTROL_SOCKET_PATH")
+	_ = os.Unsetenv("HOST_METERING_SHUTDOWN_GRACE_PERIOD_SEC")
+	_ = os.Unsetenv("HOST_METERING_COLLECTORS")
 	_ = os.Unsetenv("HOST_METERING_LOG_LEVEL")
 	_ = os.Unsetenv("HOST_METERING_LOG_PATH")
 	_ = os.Unsetenv("HOST_METERING_INSTANCE_ID")
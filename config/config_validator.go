@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -24,6 +25,54 @@ func (cv *ConfigValidator) Validate() error {
 		return fmt.Errorf("WriteURL must be defined")
 	}
 
+	switch c.WriteProtocol {
+	case WriteProtocolPrometheus, WriteProtocolPrometheusV2, WriteProtocolOTLP:
+	default:
+		return fmt.Errorf("WriteProtocol must be one of: %s, %s, %s",
+			WriteProtocolPrometheus, WriteProtocolPrometheusV2, WriteProtocolOTLP)
+	}
+
+	switch c.HostInfoSource {
+	case HostInfoSourceFiles, HostInfoSourceDBus, HostInfoSourceSubMan:
+	default:
+		return fmt.Errorf("HostInfoSource must be one of: %s, %s, %s",
+			HostInfoSourceFiles, HostInfoSourceDBus, HostInfoSourceSubMan)
+	}
+
+	switch c.CpuCountMode {
+	case CpuCountModePresent, CpuCountModeOnline, CpuCountModeCpuset, CpuCountModeQuota:
+	default:
+		return fmt.Errorf("CpuCountMode must be one of: %s, %s, %s, %s",
+			CpuCountModePresent, CpuCountModeOnline, CpuCountModeCpuset, CpuCountModeQuota)
+	}
+
+	for _, name := range sortedKeys(c.Labels) {
+		if !IsValidLabelName(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("Labels must have valid label names, got: %s", name)
+		}
+	}
+
+	hashedLabels := false
+	for _, name := range sortedKeys(c.LabelModes) {
+		switch c.LabelModes[name] {
+		case LabelModeSend, LabelModeDrop:
+		case LabelModeHash:
+			hashedLabels = true
+		default:
+			return fmt.Errorf("LabelModes must be one of: %s, %s, %s, got: %s:%s",
+				LabelModeSend, LabelModeDrop, LabelModeHash, name, c.LabelModes[name])
+		}
+	}
+	if hashedLabels && c.LabelHashKeyPath == "" {
+		return fmt.Errorf("LabelHashKeyPath must be defined to hash labels")
+	}
+
+	for _, r := range c.Relabels {
+		if _, err := r.RelabelConfig(); err != nil {
+			return err
+		}
+	}
+
 	if c.WriteInterval <= time.Duration(c.WriteRetryAttempts)*(c.WriteRetryMaxInt+c.WriteTimeout) {
 		return fmt.Errorf("WriteInterval must be bigger than WriteRetryAttempts * ( WriteRetryMaxInt + WriteTimeout )")
 	}
@@ -36,5 +85,19 @@ func (cv *ConfigValidator) Validate() error {
 		return fmt.Errorf("MetricsWALPath must be defined")
 	}
 
+	if len(c.Collectors) == 0 {
+		return fmt.Errorf("Collectors must be defined")
+	}
+
+	for _, endpoint := range c.Endpoints {
+		cfg, err := c.EndpointConfig(endpoint)
+		if err != nil {
+			return err
+		}
+		if err := NewConfigValidator(cfg).Validate(); err != nil {
+			return fmt.Errorf("endpoint '%s': %w", endpoint.Name, err)
+		}
+	}
+
 	return nil
 }
@@ -21,6 +21,113 @@ func TestConfigValidator(t *testing.T) {
 			expectErrorContains(t, err, "WriteURL must be defined")
 		})
 
+		t.Run("WriteProtocol must be supported", func(t *testing.T) {
+			// given
+			c := NewConfig()
+			c.WriteProtocol = "unknown"
+			cv := NewConfigValidator(c)
+
+			// when
+			err := cv.Validate()
+
+			// then
+			expectErrorContains(t, err, "WriteProtocol must be one of: prometheus, prometheus-v2, otlp")
+		})
+
+		t.Run("HostInfoSource must be supported", func(t *testing.T) {
+			// given
+			c := NewConfig()
+			c.HostInfoSource = "unknown"
+			cv := NewConfigValidator(c)
+
+			// when
+			err := cv.Validate()
+
+			// then
+			expectErrorContains(t, err, "HostInfoSource must be one of: files, dbus, subscription-manager")
+		})
+
+		t.Run("CpuCountMode must be supported", func(t *testing.T) {
+			// given
+			c := NewConfig()
+			c.CpuCountMode = "unknown"
+			cv := NewConfigValidator(c)
+
+			// when
+			err := cv.Validate()
+
+			// then
+			expectErrorContains(t, err, "CpuCountMode must be one of: present, online, cpuset, quota")
+		})
+
+		t.Run("Labels must have valid names", func(t *testing.T) {
+			// given
+			c := NewConfig()
+			c.Labels = map[string]string{"cost-center": "1234"}
+			cv := NewConfigValidator(c)
+
+			// when
+			err := cv.Validate()
+
+			// then
+			expectErrorContains(t, err, "Labels must have valid label names, got: cost-center")
+		})
+
+		t.Run("LabelModes must be supported", func(t *testing.T) {
+			// given
+			c := NewConfig()
+			c.LabelModes = map[string]string{"display_name": "encrypt"}
+			cv := NewConfigValidator(c)
+
+			// when
+			err := cv.Validate()
+
+			// then
+			expectErrorContains(t, err, "LabelModes must be one of: send, drop, hash, got: display_name:encrypt")
+		})
+
+		t.Run("LabelHashKeyPath must be defined to hash labels", func(t *testing.T) {
+			// given
+			c := NewConfig()
+			c.LabelModes = map[string]string{"display_name": "hash"}
+			c.LabelHashKeyPath = ""
+			cv := NewConfigValidator(c)
+
+			// when
+			err := cv.Validate()
+
+			// then
+			expectErrorContains(t, err, "LabelHashKeyPath must be defined to hash labels")
+		})
+
+		t.Run("Relabels must be valid", func(t *testing.T) {
+			// given
+			c := NewConfig()
+			c.Relabels = []Relabel{{Name: "copy", Action: "replace", Regex: "(", Replacement: "$1"}}
+			cv := NewConfigValidator(c)
+
+			// when
+			err := cv.Validate()
+
+			// then
+			expectErrorContains(t, err, "relabel 'copy': invalid regex")
+		})
+
+		t.Run("endpoints must be valid", func(t *testing.T) {
+			// given
+			c := NewConfig()
+			c.Endpoints = []Endpoint{
+				{Name: "prod", Options: map[string]string{"write_url": ""}},
+			}
+			cv := NewConfigValidator(c)
+
+			// when
+			err := cv.Validate()
+
+			// then
+			expectErrorContains(t, err, "endpoint 'prod': WriteURL must be defined")
+		})
+
 		t.Run("overlapping requests", func(t *testing.T) {
 			// given
 			c := NewConfig()
@@ -64,6 +171,19 @@ func TestConfigValidator(t *testing.T) {
 			expectErrorContains(t, err, "MetricsWALPath must be defined")
 		})
 
+		t.Run("Collectors must be defined", func(t *testing.T) {
+			// given
+			c := NewConfig()
+			c.Collectors = []string{}
+			cv := NewConfigValidator(c)
+
+			// when
+			err := cv.Validate()
+
+			// then
+			expectErrorContains(t, err, "Collectors must be defined")
+		})
+
 		t.Run("default config should be valid", func(t *testing.T) {
 			// given
 			c := NewConfig()
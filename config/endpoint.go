@@ -0,0 +1,122 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// Prefix of configuration file sections which define endpoints.
+	EndpointSectionPrefix = "endpoint."
+	// Name of the endpoint defined by the [host-metering] section
+	// when there are no endpoint sections.
+	DefaultEndpointName = "default"
+)
+
+// Options of the [host-metering] section which can be overridden
+// by an endpoint.
+var endpointOptions = []string{
+	"write_url",
+	"write_protocol",
+	"host_cert_path",
+	"host_cert_key_path",
+	"send_hostname",
+	"labels_allow",
+	"labels_deny",
+	"label_modes",
+	"write_retry_attempts",
+	"write_retry_min_int_sec",
+	"write_retry_max_int_sec",
+	"write_timeout_sec",
+	"write_max_samples",
+	"write_max_bytes",
+}
+
+// Endpoint is a destination of the metrics defined by an [endpoint.<name>]
+// section. Its options override write options of the [host-metering]
+// section, other options are shared by all endpoints.
+type Endpoint struct {
+	Name    string
+	Options map[string]string
+}
+
+func (e *Endpoint) String() string {
+	options := make([]string, 0, len(e.Options))
+	for _, key := range sortedKeys(e.Options) {
+		options = append(options, key+"="+e.Options[key])
+	}
+	return fmt.Sprintf("%s[%s]", e.Name, strings.Join(options, " "))
+}
+
+// AllEndpoints returns the configured endpoints, or the default endpoint
+// defined by the [host-metering] section if there are none.
+func (c *Config) AllEndpoints() []Endpoint {
+	if len(c.Endpoints) == 0 {
+		return []Endpoint{{Name: DefaultEndpointName}}
+	}
+	return c.Endpoints
+}
+
+// EndpointConfig returns a copy of the configuration with write options
+// overridden by the endpoint.
+func (c *Config) EndpointConfig(endpoint Endpoint) (*Config, error) {
+	cfg := *c
+	cfg.Endpoints = nil
+	if err := cfg.updateFromOptions(endpoint.Options); err != nil {
+		return nil, fmt.Errorf("invalid endpoint '%s': %w", endpoint.Name, err)
+	}
+	return &cfg, nil
+}
+
+// parseEndpoints returns endpoints sorted by name, or nil if there
+// are no endpoint sections.
+func parseEndpoints(config INIConfig) ([]Endpoint, error) {
+	var sections []string
+	for section := range config {
+		if strings.HasPrefix(section, EndpointSectionPrefix) {
+			sections = append(sections, section)
+		}
+	}
+	sort.Strings(sections)
+
+	var endpoints []Endpoint
+	var multiError MultiError
+	for _, section := range sections {
+		endpoint := Endpoint{
+			Name:    strings.TrimPrefix(section, EndpointSectionPrefix),
+			Options: make(map[string]string),
+		}
+		if endpoint.Name == "" {
+			multiError.Add(fmt.Errorf("missing name of endpoint section '%s'", section))
+			continue
+		}
+		for _, key := range sortedKeys(config[section]) {
+			if !isEndpointOption(key) {
+				multiError.Add(fmt.Errorf("unsupported option '%s' of endpoint '%s'", key, endpoint.Name))
+				continue
+			}
+			endpoint.Options[key] = config[section][key]
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, multiError.ErrorOrNil()
+}
+
+func isEndpointOption(key string) bool {
+	for _, option := range endpointOptions {
+		if key == option {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(options map[string]string) []string {
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
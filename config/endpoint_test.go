@@ -0,0 +1,78 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEndpoints(t *testing.T) {
+	path := t.TempDir() + "/endpoints"
+	createConfigFile(t, path, "[host-metering]\n"+
+		"write_url = http://test/url\n"+
+		"write_timeout_sec = 5\n"+
+		"[endpoint.regional]\n"+
+		"write_url = http://regional/url\n"+
+		"host_cert_path = /tmp/regional.pem\n"+
+		"[endpoint.audit]\n"+
+		"write_protocol = otlp\n")
+
+	c := NewConfig()
+	err := c.UpdateFromConfigFile(path)
+	checkError(t, err, "failed to update from config file")
+
+	endpoints := c.AllEndpoints()
+	if len(endpoints) != 2 || endpoints[0].Name != "audit" || endpoints[1].Name != "regional" {
+		t.Fatalf("unexpected endpoints: %v", endpoints)
+	}
+
+	// Options of the endpoint override options of the main section
+	cfg, err := c.EndpointConfig(endpoints[1])
+	checkError(t, err, "failed to get endpoint config")
+	checkString(t, cfg.WriteUrl, "http://regional/url")
+	checkString(t, cfg.HostCertPath, "/tmp/regional.pem")
+	if cfg.WriteTimeout != 5*time.Second || cfg.Endpoints != nil {
+		t.Fatalf("expected other options of the main section, got: %s", cfg.String())
+	}
+
+	cfg, err = c.EndpointConfig(endpoints[0])
+	checkError(t, err, "failed to get endpoint config")
+	checkString(t, cfg.WriteUrl, "http://test/url")
+	checkString(t, cfg.WriteProtocol, WriteProtocolOTLP)
+
+	// The main configuration is not modified
+	checkString(t, c.WriteProtocol, WriteProtocolPrometheus)
+}
+
+func TestDefaultEndpoint(t *testing.T) {
+	c := NewConfig()
+
+	endpoints := c.AllEndpoints()
+	if len(endpoints) != 1 || endpoints[0].Name != DefaultEndpointName {
+		t.Fatalf("expected only the default endpoint, got: %v", endpoints)
+	}
+	cfg, err := c.EndpointConfig(endpoints[0])
+	checkError(t, err, "failed to get endpoint config")
+	checkString(t, cfg.String(), c.String())
+}
+
+func TestInvalidEndpoints(t *testing.T) {
+	path := t.TempDir() + "/endpoints"
+	createConfigFile(t, path, "[endpoint.]\n"+
+		"write_url = http://test/url\n"+
+		"[endpoint.audit]\n"+
+		"collect_interval_sec = 10\n"+
+		"write_url = http://audit/url\n")
+
+	c := NewConfig()
+	err := c.UpdateFromConfigFile(path)
+
+	expectedMsg := "multiple errors occurred:\n" +
+		"missing name of endpoint section 'endpoint.'\n" +
+		"unsupported option 'collect_interval_sec' of endpoint 'audit'"
+	checkString(t, err.Error(), expectedMsg)
+
+	// Invalid values are reported for the endpoint
+	_, err = c.EndpointConfig(Endpoint{Name: "test", Options: map[string]string{"write_timeout_sec": "a"}})
+	checkString(t, err.Error(), "invalid endpoint 'test': multiple errors occurred:\n"+
+		"invalid value of 'write_timeout_sec': strconv.ParseUint: parsing \"a\": invalid syntax")
+}
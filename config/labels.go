@@ -0,0 +1,187 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/relabel"
+)
+
+const (
+	// Section of the configuration file with static labels.
+	LabelsSection = "labels"
+	// Prefix of configuration file sections which define relabeling rules.
+	RelabelSectionPrefix = "relabel."
+)
+
+var labelNameRegexp = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// IsValidLabelName tells whether the name follows Prometheus label name rules.
+func IsValidLabelName(name string) bool {
+	return labelNameRegexp.MatchString(name)
+}
+
+// Relabel is a rule in the style of Prometheus relabel_configs which is
+// applied to labels of every series before sending, it is defined by
+// a [relabel.<name>] section. Rules are applied in order of their names.
+type Relabel struct {
+	Name         string
+	SourceLabels []string
+	Separator    string
+	Regex        string
+	TargetLabel  string
+	Replacement  string
+	Modulus      uint64
+	Action       string
+}
+
+func (r *Relabel) String() string {
+	return fmt.Sprintf("%s[action=%s modulus=%d regex=%s replacement=%s separator=%s source_labels=%s target_label=%s]",
+		r.Name, r.Action, r.Modulus, r.Regex, r.Replacement, r.Separator,
+		strings.Join(r.SourceLabels, ","), r.TargetLabel)
+}
+
+// RelabelConfig returns the validated Prometheus relabel config of the rule.
+// Actions which keep or drop whole series are not supported, every series
+// of the host must be sent.
+func (r *Relabel) RelabelConfig() (*relabel.Config, error) {
+	cfg := relabel.DefaultRelabelConfig
+	cfg.Action = relabel.Action(strings.ToLower(r.Action))
+	switch cfg.Action {
+	case relabel.Keep, relabel.Drop, relabel.KeepEqual, relabel.DropEqual:
+		return nil, fmt.Errorf("relabel '%s': unsupported action '%s'", r.Name, r.Action)
+	case relabel.Replace, relabel.HashMod, relabel.LabelMap, relabel.LabelDrop, relabel.LabelKeep,
+		relabel.Lowercase, relabel.Uppercase:
+	default:
+		return nil, fmt.Errorf("relabel '%s': unknown action '%s'", r.Name, r.Action)
+	}
+
+	regex, err := relabel.NewRegexp(r.Regex)
+	if err != nil {
+		return nil, fmt.Errorf("relabel '%s': invalid regex: %w", r.Name, err)
+	}
+	cfg.Regex = regex
+	for _, name := range r.SourceLabels {
+		cfg.SourceLabels = append(cfg.SourceLabels, model.LabelName(name))
+	}
+	cfg.Separator = r.Separator
+	cfg.TargetLabel = r.TargetLabel
+	cfg.Replacement = r.Replacement
+	cfg.Modulus = r.Modulus
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("relabel '%s': %w", r.Name, err)
+	}
+	return &cfg, nil
+}
+
+func (c *Config) labelsString() string {
+	labels := make([]string, 0, len(c.Labels))
+	for _, name := range sortedKeys(c.Labels) {
+		labels = append(labels, name+"="+c.Labels[name])
+	}
+	return strings.Join(labels, ",")
+}
+
+func (c *Config) labelModesString() string {
+	modes := make([]string, 0, len(c.LabelModes))
+	for _, name := range sortedKeys(c.LabelModes) {
+		modes = append(modes, name+":"+c.LabelModes[name])
+	}
+	return strings.Join(modes, ",")
+}
+
+// parseLabelModes parses comma separated "name:mode" items.
+func parseLabelModes(name string, value string, defaultValue map[string]string) (map[string]string, error) {
+	modes := make(map[string]string)
+	for _, item := range parseList(value) {
+		label, mode, found := strings.Cut(item, ":")
+		if !found {
+			return defaultValue, fmt.Errorf("invalid value of '%s': missing mode of label '%s'", name, item)
+		}
+		modes[strings.TrimSpace(label)] = strings.TrimSpace(mode)
+	}
+	return modes, nil
+}
+
+func (c *Config) relabelsString() string {
+	relabels := make([]string, 0, len(c.Relabels))
+	for _, r := range c.Relabels {
+		relabels = append(relabels, r.String())
+	}
+	return strings.Join(relabels, ",")
+}
+
+func (c *Config) relabelsMap() map[string]map[string]interface{} {
+	relabels := make(map[string]map[string]interface{}, len(c.Relabels))
+	for _, r := range c.Relabels {
+		relabels[r.Name] = map[string]interface{}{
+			"source_labels": r.SourceLabels,
+			"separator":     r.Separator,
+			"regex":         r.Regex,
+			"target_label":  r.TargetLabel,
+			"replacement":   r.Replacement,
+			"modulus":       r.Modulus,
+			"action":        r.Action,
+		}
+	}
+	return relabels
+}
+
+// parseRelabels returns relabeling rules sorted by name, or nil if there
+// are no relabel sections. Unset options have defaults of Prometheus.
+func parseRelabels(config INIConfig) ([]Relabel, error) {
+	var sections []string
+	for section := range config {
+		if strings.HasPrefix(section, RelabelSectionPrefix) {
+			sections = append(sections, section)
+		}
+	}
+	sort.Strings(sections)
+
+	var relabels []Relabel
+	var multiError MultiError
+	for _, section := range sections {
+		r := Relabel{
+			Name:        strings.TrimPrefix(section, RelabelSectionPrefix),
+			Separator:   relabel.DefaultRelabelConfig.Separator,
+			Regex:       relabel.DefaultRelabelConfig.Regex.String(),
+			Replacement: relabel.DefaultRelabelConfig.Replacement,
+			Action:      string(relabel.DefaultRelabelConfig.Action),
+		}
+		if r.Name == "" {
+			multiError.Add(fmt.Errorf("missing name of relabel section '%s'", section))
+			continue
+		}
+		for _, key := range sortedKeys(config[section]) {
+			value := config[section][key]
+			switch key {
+			case "source_labels":
+				r.SourceLabels = parseList(value)
+			case "separator":
+				r.Separator = value
+			case "regex":
+				r.Regex = value
+			case "target_label":
+				r.TargetLabel = value
+			case "replacement":
+				r.Replacement = value
+			case "modulus":
+				modulus, err := strconv.ParseUint(value, 10, 64)
+				if err != nil {
+					multiError.Add(fmt.Errorf("invalid value of 'modulus' of relabel '%s': %v", r.Name, err.Error()))
+				}
+				r.Modulus = modulus
+			case "action":
+				r.Action = value
+			default:
+				multiError.Add(fmt.Errorf("unsupported option '%s' of relabel '%s'", key, r.Name))
+			}
+		}
+		relabels = append(relabels, r)
+	}
+	return relabels, multiError.ErrorOrNil()
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+	path := t.TempDir() + "/labels"
+	createConfigFile(t, path, "[host-metering]\n"+
+		"labels_deny = display_name\n"+
+		"[labels]\n"+
+		"environment = prod\n"+
+		"cost_center = 1234\n"+
+		"[relabel.2-shard]\n"+
+		"action = hashmod\n"+
+		"source_labels = _id\n"+
+		"target_label = shard\n"+
+		"modulus = 8\n"+
+		"[relabel.1-domain]\n"+
+		"source_labels = display_name\n"+
+		"regex = [^.]*\\.(.*)\n"+
+		"target_label = domain\n")
+
+	c := NewConfig()
+	err := c.UpdateFromConfigFile(path)
+	checkError(t, err, "failed to update from config file")
+
+	checkString(t, c.labelsString(), "cost_center=1234,environment=prod")
+	checkString(t, c.relabelsString(),
+		"1-domain[action=replace modulus=0 regex=[^.]*\\.(.*) replacement=$1 separator=; source_labels=display_name target_label=domain],"+
+			"2-shard[action=hashmod modulus=8 regex=(.*) replacement=$1 separator=; source_labels=_id target_label=shard]")
+	for _, r := range c.Relabels {
+		if _, err := r.RelabelConfig(); err != nil {
+			t.Fatalf("expected valid relabel config, got: %v", err)
+		}
+	}
+	err = NewConfigValidator(c).Validate()
+	checkError(t, err, "expected valid config")
+}
+
+func TestInvalidRelabels(t *testing.T) {
+	path := t.TempDir() + "/relabels"
+	createConfigFile(t, path, "[relabel.]\n"+
+		"action = replace\n"+
+		"[relabel.hash]\n"+
+		"action = hashmod\n"+
+		"modulus = many\n"+
+		"[relabel.keep]\n"+
+		"action = keep\n"+
+		"source_labels = usage\n"+
+		"filter = yes\n")
+
+	c := NewConfig()
+	err := c.UpdateFromConfigFile(path)
+
+	expectedMsg := "multiple errors occurred:\n" +
+		"missing name of relabel section 'relabel.'\n" +
+		"invalid value of 'modulus' of relabel 'hash': strconv.ParseUint: parsing \"many\": invalid syntax\n" +
+		"unsupported option 'filter' of relabel 'keep'"
+	checkString(t, err.Error(), expectedMsg)
+
+	// Series are never dropped
+	_, err = c.Relabels[1].RelabelConfig()
+	checkString(t, err.Error(), "relabel 'keep': unsupported action 'keep'")
+	_, err = c.Relabels[0].RelabelConfig()
+	checkString(t, err.Error(), "relabel 'hash': relabel configuration for hashmod requires non-zero modulus")
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Prefix of configuration file sections which define marketplaces.
+const MarketplaceSectionPrefix = "marketplace."
+
+// Marketplace is detected by a fact of subscription-manager with the ID
+// of the instance, it is defined by a [marketplace.<name>] section.
+type Marketplace struct {
+	Name         string
+	InstanceFact string
+	AccountFact  string
+}
+
+func (m *Marketplace) String() string {
+	return fmt.Sprintf("%s[account_fact=%s instance_fact=%s]", m.Name, m.AccountFact, m.InstanceFact)
+}
+
+func (c *Config) marketplacesString() string {
+	marketplaces := make([]string, 0, len(c.Marketplaces))
+	for _, marketplace := range c.Marketplaces {
+		marketplaces = append(marketplaces, marketplace.String())
+	}
+	return strings.Join(marketplaces, ",")
+}
+
+func (c *Config) marketplacesMap() map[string]map[string]string {
+	marketplaces := make(map[string]map[string]string, len(c.Marketplaces))
+	for _, marketplace := range c.Marketplaces {
+		marketplaces[marketplace.Name] = map[string]string{
+			"instance_fact": marketplace.InstanceFact,
+			"account_fact":  marketplace.AccountFact,
+		}
+	}
+	return marketplaces
+}
+
+// parseMarketplaces returns marketplaces sorted by name, or nil if there
+// are no marketplace sections.
+func parseMarketplaces(config INIConfig) ([]Marketplace, error) {
+	var sections []string
+	for section := range config {
+		if strings.HasPrefix(section, MarketplaceSectionPrefix) {
+			sections = append(sections, section)
+		}
+	}
+	sort.Strings(sections)
+
+	var marketplaces []Marketplace
+	var multiError MultiError
+	for _, section := range sections {
+		marketplace := Marketplace{Name: strings.TrimPrefix(section, MarketplaceSectionPrefix)}
+		if marketplace.Name == "" {
+			multiError.Add(fmt.Errorf("missing name of marketplace section '%s'", section))
+			continue
+		}
+		for _, key := range sortedKeys(config[section]) {
+			switch key {
+			case "instance_fact":
+				marketplace.InstanceFact = config[section][key]
+			case "account_fact":
+				marketplace.AccountFact = config[section][key]
+			default:
+				multiError.Add(fmt.Errorf("unsupported option '%s' of marketplace '%s'", key, marketplace.Name))
+			}
+		}
+		if marketplace.InstanceFact == "" {
+			multiError.Add(fmt.Errorf("missing instance_fact of marketplace '%s'", marketplace.Name))
+			continue
+		}
+		marketplaces = append(marketplaces, marketplace)
+	}
+	return marketplaces, multiError.ErrorOrNil()
+}
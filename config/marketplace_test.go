@@ -0,0 +1,28 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestInvalidMarketplaces(t *testing.T) {
+	path := t.TempDir() + "/marketplaces"
+	createConfigFile(t, path, "[marketplace.]\n"+
+		"instance_fact = test_instance_id\n"+
+		"[marketplace.ibm]\n"+
+		"account_fact = ibm_account_id\n"+
+		"[marketplace.oracle]\n"+
+		"instance_fact = oci_instance_id\n"+
+		"tenancy_fact = oci_tenancy_id\n")
+
+	c := NewConfig()
+	err := c.UpdateFromConfigFile(path)
+
+	expectedMsg := "multiple errors occurred:\n" +
+		"missing name of marketplace section 'marketplace.'\n" +
+		"missing instance_fact of marketplace 'ibm'\n" +
+		"unsupported option 'tenancy_fact' of marketplace 'oracle'"
+	checkString(t, err.Error(), expectedMsg)
+
+	// Valid marketplaces are kept
+	checkString(t, c.marketplacesString(), "oracle[account_fact= instance_fact=oci_instance_id]")
+}
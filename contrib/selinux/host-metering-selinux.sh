@@ -50,6 +50,8 @@ sepolicy manpage -p . -d hostmetering_t
 /sbin/restorecon -F -R -v /usr/lib/systemd/system/host-metering.service
 # Fixing the file context on /var/run/host-metering
 /sbin/restorecon -F -R -v /var/run/host-metering
+# Fixing the file context on /var/lib/host-metering
+/sbin/restorecon -F -R -v /var/lib/host-metering
 # Generate a rpm package for the newly generated policy
 
 pwd=$(pwd)
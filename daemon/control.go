@@ -0,0 +1,270 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/RedHatInsights/host-metering/config"
+	"github.com/RedHatInsights/host-metering/hostinfo"
+	"github.com/RedHatInsights/host-metering/logger"
+	"github.com/RedHatInsights/host-metering/notify"
+)
+
+// Commands accepted on the control socket of a running daemon.
+const (
+	ControlCommandFlush          = "flush"
+	ControlCommandReloadHostInfo = "reload-hostinfo"
+	ControlCommandReloadConfig   = "reload-config"
+	ControlCommandDump           = "dump"
+)
+
+// Time limit for the client to send the request and to read the response.
+// Handling of the request itself (e.g. flush) is not limited.
+const controlIOTimeout = 5 * time.Second
+
+// ControlRequest is sent as a single JSON line over the control socket.
+type ControlRequest struct {
+	Command string `json:"command"`
+}
+
+// ControlResponse is the single JSON line reply to a ControlRequest.
+type ControlResponse struct {
+	Error string          `json:"error,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// Dump is the data returned by the dump command.
+type Dump struct {
+	Config          *config.Config          `json:"config"`
+	HostInfo        *hostinfo.HostInfo      `json:"host_info"`
+	HostInfoError   *hostinfo.LoadError     `json:"host_info_error,omitempty"`
+	MetricsLog      *notify.MetricsLogStats `json:"metrics_log,omitempty"`
+	MetricsLogError string                  `json:"metrics_log_error,omitempty"`
+	State           *State                  `json:"state"`
+	NotifyBlockedBy string                  `json:"notify_blocked_by,omitempty"`
+}
+
+// controlRequest is passed to the daemon's event loop so that commands
+// are serialized with the periodic work.
+type controlRequest struct {
+	Command  string
+	response chan *ControlResponse
+}
+
+// SendControlCommand sends the command to the daemon listening on socketPath
+// and returns its response.
+func SendControlCommand(socketPath string, command string) (*ControlResponse, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to daemon: %w", err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetWriteDeadline(time.Now().Add(controlIOTimeout))
+	if err := json.NewEncoder(conn).Encode(&ControlRequest{Command: command}); err != nil {
+		return nil, fmt.Errorf("cannot send command: %w", err)
+	}
+
+	response := &ControlResponse{}
+	if err := json.NewDecoder(conn).Decode(response); err != nil {
+		return nil, fmt.Errorf("cannot read response: %w", err)
+	}
+	return response, nil
+}
+
+func (d *Daemon) startControlServer() error {
+	path := d.config.ControlSocketPath
+	if path == "" {
+		logger.Infoln("Control socket is disabled")
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// Remove a socket left behind by a previous instance, but not one
+	// which is still in use.
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("control socket %s is in use", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+
+	d.controlListener = listener
+	d.controlDone = make(chan struct{})
+	go d.acceptControlConnections(listener, d.controlDone)
+	logger.Infof("Listening on control socket %s\n", path)
+	return nil
+}
+
+func (d *Daemon) stopControlServer() {
+	if d.controlListener == nil {
+		return
+	}
+	close(d.controlDone)
+	// Closing the listener removes the socket file as well
+	if err := d.controlListener.Close(); err != nil {
+		logger.Warnf("Error closing control socket: %s\n", err.Error())
+	}
+	d.controlListener = nil
+}
+
+func (d *Daemon) acceptControlConnections(listener net.Listener, done chan struct{}) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Warnf("Error accepting control connection: %s\n", err.Error())
+			continue
+		}
+		go d.handleControlConnection(conn, done)
+	}
+}
+
+func (d *Daemon) handleControlConnection(conn net.Conn, done chan struct{}) {
+	defer conn.Close()
+
+	var response *ControlResponse
+	request := &ControlRequest{}
+	_ = conn.SetReadDeadline(time.Now().Add(controlIOTimeout))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, request)
+	}
+	if err != nil {
+		response = newControlResponse(nil, fmt.Errorf("invalid request: %w", err))
+	} else {
+		logger.Infof("Control command received: %s\n", request.Command)
+		r := &controlRequest{
+			Command:  request.Command,
+			response: make(chan *ControlResponse, 1),
+		}
+		select {
+		case d.controlCh <- r:
+			response = <-r.response
+		case <-done:
+			response = newControlResponse(nil, fmt.Errorf("daemon is stopping"))
+		}
+	}
+
+	_ = conn.SetWriteDeadline(time.Now().Add(controlIOTimeout))
+	if err := json.NewEncoder(conn).Encode(response); err != nil {
+		logger.Warnf("Error sending control response: %s\n", err.Error())
+	}
+}
+
+// handleControlRequest is executed on the daemon's event loop. The flush
+// command is completed outside of the loop, as it waits for the sender.
+func (d *Daemon) handleControlRequest(request *controlRequest) {
+	if request.Command != ControlCommandFlush {
+		request.response <- d.handleControlCommand(request.Command)
+		return
+	}
+	if err := d.prepareFlush(); err != nil {
+		request.response <- newControlResponse(nil, err)
+		return
+	}
+	go func() {
+		request.response <- newControlResponse(d.flushResult(d.sender.Send()))
+	}()
+}
+
+// handleControlCommand is executed on the daemon's event loop.
+func (d *Daemon) handleControlCommand(command string) *ControlResponse {
+	var data interface{}
+	var err error
+
+	switch command {
+	case ControlCommandReloadHostInfo:
+		err = d.loadHostInfo(d.ctx)
+		data = d.hostInfo
+	case ControlCommandReloadConfig:
+		err = d.reloadConfig()
+		data = d.config
+	case ControlCommandDump:
+		data = d.dump()
+	default:
+		err = fmt.Errorf("unknown command '%s'", command)
+	}
+
+	return newControlResponse(data, err)
+}
+
+func newControlResponse(data interface{}, err error) *ControlResponse {
+	response := &ControlResponse{}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	if data != nil {
+		encoded, jsonErr := json.Marshal(data)
+		if jsonErr != nil {
+			response.Error = jsonErr.Error()
+		}
+		response.Data = encoded
+	}
+	return response
+}
+
+// prepareFlush immediately collects metrics, so that they are sent
+// together with all pending samples.
+func (d *Daemon) prepareFlush() error {
+	logger.Infoln("Flushing metrics...")
+	if d.hostInfo == nil {
+		return fmt.Errorf("missing internal HostInfo")
+	}
+	d.collectMetrics()
+	return nil
+}
+
+// flushResult returns the result of the send done by the flush.
+func (d *Daemon) flushResult(err error) (*NotifyResult, error) {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	if err != nil {
+		return d.state.LastNotify, err
+	}
+	if d.notifyBlockedBy != nil {
+		return nil, fmt.Errorf("notification blocked: %w", d.notifyBlockedBy)
+	}
+	return d.state.LastNotify, nil
+}
+
+func (d *Daemon) dump() *Dump {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	dump := &Dump{
+		Config:        d.config,
+		HostInfo:      d.hostInfo,
+		HostInfoError: d.HostInfoError(),
+		State:         d.state.Copy(),
+	}
+	if d.notifyBlockedBy != nil {
+		dump.NotifyBlockedBy = d.notifyBlockedBy.Error()
+	}
+	stats, err := d.metricsLog.Stats()
+	if err != nil {
+		dump.MetricsLogError = err.Error()
+	} else {
+		dump.MetricsLog = stats
+	}
+	return dump
+}
@@ -0,0 +1,205 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControlFlush(t *testing.T) {
+	daemon, notifier, metricsLog, _ := createDaemon(t)
+	daemon.config.WriteInterval = 1 * time.Hour
+	startDaemon(t, daemon)
+	defer stopDaemon(t, daemon)
+
+	// Flush collects a new sample and sends it without waiting for the write interval
+	notifier.ResetCalledWith()
+	response := sendControlCommand(t, daemon, ControlCommandFlush)
+	checkControlSuccess(t, response)
+	notifier.CheckWasCalled(t)
+	if len(notifier.calledWith.samples) != 1 {
+		t.Fatalf("expected flush to send 1 sample, got %d", len(notifier.calledWith.samples))
+	}
+	waitForEmptyMetricsLog(t, metricsLog, 10*time.Millisecond)
+
+	result := &NotifyResult{}
+	decodeControlData(t, response, result)
+	if result.Outcome != NotifyOutcomeSuccess || result.Samples != 1 {
+		t.Fatalf("unexpected flush result: %s", result.String())
+	}
+
+	// Flush reports notification failures
+	notifier.ExpectError(errors.New("test error"))
+	response = sendControlCommand(t, daemon, ControlCommandFlush)
+	if response.Error != "test error" {
+		t.Fatalf("expected flush error, got '%s'", response.Error)
+	}
+	decodeControlData(t, response, result)
+	if result.Outcome != NotifyOutcomeError {
+		t.Fatalf("unexpected flush result: %s", result.String())
+	}
+}
+
+func TestControlReloadHostInfo(t *testing.T) {
+	daemon, notifier, _, hiProvider := createDaemon(t)
+	startDaemon(t, daemon)
+	defer stopDaemon(t, daemon)
+
+	hostChangedTimes := notifier.hostChangedTimes
+	hiProvider.hi.HostId = "reloaded-host-id"
+	response := sendControlCommand(t, daemon, ControlCommandReloadHostInfo)
+	checkControlSuccess(t, response)
+
+	data := map[string]interface{}{}
+	decodeControlData(t, response, &data)
+	if data["host_id"] != "reloaded-host-id" {
+		t.Fatalf("expected reloaded host info, got: %v", data)
+	}
+	if notifier.hostChangedTimes != hostChangedTimes+1 {
+		t.Fatalf("expected notifier to be informed about host change")
+	}
+}
+
+func TestControlReloadConfig(t *testing.T) {
+	daemon, notifier, _, _ := createDaemon(t)
+	configPath := t.TempDir() + "/host-metering.conf"
+	daemon.SetConfigPath(configPath)
+	startDaemon(t, daemon)
+	defer stopDaemon(t, daemon)
+
+	// Valid configuration is applied
+	createConfigFile(t, configPath, "[host-metering]\n"+
+		"write_url = http://reloaded/url\n"+
+		"write_interval_sec = 3600\n"+
+		"metrics_wal_path = "+daemon.config.MetricsWALPath+"\n"+
+		"state_path = "+daemon.config.StatePath+"\n"+
+		"control_socket_path = "+daemon.config.ControlSocketPath+"\n")
+	hostChangedTimes := notifier.hostChangedTimes
+	response := sendControlCommand(t, daemon, ControlCommandReloadConfig)
+	checkControlSuccess(t, response)
+	if daemon.config.WriteUrl != "http://reloaded/url" || daemon.config.WriteInterval != 1*time.Hour {
+		t.Fatalf("expected configuration to be reloaded, got:\n%s", daemon.config.String())
+	}
+	if notifier.hostChangedTimes != hostChangedTimes+1 {
+		t.Fatalf("expected notifier to be informed about config change")
+	}
+
+	// Invalid configuration is rejected and the current one is kept
+	createConfigFile(t, configPath, "[host-metering]\n"+
+		"write_url = http://invalid/url\n"+
+		"write_interval_sec = 1\n")
+	response = sendControlCommand(t, daemon, ControlCommandReloadConfig)
+	if !strings.HasPrefix(response.Error, "configuration not reloaded: ") {
+		t.Fatalf("expected reload to fail, got '%s'", response.Error)
+	}
+	if daemon.config.WriteUrl != "http://reloaded/url" {
+		t.Fatalf("expected configuration to be kept, got:\n%s", daemon.config.String())
+	}
+}
+
+func TestControlDump(t *testing.T) {
+	daemon, _, _, _ := createDaemon(t)
+	startDaemon(t, daemon)
+	defer stopDaemon(t, daemon)
+
+	response := sendControlCommand(t, daemon, ControlCommandDump)
+	checkControlSuccess(t, response)
+
+	dump := struct {
+		Config     map[string]interface{} `json:"config"`
+		HostInfo   map[string]interface{} `json:"host_info"`
+		MetricsLog map[string]interface{} `json:"metrics_log"`
+		State      *State                 `json:"state"`
+	}{}
+	decodeControlData(t, response, &dump)
+	if dump.Config["metrics_wal_path"] != daemon.config.MetricsWALPath {
+		t.Fatalf("unexpected config in dump: %v", dump.Config)
+	}
+	if dump.HostInfo["host_id"] != "testhost-id" {
+		t.Fatalf("unexpected host info in dump: %v", dump.HostInfo)
+	}
+	if dump.MetricsLog["count"] != float64(0) {
+		t.Fatalf("unexpected metrics log stats in dump: %v", dump.MetricsLog)
+	}
+	if dump.State == nil || dump.State.Pid != os.Getpid() {
+		t.Fatalf("unexpected state in dump: %v", dump.State)
+	}
+}
+
+func TestControlUnknownCommand(t *testing.T) {
+	daemon, _, _, _ := createDaemon(t)
+	startDaemon(t, daemon)
+	defer stopDaemon(t, daemon)
+
+	response := sendControlCommand(t, daemon, "unknown")
+	if response.Error != "unknown command 'unknown'" {
+		t.Fatalf("unexpected error: '%s'", response.Error)
+	}
+}
+
+func TestControlSocketLifecycle(t *testing.T) {
+	daemon, _, _, _ := createDaemon(t)
+	path := daemon.config.ControlSocketPath
+
+	// Stale socket file is replaced
+	createConfigFile(t, path, "")
+	startDaemon(t, daemon)
+
+	info, err := os.Stat(path)
+	checkError(t, err, "missing control socket")
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected control socket mode: %s", info.Mode())
+	}
+
+	// Socket is removed on stop
+	stopDaemon(t, daemon)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected control socket to be removed")
+	}
+	if _, err := SendControlCommand(path, ControlCommandDump); err == nil {
+		t.Fatalf("expected an error when daemon is not running")
+	}
+}
+
+// Helpers
+
+func startDaemon(t *testing.T, daemon *Daemon) {
+	t.Helper()
+	go daemon.Run()
+	waitForStarted(t, daemon)
+}
+
+func stopDaemon(t *testing.T, daemon *Daemon) {
+	t.Helper()
+	daemon.Stop()
+	waitForStopped(t, daemon)
+}
+
+func sendControlCommand(t *testing.T, daemon *Daemon, command string) *ControlResponse {
+	t.Helper()
+	response, err := SendControlCommand(daemon.config.ControlSocketPath, command)
+	checkError(t, err, "failed to send control command")
+	return response
+}
+
+func checkControlSuccess(t *testing.T, response *ControlResponse) {
+	t.Helper()
+	if response.Error != "" {
+		t.Fatalf("unexpected control error: %s", response.Error)
+	}
+}
+
+func decodeControlData(t *testing.T, response *ControlResponse, data interface{}) {
+	t.Helper()
+	err := json.Unmarshal(response.Data, data)
+	checkError(t, err, "failed to decode control response data")
+}
+
+func createConfigFile(t *testing.T, path string, content string) {
+	t.Helper()
+	err := os.WriteFile(path, []byte(content), 0600)
+	checkError(t, err, "failed to create file")
+}
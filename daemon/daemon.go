@@ -1,38 +1,82 @@
 package daemon
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/RedHatInsights/host-metering/collector"
 	"github.com/RedHatInsights/host-metering/config"
 	"github.com/RedHatInsights/host-metering/hostinfo"
 	"github.com/RedHatInsights/host-metering/logger"
 	"github.com/RedHatInsights/host-metering/notify"
+	"github.com/prometheus/prometheus/prompb"
 )
 
 type Daemon struct {
-	config           *config.Config
+	config *config.Config
+	// hostInfo is shared with the sender, it is replaced under hostInfoMu
+	// and never modified in place.
 	hostInfo         *hostinfo.HostInfo
+	hostInfoErr      *hostinfo.LoadError  // values which failed to load
+	hostInfoLoadedAt map[string]time.Time // last successful load of each value, used by the main loop only
+	hostInfoMu       sync.RWMutex
+	// fences are pending sends of previous identities of the host, they are
+	// queued under hostInfoMu together with the host info which replaced them
+	fences           []*identityFence
 	hostInfoProvider hostinfo.HostInfoProvider
+	collectors       []collector.Collector
 	metricsLog       *notify.MetricsLog
 	certWatcher      hostinfo.CertWatcher
-	notifier         notify.Notifier
+	endpoints        []*endpoint
 	notifyPolicy     notify.NotifyPolicy
-	stopCh           chan os.Signal
-	started          bool
+	// certNotifier creates notifiers of a previous identity of the host.
+	certNotifier    func(*config.Config, tls.Certificate) notify.Notifier
+	state           *State
+	configPath      string
+	notifyBlockedBy error
+	tickers         *tickers
+	controlListener net.Listener
+	controlCh       chan *controlRequest
+	controlDone     chan struct{}
+	stopCh          chan os.Signal
+	sender          *sender
+	// sendMu is held by a send, so that endpoints, their configuration and
+	// the metrics log are not changed while sending.
+	sendMu sync.Mutex
+	// stateMu guards state and notifyBlockedBy shared with the sender.
+	stateMu sync.Mutex
+	// ctx is done when the daemon is stopping, it interrupts notifications.
+	ctx     context.Context
+	started bool
 }
 
 func NewDaemon(config *config.Config) (*Daemon, error) {
 	var err error
 	d := &Daemon{
 		config:           config,
-		notifier:         notify.NewPrometheusNotifier(config),
-		hostInfoProvider: &hostinfo.SubManInfoProvider{},
+		hostInfoProvider: newHostInfoProvider(config),
 		notifyPolicy:     &notify.GeneralNotifyPolicy{},
+		certNotifier:     notify.NewNotifierWithCert,
+		controlCh:        make(chan *controlRequest),
+		ctx:              context.Background(),
+	}
+	d.collectors, err = collector.New(config.Collectors, collector.DefaultPaths)
+	if err != nil {
+		return nil, err
+	}
+	d.endpoints, err = newEndpoints(config)
+	if err != nil {
+		return nil, err
 	}
 	d.certWatcher, err = hostinfo.NewINotifyCertWatcher(d.config.HostCertPath)
 	if err != nil {
@@ -42,23 +86,79 @@ func NewDaemon(config *config.Config) (*Daemon, error) {
 	if err := d.initMetricsLog(); err != nil {
 		return nil, err
 	}
+	d.initState()
+	d.pruneEndpointStates()
 	return d, nil
 }
 
+// newHostInfoProvider creates the provider of the configured source,
+// subscription-manager is run when the source is not available. Files and
+// D-Bus are opt-in, subscription-manager is the default source.
+func newHostInfoProvider(cfg *config.Config) hostinfo.HostInfoProvider {
+	cpu := hostinfo.NewCPUCounter(hostinfo.CPUCountMode(cfg.CpuCountMode))
+	billing := newBillingRules(cfg)
+	subMan := hostinfo.NewSubManInfoProvider(cpu, billing, cfg.SubManTimeout, cfg.SubManCacheTTL)
+	switch cfg.HostInfoSource {
+	case config.HostInfoSourceFiles:
+		return hostinfo.NewNativeInfoProvider(cpu, billing, cfg.HostCertPath, subMan)
+	case config.HostInfoSourceDBus:
+		return hostinfo.NewDBusInfoProvider(cpu, billing, cfg.HostCertPath, subMan)
+	default:
+		return subMan
+	}
+}
+
+// newBillingRules detects the configured marketplaces before the default ones.
+func newBillingRules(cfg *config.Config) *hostinfo.BillingRules {
+	marketplaces := make([]hostinfo.MarketplaceRule, 0, len(cfg.Marketplaces))
+	for _, m := range cfg.Marketplaces {
+		marketplaces = append(marketplaces, hostinfo.MarketplaceRule{
+			Marketplace:  m.Name,
+			InstanceFact: m.InstanceFact,
+			AccountFact:  m.AccountFact,
+		})
+	}
+	return hostinfo.NewBillingRules(marketplaces, cfg.BillingModel)
+}
+
 func (d *Daemon) Run() error {
 	d.started = false
 	logger.Infoln("Starting server...")
 
-	// Wait for SIGINT or SIGTERM to stop server
+	d.state.Pid = os.Getpid()
+	d.state.StartedAt = time.Now()
+	d.saveState()
+
+	// Wait for SIGINT or SIGTERM to stop server. The stop is signalled by
+	// a context, so that it can interrupt a notification in progress.
 	d.stopCh = make(chan os.Signal, 1)
 	signal.Notify(d.stopCh, syscall.SIGINT, syscall.SIGTERM)
 	shutdownCh := make(chan int)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.ctx = ctx
+	go func() {
+		select {
+		case <-d.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	// Wait for SIGHUP to reload host info
+	// Wait for SIGHUP to reload configuration and host info
 	reloadCh := make(chan os.Signal, 1)
 	signal.Notify(reloadCh, syscall.SIGHUP)
 
-	err := d.initialNotify()
+	// Resume the write schedule of the previous run on a quick restart,
+	// so that the endpoints are not notified on every start.
+	resumeDelay := d.resumeDelay()
+	var err error
+	if resumeDelay > 0 {
+		logger.Infof("Resuming write schedule, next write in %s\n", resumeDelay.Round(time.Second))
+		err = d.initialCollect(ctx)
+	} else {
+		err = d.initialNotify(ctx)
+	}
 	if err != nil {
 		logger.Errorln(err.Error())
 	}
@@ -68,49 +168,39 @@ func (d *Daemon) Run() error {
 		certWatchEvent = d.certWatcher.Event()
 	}
 
-	var collectTicker *time.Ticker
-	if d.config.CollectInterval > 0 {
-		collectTicker = time.NewTicker(d.config.CollectInterval)
-		defer collectTicker.Stop()
-	} else {
-		// Create dummy stopped ticker if collect interval is not configured
-		collectTicker = time.NewTicker(time.Duration(1) * time.Hour)
-		collectTicker.Stop()
-	}
-
-	writeTicker := time.NewTicker(d.config.WriteInterval)
-	defer writeTicker.Stop()
+	d.tickers = newTickers(d.config, resumeDelay)
+	d.sender = newSender(d)
+	go d.sender.run(ctx)
 
-	var labelTicker *time.Ticker
-	if d.config.LabelRefreshInterval > 0 {
-		labelTicker = time.NewTicker(d.config.LabelRefreshInterval)
-		defer labelTicker.Stop()
-	} else {
-		// Create dummy stopped ticker if label interval is not configured
-		labelTicker = time.NewTicker(time.Duration(1) * time.Hour)
-		labelTicker.Stop()
+	if err := d.startControlServer(); err != nil {
+		// Control socket failure should not be fatal
+		logger.Errorf("Control socket initialization failed: %v\n", err.Error())
 	}
 
 	go func() {
 		for {
 			select {
-			case <-collectTicker.C:
+			case <-d.tickers.collect.C:
 				d.collectMetrics()
-			case <-writeTicker.C:
+			case <-d.tickers.write.C:
+				d.tickers.WriteTicked()
 				if d.config.CollectInterval == 0 {
 					d.collectMetrics()
 				}
-				d.notify()
-			case <-labelTicker.C:
+				d.sender.Trigger()
+			case <-d.tickers.label.C:
 				logger.Infoln("Refresh labels...")
-				if err := d.loadHostInfo(); err != nil {
+				if err := d.loadHostInfo(ctx); err != nil {
 					logger.Errorln(err.Error())
 					continue
 				}
 				logger.Infoln("Labels refreshed")
 			case <-reloadCh:
+				if err := d.reloadConfig(); err != nil {
+					logger.Errorln(err.Error())
+				}
 				logger.Infoln("Reloading HostInfo...")
-				if err := d.loadHostInfo(); err != nil {
+				if err := d.loadHostInfo(ctx); err != nil {
 					logger.Errorln(err.Error())
 					continue
 				}
@@ -124,12 +214,19 @@ func (d *Daemon) Run() error {
 					logger.Infoln("Host cert updated")
 				case hostinfo.RemoveEvent:
 					logger.Infoln("Host cert removed")
+					d.forgetIdentity()
 				}
-				if err := d.loadHostInfo(); err != nil {
+				if err := d.loadHostInfo(ctx); err != nil {
 					logger.Errorf("Host info load error: %s\n", err.Error())
 				}
-			case <-d.stopCh:
+			case request := <-d.controlCh:
+				d.handleControlRequest(request)
+			case <-ctx.Done():
 				d.stopCh = nil
+				d.stopControlServer()
+				d.tickers.Stop()
+				d.sender.Wait()
+				d.finalFlush()
 				shutdownCh <- 1
 				return
 			}
@@ -143,9 +240,15 @@ func (d *Daemon) Run() error {
 	return nil
 }
 
+// SetConfigPath sets path of the configuration file which is re-read
+// when the configuration is reloaded.
+func (d *Daemon) SetConfigPath(path string) {
+	d.configPath = path
+}
+
 func (d *Daemon) RunOnce() error {
 	logger.Infoln("Executing once...")
-	return d.initialNotify()
+	return d.initialNotify(context.Background())
 }
 
 func (d *Daemon) Stop() {
@@ -163,28 +266,343 @@ func (d *Daemon) IsStarted() bool {
 }
 
 // initialNotify collects data and does an initial notification
-func (d *Daemon) initialNotify() error {
-	if err := d.loadHostInfo(); err != nil {
+func (d *Daemon) initialNotify(ctx context.Context) error {
+	if err := d.initialCollect(ctx); err != nil {
 		return err
 	}
-	d.collectMetrics()
-	err := d.notify()
+	err := d.notify(ctx)
 	return err
 }
 
-func (d *Daemon) loadHostInfo() error {
+// initialCollect loads HostInfo and collects data
+func (d *Daemon) initialCollect(ctx context.Context) error {
+	if err := d.loadHostInfo(ctx); err != nil {
+		return err
+	}
+	d.collectMetrics()
+	return nil
+}
+
+// resumeDelay returns time remaining to the next write if the last
+// notification was done less than the write interval ago, zero otherwise.
+func (d *Daemon) resumeDelay() time.Duration {
+	last := d.state.LastSuccessAt
+	if d.state.LastNotify != nil && d.state.LastNotify.Time.After(last) {
+		last = d.state.LastNotify.Time
+	}
+	if last.IsZero() {
+		return 0
+	}
+	delay := time.Until(last.Add(d.config.WriteInterval))
+	// Time in the future is ignored, e.g. the clock was changed
+	if delay <= 0 || delay > d.config.WriteInterval {
+		return 0
+	}
+	return delay
+}
+
+// finalFlush sends pending samples on shutdown. Notifications in progress
+// were interrupted, so it gets its own context limited by the grace period.
+func (d *Daemon) finalFlush() {
+	if d.config.ShutdownGracePeriod <= 0 || d.hostInfo == nil {
+		return
+	}
+	logger.Infoln("Flushing metrics before shutdown...")
+	ctx, cancel := context.WithTimeout(context.Background(), d.config.ShutdownGracePeriod)
+	defer cancel()
+	if err := d.notify(ctx); err != nil {
+		logger.Warnf("Final flush failed: %s\n", err.Error())
+	}
+}
+
+func (d *Daemon) loadHostInfo(ctx context.Context) error {
 	logger.Debugln("Load HostInfo...")
-	hostInfo, err := d.hostInfoProvider.Load()
-	if err != nil {
+	hostInfo, err := d.hostInfoProvider.Load(ctx)
+	// Partially loaded information is used, the policy decides whether
+	// it is enough for sending.
+	var loadErr *hostinfo.LoadError
+	if err != nil && (hostInfo == nil || !errors.As(err, &loadErr)) {
 		return err
 	}
+	d.reportLoadError(loadErr)
+	hostInfo = d.keepLastKnownGood(hostInfo, loadErr)
 	logger.Infoln("HostInfo loaded")
 	logger.Infoln(hostInfo.String())
+	var fence *identityFence
+	if previous := d.hostInfo; previous == nil {
+		d.checkHostIdentity(hostInfo)
+	} else if previous.Fingerprint() != hostInfo.Fingerprint() {
+		logger.Warnf("Host identity changed (HostId '%s' -> '%s')\n", previous.HostId, hostInfo.HostId)
+		fence = d.newIdentityFence(previous)
+	}
+	d.setHostInfoWithFence(hostInfo, fence)
+	for _, e := range d.endpoints {
+		e.loadHostCert()
+		e.notifier.HostChanged()
+	}
+	// Samples of the previous identity are sent by the sender, so that
+	// a slow server doesn't block the main loop
+	if fence != nil && d.sender != nil {
+		d.sender.Trigger()
+	}
+	return nil
+}
+
+func (d *Daemon) setHostInfo(hostInfo *hostinfo.HostInfo) {
+	d.setHostInfoWithFence(hostInfo, nil)
+}
+
+// setHostInfoWithFence replaces the host info and queues the fence of the
+// previous identity, if any, so that no send uses the new identity before
+// the fence.
+func (d *Daemon) setHostInfoWithFence(hostInfo *hostinfo.HostInfo, fence *identityFence) {
+	d.hostInfoMu.Lock()
+	defer d.hostInfoMu.Unlock()
 	d.hostInfo = hostInfo
-	d.notifier.HostChanged()
+	if fence != nil {
+		d.fences = append(d.fences, fence)
+	}
+}
+
+// keepLastKnownGood keeps previous values of the fields which failed to load,
+// unless they were loaded longer than HostInfoMaxStaleness ago, so that a
+// single failed refresh doesn't drop labels or the identity of the host.
+// A host which is not registered anymore keeps nothing, it must not be
+// billed under its previous identity.
+func (d *Daemon) keepLastKnownGood(hostInfo *hostinfo.HostInfo, loadErr *hostinfo.LoadError) *hostinfo.HostInfo {
+	now := time.Now()
+	if d.hostInfoLoadedAt == nil {
+		d.hostInfoLoadedAt = map[string]time.Time{}
+	}
+	if isNotRegistered(loadErr) {
+		logger.Warnln("The host is not registered, previous identity is not kept")
+		d.forgetIdentity()
+	}
+	var kept []string
+	for _, field := range hostinfo.Fields {
+		var fe *hostinfo.FieldError
+		if loadErr != nil {
+			fe = loadErr.Field(field)
+		}
+		if fe == nil {
+			d.hostInfoLoadedAt[field] = now
+			continue
+		}
+		if fe.Reason == hostinfo.ReasonNotRegistered {
+			delete(d.hostInfoLoadedAt, field)
+			continue
+		}
+		loadedAt, ok := d.hostInfoLoadedAt[field]
+		if ok && d.hostInfo != nil && now.Sub(loadedAt) < d.config.HostInfoMaxStaleness {
+			kept = append(kept, field)
+		}
+	}
+
+	if len(kept) > 0 {
+		// The loaded host info may be shared by the provider
+		merged := *hostInfo
+		hostinfo.MergeHostInfo(&merged, d.hostInfo, kept)
+		hostInfo = &merged
+		logger.Warnf("Keeping previous values of %s which failed to refresh\n", strings.Join(kept, ", "))
+	}
+
+	if previous := d.hostInfo; previous != nil {
+		if previous.HostId != "" && hostInfo.HostId == "" {
+			logger.Warnf("HostId regressed to an empty value (was '%s')\n", previous.HostId)
+		}
+		if previous.ExternalOrganization != "" && hostInfo.ExternalOrganization == "" {
+			logger.Warnf("ExternalOrganization regressed to an empty value (was '%s')\n", previous.ExternalOrganization)
+		}
+	}
+	return hostInfo
+}
+
+// isNotRegistered tells whether a value failed because the host is not
+// registered, such a failure is final.
+func isNotRegistered(loadErr *hostinfo.LoadError) bool {
+	if loadErr == nil {
+		return false
+	}
+	for _, fe := range loadErr.Fields {
+		if fe.Reason == hostinfo.ReasonNotRegistered {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetIdentity makes the next load clear the identity of the host when it
+// fails to load, e.g. after the consumer certificate was removed.
+func (d *Daemon) forgetIdentity() {
+	for _, field := range []string{"HostId", "HostName", "ExternalOrganization"} {
+		delete(d.hostInfoLoadedAt, field)
+	}
+}
+
+// reportLoadError keeps the failures of the last load, they are logged
+// once until they change.
+func (d *Daemon) reportLoadError(loadErr *hostinfo.LoadError) {
+	previous := d.HostInfoError()
+	d.hostInfoMu.Lock()
+	d.hostInfoErr = loadErr
+	d.hostInfoMu.Unlock()
+
+	switch {
+	case loadErr == nil:
+		if previous != nil {
+			logger.Infoln("HostInfo loaded without failures")
+		}
+	case previous != nil && previous.Error() == loadErr.Error():
+		logger.Debugf("%s\n", loadErr.Error())
+	case loadErr.Required():
+		logger.Errorf("%s\nTo fix it: %s\n", loadErr.Error(), loadErr.Remediation())
+	default:
+		logger.Warnf("%s\nTo fix it: %s\n", loadErr.Error(), loadErr.Remediation())
+	}
+}
+
+// HostInfoError returns values of the host info which failed to load
+// last time, nil if all were loaded.
+func (d *Daemon) HostInfoError() *hostinfo.LoadError {
+	d.hostInfoMu.RLock()
+	defer d.hostInfoMu.RUnlock()
+	return d.hostInfoErr
+}
+
+// currentHostInfo returns HostInfo for use outside of the event loop.
+func (d *Daemon) currentHostInfo() *hostinfo.HostInfo {
+	d.hostInfoMu.RLock()
+	defer d.hostInfoMu.RUnlock()
+	return d.hostInfo
+}
+
+// reloadConfig re-reads the configuration file and environment variables.
+// The new configuration is applied only if it is entirely valid, otherwise
+// the current one is kept.
+func (d *Daemon) reloadConfig() error {
+	logger.Infoln("Reloading configuration...")
+	cfg, err := d.readConfig()
+	changes := d.config.Diff(cfg)
+
+	if err == nil {
+		err = config.NewConfigValidator(cfg).Validate()
+	}
+	var collectors []collector.Collector
+	if err == nil {
+		collectors, err = collector.New(cfg.Collectors, collector.DefaultPaths)
+	}
+	if err == nil && loggerChanged(d.config, cfg) {
+		err = logger.InitLogger(cfg.LogPath, cfg.LogLevel, cfg.InstanceID)
+	}
+	if err != nil {
+		if len(changes) > 0 {
+			logger.Warnf("Rejected configuration changes:\n%s\n", strings.Join(changes, "\n"))
+		}
+		return fmt.Errorf("configuration not reloaded: %w", err)
+	}
+
+	if len(changes) == 0 {
+		logger.Infoln("Configuration unchanged")
+		return nil
+	}
+	logger.Infof("Configuration changes:\n%s\n", strings.Join(changes, "\n"))
+	d.collectors = collectors
+	d.applyConfig(cfg)
+	logger.Infoln("Configuration reloaded")
 	return nil
 }
 
+func (d *Daemon) readConfig() (*config.Config, error) {
+	cfg := config.NewConfig()
+	if d.configPath != "" {
+		// Missing file is not an error, defaults are used as on startup
+		if _, err := os.Stat(d.configPath); err == nil {
+			if err := cfg.UpdateFromConfigFile(d.configPath); err != nil {
+				return cfg, err
+			}
+		}
+	}
+	return cfg, cfg.UpdateFromEnvVars()
+}
+
+func tickersChanged(current *config.Config, updated *config.Config) bool {
+	return current.CollectInterval != updated.CollectInterval ||
+		current.WriteInterval != updated.WriteInterval ||
+		current.WriteSplay != updated.WriteSplay ||
+		current.LabelRefreshInterval != updated.LabelRefreshInterval
+}
+
+func loggerChanged(current *config.Config, updated *config.Config) bool {
+	return current.LogPath != updated.LogPath ||
+		current.LogLevel != updated.LogLevel ||
+		current.InstanceID != updated.InstanceID
+}
+
+// applyConfig replaces the configuration in place, so that components holding
+// the config pointer see the new values.
+func (d *Daemon) applyConfig(cfg *config.Config) {
+	// Don't wait for a send in progress, it may take long on retries
+	if d.sender != nil {
+		d.sender.Interrupt()
+	}
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+
+	old := *d.config
+	*d.config = *cfg
+
+	endpoints, err := updateEndpoints(d.endpoints, d.config)
+	if err != nil {
+		logger.Errorf("Keeping current endpoints: %s\n", err.Error())
+	} else {
+		d.endpoints = endpoints
+		d.pruneEndpointStates()
+	}
+
+	// Rebuilding the tickers rolls a new splay and restarts the write
+	// interval, frequent reloads would postpone writes indefinitely
+	if d.tickers != nil && tickersChanged(&old, d.config) {
+		d.tickers.Stop()
+		d.tickers = newTickers(d.config, 0)
+	}
+
+	if old.MetricsWALPath != d.config.MetricsWALPath {
+		oldLog := d.metricsLog
+		if err := d.initMetricsLog(); err != nil {
+			logger.Errorf("Keeping metrics log at %s: %s\n", old.MetricsWALPath, err.Error())
+			d.config.MetricsWALPath = old.MetricsWALPath
+		} else {
+			// Cursors of the endpoints point to the old log
+			for _, state := range d.state.Endpoints {
+				state.Cursor = 0
+			}
+			if oldLog != nil {
+				oldLog.Close()
+			}
+		}
+	}
+
+	if old.StatePath != d.config.StatePath {
+		d.saveState()
+	}
+
+	if old.HostInfoSource != d.config.HostInfoSource || old.HostCertPath != d.config.HostCertPath ||
+		old.SubManTimeout != d.config.SubManTimeout || old.SubManCacheTTL != d.config.SubManCacheTTL ||
+		old.CpuCountMode != d.config.CpuCountMode || old.BillingModel != d.config.BillingModel ||
+		!reflect.DeepEqual(old.Marketplaces, d.config.Marketplaces) {
+		d.hostInfoProvider = newHostInfoProvider(d.config)
+	}
+
+	if old.ControlSocketPath != d.config.ControlSocketPath && d.tickers != nil {
+		d.stopControlServer()
+		if err := d.startControlServer(); err != nil {
+			logger.Errorf("Control socket initialization failed: %v\n", err.Error())
+		}
+	}
+}
+
 func (d *Daemon) initMetricsLog() error {
 	logger.Debugln("Initializing metrics log...")
 	log, err := notify.NewMetricsLog(d.config.MetricsWALPath)
@@ -197,70 +615,292 @@ func (d *Daemon) initMetricsLog() error {
 	return nil
 }
 
+func (d *Daemon) initState() {
+	d.state = &State{}
+	if d.config.StatePath == "" {
+		return
+	}
+	state, err := LoadState(d.config.StatePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warnf("Error loading state: %s\n", err.Error())
+		}
+		return
+	}
+	d.state = state
+}
+
+// pruneEndpointStates removes state of endpoints which are not configured,
+// so that their cursors are not kept forever.
+func (d *Daemon) pruneEndpointStates() {
+	for name := range d.state.Endpoints {
+		if findEndpoint(d.endpoints, name) == nil {
+			delete(d.state.Endpoints, name)
+		}
+	}
+}
+
+func (d *Daemon) saveState() {
+	if d.config.StatePath == "" {
+		return
+	}
+	if err := d.state.Save(d.config.StatePath); err != nil {
+		logger.Warnf("Error saving state: %s\n", err.Error())
+	}
+}
+
 func (d *Daemon) collectMetrics() {
 	logger.Debugln("Collecting metrics...")
+	if d.hostInfo == nil {
+		logger.Warnln("Cannot collect metrics: missing internal HostInfo")
+		return
+	}
 
-	err := d.hostInfoProvider.RefreshCpuCount(d.hostInfo)
+	// The CPU count is refreshed on a copy as HostInfo may be in use
+	// by the sender.
+	hostInfo := *d.hostInfo
+	err := d.hostInfoProvider.RefreshCpuCount(&hostInfo)
 	if err != nil {
 		logger.Warnf("Error refreshing CPU count: %s\n", err.Error())
 		return
 	}
+	d.setHostInfo(&hostInfo)
+
+	// Store labels of the host valid at the time of collection together
+	// with the samples so that they are not affected by later changes.
+	hostLabels := notify.HostInfoLabels(&hostInfo)
+	timestamp := time.Now().UnixMilli()
+	var series []prompb.TimeSeries
+	for _, c := range d.collectors {
+		metrics, err := c.Collect(&hostInfo)
+		if err != nil {
+			logger.Warnf("Error collecting %s: %s\n", c.Name(), err.Error())
+			continue
+		}
+		for _, metric := range metrics {
+			ts := metric.TimeSeries(timestamp)
+			ts.Labels = notify.MergeLabels(ts.Labels, hostLabels)
+			series = append(series, ts)
+		}
+	}
 
-	err = d.metricsLog.WriteSampleNow(d.hostInfo.CpuCount)
+	err = d.metricsLog.WriteSeries(series)
 	if err != nil {
 		logger.Warnf("Error writing metrics log: %s\n", err.Error())
 		return
 	}
-	logger.Debugln("Metrics collected")
+	logger.Debugf("Metrics collected - %d sample(s)\n", len(series))
 }
 
-func (d *Daemon) notify() error {
-	if d.hostInfo == nil {
+// notify sends samples to all endpoints. Samples are removed from the metrics
+// log once every endpoint acknowledged them or they expired. The first error
+// is returned.
+func (d *Daemon) notify(ctx context.Context) error {
+	d.hostInfoMu.Lock()
+	hostInfo, fences := d.hostInfo, d.fences
+	d.fences = nil
+	d.hostInfoMu.Unlock()
+	if hostInfo == nil {
 		return fmt.Errorf("missing internal HostInfo")
 	}
 	logger.Debugln("Initiating notification request...")
-	samples, checkpoint, err := d.metricsLog.GetSamples()
+
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	// Samples of previous identities are sent first, the new identity
+	// would quarantine them
+	if pending := d.sendFences(ctx, fences); len(pending) > 0 {
+		d.hostInfoMu.Lock()
+		d.fences = append(pending, d.fences...)
+		d.hostInfoMu.Unlock()
+		return ctx.Err()
+	}
+	return d.notifyEndpoints(ctx, d.endpoints, hostInfo)
+}
+
+// notifyEndpoints sends samples of the host to the endpoints. It is called
+// with sendMu and stateMu held.
+func (d *Daemon) notifyEndpoints(ctx context.Context, endpoints []*endpoint, hostInfo *hostinfo.HostInfo) error {
+	d.notifyBlockedBy = nil
+	var firstErr error
+	var result *NotifyResult
+	for _, e := range endpoints {
+		endpointResult, err := d.notifyEndpoint(ctx, e, hostInfo)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		// Result of the first failed endpoint takes precedence
+		if endpointResult != nil && (result == nil || result.Outcome == NotifyOutcomeSuccess) {
+			result = endpointResult
+		}
+	}
+	if result != nil {
+		d.state.LastNotify = result
+		if firstErr == nil && d.notifyBlockedBy == nil {
+			d.state.LastSuccessAt = result.Time
+			d.state.HostId = hostInfo.HostId
+			d.state.HostFingerprint = hostInfo.Fingerprint()
+		}
+	}
+	d.saveState()
+	d.truncateMetricsLog()
+
+	return firstErr
+}
+
+// notifyEndpoint sends samples which the endpoint did not acknowledge yet
+// in chunks limited by configuration of the endpoint. The cursor of the
+// endpoint is advanced after each acknowledged chunk, sending stops on the
+// first failed chunk. The result is nil if nothing was sent. It is called
+// with stateMu held, which is released while sending a chunk.
+func (d *Daemon) notifyEndpoint(ctx context.Context, e *endpoint, hostInfo *hostinfo.HostInfo) (*NotifyResult, error) {
+	state := d.state.Endpoint(e.name)
+	chunks, err := d.metricsLog.GetChunksFrom(state.Cursor, notify.HostInfoLabels(hostInfo),
+		e.config.WriteMaxSamples, e.config.WriteMaxBytes)
 	if err != nil {
-		logger.Warnf("Error getting samples: %s\n", err.Error())
-		return err
+		logger.Warnf("Error getting samples for %s: %s\n", e.name, err.Error())
+		return nil, err
 	}
-	origCount := len(samples)
-	if d.config.MetricsMaxAge > 0 {
-		samples = notify.FilterSamplesByAge(samples, d.config.MetricsMaxAge)
+	var series []prompb.TimeSeries
+	// Samples collected for another identity of the host are never sent
+	// with the current one.
+	foreign := make([][]prompb.TimeSeries, len(chunks))
+	for idx := range chunks {
+		if d.config.MetricsMaxAge > 0 {
+			chunks[idx].Series = notify.FilterSamplesByAge(chunks[idx].Series, d.config.MetricsMaxAge)
+		}
+		chunks[idx].Series, foreign[idx] = splitByIdentity(chunks[idx].Series, hostInfo)
+		series = append(series, chunks[idx].Series...)
 	}
-	err = d.notifyPolicy.ShouldNotify(samples, d.hostInfo)
+	err = d.notifyPolicy.ShouldNotify(series, hostInfo)
 	if err != nil {
-		logger.Warnf("Cannot notify: %s\n", err.Error())
-		return nil
+		d.notifyBlockedBy = err
+		logger.Warnf("Cannot notify %s: %s\n", e.name, err.Error())
+		return nil, nil
 	}
 
-	count := len(samples)
-	logger.Debugf("Sending %d sample(s)...\n", count)
-	err = d.notifier.Notify(samples, d.hostInfo)
-	var notifyError *notify.NotifyError
-	var truncateError error
-	if err == nil {
-		// clear all samples on success as they were accepted by the server
-		logger.Infof("Notification successful - sent %d sample(s)\n", count)
-		truncateError = d.metricsLog.RemoveSamples(checkpoint)
-	} else if errors.As(err, &notifyError) && !notifyError.Recoverable() {
-		// clear all samples on non-recoverable error
-		logger.Warnf("Notification [%d sample(s)]): %s\n", count, notifyError.Error())
-		truncateError = d.metricsLog.RemoveSamples(checkpoint)
-	} else {
-		// don't clear or clear only old so that WAL does not grow indefinitely on retries
-		// on recoverable or unknowns errors
-		logger.Warnf("Notification [%d sample(s)]: %s\n", count, err.Error())
-		if origCount != count {
-			logger.Infof("Dropping %d expired sample(s)\n", origCount-count)
-			truncateError = d.metricsLog.RemoveOldestSamples(origCount - count)
+	sent := 0
+	for idx, chunk := range chunks {
+		count := notify.SamplesCount(chunk.Series)
+		if count == 0 {
+			// all samples of the chunk expired or are of another identity
+			d.advanceCursor(e, chunk.Checkpoint, foreign[idx])
+			continue
+		}
+
+		logger.Debugf("Sending %d sample(s) in %d series to %s (chunk %d/%d)...\n",
+			count, len(chunk.Series), e.name, idx+1, len(chunks))
+		d.stateMu.Unlock()
+		err = e.notifier.Notify(ctx, chunk.Series, hostInfo)
+		d.stateMu.Lock()
+		var notifyError *notify.NotifyError
+		if err == nil {
+			// samples were accepted by the server
+			sent += count
+			d.advanceCursor(e, chunk.Checkpoint, foreign[idx])
+			if newest := notify.NewestSampleTime(chunk.Series); newest.After(state.LastSampleAt) {
+				state.LastSampleAt = newest
+			}
+			continue
+		}
+		if errors.As(err, &notifyError) && !notifyError.Recoverable() {
+			// samples would be rejected again on non-recoverable error
+			logger.Warnf("Notification of %s [%d sample(s)]: %s\n", e.name, count, notifyError.Error())
+			d.advanceCursor(e, chunk.Checkpoint, foreign[idx])
+		} else {
+			// samples are sent again on recoverable or unknown errors
+			logger.Warnf("Notification of %s [%d sample(s)]: %s\n", e.name, count, err.Error())
 		}
+		state.LastNotify = newNotifyResult(sent+count, err)
+		return state.LastNotify, err
 	}
 
-	if truncateError != nil {
-		logger.Warnf("Error truncating WAL: %s\n", truncateError.Error())
-		return err
+	logger.Infof("Notification successful - sent %d sample(s) to %s\n", sent, e.name)
+	state.LastNotify = newNotifyResult(sent, nil)
+	return state.LastNotify, nil
+}
+
+// truncateMetricsLog removes samples acknowledged by all endpoints and
+// expired samples, so that the log does not grow indefinitely on retries.
+func (d *Daemon) truncateMetricsLog() {
+	var cursor uint64
+	for idx, e := range d.endpoints {
+		endpointCursor := d.state.Endpoint(e.name).Cursor
+		if idx == 0 || endpointCursor < cursor {
+			cursor = endpointCursor
+		}
+	}
+	if err := d.metricsLog.RemoveSamplesBefore(cursor); err != nil {
+		logger.Warnf("Error truncating WAL: %s\n", err.Error())
+		return
 	}
 
-	return err
+	if d.config.MetricsMaxAge > 0 {
+		removed, err := d.metricsLog.RemoveExpiredSamples(d.config.MetricsMaxAge)
+		if err != nil {
+			logger.Warnf("Error truncating WAL: %s\n", err.Error())
+		} else if removed > 0 {
+			logger.Infof("Dropped %d expired sample(s)\n", removed)
+		}
+	}
+}
+
+type tickers struct {
+	collect *time.Ticker
+	write   *time.Ticker
+	label   *time.Ticker
+	// Interval of the write ticker after its first tick, if the first
+	// tick is delayed by a random splay.
+	writeInterval time.Duration
+}
+
+// newTickers creates tickers of the configuration. The first write is done
+// after firstWrite, if it is zero the first write is delayed by a random splay.
+func newTickers(cfg *config.Config, firstWrite time.Duration) *tickers {
+	t := &tickers{
+		collect: newOptionalTicker(cfg.CollectInterval),
+		write:   time.NewTicker(cfg.WriteInterval),
+		label:   newOptionalTicker(cfg.LabelRefreshInterval),
+	}
+	if firstWrite <= 0 {
+		// Delay the first write randomly so that hosts started at the same
+		// time don't write at the same time.
+		splay := cfg.WriteSplay
+		if splay > cfg.WriteInterval {
+			splay = cfg.WriteInterval
+		}
+		firstWrite = notify.RandomDuration(splay)
+	}
+	if firstWrite > 0 {
+		logger.Debugf("First write delayed by %s\n", firstWrite)
+		t.write.Reset(firstWrite)
+		t.writeInterval = cfg.WriteInterval
+	}
+	return t
+}
+
+// WriteTicked restores the write interval after the first delayed tick.
+func (t *tickers) WriteTicked() {
+	if t.writeInterval > 0 {
+		t.write.Reset(t.writeInterval)
+		t.writeInterval = 0
+	}
+}
+
+func newOptionalTicker(interval time.Duration) *time.Ticker {
+	if interval > 0 {
+		return time.NewTicker(interval)
+	}
+	// Create dummy stopped ticker if the interval is not configured
+	ticker := time.NewTicker(time.Duration(1) * time.Hour)
+	ticker.Stop()
+	return ticker
+}
+
+func (t *tickers) Stop() {
+	t.collect.Stop()
+	t.write.Stop()
+	t.label.Stop()
 }
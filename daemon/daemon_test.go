@@ -1,13 +1,20 @@
 package daemon
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"os"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/RedHatInsights/host-metering/collector"
 	"github.com/RedHatInsights/host-metering/config"
 	"github.com/RedHatInsights/host-metering/hostinfo"
+	"github.com/RedHatInsights/host-metering/logger"
 	"github.com/RedHatInsights/host-metering/notify"
 	"github.com/prometheus/prometheus/prompb"
 )
@@ -150,16 +157,377 @@ func TestReloadOnCertChange(t *testing.T) {
 	waitForStopped(t, daemon)
 }
 
+// Test that each enabled collector writes its own series
+func TestCollectors(t *testing.T) {
+	daemon, notifier, metricsLog, _ := createDaemon(t)
+	var err error
+	daemon.collectors, err = collector.New(
+		[]string{collector.CpuLogicalCount, collector.MemoryTotalBytes}, collector.DefaultPaths)
+	checkError(t, err, "failed to create collectors")
+	daemon.hostInfo = daemon.hostInfoProvider.(*mockHostInfoProvider).hi
+
+	daemon.collectMetrics()
+	daemon.collectMetrics()
+	series, _, _ := metricsLog.GetSamples(nil)
+	if len(series) != 2 || len(series[0].Samples) != 2 || len(series[1].Samples) != 2 {
+		t.Fatalf("expected 2 series with 2 samples, got: %v", series)
+	}
+	if series[0].Labels[0].Value != collector.CpuLogicalCount || series[0].Samples[0].Value != 2 {
+		t.Fatalf("unexpected logical CPU count series: %v", series[0])
+	}
+	if series[1].Labels[0].Value != collector.MemoryTotalBytes {
+		t.Fatalf("unexpected memory series: %v", series[1])
+	}
+
+	// Test that all series are sent
+	err = daemon.notify(context.Background())
+	checkError(t, err, "failed to notify")
+	if len(notifier.calledWith.series) != 2 || len(notifier.calledWith.samples) != 4 {
+		t.Fatalf("expected 2 series with 4 samples to be sent")
+	}
+
+	// Test that unknown collector is refused
+	daemon.config.Collectors = []string{"unknown"}
+	_, err = NewDaemon(daemon.config)
+	if err == nil {
+		t.Fatalf("expected unknown collector to be refused")
+	}
+}
+
+// Test that samples keep labels of the host valid at the time of collection
+func TestHostLabelsAtCollection(t *testing.T) {
+	daemon, notifier, _, hostInfoProvider := createDaemon(t)
+	daemon.hostInfo = hostInfoProvider.hi
+
+	daemon.collectMetrics()
+	hostInfo := *hostInfoProvider.hi
+	hostInfo.Usage = "newusage"
+	daemon.hostInfo = &hostInfo
+	daemon.collectMetrics()
+
+	err := daemon.notify(context.Background())
+	checkError(t, err, "failed to notify")
+	series := notifier.calledWith.series
+	if len(series) != 2 {
+		t.Fatalf("expected 2 series, got: %v", series)
+	}
+	checkLabel(t, series[0], "usage", "testusage")
+	checkLabel(t, series[1], "usage", "newusage")
+}
+
+// Test that samples are never sent with another identity of the host
+func TestHostIdentityChange(t *testing.T) {
+	daemon, notifier, metricsLog, _ := createDaemon(t)
+	fenceNotifier := &mockNotifier{}
+	fenceNotifier.ExpectSuccess()
+	var fenceCert tls.Certificate
+	daemon.certNotifier = func(cfg *config.Config, cert tls.Certificate) notify.Notifier {
+		fenceCert = cert
+		return fenceNotifier
+	}
+	err := daemon.loadHostInfo(context.Background())
+	checkError(t, err, "failed to load host info")
+	daemon.endpoints[0].hostCert = &tls.Certificate{Certificate: [][]byte{[]byte("old")}}
+	daemon.collectMetrics()
+
+	// Test that the main loop doesn't send samples of the previous identity
+	daemon.hostInfoProvider = newMockHostInfoProvider(&hostinfo.HostInfo{
+		CpuCount:             2,
+		HostId:               "new-host-id",
+		ExternalOrganization: "testorg",
+	})
+	err = daemon.loadHostInfo(context.Background())
+	checkError(t, err, "failed to load host info")
+	fenceNotifier.CheckWasNotCalled(t)
+
+	// Test that an interrupted send keeps the fence
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = daemon.notify(ctx)
+	checkExpectedError(t, err, "context canceled")
+	fenceNotifier.CheckWasNotCalled(t)
+
+	// Test that samples of the previous identity are sent with its labels
+	// and certificate before samples of the new one
+	err = daemon.notify(context.Background())
+	checkError(t, err, "failed to notify")
+	fenceNotifier.CheckWasCalled(t)
+	if fenceNotifier.calledWith.hostinfo.HostId != "testhost-id" || string(fenceCert.Certificate[0]) != "old" {
+		t.Fatalf("expected samples to be sent as the previous identity")
+	}
+	checkLabel(t, fenceNotifier.calledWith.series[0], "_id", "testhost-id")
+	checkEmptyMetricsLog(t, metricsLog)
+	notifier.CheckWasNotCalled(t)
+
+	// Test that samples of the previous identity are quarantined if its
+	// certificate is not available
+	daemon.collectMetrics()
+	daemon.hostInfoProvider = newMockHostInfoProvider(&hostinfo.HostInfo{
+		CpuCount:             2,
+		HostId:               "new-host-id",
+		ExternalOrganization: "neworg",
+	})
+	err = daemon.loadHostInfo(context.Background())
+	checkError(t, err, "failed to load host info")
+	daemon.collectMetrics()
+
+	err = daemon.notify(context.Background())
+	checkError(t, err, "failed to notify")
+	if len(notifier.calledWith.series) != 1 {
+		t.Fatalf("expected only samples of the current identity, got: %v", notifier.calledWith.series)
+	}
+	checkLabel(t, notifier.calledWith.series[0], "external_organization", "neworg")
+	checkEmptyMetricsLog(t, metricsLog)
+
+	quarantine, err := notify.NewMetricsLog(daemon.config.MetricsWALPath + ".quarantine/" + config.DefaultEndpointName)
+	checkError(t, err, "failed to open quarantine")
+	defer quarantine.Close()
+	series, _, _ := quarantine.GetSamples(nil)
+	if len(series) != 1 {
+		t.Fatalf("expected quarantined samples of the previous identity, got: %v", series)
+	}
+	checkLabel(t, series[0], "external_organization", "testorg")
+}
+
+// Test that subscription-manager is the default source of the host info.
+func TestHostInfoSource(t *testing.T) {
+	cfg := config.NewConfig()
+	if _, ok := newHostInfoProvider(cfg).(*hostinfo.SubManInfoProvider); !ok {
+		t.Fatalf("expected subscription-manager to be the default source")
+	}
+	cfg.HostInfoSource = config.HostInfoSourceFiles
+	if _, ok := newHostInfoProvider(cfg).(*hostinfo.NativeInfoProvider); !ok {
+		t.Fatalf("expected files to be read when configured")
+	}
+	cfg.HostInfoSource = config.HostInfoSourceDBus
+	if _, ok := newHostInfoProvider(cfg).(*hostinfo.DBusInfoProvider); !ok {
+		t.Fatalf("expected D-Bus to be used when configured")
+	}
+}
+
+func TestHostInfoLoadError(t *testing.T) {
+	daemon, _, _, hiProvider := createDaemon(t)
+
+	// Test that partially loaded information is used and failures are kept
+	loadErr := &hostinfo.LoadError{}
+	loadErr.Add(hostinfo.ErrNotRegistered, "HostId")
+	hiProvider.err = loadErr
+	err := daemon.loadHostInfo(context.Background())
+	checkError(t, err, "failed to load host info")
+	if daemon.hostInfo != hiProvider.hi || daemon.HostInfoError() != loadErr {
+		t.Fatalf("expected partial host info with its failures")
+	}
+	fe := daemon.HostInfoError().Field("HostId")
+	if fe == nil || !fe.Required || fe.Reason != hostinfo.ReasonNotRegistered {
+		t.Fatalf("unexpected failure of HostId: %v", fe)
+	}
+	if dump := daemon.dump(); dump.HostInfoError != loadErr {
+		t.Fatalf("expected failures in dump")
+	}
+
+	// Test that other errors keep the previous information
+	hiProvider.hi = nil
+	hiProvider.err = context.Canceled
+	err = daemon.loadHostInfo(context.Background())
+	checkExpectedError(t, err, "context canceled")
+	if daemon.hostInfo == nil || daemon.HostInfoError() != loadErr {
+		t.Fatalf("expected previous host info to be kept")
+	}
+
+	// Test that failures are cleared by a complete load
+	hiProvider.hi = &hostinfo.HostInfo{HostId: "testhost-id", ExternalOrganization: "testorg"}
+	hiProvider.err = nil
+	err = daemon.loadHostInfo(context.Background())
+	checkError(t, err, "failed to load host info")
+	if daemon.HostInfoError() != nil {
+		t.Fatalf("expected no failures, got: %v", daemon.HostInfoError())
+	}
+}
+
+func TestHostInfoKeepsLastKnownGood(t *testing.T) {
+	daemon, _, _, hiProvider := createDaemon(t)
+	err := daemon.loadHostInfo(context.Background())
+	checkError(t, err, "failed to load host info")
+
+	// Test that values which failed to refresh keep their previous values
+	degraded := *hiProvider.hi
+	degraded.HostId = ""
+	degraded.Usage = ""
+	loadErr := &hostinfo.LoadError{}
+	loadErr.Add(context.DeadlineExceeded, "HostId", "Usage")
+	hiProvider.hi, hiProvider.err = &degraded, loadErr
+	err = daemon.loadHostInfo(context.Background())
+	checkError(t, err, "failed to load host info")
+	hi := daemon.currentHostInfo()
+	if hi.HostId != "testhost-id" || hi.Usage != "testusage" {
+		t.Fatalf("expected previous values to be kept, got:\n%s", hi.String())
+	}
+	if degraded.HostId != "" || daemon.HostInfoError() != loadErr {
+		t.Fatalf("expected loaded host info to be unchanged with its failures")
+	}
+
+	// Test that the identity is cleared once the host cert is removed
+	daemon.forgetIdentity()
+	err = daemon.loadHostInfo(context.Background())
+	checkError(t, err, "failed to load host info")
+	hi = daemon.currentHostInfo()
+	if hi.HostId != "" || hi.Usage != "testusage" {
+		t.Fatalf("expected only identity to be cleared, got:\n%s", hi.String())
+	}
+
+	// Test that stale values are not kept
+	daemon.config.HostInfoMaxStaleness = 0
+	err = daemon.loadHostInfo(context.Background())
+	checkError(t, err, "failed to load host info")
+	if hi := daemon.currentHostInfo(); hi.Usage != "" {
+		t.Fatalf("expected stale usage to be dropped, got: %s", hi.Usage)
+	}
+}
+
+// Test that values of failed facts, including the virtualization and the
+// cloud provider, keep their previous values.
+func TestHostInfoKeepsFactsOnDegradedRefresh(t *testing.T) {
+	daemon, _, _, hiProvider := createDaemon(t)
+	hiProvider.hi.Virt = hostinfo.VirtInfo{IsGuest: "true", HostType: "kvm", UUID: "testuuid"}
+	hiProvider.hi.CloudProvider = "testmarketplace"
+	err := daemon.loadHostInfo(context.Background())
+	checkError(t, err, "failed to load host info")
+
+	degraded := *hiProvider.hi
+	degraded.SocketCount = ""
+	degraded.Billing = hostinfo.BillingInfo{}
+	degraded.Virt = hostinfo.VirtInfo{}
+	degraded.CloudProvider = ""
+	loadErr := &hostinfo.LoadError{}
+	loadErr.Add(context.DeadlineExceeded, "SocketCount", "ConversionsSuccess", "Billing", "Virt", "CloudProvider")
+	hiProvider.hi, hiProvider.err = &degraded, loadErr
+	err = daemon.loadHostInfo(context.Background())
+	checkError(t, err, "failed to load host info")
+	hi := daemon.currentHostInfo()
+	if hi.SocketCount != "1" || hi.Billing.Marketplace != "testmarketplace" ||
+		hi.Virt.HostType != "kvm" || hi.Virt.UUID != "testuuid" || hi.CloudProvider != "testmarketplace" {
+		t.Fatalf("expected previous facts to be kept, got:\n%s", hi.String())
+	}
+}
+
+// Test that a host which stops being registered doesn't keep its identity.
+func TestHostInfoNotRegisteredDropsIdentity(t *testing.T) {
+	daemon, _, _, hiProvider := createDaemon(t)
+	err := daemon.loadHostInfo(context.Background())
+	checkError(t, err, "failed to load host info")
+
+	// The identity times out while usage fails as not registered
+	unregistered := *hiProvider.hi
+	unregistered.HostId = ""
+	unregistered.HostName = ""
+	unregistered.ExternalOrganization = ""
+	unregistered.Usage = ""
+	loadErr := &hostinfo.LoadError{}
+	loadErr.Add(context.DeadlineExceeded, "HostId", "HostName", "ExternalOrganization")
+	loadErr.Add(hostinfo.ErrNotRegistered, "Usage")
+	hiProvider.hi, hiProvider.err = &unregistered, loadErr
+	err = daemon.loadHostInfo(context.Background())
+	checkError(t, err, "failed to load host info")
+	hi := daemon.currentHostInfo()
+	if hi.HostId != "" || hi.ExternalOrganization != "" || hi.Usage != "" {
+		t.Fatalf("expected identity of unregistered host to be dropped, got:\n%s", hi.String())
+	}
+
+	// Values which were not kept are not restored by later failures
+	loadErr = &hostinfo.LoadError{}
+	loadErr.Add(context.DeadlineExceeded, "HostId", "HostName", "ExternalOrganization", "Usage")
+	hiProvider.err = loadErr
+	err = daemon.loadHostInfo(context.Background())
+	checkError(t, err, "failed to load host info")
+	if hi := daemon.currentHostInfo(); hi.HostId != "" || hi.Usage != "" {
+		t.Fatalf("expected identity to stay dropped, got:\n%s", hi.String())
+	}
+}
+
+// Test that configuration and HostInfo are reloaded on SIGHUP
+func TestReloadOnSIGHUP(t *testing.T) {
+	daemon, mockNotifier, _, hostInfoProvider := createDaemon(t)
+	dir := t.TempDir()
+	configPath := dir + "/host-metering.conf"
+	logPath := dir + "/host-metering.log"
+	daemon.SetConfigPath(configPath)
+	t.Cleanup(func() { _ = logger.InitLogger("", config.DefaultLogLevel, "") })
+
+	go daemon.Run()
+	waitForStarted(t, daemon)
+	hostInfoProvider.ResetCalled()
+	checkHostChanged(t, mockNotifier, 1)
+
+	// Test that valid configuration is applied, including the logger
+	createConfigFile(t, configPath, "[host-metering]\n"+
+		"write_url = http://reloaded/url\n"+
+		"write_interval_sec = 3600\n"+
+		"metrics_wal_path = "+daemon.config.MetricsWALPath+"\n"+
+		"state_path = "+daemon.config.StatePath+"\n"+
+		"control_socket_path = "+daemon.config.ControlSocketPath+"\n"+
+		"log_path = "+logPath+"\n")
+	err := syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	checkError(t, err, "failed to send SIGHUP")
+	hostInfoProvider.WaitForCalled(t, 1)
+	if daemon.config.WriteUrl != "http://reloaded/url" || daemon.config.WriteInterval != 1*time.Hour {
+		t.Fatalf("expected configuration to be reloaded, got:\n%s", daemon.config.String())
+	}
+	// Config change and HostInfo reload
+	checkHostChanged(t, mockNotifier, 3)
+	checkLogContains(t, logPath, "HostInfo reloaded")
+
+	// Test that invalid configuration is rejected and the changes are logged
+	createConfigFile(t, configPath, "[host-metering]\n"+
+		"write_url = http://invalid/url\n"+
+		"write_interval_sec = 1\n"+
+		"log_path = "+logPath+"\n")
+	err = syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	checkError(t, err, "failed to send SIGHUP")
+	hostInfoProvider.WaitForCalled(t, 2)
+	if daemon.config.WriteUrl != "http://reloaded/url" {
+		t.Fatalf("expected configuration to be kept, got:\n%s", daemon.config.String())
+	}
+	checkLogContains(t, logPath, "Rejected configuration changes:\n"+
+		"WriteUrl: http://reloaded/url -> http://invalid/url\n"+
+		"WriteIntervalSec: 3600 -> 1\n")
+
+	// Cleanup
+	daemon.Stop()
+	waitForStopped(t, daemon)
+}
+
+// Test that tickers are rebuilt only when their intervals change
+func TestApplyConfigKeepsTickers(t *testing.T) {
+	daemon, _, _, _ := createDaemon(t)
+	daemon.tickers = newTickers(daemon.config, 0)
+	t.Cleanup(func() { daemon.tickers.Stop() })
+	tickers := daemon.tickers
+
+	cfg := *daemon.config
+	cfg.WriteUrl = "http://reloaded/url"
+	daemon.applyConfig(&cfg)
+	if daemon.tickers != tickers {
+		t.Fatalf("expected tickers to be kept")
+	}
+
+	cfg = *daemon.config
+	cfg.WriteSplay = cfg.WriteSplay + time.Second
+	daemon.applyConfig(&cfg)
+	if daemon.tickers == tickers {
+		t.Fatalf("expected tickers to be rebuilt")
+	}
+}
+
 func TestNotify(t *testing.T) {
 	daemon, notifier, metricsLog, hiProvider := createDaemon(t)
 	daemon.config.MetricsMaxAge = 10 * time.Second
-	daemon.hostInfo, _ = hiProvider.Load()
+	daemon.hostInfo, _ = hiProvider.Load(context.Background())
 	notifyPolicy := daemon.notifyPolicy.(*mockNotifyPolicy)
 
 	// Test that notifier is called when there are some samples
 	metricsLog.WriteSampleNow(1)
 	notifier.ExpectSuccess()
-	err := daemon.notify()
+	err := daemon.notify(context.Background())
 	checkError(t, err, "failed to notify")
 	notifier.CheckWasCalled(t)
 	notifyPolicy.CheckWasCalled(t)
@@ -175,9 +543,12 @@ func TestNotify(t *testing.T) {
 	// Test that log is truncated after notifying
 	checkEmptyMetricsLog(t, metricsLog)
 
+	// Test that the result is persisted in the state
+	checkLastNotify(t, daemon, NotifyOutcomeSuccess, 1)
+
 	// Test that notifier is not called when there are no samples
 	notifier.ResetCalledWith()
-	err = daemon.notify()
+	err = daemon.notify(context.Background())
 	checkError(t, err, "failed to notify")
 	notifier.CheckWasNotCalled(t)
 
@@ -186,9 +557,10 @@ func TestNotify(t *testing.T) {
 	metricsLog.WriteSample(1, expiredTs)
 	metricsLog.WriteSampleNow(2)
 	notifier.ExpectError(errors.New("mocked error"))
-	err = daemon.notify()
+	err = daemon.notify(context.Background())
 	checkExpectedError(t, err, "mocked error")
-	samples, _, _ := metricsLog.GetSamples()
+	checkLastNotify(t, daemon, NotifyOutcomeError, 1)
+	samples := getSamples(metricsLog)
 	if len(samples) != 1 {
 		t.Fatalf("expected expired sample to be pruned")
 	}
@@ -205,24 +577,25 @@ func TestNotify(t *testing.T) {
 	}
 
 	// Test that only expired samples are pruned on recoverable error
-	_, checkpoint, _ := metricsLog.GetSamples()
+	_, checkpoint, _ := metricsLog.GetSamples(nil)
 	metricsLog.RemoveSamples(checkpoint)
 	expiredTs = time.Now().UnixMilli() - 11000
 	metricsLog.WriteSample(1, expiredTs)
-	_, _, _ = metricsLog.GetSamples()
+	_, _, _ = metricsLog.GetSamples(nil)
 	metricsLog.WriteSample(1, expiredTs)
-	_, _, _ = metricsLog.GetSamples()
+	_, _, _ = metricsLog.GetSamples(nil)
 	metricsLog.WriteSampleNow(2)
-	_, _, _ = metricsLog.GetSamples()
+	_, _, _ = metricsLog.GetSamples(nil)
 	metricsLog.WriteSampleNow(3)
-	_, _, _ = metricsLog.GetSamples()
+	_, _, _ = metricsLog.GetSamples(nil)
 	metricsLog.WriteSampleNow(4)
-	_, _, _ = metricsLog.GetSamples()
+	_, _, _ = metricsLog.GetSamples(nil)
 	metricsLog.WriteSampleNow(5)
 	notifier.ExpectError(notify.RecoverableError(fmt.Errorf("mocked")))
-	err = daemon.notify()
+	err = daemon.notify(context.Background())
 	checkExpectedError(t, err, "recoverable notify error: mocked")
-	samples, _, _ = metricsLog.GetSamples()
+	checkLastNotify(t, daemon, NotifyOutcomeRecoverable, 4)
+	samples = getSamples(metricsLog)
 	if len(samples) != 4 {
 		t.Fatalf("expected expired sample to be pruned, got %d", len(samples))
 	}
@@ -234,14 +607,274 @@ func TestNotify(t *testing.T) {
 	metricsLog.WriteSampleNow(2)
 	metricsLog.WriteSampleNow(2)
 	notifier.ExpectError(notify.NonRecoverableError(fmt.Errorf("mocked")))
-	err = daemon.notify()
+	err = daemon.notify(context.Background())
 	checkExpectedError(t, err, "non-recoverable notify error: mocked")
-	samples, _, _ = metricsLog.GetSamples()
+	checkLastNotify(t, daemon, NotifyOutcomeNonRecoverable, 6)
+	samples = getSamples(metricsLog)
 	if len(samples) != 0 {
 		t.Fatalf("expected all samples to be pruned")
 	}
 }
 
+// Test that each endpoint is sent samples it did not acknowledge and that
+// samples are kept until all endpoints acknowledged them.
+func TestNotifyEndpoints(t *testing.T) {
+	daemon, notifier, metricsLog, hiProvider := createDaemon(t)
+	audit := addEndpoint(t, daemon, "audit")
+	daemon.hostInfo, _ = hiProvider.Load(context.Background())
+
+	// Test that samples are kept when one of the endpoints fails
+	metricsLog.WriteSampleNow(1)
+	audit.ExpectError(notify.RecoverableError(fmt.Errorf("mocked")))
+	err := daemon.notify(context.Background())
+	checkExpectedError(t, err, "recoverable notify error: mocked")
+	notifier.CheckWasCalled(t)
+	audit.CheckWasCalled(t)
+	checkLastNotify(t, daemon, NotifyOutcomeRecoverable, 1)
+	if len(getSamples(metricsLog)) != 1 {
+		t.Fatalf("expected samples to be kept until acknowledged by all endpoints")
+	}
+
+	// Test that the endpoint which succeeded gets only new samples
+	metricsLog.WriteSampleNow(2)
+	notifier.ResetCalledWith()
+	audit.ExpectSuccess()
+	err = daemon.notify(context.Background())
+	checkError(t, err, "failed to notify")
+	if len(notifier.calledWith.samples) != 1 || notifier.calledWith.samples[0].Value != 2 {
+		t.Fatalf("expected only the new sample to be sent, got %v", notifier.calledWith.samples)
+	}
+	if len(audit.calledWith.samples) != 2 {
+		t.Fatalf("expected 2 samples to be sent, got %d", len(audit.calledWith.samples))
+	}
+	checkLastNotify(t, daemon, NotifyOutcomeSuccess, 2)
+	checkEmptyMetricsLog(t, metricsLog)
+
+	// Test that cursors are persisted
+	state, err := LoadState(daemon.config.StatePath)
+	checkError(t, err, "failed to load state")
+	if state.Endpoint("audit").Cursor == 0 ||
+		state.Endpoint("audit").Cursor != state.Endpoint(config.DefaultEndpointName).Cursor {
+		t.Fatalf("unexpected cursors of endpoints: %+v", state.Endpoints)
+	}
+
+	// Test that state of removed endpoints is dropped
+	daemon.applyConfig(config.NewConfig())
+	if len(daemon.endpoints) != 1 || daemon.state.Endpoints["audit"] != nil {
+		t.Fatalf("expected audit endpoint to be removed, got %+v", daemon.state.Endpoints)
+	}
+}
+
+func TestNotifyRecordsSuccess(t *testing.T) {
+	daemon, notifier, metricsLog, hiProvider := createDaemon(t)
+	daemon.hostInfo, _ = hiProvider.Load(context.Background())
+
+	// Test that a failed notification is not recorded as success
+	metricsLog.WriteSample(1, time.Now().UnixMilli()-1000)
+	notifier.ExpectError(notify.RecoverableError(fmt.Errorf("mocked")))
+	_ = daemon.notify(context.Background())
+	if !daemon.state.LastSuccessAt.IsZero() || daemon.state.HostFingerprint != "" {
+		t.Fatalf("expected no successful notification, got %v", daemon.state.LastSuccessAt)
+	}
+
+	timestamp := time.Now().UnixMilli()
+	metricsLog.WriteSample(2, timestamp)
+	notifier.ExpectSuccess()
+	err := daemon.notify(context.Background())
+	checkError(t, err, "failed to notify")
+
+	state, err := LoadState(daemon.config.StatePath)
+	checkError(t, err, "failed to load state")
+	if state.LastSuccessAt.IsZero() || state.HostId != daemon.hostInfo.HostId ||
+		state.HostFingerprint != daemon.hostInfo.Fingerprint() {
+		t.Fatalf("expected successful notification to be recorded, got %+v", state)
+	}
+	if lastSample := state.Endpoint(config.DefaultEndpointName).LastSampleAt; lastSample.UnixMilli() != timestamp {
+		t.Fatalf("expected last acknowledged sample at %d, got %v", timestamp, lastSample)
+	}
+
+	// Test that a change of host identity is detected
+	if daemon.checkHostIdentity(daemon.hostInfo) {
+		t.Fatalf("expected host identity to be unchanged")
+	}
+	if !daemon.checkHostIdentity(&hostinfo.HostInfo{HostId: "other-host-id"}) {
+		t.Fatalf("expected host identity change to be detected")
+	}
+}
+
+func TestResumeWriteSchedule(t *testing.T) {
+	daemon, notifier, _, _ := createDaemon(t)
+	daemon.config.WriteInterval = 1 * time.Hour
+
+	// Recent notification resumes the schedule
+	daemon.state.LastSuccessAt = time.Now().Add(-10 * time.Minute)
+	delay := daemon.resumeDelay()
+	if delay <= 49*time.Minute || delay > 50*time.Minute {
+		t.Fatalf("expected next write in 50 minutes, got %s", delay)
+	}
+	startDaemon(t, daemon)
+	notifier.CheckWasNotCalled(t)
+	stopDaemon(t, daemon)
+
+	// Last failed attempt is considered as well
+	daemon.state.LastSuccessAt = time.Now().Add(-2 * time.Hour)
+	daemon.state.LastNotify = &NotifyResult{Time: time.Now().Add(-30 * time.Minute)}
+	if delay := daemon.resumeDelay(); delay <= 29*time.Minute || delay > 30*time.Minute {
+		t.Fatalf("expected next write in 30 minutes, got %s", delay)
+	}
+
+	// Old notification or notification in future is not resumed
+	daemon.state.LastNotify = nil
+	if delay := daemon.resumeDelay(); delay != 0 {
+		t.Fatalf("expected immediate write, got %s", delay)
+	}
+	daemon.state.LastSuccessAt = time.Now().Add(2 * time.Hour)
+	if delay := daemon.resumeDelay(); delay != 0 {
+		t.Fatalf("expected immediate write, got %s", delay)
+	}
+	daemon.state.LastSuccessAt = time.Time{}
+	startDaemon(t, daemon)
+	notifier.CheckWasCalled(t)
+	stopDaemon(t, daemon)
+}
+
+// Test that the backlog is sent in chunks and that acknowledged chunks
+// are not sent again when a later chunk fails.
+func TestNotifyChunks(t *testing.T) {
+	daemon, notifier, metricsLog, hiProvider := createDaemon(t)
+	daemon.endpoints[0].config.WriteMaxSamples = 2
+	daemon.hostInfo, _ = hiProvider.Load(context.Background())
+
+	for value := 1; value <= 5; value++ {
+		metricsLog.WriteSampleNow(uint(value))
+	}
+
+	// The second chunk fails
+	calls := 0
+	notifier.result = func(series []prompb.TimeSeries, hostinfo *hostinfo.HostInfo) error {
+		calls++
+		if calls == 2 {
+			return notify.RecoverableError(fmt.Errorf("mocked"))
+		}
+		return nil
+	}
+	err := daemon.notify(context.Background())
+	checkExpectedError(t, err, "recoverable notify error: mocked")
+	if calls != 2 {
+		t.Fatalf("expected sending to stop on the failed chunk, got %d calls", calls)
+	}
+	checkLastNotify(t, daemon, NotifyOutcomeRecoverable, 4)
+	samples := getSamples(metricsLog)
+	if len(samples) != 3 || samples[0].Value != 3 {
+		t.Fatalf("expected the acknowledged chunk to be removed, got %v", samples)
+	}
+
+	// The remaining chunks are sent
+	notifier.ExpectSuccess()
+	err = daemon.notify(context.Background())
+	checkError(t, err, "failed to notify")
+	if len(notifier.calledWith.samples) != 1 || notifier.calledWith.samples[0].Value != 5 {
+		t.Fatalf("expected the last chunk to contain the last sample, got %v", notifier.calledWith.samples)
+	}
+	checkLastNotify(t, daemon, NotifyOutcomeSuccess, 3)
+	checkEmptyMetricsLog(t, metricsLog)
+}
+
+// Test that the first periodic write is delayed by a random splay
+// and the following ones are done in the write interval
+func TestWriteSplay(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.WriteInterval = 1 * time.Hour
+	cfg.WriteSplay = 10 * time.Millisecond
+
+	tickers := newTickers(cfg, 0)
+	defer tickers.Stop()
+	select {
+	case <-tickers.write.C:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("expected the first write within the splay")
+	}
+
+	tickers.WriteTicked()
+	select {
+	case <-tickers.write.C:
+		t.Fatalf("expected the next write after the write interval")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+// Test that stopping the daemon interrupts a notification in progress
+func TestStopInterruptsNotify(t *testing.T) {
+	daemon, notifier, metricsLog, _ := createDaemon(t)
+	daemon.config.WriteInterval = 1 * time.Hour
+	startDaemon(t, daemon)
+
+	notifying := make(chan struct{})
+	notifier.result = func(series []prompb.TimeSeries, hostinfo *hostinfo.HostInfo) error {
+		close(notifying)
+		<-daemon.ctx.Done()
+		return notify.RecoverableError(daemon.ctx.Err())
+	}
+	metricsLog.WriteSampleNow(1)
+	go SendControlCommand(daemon.config.ControlSocketPath, ControlCommandFlush)
+	<-notifying
+
+	stopDaemon(t, daemon)
+	checkLastNotify(t, daemon, NotifyOutcomeRecoverable, 2)
+	if len(getSamples(metricsLog)) != 2 {
+		t.Fatalf("expected samples to be kept for the next start")
+	}
+}
+
+func TestCollectWhileSending(t *testing.T) {
+	daemon, notifier, metricsLog, _ := createDaemon(t)
+	daemon.config.CollectInterval = 5 * time.Millisecond
+	daemon.config.WriteInterval = 10 * time.Millisecond
+	startDaemon(t, daemon)
+
+	sending := make(chan struct{}, 1)
+	release := make(chan struct{})
+	notifier.result = func(series []prompb.TimeSeries, hostinfo *hostinfo.HostInfo) error {
+		select {
+		case sending <- struct{}{}:
+		default:
+		}
+		<-release
+		return nil
+	}
+	<-sending
+
+	// Samples are collected while the send is in progress
+	count := len(getSamples(metricsLog))
+	deadline := time.Now().Add(1 * time.Second)
+	for len(getSamples(metricsLog)) < count+2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected samples to be collected while sending")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	close(release)
+	stopDaemon(t, daemon)
+}
+
+func TestFinalFlushOnStop(t *testing.T) {
+	daemon, notifier, metricsLog, _ := createDaemon(t)
+	daemon.config.WriteInterval = 1 * time.Hour
+	daemon.config.ShutdownGracePeriod = 1 * time.Second
+	startDaemon(t, daemon)
+
+	metricsLog.WriteSampleNow(1)
+	notifier.ResetCalledWith()
+	stopDaemon(t, daemon)
+
+	notifier.CheckWasCalled(t)
+	if len(notifier.calledWith.samples) != 1 {
+		t.Fatalf("expected pending sample to be flushed, got: %v", notifier.calledWith.samples)
+	}
+	checkLastNotify(t, daemon, NotifyOutcomeSuccess, 1)
+}
+
 func TestRunWithLabelRefresh(t *testing.T) {
 	daemon, _, _, _ := createDaemon(t)
 	daemon.config.LabelRefreshInterval = 5 * time.Millisecond
@@ -306,6 +939,15 @@ func TestRunWithoutLabelRefresh(t *testing.T) {
 // Helper functions
 
 // Wait and check if daemon run was initiated
+func checkLogContains(t *testing.T, logPath string, expected string) {
+	t.Helper()
+	data, err := os.ReadFile(logPath)
+	checkError(t, err, "failed to read log")
+	if !strings.Contains(string(data), expected) {
+		t.Fatalf("expected log to contain:\n%s\ngot:\n%s", expected, string(data))
+	}
+}
+
 func checkRunning(t *testing.T, daemon *Daemon) {
 	timeout := time.NewTimer(10 * time.Millisecond)
 	defer timeout.Stop()
@@ -367,7 +1009,7 @@ func waitForEmptyMetricsLog(t *testing.T, metricsLog *notify.MetricsLog, timeout
 		case <-timeoutTimer.C:
 			t.Fatalf("expected metrics log to be empty")
 		default:
-			samples, _, _ := metricsLog.GetSamples()
+			samples := getSamples(metricsLog)
 			if len(samples) == 0 {
 				return
 			}
@@ -385,7 +1027,7 @@ func waitForValuesInMetricsLog(t *testing.T, metricsLog *notify.MetricsLog, coun
 		case <-timeoutTimer.C:
 			t.Fatalf("expected metrics log to have %d values", count)
 		default:
-			samples, _, _ := metricsLog.GetSamples()
+			samples := getSamples(metricsLog)
 			if len(samples) == count {
 				return
 			}
@@ -394,9 +1036,36 @@ func waitForValuesInMetricsLog(t *testing.T, metricsLog *notify.MetricsLog, coun
 	}
 }
 
+// getSamples returns samples of all series in the metrics log.
+func getSamples(metricsLog *notify.MetricsLog) []prompb.Sample {
+	series, _, _ := metricsLog.GetSamples(nil)
+	return flattenSamples(series)
+}
+
+func flattenSamples(series []prompb.TimeSeries) []prompb.Sample {
+	var samples []prompb.Sample
+	for _, ts := range series {
+		samples = append(samples, ts.Samples...)
+	}
+	return samples
+}
+
+func checkLabel(t *testing.T, series prompb.TimeSeries, name string, expected string) {
+	t.Helper()
+	for _, label := range series.Labels {
+		if label.Name == name {
+			if label.Value != expected {
+				t.Fatalf("expected label %s=%s, got %s", name, expected, label.Value)
+			}
+			return
+		}
+	}
+	t.Fatalf("expected label %s in %v", name, series.Labels)
+}
+
 func checkEmptyMetricsLog(t *testing.T, metricsLog *notify.MetricsLog) {
 	t.Helper()
-	samples, _, _ := metricsLog.GetSamples()
+	samples := getSamples(metricsLog)
 	if len(samples) != 0 {
 		t.Fatalf("expected no values in metrics log")
 	}
@@ -409,6 +1078,18 @@ func checkHostChanged(t *testing.T, notifier *mockNotifier, times uint) {
 	}
 }
 
+func checkLastNotify(t *testing.T, daemon *Daemon, outcome string, samples int) {
+	t.Helper()
+	state, err := LoadState(daemon.config.StatePath)
+	checkError(t, err, "failed to load state")
+	if state.LastNotify == nil {
+		t.Fatalf("expected last notify result to be persisted")
+	}
+	if state.LastNotify.Outcome != outcome || state.LastNotify.Samples != samples {
+		t.Fatalf("unexpected last notify result: %s", state.LastNotify.String())
+	}
+}
+
 func checkError(t *testing.T, err error, message string) {
 	t.Helper()
 	if err != nil {
@@ -432,10 +1113,14 @@ func createDaemon(t *testing.T) (*Daemon, *mockNotifier, *notify.MetricsLog, *mo
 	mlPath := createMetricsPath(t)
 	config := config.NewConfig()
 	config.MetricsWALPath = mlPath
+	config.StatePath = createStatePath(t)
+	config.ControlSocketPath = createControlSocketPath(t)
+	config.WriteSplay = 0
+	config.ShutdownGracePeriod = 0
 	daemon, err := NewDaemon(config)
 	notifier := &mockNotifier{}
 	notifier.ExpectSuccess()
-	daemon.notifier = notifier
+	daemon.endpoints[0].notifier = notifier
 	daemon.notifyPolicy = NewMockNotifyPolicy(false)
 	daemon.certWatcher = &mockCertWatcher{make(chan hostinfo.CertEvent)}
 	hiProvider := newMockHostInfoProvider(&hostinfo.HostInfo{
@@ -458,27 +1143,51 @@ func createDaemon(t *testing.T) (*Daemon, *mockNotifier, *notify.MetricsLog, *mo
 	return daemon, notifier, daemon.metricsLog, hiProvider
 }
 
+// addEndpoint adds an endpoint with a mocked notifier to the daemon.
+func addEndpoint(t *testing.T, daemon *Daemon, name string) *mockNotifier {
+	daemon.config.Endpoints = []config.Endpoint{{Name: config.DefaultEndpointName}, {Name: name}}
+	endpoints, err := updateEndpoints(daemon.endpoints, daemon.config)
+	checkError(t, err, "failed to add endpoint")
+	daemon.endpoints = endpoints
+
+	notifier := &mockNotifier{}
+	notifier.ExpectSuccess()
+	findEndpoint(daemon.endpoints, name).notifier = notifier
+	return notifier
+}
+
 func createMetricsPath(t *testing.T) string {
 	dir := t.TempDir()
 	return dir + "/metrics"
 }
 
+func createStatePath(t *testing.T) string {
+	dir := t.TempDir()
+	return dir + "/state.json"
+}
+
+func createControlSocketPath(t *testing.T) string {
+	dir := t.TempDir()
+	return dir + "/control.sock"
+}
+
 // Mock Notifier
 
 type notifyArgs struct {
-	samples  []prompb.Sample
+	series   []prompb.TimeSeries
+	samples  []prompb.Sample // samples of all series
 	hostinfo *hostinfo.HostInfo
 }
 
 type mockNotifier struct {
 	calledWith       *notifyArgs
 	hostChangedTimes uint
-	result           func(samples []prompb.Sample, hostinfo *hostinfo.HostInfo) error
+	result           func(series []prompb.TimeSeries, hostinfo *hostinfo.HostInfo) error
 }
 
-func (n *mockNotifier) Notify(samples []prompb.Sample, hostinfo *hostinfo.HostInfo) error {
-	n.calledWith = &notifyArgs{samples, hostinfo}
-	return n.result(samples, hostinfo)
+func (n *mockNotifier) Notify(ctx context.Context, series []prompb.TimeSeries, hostinfo *hostinfo.HostInfo) error {
+	n.calledWith = &notifyArgs{series, flattenSamples(series), hostinfo}
+	return n.result(series, hostinfo)
 }
 
 func (n *mockNotifier) HostChanged() {
@@ -504,13 +1213,13 @@ func (n *mockNotifier) CheckWasNotCalled(t *testing.T) {
 }
 
 func (n *mockNotifier) ExpectError(err error) {
-	n.result = func(samples []prompb.Sample, hostinfo *hostinfo.HostInfo) error {
+	n.result = func(series []prompb.TimeSeries, hostinfo *hostinfo.HostInfo) error {
 		return err
 	}
 }
 
 func (n *mockNotifier) ExpectSuccess() {
-	n.result = func(samples []prompb.Sample, hostinfo *hostinfo.HostInfo) error {
+	n.result = func(series []prompb.TimeSeries, hostinfo *hostinfo.HostInfo) error {
 		return nil
 	}
 }
@@ -535,11 +1244,11 @@ type mockNotifyPolicy struct {
 	Fake   bool
 }
 
-func (m *mockNotifyPolicy) ShouldNotify(samples []prompb.Sample, hostinfo *hostinfo.HostInfo) error {
+func (m *mockNotifyPolicy) ShouldNotify(series []prompb.TimeSeries, hostinfo *hostinfo.HostInfo) error {
 	m.Called++
 	if !m.Fake {
 		policy := &notify.GeneralNotifyPolicy{}
-		return policy.ShouldNotify(samples, hostinfo)
+		return policy.ShouldNotify(series, hostinfo)
 	}
 	return nil
 }
@@ -560,15 +1269,16 @@ func NewMockNotifyPolicy(fake bool) *mockNotifyPolicy {
 type mockHostInfoProvider struct {
 	called uint
 	hi     *hostinfo.HostInfo
+	err    error
 }
 
 func newMockHostInfoProvider(hi *hostinfo.HostInfo) *mockHostInfoProvider {
-	return &mockHostInfoProvider{0, hi}
+	return &mockHostInfoProvider{hi: hi}
 }
 
-func (m *mockHostInfoProvider) Load() (*hostinfo.HostInfo, error) {
+func (m *mockHostInfoProvider) Load(ctx context.Context) (*hostinfo.HostInfo, error) {
 	m.called++
-	return m.hi, nil
+	return m.hi, m.err
 }
 
 func (m *mockHostInfoProvider) RefreshCpuCount(hi *hostinfo.HostInfo) error {
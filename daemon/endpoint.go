@@ -0,0 +1,83 @@
+package daemon
+
+import (
+	"crypto/tls"
+
+	"github.com/RedHatInsights/host-metering/config"
+	"github.com/RedHatInsights/host-metering/logger"
+	"github.com/RedHatInsights/host-metering/notify"
+)
+
+// endpoint is a destination of the samples. Each endpoint has its own
+// configuration of writing and its own cursor in the metrics log.
+type endpoint struct {
+	name     string
+	config   *config.Config
+	notifier notify.Notifier
+	// hostCert is the host certificate loaded together with HostInfo, it is
+	// kept to send samples of the host identity after the file is replaced.
+	hostCert *tls.Certificate
+}
+
+func newEndpoints(cfg *config.Config) ([]*endpoint, error) {
+	return updateEndpoints(nil, cfg)
+}
+
+// updateEndpoints returns endpoints of the configuration. Existing endpoints
+// with the same name are kept and their configuration is replaced in place,
+// the notifier is recreated only if the protocol changed.
+func updateEndpoints(current []*endpoint, cfg *config.Config) ([]*endpoint, error) {
+	var configs []*config.Config
+	for _, e := range cfg.AllEndpoints() {
+		endpointConfig, err := cfg.EndpointConfig(e)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, endpointConfig)
+	}
+
+	var endpoints []*endpoint
+	for idx, e := range cfg.AllEndpoints() {
+		existing := findEndpoint(current, e.Name)
+		if existing == nil {
+			newEndpoint := &endpoint{
+				name:     e.Name,
+				config:   configs[idx],
+				notifier: notify.NewNotifier(configs[idx]),
+			}
+			newEndpoint.loadHostCert()
+			endpoints = append(endpoints, newEndpoint)
+			continue
+		}
+
+		protocolChanged := existing.config.WriteProtocol != configs[idx].WriteProtocol
+		*existing.config = *configs[idx]
+		if protocolChanged {
+			existing.notifier = notify.NewNotifier(existing.config)
+		}
+		// Force the notifier to create a new HTTP client (cert paths, timeout)
+		existing.loadHostCert()
+		existing.notifier.HostChanged()
+		endpoints = append(endpoints, existing)
+	}
+	return endpoints, nil
+}
+
+func (e *endpoint) loadHostCert() {
+	cert, err := notify.LoadHostCert(e.config)
+	if err != nil {
+		logger.Debugf("Host certificate of %s not loaded: %s\n", e.name, err.Error())
+		e.hostCert = nil
+		return
+	}
+	e.hostCert = &cert
+}
+
+func findEndpoint(endpoints []*endpoint, name string) *endpoint {
+	for _, e := range endpoints {
+		if e.name == name {
+			return e
+		}
+	}
+	return nil
+}
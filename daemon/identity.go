@@ -0,0 +1,130 @@
+package daemon
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/RedHatInsights/host-metering/hostinfo"
+	"github.com/RedHatInsights/host-metering/logger"
+	"github.com/RedHatInsights/host-metering/notify"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Suffix of the metrics log path of the directory with quarantined samples.
+const quarantineSuffix = ".quarantine"
+
+// checkHostIdentity warns if the host is not the one for which the last
+// successful notification was done, e.g. it was registered again.
+func (d *Daemon) checkHostIdentity(hostInfo *hostinfo.HostInfo) bool {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	if d.state.HostFingerprint == "" || d.state.HostFingerprint == hostInfo.Fingerprint() {
+		return false
+	}
+	logger.Warnf("Host identity changed since the last notification (HostId '%s' -> '%s')\n",
+		d.state.HostId, hostInfo.HostId)
+	return true
+}
+
+// identityFence is a pending send of samples of a previous identity of the
+// host to the endpoints which have its certificate.
+type identityFence struct {
+	previous  *hostinfo.HostInfo
+	endpoints []*endpoint
+}
+
+// newIdentityFence captures the previous identity of the host and the
+// certificates of the endpoints before switching to the new one. It is nil
+// if no endpoint has a certificate. The fence is sent by the sender before
+// samples of the new identity, with the labels and the certificate of the
+// previous identity, so that the samples are not attributed to the new one.
+// Samples which are not sent are quarantined once the new identity is used.
+func (d *Daemon) newIdentityFence(previous *hostinfo.HostInfo) *identityFence {
+	var endpoints []*endpoint
+	for _, e := range d.endpoints {
+		if e.hostCert == nil {
+			logger.Warnf("Certificate of the previous host identity is not available for %s\n", e.name)
+			continue
+		}
+		endpoints = append(endpoints, &endpoint{
+			name:     e.name,
+			config:   e.config,
+			notifier: d.certNotifier(e.config, *e.hostCert),
+		})
+	}
+	if len(endpoints) == 0 {
+		return nil
+	}
+	return &identityFence{previous: previous, endpoints: endpoints}
+}
+
+// sendFences sends samples of the previous identities of the host. Fences
+// which were not sent because the context is done are returned. It is
+// called with sendMu and stateMu held.
+func (d *Daemon) sendFences(ctx context.Context, fences []*identityFence) []*identityFence {
+	for idx, fence := range fences {
+		if ctx.Err() != nil {
+			return fences[idx:]
+		}
+		logger.Infoln("Sending samples of the previous host identity...")
+		if err := d.notifyEndpoints(ctx, fence.endpoints, fence.previous); err != nil {
+			if ctx.Err() != nil {
+				return fences[idx:]
+			}
+			logger.Warnf("Samples of the previous host identity not sent: %s\n", err.Error())
+		}
+	}
+	return nil
+}
+
+// splitByIdentity splits series to those collected for the identity of the
+// host and those of other identities. Series without identity labels are
+// considered to be of the host.
+func splitByIdentity(series []prompb.TimeSeries, hostInfo *hostinfo.HostInfo) (own, foreign []prompb.TimeSeries) {
+	for _, ts := range series {
+		if labelMatches(ts.Labels, "_id", hostInfo.HostId) &&
+			labelMatches(ts.Labels, "external_organization", hostInfo.ExternalOrganization) {
+			own = append(own, ts)
+		} else {
+			foreign = append(foreign, ts)
+		}
+	}
+	return own, foreign
+}
+
+func labelMatches(labels []prompb.Label, name string, value string) bool {
+	for _, label := range labels {
+		if label.Name == name {
+			return label.Value == value
+		}
+	}
+	return true
+}
+
+// advanceCursor moves the cursor of the endpoint past a chunk. Samples of
+// other identities of the host in the chunk are quarantined as they were
+// not sent. It is called with stateMu held.
+func (d *Daemon) advanceCursor(e *endpoint, checkpoint uint64, foreign []prompb.TimeSeries) {
+	d.state.Endpoint(e.name).Cursor = checkpoint
+	if len(foreign) > 0 {
+		d.quarantine(e, foreign)
+	}
+}
+
+// quarantine stores samples which cannot be sent to the endpoint, so that
+// they are not lost and can be inspected.
+func (d *Daemon) quarantine(e *endpoint, series []prompb.TimeSeries) {
+	path := filepath.Join(d.config.MetricsWALPath+quarantineSuffix, e.name)
+	log, err := notify.NewMetricsLog(path)
+	if err != nil {
+		logger.Errorf("Error opening quarantine %s: %s\n", path, err.Error())
+		return
+	}
+	defer log.Close()
+	if err := log.WriteSeries(series); err != nil {
+		logger.Errorf("Error writing quarantine %s: %s\n", path, err.Error())
+		return
+	}
+	logger.Warnf("Quarantined %d sample(s) of another host identity for %s in %s\n",
+		notify.SamplesCount(series), e.name, path)
+}
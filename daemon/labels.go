@@ -0,0 +1,110 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/RedHatInsights/host-metering/config"
+	"github.com/RedHatInsights/host-metering/hostinfo"
+	"github.com/RedHatInsights/host-metering/notify"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Labels describes labels of the host sent to every endpoint. Like Status,
+// it is gathered from the host itself, the daemon doesn't need to be running.
+type Labels struct {
+	HostInfo      *hostinfo.HostInfo
+	HostInfoError error
+	Endpoints     []EndpointLabels
+}
+
+type EndpointLabels struct {
+	Name   string
+	Labels []notify.LabelExplanation
+	// Fingerprint of the key of hashed labels, empty if no label is hashed.
+	KeyFingerprint string
+	KeyError       error
+}
+
+func GetLabels(cfg *config.Config) *Labels {
+	return getLabels(cfg, newHostInfoProvider(cfg))
+}
+
+func getLabels(cfg *config.Config, hostInfoProvider hostinfo.HostInfoProvider) *Labels {
+	l := &Labels{}
+
+	l.HostInfo, l.HostInfoError = hostInfoProvider.Load(context.Background())
+	if l.HostInfo == nil {
+		return l
+	}
+
+	// Labels are the same for every metric, explain them with the first one
+	series := []prompb.Label{}
+	if len(cfg.Collectors) > 0 {
+		series = append(series, prompb.Label{Name: "__name__", Value: cfg.Collectors[0]})
+	}
+	series = notify.MergeLabels(series, notify.HostInfoLabels(l.HostInfo))
+	for _, endpoint := range cfg.AllEndpoints() {
+		endpointConfig, err := cfg.EndpointConfig(endpoint)
+		if err != nil {
+			continue
+		}
+		endpointLabels := EndpointLabels{
+			Name:   endpoint.Name,
+			Labels: notify.ExplainLabels(endpointConfig, series),
+		}
+		if hasHashedLabels(endpointConfig) {
+			key, err := notify.LoadLabelHashKey(endpointConfig.LabelHashKeyPath)
+			if err != nil {
+				endpointLabels.KeyError = err
+			} else {
+				endpointLabels.KeyFingerprint = notify.LabelHashKeyFingerprint(key)
+			}
+		}
+		l.Endpoints = append(l.Endpoints, endpointLabels)
+	}
+	return l
+}
+
+func hasHashedLabels(cfg *config.Config) bool {
+	for _, mode := range cfg.LabelModes {
+		if mode == config.LabelModeHash {
+			return true
+		}
+	}
+	return false
+}
+
+// String lists the sent labels of every endpoint. When explained, every
+// label of the host is listed with its value and how it is sent.
+func (l *Labels) String(explain bool) string {
+	lines := []string{"Labels:"}
+	if l.HostInfo == nil {
+		lines = append(lines, "|  Error: "+l.HostInfoError.Error())
+		return strings.Join(lines, "\n")
+	}
+	for _, endpoint := range l.Endpoints {
+		lines = append(lines, fmt.Sprintf("|  Endpoint: %s", endpoint.Name))
+		if endpoint.KeyError != nil {
+			lines = append(lines, "|    HashKey: error: "+endpoint.KeyError.Error())
+		} else if endpoint.KeyFingerprint != "" {
+			lines = append(lines, "|    HashKey: fingerprint "+endpoint.KeyFingerprint)
+		}
+		for _, label := range endpoint.Labels {
+			switch {
+			case explain && label.Mode == config.LabelModeDrop:
+				lines = append(lines, fmt.Sprintf("|    %s: %s (drop)", label.Name, label.Value))
+			case explain && label.Mode == config.LabelModeHash:
+				lines = append(lines, fmt.Sprintf("|    %s: %s (hash of %s)", label.Name, label.SentValue, label.Value))
+			case explain && label.Mode == config.LabelModeSend && label.SentValue != label.Value:
+				lines = append(lines, fmt.Sprintf("|    %s: %s (relabeled from %s)", label.Name, label.SentValue, label.Value))
+			case explain:
+				lines = append(lines, fmt.Sprintf("|    %s: %s (%s)", label.Name, label.SentValue, label.Mode))
+			case label.Mode != config.LabelModeDrop:
+				lines = append(lines, fmt.Sprintf("|    %s: %s", label.Name, label.SentValue))
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
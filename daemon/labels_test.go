@@ -0,0 +1,87 @@
+package daemon
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/RedHatInsights/host-metering/config"
+	"github.com/RedHatInsights/host-metering/notify"
+)
+
+func TestLabels(t *testing.T) {
+	daemon, _, _, hiProvider := createDaemon(t)
+	cfg := daemon.config
+	cfg.LabelModes = map[string]string{
+		"billing_marketplace_account": config.LabelModeHash,
+		"_id":                         config.LabelModeDrop,
+	}
+	cfg.LabelHashKeyPath = t.TempDir() + "/label-hash.key"
+	cfg.Endpoints = []config.Endpoint{
+		{Name: "audit", Options: map[string]string{"label_modes": "_id:drop, billing_marketplace_account:drop"}},
+		{Name: "console"},
+	}
+
+	// when
+	labels := getLabels(cfg, hiProvider)
+
+	// then
+	checkError(t, labels.HostInfoError, "unexpected host info error")
+	if len(labels.Endpoints) != 2 {
+		t.Fatalf("expected labels of 2 endpoints, got %d", len(labels.Endpoints))
+	}
+	checkLabelsString(t, labels, false, "|  Endpoint: audit\n|    __name__: system_cpu_logical_count\n|    billing_marketplace: testmarketplace\n")
+	checkLabelsString(t, labels, false, "|    HashKey: fingerprint "+labels.Endpoints[1].KeyFingerprint+"\n")
+	if strings.Contains(labels.String(false), "testhost-id") || strings.Contains(labels.String(false), "testmarketplaceaccount") {
+		t.Fatalf("expected dropped and hashed values not to be listed, got:\n%s", labels.String(false))
+	}
+
+	// Explained labels include values of the host
+	hashed := findLabel(t, labels.Endpoints[1], "billing_marketplace_account")
+	checkLabelsString(t, labels, true, "|    _id: testhost-id (drop)\n")
+	checkLabelsString(t, labels, true, "|    billing_marketplace_account: "+hashed.SentValue+" (hash of testmarketplaceaccount)\n")
+	checkLabelsString(t, labels, true, "|    usage: testusage (send)\n")
+
+	// Hashes are stable
+	again := findLabel(t, getLabels(cfg, hiProvider).Endpoints[1], "billing_marketplace_account")
+	if again != hashed {
+		t.Fatalf("expected stable hash, got %v and %v", hashed, again)
+	}
+}
+
+// Test that labels are listed without the metric name when no collector is
+// configured, the configuration is not necessarily validated by callers.
+func TestLabelsNoCollectors(t *testing.T) {
+	daemon, _, _, hiProvider := createDaemon(t)
+	cfg := daemon.config
+	cfg.Collectors = []string{}
+
+	// when
+	labels := getLabels(cfg, hiProvider)
+
+	// then
+	if len(labels.Endpoints) == 0 {
+		t.Fatalf("expected labels of endpoints")
+	}
+	if strings.Contains(labels.String(false), "__name__") {
+		t.Fatalf("expected no metric name, got:\n%s", labels.String(false))
+	}
+	checkLabelsString(t, labels, false, "|    billing_marketplace: testmarketplace\n")
+}
+
+func findLabel(t *testing.T, endpoint EndpointLabels, name string) notify.LabelExplanation {
+	t.Helper()
+	for _, label := range endpoint.Labels {
+		if label.Name == name {
+			return label
+		}
+	}
+	t.Fatalf("label %s not found", name)
+	return notify.LabelExplanation{}
+}
+
+func checkLabelsString(t *testing.T, labels *Labels, explain bool, expected string) {
+	t.Helper()
+	if !strings.Contains(labels.String(explain), expected) {
+		t.Fatalf("expected labels to contain '%s', got:\n%s", expected, labels.String(explain))
+	}
+}
@@ -0,0 +1,94 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// sender sends samples of the metrics log in its own goroutine, so that
+// a slow or unreachable server doesn't delay collection of the samples.
+type sender struct {
+	daemon *Daemon
+	// requests holds at most one pending send, the response channel
+	// is nil if nobody waits for the result.
+	requests chan chan error
+	done     chan struct{}
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // cancels the send in progress
+}
+
+func newSender(d *Daemon) *sender {
+	return &sender{
+		daemon:   d,
+		requests: make(chan chan error, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// run sends samples on request until the context is done.
+func (s *sender) run(ctx context.Context) {
+	defer close(s.done)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case response := <-s.requests:
+			sendCtx, cancel := context.WithCancel(ctx)
+			s.mu.Lock()
+			s.cancel = cancel
+			s.mu.Unlock()
+
+			err := s.daemon.notify(sendCtx)
+
+			s.mu.Lock()
+			s.cancel = nil
+			s.mu.Unlock()
+			cancel()
+			if response != nil {
+				response <- err
+			}
+		}
+	}
+}
+
+// Trigger requests a send without waiting for it. The request is dropped
+// if a send is already pending, as the pending send sends all samples.
+func (s *sender) Trigger() {
+	select {
+	case s.requests <- nil:
+	default:
+	}
+}
+
+// Send requests a send and waits for its result.
+func (s *sender) Send() error {
+	response := make(chan error, 1)
+	select {
+	case s.requests <- response:
+	case <-s.done:
+		return fmt.Errorf("daemon is stopping")
+	}
+	select {
+	case err := <-response:
+		return err
+	case <-s.done:
+		return fmt.Errorf("daemon is stopping")
+	}
+}
+
+// Interrupt cancels the send in progress, if any. Samples which were not
+// acknowledged are sent again by the next send.
+func (s *sender) Interrupt() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// Wait waits until the sender stops.
+func (s *sender) Wait() {
+	<-s.done
+}
@@ -0,0 +1,135 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/RedHatInsights/host-metering/notify"
+)
+
+const (
+	NotifyOutcomeSuccess        = "success"
+	NotifyOutcomeRecoverable    = "recoverable error"
+	NotifyOutcomeNonRecoverable = "non-recoverable error"
+	NotifyOutcomeError          = "error"
+)
+
+// State is persisted by the daemon so that it can be inspected
+// by other processes, e.g. by the `status` subcommand.
+type State struct {
+	Pid        int           `json:"pid"`
+	StartedAt  time.Time     `json:"started_at"`
+	LastNotify *NotifyResult `json:"last_notify,omitempty"`
+	// Time of the last notification which succeeded for all endpoints
+	// and identity of the host it was done for.
+	LastSuccessAt   time.Time `json:"last_success_at"`
+	HostId          string    `json:"host_id,omitempty"`
+	HostFingerprint string    `json:"host_fingerprint,omitempty"`
+	// State of each endpoint by its name.
+	Endpoints map[string]*EndpointState `json:"endpoints,omitempty"`
+}
+
+// EndpointState tracks what was sent to an endpoint.
+type EndpointState struct {
+	// Metrics log checkpoint up to which the endpoint acknowledged samples.
+	Cursor uint64 `json:"cursor"`
+	// Timestamp of the newest sample acknowledged by the endpoint.
+	LastSampleAt time.Time     `json:"last_sample_at"`
+	LastNotify   *NotifyResult `json:"last_notify,omitempty"`
+}
+
+// Endpoint returns state of the endpoint, it is created if missing.
+func (s *State) Endpoint(name string) *EndpointState {
+	if s.Endpoints == nil {
+		s.Endpoints = make(map[string]*EndpointState)
+	}
+	state, ok := s.Endpoints[name]
+	if !ok {
+		state = &EndpointState{}
+		s.Endpoints[name] = state
+	}
+	return state
+}
+
+// Copy returns a copy of the state which can be used while the daemon
+// updates the state.
+func (s *State) Copy() *State {
+	state := *s
+	state.Endpoints = nil
+	for name, endpointState := range s.Endpoints {
+		*state.Endpoint(name) = *endpointState
+	}
+	return &state
+}
+
+type NotifyResult struct {
+	Time    time.Time `json:"time"`
+	Outcome string    `json:"outcome"`
+	Samples int       `json:"samples"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func newNotifyResult(samples int, err error) *NotifyResult {
+	result := &NotifyResult{
+		Time:    time.Now(),
+		Outcome: NotifyOutcomeSuccess,
+		Samples: samples,
+	}
+	if err == nil {
+		return result
+	}
+
+	result.Error = err.Error()
+	var notifyError *notify.NotifyError
+	if !errors.As(err, &notifyError) {
+		result.Outcome = NotifyOutcomeError
+	} else if notifyError.Recoverable() {
+		result.Outcome = NotifyOutcomeRecoverable
+	} else {
+		result.Outcome = NotifyOutcomeNonRecoverable
+	}
+	return result
+}
+
+func (r *NotifyResult) String() string {
+	str := fmt.Sprintf("%s at %s (%d sample(s))", r.Outcome, r.Time.Format(time.RFC3339), r.Samples)
+	if r.Error != "" {
+		str += ": " + r.Error
+	}
+	return str
+}
+
+func LoadState(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &State{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// Save writes the state atomically so that readers never see a partial file.
+func (s *State) Save(path string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,72 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/RedHatInsights/host-metering/notify"
+)
+
+func TestStateSaveAndLoad(t *testing.T) {
+	path := createStatePath(t)
+
+	// Test that missing state is reported
+	_, err := LoadState(path)
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+
+	// Test that saved state can be loaded
+	state := &State{
+		Pid:        42,
+		StartedAt:  time.Now().Truncate(time.Second),
+		LastNotify: newNotifyResult(3, nil),
+	}
+	state.Endpoint("prod").Cursor = 7
+	err = state.Save(path)
+	checkError(t, err, "failed to save state")
+
+	loaded, err := LoadState(path)
+	checkError(t, err, "failed to load state")
+	if loaded.Pid != 42 || !loaded.StartedAt.Equal(state.StartedAt) {
+		t.Fatalf("unexpected state loaded: %+v", loaded)
+	}
+	if loaded.LastNotify.Outcome != NotifyOutcomeSuccess || loaded.LastNotify.Samples != 3 {
+		t.Fatalf("unexpected last notify loaded: %s", loaded.LastNotify.String())
+	}
+	if loaded.Endpoint("prod").Cursor != 7 {
+		t.Fatalf("unexpected endpoint state loaded: %+v", loaded.Endpoints)
+	}
+
+	// Test that invalid state is reported
+	err = os.WriteFile(path, []byte("{"), 0600)
+	checkError(t, err, "failed to write state")
+	_, err = LoadState(path)
+	if err == nil {
+		t.Fatalf("expected error on invalid state file")
+	}
+}
+
+func TestNewNotifyResult(t *testing.T) {
+	testCases := []struct {
+		err     error
+		outcome string
+	}{
+		{nil, NotifyOutcomeSuccess},
+		{fmt.Errorf("mocked"), NotifyOutcomeError},
+		{notify.RecoverableError(fmt.Errorf("mocked")), NotifyOutcomeRecoverable},
+		{notify.NonRecoverableError(fmt.Errorf("mocked")), NotifyOutcomeNonRecoverable},
+	}
+
+	for _, tc := range testCases {
+		result := newNotifyResult(1, tc.err)
+		if result.Outcome != tc.outcome {
+			t.Fatalf("expected outcome '%s', got '%s'", tc.outcome, result.Outcome)
+		}
+		if tc.err != nil && result.Error != tc.err.Error() {
+			t.Fatalf("expected error '%s', got '%s'", tc.err.Error(), result.Error)
+		}
+	}
+}
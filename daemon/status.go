@@ -0,0 +1,206 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/RedHatInsights/host-metering/config"
+	"github.com/RedHatInsights/host-metering/hostinfo"
+	"github.com/RedHatInsights/host-metering/notify"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Status describes health of host-metering on the host. It is requested from
+// the running daemon over its control socket, otherwise it is gathered from
+// the host itself and from files persisted by the daemon.
+type Status struct {
+	HostInfo        *hostinfo.HostInfo
+	HostInfoError   error
+	MetricsLog      *notify.MetricsLogStats
+	MetricsLogError error
+	State           *State
+	StateError      error
+	// Reason why the notify policy currently blocks sending, nil if not blocked.
+	NotifyBlockedBy error
+}
+
+func GetStatus(cfg *config.Config) *Status {
+	if cfg.ControlSocketPath != "" {
+		if s, err := getDaemonStatus(cfg.ControlSocketPath); err == nil {
+			return s
+		}
+	}
+	return getStatus(cfg, newHostInfoProvider(cfg), &notify.GeneralNotifyPolicy{})
+}
+
+// getDaemonStatus returns the status of the running daemon, so that the files
+// owned by the daemon are not accessed while it may be writing them.
+func getDaemonStatus(socketPath string) (*Status, error) {
+	response, err := SendControlCommand(socketPath, ControlCommandDump)
+	if err != nil {
+		return nil, err
+	}
+	if response.Error != "" {
+		return nil, errors.New(response.Error)
+	}
+	// Only the config is not decoded, it is not a part of the status.
+	var dump struct {
+		Dump
+		Config json.RawMessage `json:"config"`
+	}
+	if err := json.Unmarshal(response.Data, &dump); err != nil {
+		return nil, err
+	}
+
+	s := &Status{
+		HostInfo:   dump.HostInfo,
+		MetricsLog: dump.MetricsLog,
+		State:      dump.State,
+	}
+	if dump.HostInfoError != nil {
+		s.HostInfoError = dump.HostInfoError
+	}
+	if dump.MetricsLogError != "" {
+		s.MetricsLogError = errors.New(dump.MetricsLogError)
+	}
+	if dump.NotifyBlockedBy != "" {
+		s.NotifyBlockedBy = errors.New(dump.NotifyBlockedBy)
+	}
+	return s, nil
+}
+
+func getStatus(cfg *config.Config, hostInfoProvider hostinfo.HostInfoProvider, notifyPolicy notify.NotifyPolicy) *Status {
+	s := &Status{}
+
+	s.HostInfo, s.HostInfoError = hostInfoProvider.Load(context.Background())
+
+	if cfg.StatePath == "" {
+		s.StateError = fmt.Errorf("state path is not configured")
+	} else {
+		s.State, s.StateError = LoadState(cfg.StatePath)
+	}
+
+	var series []prompb.TimeSeries
+	series, s.MetricsLog, s.MetricsLogError = readMetricsLog(cfg.MetricsWALPath)
+	if s.MetricsLogError == nil {
+		if cfg.MetricsMaxAge > 0 {
+			series = notify.FilterSamplesByAge(series, cfg.MetricsMaxAge)
+		}
+		s.NotifyBlockedBy = notifyPolicy.ShouldNotify(series, s.HostInfo)
+	}
+
+	return s
+}
+
+func readMetricsLog(path string) ([]prompb.TimeSeries, *notify.MetricsLogStats, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil, fmt.Errorf("no metrics log at %s", path)
+	}
+
+	series, err := notify.PeekMetricsLog(path, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return series, notify.NewMetricsLogStats(series), nil
+}
+
+// Healthy is true when sending is not blocked and the last notification
+// (if any) succeeded.
+func (s *Status) Healthy() bool {
+	if s.MetricsLogError != nil || s.NotifyBlockedBy != nil {
+		return false
+	}
+	if s.State != nil && s.State.LastNotify != nil {
+		return s.State.LastNotify.Outcome == NotifyOutcomeSuccess
+	}
+	return true
+}
+
+func (s *Status) String() string {
+	daemon := "unknown"
+	lastNotify := "unknown"
+	lastSuccess := "unknown"
+	if os.IsNotExist(s.StateError) {
+		daemon = "never started"
+		lastNotify = "never"
+		lastSuccess = "never"
+	} else if s.StateError != nil {
+		daemon = fmt.Sprintf("unknown (%s)", s.StateError.Error())
+	} else if s.State != nil {
+		running := "not running"
+		if isProcessRunning(s.State.Pid) {
+			running = "running"
+		}
+		daemon = fmt.Sprintf("%s (pid %d, started at %s)",
+			running, s.State.Pid, s.State.StartedAt.Format(time.RFC3339))
+		lastNotify = "never"
+		if s.State.LastNotify != nil {
+			lastNotify = s.State.LastNotify.String()
+		}
+		lastSuccess = s.lastSuccess()
+	}
+
+	var metricsLog string
+	if s.MetricsLogError != nil {
+		metricsLog = "error: " + s.MetricsLogError.Error()
+	} else {
+		metricsLog = s.MetricsLog.String()
+	}
+
+	notifyPolicy := "allowed"
+	if s.MetricsLogError != nil {
+		notifyPolicy = "unknown"
+	} else if s.NotifyBlockedBy != nil {
+		notifyPolicy = "blocked: " + s.NotifyBlockedBy.Error()
+	}
+
+	var hostInfo string
+	var loadErr *hostinfo.LoadError
+	if s.HostInfo == nil {
+		hostInfo = "HostInfo: error: " + s.HostInfoError.Error()
+	} else {
+		hostInfo = s.HostInfo.String()
+	}
+	if s.HostInfo != nil && errors.As(s.HostInfoError, &loadErr) {
+		for _, fe := range loadErr.Fields {
+			hostInfo += "\n|  Failed: " + fe.Error()
+		}
+		hostInfo += "\n|  Remediation: " + loadErr.Remediation()
+	}
+
+	return strings.Join(
+		[]string{
+			"Status:",
+			fmt.Sprintf("|  Daemon: %s", daemon),
+			fmt.Sprintf("|  LastNotify: %s", lastNotify),
+			fmt.Sprintf("|  LastSuccess: %s", lastSuccess),
+			fmt.Sprintf("|  MetricsLog: %s", metricsLog),
+			fmt.Sprintf("|  Notify: %s", notifyPolicy),
+			hostInfo,
+		}, "\n")
+}
+
+func isProcessRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+func (s *Status) lastSuccess() string {
+	if s.State.LastSuccessAt.IsZero() {
+		return "never"
+	}
+	str := fmt.Sprintf("%s (HostId %s)", s.State.LastSuccessAt.Format(time.RFC3339), s.State.HostId)
+	if s.HostInfo != nil && s.State.HostFingerprint != s.HostInfo.Fingerprint() {
+		str += ", host identity changed since"
+	}
+	return str
+}
@@ -0,0 +1,131 @@
+package daemon
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RedHatInsights/host-metering/hostinfo"
+	"github.com/RedHatInsights/host-metering/notify"
+)
+
+func TestStatus(t *testing.T) {
+	daemon, _, metricsLog, hiProvider := createDaemon(t)
+	cfg := daemon.config
+	policy := &notify.GeneralNotifyPolicy{}
+
+	// Test status without any persisted state and samples
+	status := getStatus(cfg, hiProvider, policy)
+	checkError(t, status.HostInfoError, "unexpected host info error")
+	if !os.IsNotExist(status.StateError) {
+		t.Fatalf("expected missing state, got %v", status.StateError)
+	}
+	checkError(t, status.MetricsLogError, "unexpected metrics log error")
+	checkExpectedError(t, status.NotifyBlockedBy, "no samples to send")
+	if status.Healthy() {
+		t.Fatalf("expected status to be unhealthy when there is nothing to send")
+	}
+
+	// Test status with pending samples and a persisted notification result
+	metricsLog.WriteSample(1, time.Now().UnixMilli()-1000)
+	metricsLog.WriteSampleNow(2)
+	daemon.state.Pid = os.Getpid()
+	daemon.state.LastNotify = newNotifyResult(2, nil)
+	daemon.saveState()
+
+	status = getStatus(cfg, hiProvider, policy)
+	checkError(t, status.StateError, "unexpected state error")
+	if status.MetricsLog.Count != 2 {
+		t.Fatalf("expected 2 pending samples, got %d", status.MetricsLog.Count)
+	}
+	if !status.MetricsLog.Oldest.Before(status.MetricsLog.Newest) {
+		t.Fatalf("expected oldest sample to be before newest")
+	}
+	checkError(t, status.NotifyBlockedBy, "unexpected blocked notify")
+	if !status.Healthy() {
+		t.Fatalf("expected status to be healthy")
+	}
+	checkStatusString(t, status, "|  Daemon: running (pid")
+	checkStatusString(t, status, "|  LastNotify: success at")
+	checkStatusString(t, status, "|  LastSuccess: never")
+	checkStatusString(t, status, "|  MetricsLog: 2 sample(s)")
+	checkStatusString(t, status, "|  Notify: allowed")
+	checkStatusString(t, status, "|  HostId: testhost-id")
+
+	// Test that status reports last successful notification
+	daemon.state.LastSuccessAt = time.Now()
+	daemon.state.HostId = "old-host-id"
+	daemon.state.HostFingerprint = (&hostinfo.HostInfo{HostId: "old-host-id"}).Fingerprint()
+	daemon.saveState()
+	status = getStatus(cfg, hiProvider, policy)
+	checkStatusString(t, status, "(HostId old-host-id), host identity changed since")
+
+	// Test that status reports blocking policy
+	hiProvider.hi.HostId = ""
+	status = getStatus(cfg, hiProvider, policy)
+	checkExpectedError(t, status.NotifyBlockedBy, "missing HostId")
+	checkStatusString(t, status, "|  Notify: blocked: missing HostId")
+
+	// Test that status reports values which failed to load
+	loadErr := &hostinfo.LoadError{}
+	loadErr.Add(hostinfo.ErrNotRegistered, "HostId")
+	hiProvider.err = loadErr
+	status = getStatus(cfg, hiProvider, policy)
+	checkStatusString(t, status, "|  HostId: \n")
+	checkStatusString(t, status, "|  Failed: HostId (required): not registered: the host is not registered\n")
+	checkStatusString(t, status, "|  Remediation: register the host with")
+	hiProvider.err = nil
+
+	// Test that status is unhealthy after failed notification
+	hiProvider.hi.HostId = "testhost-id"
+	daemon.state.LastNotify = newNotifyResult(2, notify.RecoverableError(nil))
+	daemon.saveState()
+	status = getStatus(cfg, hiProvider, policy)
+	if status.Healthy() {
+		t.Fatalf("expected status to be unhealthy after failed notification")
+	}
+	checkStatusString(t, status, "|  LastNotify: recoverable error at")
+}
+
+// Test that the status of a running daemon is requested over the control socket.
+func TestStatusOfRunningDaemon(t *testing.T) {
+	daemon, _, _, hiProvider := createDaemon(t)
+	loadErr := &hostinfo.LoadError{}
+	loadErr.Add(errors.New("test error"), "Usage")
+	hiProvider.err = loadErr
+	startDaemon(t, daemon)
+	defer stopDaemon(t, daemon)
+
+	status := GetStatus(daemon.config)
+	if status.HostInfo == nil || status.HostInfo.HostId != "testhost-id" {
+		t.Fatalf("expected host info of the daemon, got %v", status.HostInfo)
+	}
+	checkError(t, status.StateError, "unexpected state error")
+	checkError(t, status.MetricsLogError, "unexpected metrics log error")
+	if status.MetricsLog == nil || status.State == nil || status.State.Pid != os.Getpid() {
+		t.Fatalf("expected metrics log stats and state of the daemon")
+	}
+	checkStatusString(t, status, "|  Daemon: running (pid")
+	checkStatusString(t, status, "|  Failed: Usage (optional): failure: test error\n")
+}
+
+func TestStatusMissingMetricsLog(t *testing.T) {
+	daemon, _, _, hiProvider := createDaemon(t)
+	daemon.config.MetricsWALPath = t.TempDir() + "/missing"
+
+	status := getStatus(daemon.config, hiProvider, &notify.GeneralNotifyPolicy{})
+	checkExpectedError(t, status.MetricsLogError, "no metrics log at "+daemon.config.MetricsWALPath)
+	if _, err := os.Stat(daemon.config.MetricsWALPath); !os.IsNotExist(err) {
+		t.Fatalf("expected metrics log not to be created by status")
+	}
+	checkStatusString(t, status, "|  Notify: unknown")
+}
+
+func checkStatusString(t *testing.T, status *Status, expected string) {
+	t.Helper()
+	if !strings.Contains(status.String(), expected) {
+		t.Fatalf("expected status to contain '%s', got:\n%s", expected, status.String())
+	}
+}
@@ -4,18 +4,24 @@ go 1.19
 
 require (
 	github.com/fsnotify/fsnotify v1.7.0 // direct
+	github.com/godbus/dbus/v5 v5.1.0 // direct
 	github.com/gogo/protobuf v1.3.2 // direct
 	github.com/golang/snappy v0.0.4 // direct
+	github.com/prometheus/common v0.46.0 // direct
 	github.com/prometheus/procfs v0.13.0 // direct
 	github.com/prometheus/prometheus v0.50.1 // direct
 	github.com/sirupsen/logrus v1.9.3 // direct
 	github.com/tidwall/wal v1.1.7 // direct
+	golang.org/x/sys v0.18.0 // direct
 )
 
 require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/grafana/regexp v0.0.0-20221122212121-6b5c0a4cb7fd // indirect
 	github.com/tidwall/gjson v1.17.1 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.1 // indirect
 	github.com/tidwall/tinylru v1.2.1 // indirect
-	golang.org/x/sys v0.18.0 // indirect
+	golang.org/x/exp v0.0.0-20240119083558-1b970713d09a // indirect
+	golang.org/x/sync v0.6.0 // indirect
 )
@@ -0,0 +1,120 @@
+package hostinfo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/RedHatInsights/host-metering/logger"
+)
+
+// MarketplaceRule detects a marketplace by a fact of subscription-manager
+// with the ID of the instance.
+type MarketplaceRule struct {
+	Marketplace  string
+	InstanceFact string
+	AccountFact  string
+	// DMIAttribute and DMIValue detect the marketplace by the dmi.* fact of
+	// the DMI attribute containing the value instead of by the instance
+	// fact, e.g. for clouds without cloud facts of subscription-manager
+	DMIAttribute string
+	DMIValue     string
+}
+
+// Marketplaces detected by default. subscription-manager collects cloud
+// facts of AWS, Azure and GCP. IBM Cloud, Oracle Cloud and Alibaba Cloud
+// are detected by the DMI data of their instances, which are identified by
+// the system UUID. Their accounts are read from custom facts, e.g. written
+// to /etc/rhsm/facts/cloud.facts by the provisioning of the host.
+var DefaultMarketplaceRules = []MarketplaceRule{
+	{Marketplace: "aws", InstanceFact: "aws_instance_id", AccountFact: "aws_account_id"},
+	{Marketplace: "azure", InstanceFact: "azure_instance_id", AccountFact: "azure_subscription_id"},
+	{Marketplace: "gcp", InstanceFact: "gcp_instance_id", AccountFact: "gcp_project_number"},
+	dmiMarketplaceRule("ibm", "ibm_account_id"),
+	dmiMarketplaceRule("oracle", "oci_tenancy_id"),
+	dmiMarketplaceRule("alibaba", "alibaba_account_id"),
+}
+
+// dmiMarketplaceRule detects the marketplace by the DMI rule of its cloud
+// provider.
+func dmiMarketplaceRule(marketplace string, accountFact string) MarketplaceRule {
+	for _, rule := range cloudProviderRules {
+		if rule.result == marketplace {
+			return MarketplaceRule{
+				Marketplace:  marketplace,
+				InstanceFact: dmiFacts["product_uuid"],
+				AccountFact:  accountFact,
+				DMIAttribute: rule.attribute,
+				DMIValue:     rule.value,
+			}
+		}
+	}
+	panic("no DMI rule of cloud provider " + marketplace)
+}
+
+// matches tells whether the host with the facts is on the marketplace.
+func (rule *MarketplaceRule) matches(facts SubManValues) bool {
+	if rule.DMIAttribute != "" {
+		value, ok := facts[dmiFacts[rule.DMIAttribute]]
+		return ok && strings.Contains(value, rule.DMIValue)
+	}
+	return facts.has(rule.InstanceFact)
+}
+
+// BillingRules detect the billing of the host from its facts.
+type BillingRules struct {
+	// Marketplaces are checked in order, the first match wins
+	Marketplaces []MarketplaceRule
+	// Model is the billing model of hosts which are not on a marketplace,
+	// the billing info is empty when it's not set.
+	Model string
+}
+
+// DefaultBillingRules are used by providers without billing rules.
+var DefaultBillingRules = &BillingRules{Marketplaces: DefaultMarketplaceRules}
+
+// NewBillingRules creates billing rules with the marketplaces checked before
+// the default ones.
+func NewBillingRules(marketplaces []MarketplaceRule, model string) *BillingRules {
+	rules := make([]MarketplaceRule, 0, len(marketplaces)+len(DefaultMarketplaceRules))
+	rules = append(rules, marketplaces...)
+	rules = append(rules, DefaultMarketplaceRules...)
+	return &BillingRules{Marketplaces: rules, Model: model}
+}
+
+// BillingInfo returns the billing of the host with the facts. It fails when
+// the host is not on a known marketplace and there is no billing model.
+func (br *BillingRules) BillingInfo(facts SubManValues) (BillingInfo, error) {
+	for _, rule := range br.Marketplaces {
+		if !rule.matches(facts) {
+			continue
+		}
+		bi := BillingInfo{
+			Model:       "marketplace",
+			Marketplace: rule.Marketplace,
+		}
+		bi.MarketplaceAccount, _ = facts.get(rule.AccountFact)
+		bi.MarketplaceInstanceId, _ = facts.get(rule.InstanceFact)
+		return bi, nil
+	}
+
+	if br.Model != "" {
+		return BillingInfo{Model: br.Model}, nil
+	}
+
+	err := fmt.Errorf("unsupported or missing marketplace values")
+	logger.Debugf("Error getting billing info: %s\n", err.Error())
+	return BillingInfo{}, err
+}
+
+func GetBillingInfo(facts SubManValues) (BillingInfo, error) {
+	return DefaultBillingRules.BillingInfo(facts)
+}
+
+// billingRules returns the billing rules of a provider, the default ones if
+// it has none.
+func billingRules(br *BillingRules) *BillingRules {
+	if br == nil {
+		return DefaultBillingRules
+	}
+	return br
+}
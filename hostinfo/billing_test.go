@@ -0,0 +1,92 @@
+package hostinfo
+
+import (
+	"testing"
+)
+
+func TestBillingRules(t *testing.T) {
+	rules := NewBillingRules([]MarketplaceRule{
+		{Marketplace: "hetzner", InstanceFact: "hetzner_server_id", AccountFact: "hetzner_project_id"},
+	}, "direct")
+
+	// Marketplaces of the default rules are detected
+	bi, err := rules.BillingInfo(SubManValues{"gcp_instance_id": "1234", "gcp_project_number": "5678"})
+	checkError(t, err, "failed to get billing info")
+	expected := BillingInfo{
+		Model:                 "marketplace",
+		Marketplace:           "gcp",
+		MarketplaceAccount:    "5678",
+		MarketplaceInstanceId: "1234",
+	}
+	if bi != expected {
+		t.Fatalf("unexpected billing info: %+v", bi)
+	}
+
+	// Configured marketplaces are detected
+	bi, err = rules.BillingInfo(SubManValues{"hetzner_server_id": "42"})
+	checkError(t, err, "failed to get billing info")
+	if bi != (BillingInfo{Model: "marketplace", Marketplace: "hetzner", MarketplaceInstanceId: "42"}) {
+		t.Fatalf("unexpected billing info: %+v", bi)
+	}
+
+	// Hosts which are not on a marketplace get the billing model
+	bi, err = rules.BillingInfo(SubManValues{})
+	checkError(t, err, "failed to get billing info")
+	if bi != (BillingInfo{Model: "direct"}) {
+		t.Fatalf("unexpected billing info: %+v", bi)
+	}
+
+	if _, err := GetBillingInfo(SubManValues{}); err == nil {
+		t.Fatalf("expected missing marketplace to fail without billing model")
+	}
+}
+
+// Test that each built-in marketplace is detected with its instance and
+// account IDs.
+func TestDefaultMarketplaceRules(t *testing.T) {
+	uuid := "ec2d7e3a-0b3c-4a55-9b5e-3f1f9d0c2a11"
+	testCases := []struct {
+		facts    SubManValues
+		expected BillingInfo
+	}{
+		{
+			SubManValues{"aws_instance_id": "i-0123456789abcdef0", "aws_account_id": "000000000000"},
+			BillingInfo{"marketplace", "aws", "000000000000", "i-0123456789abcdef0"},
+		},
+		{
+			SubManValues{"azure_instance_id": "azure-vm-id", "azure_subscription_id": "azure-subscription"},
+			BillingInfo{"marketplace", "azure", "azure-subscription", "azure-vm-id"},
+		},
+		{
+			SubManValues{"gcp_instance_id": "1234", "gcp_project_number": "5678"},
+			BillingInfo{"marketplace", "gcp", "5678", "1234"},
+		},
+		{
+			SubManValues{"dmi.chassis.asset_tag": "ibmcloud", "dmi.system.uuid": uuid, "ibm_account_id": "ibm-account"},
+			BillingInfo{"marketplace", "ibm", "ibm-account", uuid},
+		},
+		{
+			SubManValues{"dmi.chassis.asset_tag": "OracleCloud.com", "dmi.system.uuid": uuid, "oci_tenancy_id": "ocid1.tenancy"},
+			BillingInfo{"marketplace", "oracle", "ocid1.tenancy", uuid},
+		},
+		{
+			SubManValues{"dmi.system.manufacturer": "Alibaba Cloud", "dmi.system.uuid": uuid, "alibaba_account_id": "alibaba-account"},
+			BillingInfo{"marketplace", "alibaba", "alibaba-account", uuid},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expected.Marketplace, func(t *testing.T) {
+			bi, err := GetBillingInfo(tc.facts)
+			checkError(t, err, "failed to get billing info")
+			if bi != tc.expected {
+				t.Fatalf("unexpected billing info: %+v", bi)
+			}
+		})
+	}
+
+	// DMI data of other hosts doesn't match a marketplace
+	if _, err := GetBillingInfo(SubManValues{"dmi.system.manufacturer": "QEMU", "dmi.system.uuid": uuid}); err == nil {
+		t.Fatalf("expected host without marketplace not to be detected")
+	}
+}
@@ -2,23 +2,233 @@ package hostinfo
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
-	"github.com/prometheus/procfs"
+	"golang.org/x/sys/unix"
 )
 
-// multi-platform way to get cpu core count
-func GetCPUCount() (uint, error) {
+// CPUCountMode tells which CPUs are counted.
+type CPUCountMode string
 
-	fs, err := procfs.NewFS("/proc")
+const (
+	CPUCountModePresent CPUCountMode = "present" // CPUs present in the host
+	CPUCountModeOnline  CPUCountMode = "online"  // CPUs which are online
+	CPUCountModeCpuset  CPUCountMode = "cpuset"  // CPUs of the cgroup cpuset of the process
+	CPUCountModeQuota   CPUCountMode = "quota"   // vCPUs of the cgroup CPU quota of the process
+)
+
+// CPUCounter counts CPUs of the host in the mode.
+type CPUCounter struct {
+	Mode CPUCountMode
+	// ProcPath and SysPath are mount points of procfs and sysfs
+	ProcPath string
+	SysPath  string
+}
+
+// DefaultCPUCounter is used by providers without a CPU counter.
+var DefaultCPUCounter = NewCPUCounter(CPUCountModeOnline)
+
+func NewCPUCounter(mode CPUCountMode) *CPUCounter {
+	return &CPUCounter{
+		Mode:     mode,
+		ProcPath: "/proc",
+		SysPath:  "/sys",
+	}
+}
+
+// Count returns the number of CPUs.
+func (cc *CPUCounter) Count() (uint, error) {
+	switch cc.Mode {
+	case CPUCountModePresent:
+		return cc.countCPUList(filepath.Join(cc.SysPath, "devices/system/cpu/present"))
+	case CPUCountModeOnline:
+		return cc.countCPUList(filepath.Join(cc.SysPath, "devices/system/cpu/online"))
+	case CPUCountModeCpuset:
+		return cc.countCpuset()
+	case CPUCountModeQuota:
+		return cc.countQuota()
+	}
+	return 0, fmt.Errorf("unknown CPU count mode: %s", cc.Mode)
+}
+
+// Refresh sets the CPU count of the host info and the mode of the count.
+func (cc *CPUCounter) Refresh(hi *HostInfo) error {
+	cpuCount, err := cc.Count()
+	if err != nil {
+		return err
+	}
+
+	hi.CpuCount = cpuCount
+	hi.CpuCountMode = string(cc.Mode)
+	return nil
+}
+
+// cpuCounter returns the counter of a provider, the default one if it has none.
+func cpuCounter(cc *CPUCounter) *CPUCounter {
+	if cc == nil {
+		return DefaultCPUCounter
+	}
+	return cc
+}
+
+// countCPUList counts CPUs of a file with a list like "0-3,8".
+func (cc *CPUCounter) countCPUList(path string) (uint, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return 0, fmt.Errorf("GetCPUCount: failed to open procfs: %w", err)
+		return 0, err
 	}
+	count, err := parseCPUList(string(data))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	return count, nil
+}
 
-	info, err := fs.CPUInfo()
+// countCpuset counts CPUs of the effective cpuset of the cgroup of the
+// process, or of its CPU affinity without a cgroup cpuset.
+func (cc *CPUCounter) countCpuset() (uint, error) {
+	v2Path, v1Path, err := cc.cgroupPaths("cpuset")
 	if err != nil {
-		return 0, fmt.Errorf("GetCPUCount: failed to load CPUInfo: %w", err)
+		return 0, err
+	}
+	for _, path := range []string{
+		filepath.Join(v2Path, "cpuset.cpus.effective"),
+		filepath.Join(v1Path, "cpuset.effective_cpus"),
+	} {
+		count, err := cc.countCPUList(path)
+		if !os.IsNotExist(err) {
+			return count, err
+		}
 	}
 
-	cpuCount := uint(len(info))
-	return cpuCount, nil
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return 0, fmt.Errorf("failed to get CPU affinity: %w", err)
+	}
+	return uint(set.Count()), nil
+}
+
+// countQuota counts vCPUs of the CPU quota of the cgroup of the process,
+// rounded up. It counts the cpuset when there is no quota.
+func (cc *CPUCounter) countQuota() (uint, error) {
+	cpuset, err := cc.countCpuset()
+	if err != nil {
+		return 0, err
+	}
+
+	v2Path, v1Path, err := cc.cgroupPaths("cpu")
+	if err != nil {
+		return 0, err
+	}
+	var quota, period int64
+	if data, err := os.ReadFile(filepath.Join(v2Path, "cpu.max")); err == nil {
+		// "max 100000" or "200000 100000"
+		fields := strings.Fields(string(data))
+		if len(fields) != 2 {
+			return 0, fmt.Errorf("unexpected content of cpu.max: %s", data)
+		}
+		if fields[0] == "max" {
+			return cpuset, nil
+		}
+		if quota, err = strconv.ParseInt(fields[0], 10, 64); err == nil {
+			period, err = strconv.ParseInt(fields[1], 10, 64)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("unexpected content of cpu.max: %w", err)
+		}
+	} else if os.IsNotExist(err) {
+		if quota, err = readInt(filepath.Join(v1Path, "cpu.cfs_quota_us")); err == nil {
+			period, err = readInt(filepath.Join(v1Path, "cpu.cfs_period_us"))
+		}
+		if os.IsNotExist(err) || quota < 0 {
+			return cpuset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		return 0, err
+	}
+
+	if period <= 0 {
+		return 0, fmt.Errorf("invalid CPU quota period: %d", period)
+	}
+	count := uint((quota + period - 1) / period)
+	if count > cpuset {
+		count = cpuset
+	}
+	return count, nil
+}
+
+// cgroupPaths returns paths of the cgroup v2 and of the cgroup v1 of the
+// controller of the process. A path falls back to the root of the hierarchy
+// when it doesn't exist, e.g. in a container with a cgroup namespace.
+func (cc *CPUCounter) cgroupPaths(controller string) (string, string, error) {
+	data, err := os.ReadFile(filepath.Join(cc.ProcPath, "self/cgroup"))
+	if err != nil {
+		return "", "", err
+	}
+
+	v2Root := filepath.Join(cc.SysPath, "fs/cgroup")
+	v1Root := filepath.Join(cc.SysPath, "fs/cgroup", controller)
+	v2Path, v1Path := v2Root, v1Root
+	// Each line is "hierarchy-ID:controller-list:cgroup-path"
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			v2Path = existingPath(filepath.Join(v2Root, parts[2]), v2Root)
+			continue
+		}
+		for _, c := range strings.Split(parts[1], ",") {
+			if c == controller {
+				v1Path = existingPath(filepath.Join(v1Root, parts[2]), v1Root)
+			}
+		}
+	}
+	return v2Path, v1Path, nil
+}
+
+func existingPath(path string, fallback string) string {
+	if _, err := os.Stat(path); err != nil {
+		return fallback
+	}
+	return path
+}
+
+func readInt(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// parseCPUList counts CPUs of a list like "0-3,8".
+func parseCPUList(list string) (uint, error) {
+	var count uint
+	list = strings.TrimSpace(list)
+	for _, item := range strings.Split(list, ",") {
+		if item == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(item, "-")
+		start, err := strconv.ParseUint(first, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid CPU list %q", list)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.ParseUint(last, 10, 32); err != nil || end < start {
+				return 0, fmt.Errorf("invalid CPU list %q", list)
+			}
+		}
+		count += uint(end - start + 1)
+	}
+	return count, nil
 }
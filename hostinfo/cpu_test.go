@@ -1,17 +1,107 @@
 package hostinfo
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 )
 
-func TestGetCPUCount(t *testing.T) {
-	cpuCount, err := GetCPUCount()
+func TestCPUCounter(t *testing.T) {
+	root := t.TempDir()
+	counter := &CPUCounter{ProcPath: filepath.Join(root, "proc"), SysPath: filepath.Join(root, "sys")}
+	writeTree(t, root, map[string]string{
+		"proc/self/cgroup":               "0::/system.slice/host-metering.service\n",
+		"sys/devices/system/cpu/present": "0-15\n",
+		"sys/devices/system/cpu/online":  "0-7,12\n",
+		"sys/fs/cgroup/system.slice/host-metering.service/cpuset.cpus.effective": "0-3\n",
+		"sys/fs/cgroup/system.slice/host-metering.service/cpu.max":               "150000 100000\n",
+	})
 
-	if err != nil {
-		t.Fatalf("failed to get the CPU count: %v", err)
+	expected := map[CPUCountMode]uint{
+		CPUCountModePresent: 16,
+		CPUCountModeOnline:  9,
+		CPUCountModeCpuset:  4,
+		CPUCountModeQuota:   2,
 	}
+	for mode, count := range expected {
+		counter.Mode = mode
+		hi := &HostInfo{}
+		err := counter.Refresh(hi)
+		checkError(t, err, "failed to count CPUs in mode "+string(mode))
+		if hi.CpuCount != count || hi.CpuCountMode != string(mode) {
+			t.Fatalf("unexpected count in mode %s: %d (%s)", mode, hi.CpuCount, hi.CpuCountMode)
+		}
+	}
+
+	// Without a quota the cpuset is counted
+	writeTree(t, root, map[string]string{
+		"sys/fs/cgroup/system.slice/host-metering.service/cpu.max": "max 100000\n",
+	})
+	counter.Mode = CPUCountModeQuota
+	if count, err := counter.Count(); err != nil || count != 4 {
+		t.Fatalf("expected cpuset without quota, got: %d, %v", count, err)
+	}
+
+	counter.Mode = "unknown"
+	if _, err := counter.Count(); err == nil {
+		t.Fatalf("expected unknown mode to fail")
+	}
+}
+
+func TestCPUCounterCgroupV1(t *testing.T) {
+	root := t.TempDir()
+	counter := &CPUCounter{ProcPath: filepath.Join(root, "proc"), SysPath: filepath.Join(root, "sys")}
+	// The cgroup of a container with a cgroup namespace is the root
+	writeTree(t, root, map[string]string{
+		"proc/self/cgroup": "5:cpuset:/container\n" +
+			"4:cpu,cpuacct:/container\n" +
+			"1:name=systemd:/container\n",
+		"sys/fs/cgroup/cpuset/cpuset.effective_cpus":  "0-1,4-5\n",
+		"sys/fs/cgroup/cpu,cpuacct/cpu.cfs_quota_us":  "250000\n",
+		"sys/fs/cgroup/cpu,cpuacct/cpu.cfs_period_us": "100000\n",
+	})
+	// The controllers share a hierarchy
+	if err := os.Symlink("cpu,cpuacct", filepath.Join(root, "sys/fs/cgroup/cpu")); err != nil {
+		t.Fatalf("failed to link cgroup: %v", err)
+	}
+
+	counter.Mode = CPUCountModeCpuset
+	if count, err := counter.Count(); err != nil || count != 4 {
+		t.Fatalf("unexpected cpuset count: %d, %v", count, err)
+	}
+	counter.Mode = CPUCountModeQuota
+	if count, err := counter.Count(); err != nil || count != 3 {
+		t.Fatalf("unexpected quota count: %d, %v", count, err)
+	}
+
+	// No quota
+	writeTree(t, root, map[string]string{"sys/fs/cgroup/cpu,cpuacct/cpu.cfs_quota_us": "-1\n"})
+	if count, err := counter.Count(); err != nil || count != 4 {
+		t.Fatalf("expected cpuset without quota, got: %d, %v", count, err)
+	}
+}
+
+func TestParseCPUList(t *testing.T) {
+	for list, expected := range map[string]uint{"0": 1, "0-3\n": 4, "0-3,8,10-11": 7, "": 0} {
+		count, err := parseCPUList(list)
+		if err != nil || count != expected {
+			t.Fatalf("unexpected count of %q: %d, %v", list, count, err)
+		}
+	}
+	for _, list := range []string{"a", "3-1", "0-"} {
+		if _, err := parseCPUList(list); err == nil {
+			t.Fatalf("expected %q to be invalid", list)
+		}
+	}
+}
 
-	if cpuCount < 1 {
-		t.Fatalf("invalid value of CPU count: %d < 1", cpuCount)
+// writeTree creates files relative to the root directory.
+func writeTree(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		writeFile(t, path, content)
 	}
 }
@@ -0,0 +1,235 @@
+package hostinfo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/RedHatInsights/host-metering/logger"
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	rhsmBusName = "com.redhat.RHSM1"
+	rhsmPath    = "/com/redhat/RHSM1"
+	// Messages of errors are not translated
+	rhsmLocale = "C"
+)
+
+// DBusInfoProvider gets information about the host from the D-Bus API of
+// rhsm.service. The fallback provider is used when the service is not
+// available.
+type DBusInfoProvider struct {
+	// Connect opens a connection to the bus of rhsm.service
+	Connect  func(ctx context.Context) (*dbus.Conn, error)
+	Fallback HostInfoProvider
+	CPU      *CPUCounter
+	Platform *Platform
+	Billing  *BillingRules
+	// ConsumerCert is read for the consumer name, the API doesn't provide it
+	ConsumerCert string
+}
+
+func NewDBusInfoProvider(cpu *CPUCounter, billing *BillingRules, certPath string, fallback HostInfoProvider) *DBusInfoProvider {
+	return &DBusInfoProvider{
+		CPU:          cpu,
+		Billing:      billing,
+		Connect:      connectSystemBus,
+		Fallback:     fallback,
+		ConsumerCert: certPath,
+	}
+}
+
+func connectSystemBus(ctx context.Context) (*dbus.Conn, error) {
+	return dbus.ConnectSystemBus(dbus.WithContext(ctx))
+}
+
+func (dip *DBusInfoProvider) Load(ctx context.Context) (*HostInfo, error) {
+	hi := &HostInfo{}
+	if err := dip.RefreshCpuCount(hi); err != nil {
+		return nil, err
+	}
+
+	conn, err := dip.Connect(ctx)
+	if err != nil {
+		return dip.fallback(ctx, err)
+	}
+	defer conn.Close()
+
+	rhsm := &rhsmClient{conn: conn, billing: dip.Billing, consumerCert: dip.ConsumerCert}
+	err = rhsm.load(ctx, hi)
+	if isServiceUnavailable(err) {
+		return dip.fallback(ctx, err)
+	}
+
+	// Information of an interrupted load is incomplete
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	platform(dip.Platform).Detect(hi)
+	return hi, err
+}
+
+func (dip *DBusInfoProvider) RefreshCpuCount(hi *HostInfo) error {
+	return cpuCounter(dip.CPU).Refresh(hi)
+}
+
+func (dip *DBusInfoProvider) fallback(ctx context.Context, err error) (*HostInfo, error) {
+	if dip.Fallback == nil {
+		return nil, fmt.Errorf("rhsm.service is not available: %w", err)
+	}
+	logger.Debugf("rhsm.service is not available, using fallback provider: %s\n", err.Error())
+	return dip.Fallback.Load(ctx)
+}
+
+// isServiceUnavailable tells whether the error means that rhsm.service
+// is not running and can't be activated.
+func isServiceUnavailable(err error) bool {
+	var dbusErr dbus.Error
+	if !errors.As(err, &dbusErr) {
+		return false
+	}
+	return dbusErr.Name == "org.freedesktop.DBus.Error.ServiceUnknown" ||
+		dbusErr.Name == "org.freedesktop.DBus.Error.NameHasNoOwner"
+}
+
+type rhsmClient struct {
+	conn         *dbus.Conn
+	billing      *BillingRules
+	consumerCert string
+}
+
+// load fills the host info, values which failed to load are listed by the
+// returned *LoadError. It fails right away when the service is unavailable.
+func (rc *rhsmClient) load(ctx context.Context, hi *HostInfo) error {
+	loadErr := &LoadError{}
+	var err error
+
+	if hi.HostId, err = rc.GetUuid(ctx); err != nil {
+		if isServiceUnavailable(err) {
+			return err
+		}
+		loadErr.Add(err, "HostId")
+	}
+	if hi.ExternalOrganization, err = rc.GetOrg(ctx); err != nil {
+		loadErr.Add(err, "ExternalOrganization")
+	}
+	if hi.HostName, err = ReadConsumerName(rc.consumerCert); err != nil {
+		loadErr.Add(err, "HostName")
+	}
+
+	facts, err := rc.GetFacts(ctx)
+	if err != nil {
+		loadErr.Add(err, factsFields...)
+	} else {
+		loadFacts(hi, facts, billingRules(rc.billing), loadErr)
+	}
+
+	if hi.Product, err = rc.ListInstalledProducts(ctx); err != nil {
+		loadErr.Add(err, "Product")
+	}
+
+	if syspurpose, err := rc.GetSyspurpose(ctx); err != nil {
+		loadErr.Add(err, syspurposeFields...)
+	} else {
+		syspurpose.update(hi)
+	}
+
+	return loadErr.ErrorOrNil()
+}
+
+// call calls the method of the RHSM object, e.g. "Consumer.GetUuid", and
+// stores its result.
+func (rc *rhsmClient) call(ctx context.Context, method string, result interface{}, args ...interface{}) error {
+	object, _, _ := strings.Cut(method, ".")
+	obj := rc.conn.Object(rhsmBusName, dbus.ObjectPath(rhsmPath+"/"+object))
+	err := obj.CallWithContext(ctx, rhsmBusName+"."+method, 0, args...).Store(result)
+	if err != nil {
+		err = fmt.Errorf("D-Bus call %s has failed: %w", method, err)
+		if strings.Contains(err.Error(), "requires the consumer to be registered") {
+			err = &notRegisteredError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+func (rc *rhsmClient) GetUuid(ctx context.Context) (string, error) {
+	var uuid string
+	err := rc.call(ctx, "Consumer.GetUuid", &uuid, rhsmLocale)
+	return uuid, err
+}
+
+func (rc *rhsmClient) GetOrg(ctx context.Context) (string, error) {
+	var data string
+	if err := rc.call(ctx, "Consumer.GetOrg", &data, rhsmLocale); err != nil {
+		return "", err
+	}
+
+	var org struct {
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal([]byte(data), &org); err != nil {
+		return "", &ParseError{fmt.Errorf("unable to parse organization: %s", err.Error())}
+	}
+	return org.Key, nil
+}
+
+func (rc *rhsmClient) GetFacts(ctx context.Context) (SubManValues, error) {
+	var values map[string]string
+	if err := rc.call(ctx, "Facts.GetFacts", &values); err != nil {
+		return nil, err
+	}
+
+	facts := SubManValues{}
+	for key, value := range values {
+		// Unify the letter case of keys, like for the command output.
+		facts[strings.ToLower(key)] = value
+	}
+	return facts, nil
+}
+
+func (rc *rhsmClient) ListInstalledProducts(ctx context.Context) ([]string, error) {
+	var data string
+	err := rc.call(ctx, "Products.ListInstalledProducts", &data, "", map[string]dbus.Variant{}, rhsmLocale)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each product is a list of its name, ID, version, arch, status ...
+	var products [][]interface{}
+	if err := json.Unmarshal([]byte(data), &products); err != nil {
+		return nil, &ParseError{fmt.Errorf("unable to parse installed products: %s", err.Error())}
+	}
+
+	product := make([]string, 0, len(products))
+	for _, p := range products {
+		if len(p) < 2 {
+			return nil, &ParseError{fmt.Errorf("unable to parse installed products: missing product ID")}
+		}
+		id, ok := p[1].(string)
+		if !ok {
+			return nil, &ParseError{fmt.Errorf("unable to parse installed products: invalid product ID %v", p[1])}
+		}
+		product = append(product, id)
+	}
+	sort.Strings(product)
+	return product, nil
+}
+
+func (rc *rhsmClient) GetSyspurpose(ctx context.Context) (*Syspurpose, error) {
+	var data string
+	if err := rc.call(ctx, "Syspurpose.GetSyspurpose", &data, rhsmLocale); err != nil {
+		return nil, err
+	}
+
+	syspurpose, err := parseSyspurpose([]byte(data))
+	if err != nil {
+		return nil, &ParseError{fmt.Errorf("unable to parse syspurpose: %s", err.Error())}
+	}
+	return syspurpose, nil
+}
@@ -0,0 +1,181 @@
+package hostinfo
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func TestDBusInfoProvider(t *testing.T) {
+	address := startBus(t)
+	startFakeRHSM(t, address, &fakeRHSM{})
+	fallback := &staticInfoProvider{hi: &HostInfo{HostId: "fallback"}}
+	provider := &DBusInfoProvider{Connect: connectBus(address), Fallback: fallback,
+		ConsumerCert: createRHSMFiles(t).ConsumerCert}
+
+	hi, err := provider.Load(context.Background())
+	checkError(t, err, "failed to load host info")
+
+	expected := &HostInfo{
+		HostId:               "01234567-89ab-cdef-0123-456789abcdef",
+		HostName:             "host.mock.test",
+		ExternalOrganization: "12345678",
+		SocketCount:          "3",
+		Product:              []string{"394", "69"},
+		Support:              "Premium",
+		Usage:                "Production",
+		Role:                 "Red Hat Enterprise Linux Server",
+		Addons:               []string{"RHEL for SAP"},
+		ConversionsSuccess:   "true",
+		Billing: BillingInfo{
+			Model:                 "marketplace",
+			Marketplace:           "aws",
+			MarketplaceAccount:    "000000000000",
+			MarketplaceInstanceId: "1-11111111111111111",
+		},
+		Virt: VirtInfo{
+			IsGuest:  "true",
+			HostType: "kvm",
+			UUID:     "ec2a1b2c-3d4e-5f60-7182-93a4b5c6d7e8",
+		},
+	}
+	compareHostInfo(t, hi, expected)
+	if hi.CloudProvider != "aws" {
+		t.Fatalf("unexpected cloud provider: %s", hi.CloudProvider)
+	}
+	if hi.HostName != expected.HostName || hi.ExternalOrganization != expected.ExternalOrganization {
+		t.Fatalf("unexpected identity: %s, %s", hi.HostName, hi.ExternalOrganization)
+	}
+	if fallback.called != 0 {
+		t.Fatalf("expected no fallback when rhsm.service is available")
+	}
+}
+
+func TestDBusInfoProviderError(t *testing.T) {
+	address := startBus(t)
+	notRegistered := dbus.NewError("com.redhat.RHSM1.Error", []interface{}{"This object requires the consumer to be registered"})
+	startFakeRHSM(t, address, &fakeRHSM{err: notRegistered})
+	fallback := &staticInfoProvider{hi: &HostInfo{HostId: "fallback"}}
+	provider := &DBusInfoProvider{Connect: connectBus(address), Fallback: fallback}
+
+	// Errors of the service are not hidden by the fallback
+	hi, err := provider.Load(context.Background())
+	var loadErr *LoadError
+	if hi == nil || !errors.As(err, &loadErr) {
+		t.Fatalf("expected partial host info with load error, got: %v, %v", hi, err)
+	}
+	fe := loadErr.Field("HostId")
+	if fe == nil || !fe.Required || fe.Reason != ReasonNotRegistered {
+		t.Fatalf("expected HostId to fail as not registered, got: %v", fe)
+	}
+	expectedMsg := "HostId (required): not registered: D-Bus call Consumer.GetUuid has failed: This object requires the consumer to be registered"
+	if fe.Error() != expectedMsg {
+		t.Fatalf("unexpected error: %s", fe.Error())
+	}
+	if fallback.called != 0 {
+		t.Fatalf("expected no fallback when rhsm.service fails")
+	}
+}
+
+func TestDBusInfoProviderFallback(t *testing.T) {
+	address := startBus(t)
+	fallback := &staticInfoProvider{hi: &HostInfo{HostId: "fallback"}}
+	provider := &DBusInfoProvider{Connect: connectBus(address), Fallback: fallback}
+
+	// rhsm.service is not running
+	hi, err := provider.Load(context.Background())
+	checkError(t, err, "failed to load host info")
+	if hi.HostId != "fallback" || fallback.called != 1 {
+		t.Fatalf("expected host info of fallback, got: %s", hi.HostId)
+	}
+
+	provider.Fallback = nil
+	if _, err := provider.Load(context.Background()); err == nil || !strings.HasPrefix(err.Error(), "rhsm.service is not available") {
+		t.Fatalf("expected load without fallback to fail, got: %v", err)
+	}
+}
+
+// startBus starts a private bus and returns its address.
+func startBus(t *testing.T) string {
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("dbus-daemon is not available")
+	}
+
+	cmd := exec.Command("dbus-daemon", "--session", "--nofork", "--print-address=1")
+	stdout, err := cmd.StdoutPipe()
+	checkError(t, err, "failed to get output of dbus-daemon")
+	checkError(t, cmd.Start(), "failed to start dbus-daemon")
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	checkError(t, err, "failed to read address of dbus-daemon")
+	return strings.TrimSpace(address)
+}
+
+func connectBus(address string) func(ctx context.Context) (*dbus.Conn, error) {
+	return func(ctx context.Context) (*dbus.Conn, error) {
+		return dbus.Connect(address, dbus.WithContext(ctx))
+	}
+}
+
+// startFakeRHSM exports objects of rhsm.service on the bus.
+func startFakeRHSM(t *testing.T, address string, rhsm *fakeRHSM) {
+	conn, err := dbus.Connect(address)
+	checkError(t, err, "failed to connect to bus")
+	t.Cleanup(func() { conn.Close() })
+
+	for _, object := range []string{"Consumer", "Facts", "Products", "Syspurpose"} {
+		err := conn.Export(rhsm, dbus.ObjectPath(rhsmPath+"/"+object), rhsmBusName+"."+object)
+		checkError(t, err, "failed to export "+object)
+	}
+	reply, err := conn.RequestName(rhsmBusName, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("failed to request name: %v, %v", reply, err)
+	}
+}
+
+// fakeRHSM replies like rhsm.service on the registered mocked host, or
+// fails all calls with the error.
+type fakeRHSM struct {
+	err *dbus.Error
+}
+
+func (f *fakeRHSM) GetUuid(locale string) (string, *dbus.Error) {
+	return "01234567-89ab-cdef-0123-456789abcdef", f.err
+}
+
+func (f *fakeRHSM) GetOrg(locale string) (string, *dbus.Error) {
+	return `{"displayName": "Mock Org", "key": "12345678", "id": "ff808081"}`, f.err
+}
+
+func (f *fakeRHSM) GetFacts() (map[string]string, *dbus.Error) {
+	return map[string]string{
+		"network.fqdn":        "host.mock.test",
+		"cpu.cpu_socket(s)":   "3",
+		"conversions.success": "True",
+		"aws_account_id":      "000000000000",
+		"aws_instance_id":     "1-11111111111111111",
+		"virt.host_type":      "kvm",
+		"virt.is_guest":       "True",
+		"virt.uuid":           "ec2a1b2c-3d4e-5f60-7182-93a4b5c6d7e8",
+	}, f.err
+}
+
+func (f *fakeRHSM) ListInstalledProducts(filter string, options map[string]dbus.Variant, locale string) (string, *dbus.Error) {
+	return `[
+		["Red Hat Enterprise Linux for x86_64", "69", "9.2", "x86_64", "subscribed", "", "", ""],
+		["Red Hat Enterprise Linux Server", "394", "9.2", "x86_64", "subscribed", "", "", ""]
+	]`, f.err
+}
+
+func (f *fakeRHSM) GetSyspurpose(locale string) (string, *dbus.Error) {
+	return `{"usage": "Production", "service_level_agreement": "Premium", "role": "Red Hat Enterprise Linux Server", "addons": ["RHEL for SAP"]}`, f.err
+}
@@ -0,0 +1,203 @@
+package hostinfo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Reason why a value of the host info failed to load.
+type FailureReason string
+
+const (
+	ReasonCommandNotFound FailureReason = "command not found"
+	ReasonTimeout         FailureReason = "timeout"
+	ReasonNotRegistered   FailureReason = "not registered"
+	ReasonParseFailure    FailureReason = "parse failure"
+	ReasonOther           FailureReason = "failure"
+)
+
+var remediationHints = map[FailureReason]string{
+	ReasonCommandNotFound: "install subscription-manager",
+	ReasonTimeout:         "check whether subscription-manager hangs, e.g. on a lock held by rhsmcertd",
+	ReasonNotRegistered:   "register the host with `subscription-manager register` or `rhc connect`",
+	ReasonParseFailure:    "check that the installed subscription-manager is supported",
+	ReasonOther:           "check logs of subscription-manager in /var/log/rhsm/rhsm.log",
+}
+
+// ErrNotRegistered is returned when the host is not registered.
+var ErrNotRegistered = errors.New("the host is not registered")
+
+// notRegisteredError is a failure caused by the host not being registered,
+// it keeps the original error for its message.
+type notRegisteredError struct {
+	err error
+}
+
+func (e *notRegisteredError) Error() string {
+	return e.err.Error()
+}
+
+func (e *notRegisteredError) Unwrap() error {
+	return e.err
+}
+
+func (e *notRegisteredError) Is(target error) bool {
+	return target == ErrNotRegistered
+}
+
+// ParseError is returned when a value is missing in the output or
+// files of subscription-manager or can't be parsed.
+type ParseError struct {
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Values of the host info without which the host can't be billed.
+var requiredFields = map[string]bool{
+	"HostId":               true,
+	"ExternalOrganization": true,
+}
+
+// FieldError describes why a value of the host info failed to load.
+type FieldError struct {
+	Field    string // name of the HostInfo field
+	Required bool
+	Reason   FailureReason
+	Err      error
+}
+
+func NewFieldError(field string, err error) *FieldError {
+	return &FieldError{
+		Field:    field,
+		Required: requiredFields[field],
+		Reason:   classifyError(err),
+		Err:      err,
+	}
+}
+
+func (fe *FieldError) Error() string {
+	required := "optional"
+	if fe.Required {
+		required = "required"
+	}
+	return fmt.Sprintf("%s (%s): %s: %s", fe.Field, required, fe.Reason, fe.Err.Error())
+}
+
+func (fe *FieldError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"field":    fe.Field,
+		"required": fe.Required,
+		"reason":   fe.Reason,
+		"error":    fe.Err.Error(),
+	})
+}
+
+// UnmarshalJSON decodes a failure reported by a running daemon, the original
+// error is kept only as its message.
+func (fe *FieldError) UnmarshalJSON(data []byte) error {
+	var decoded struct {
+		Field    string        `json:"field"`
+		Required bool          `json:"required"`
+		Reason   FailureReason `json:"reason"`
+		Error    string        `json:"error"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	fe.Field = decoded.Field
+	fe.Required = decoded.Required
+	fe.Reason = decoded.Reason
+	fe.Err = errors.New(decoded.Error)
+	return nil
+}
+
+// LoadError lists values of the host info which failed to load. The host
+// info is loaded partially when a provider returns it.
+type LoadError struct {
+	Fields []*FieldError `json:"fields"`
+}
+
+func (le *LoadError) Error() string {
+	fields := make([]string, 0, len(le.Fields))
+	for _, fe := range le.Fields {
+		fields = append(fields, fe.Error())
+	}
+	return "failed to load host info: " + strings.Join(fields, "; ")
+}
+
+// Add records the failure of the fields, the first failure of a field is kept.
+func (le *LoadError) Add(err error, fields ...string) {
+	for _, field := range fields {
+		if le.Field(field) == nil {
+			le.Fields = append(le.Fields, NewFieldError(field, err))
+		}
+	}
+}
+
+// Field returns the failure of the field, nil if it didn't fail.
+func (le *LoadError) Field(field string) *FieldError {
+	for _, fe := range le.Fields {
+		if fe.Field == field {
+			return fe
+		}
+	}
+	return nil
+}
+
+// Required tells whether a required field failed.
+func (le *LoadError) Required() bool {
+	for _, fe := range le.Fields {
+		if fe.Required {
+			return true
+		}
+	}
+	return false
+}
+
+// Remediation suggests how to fix the failures.
+func (le *LoadError) Remediation() string {
+	var hints []string
+	seen := map[FailureReason]bool{}
+	for _, fe := range le.Fields {
+		if !seen[fe.Reason] {
+			seen[fe.Reason] = true
+			hints = append(hints, remediationHints[fe.Reason])
+		}
+	}
+	return strings.Join(hints, "; ")
+}
+
+// ErrorOrNil returns nil if no field failed, so that the result can be
+// returned as an error.
+func (le *LoadError) ErrorOrNil() error {
+	if le == nil || len(le.Fields) == 0 {
+		return nil
+	}
+	return le
+}
+
+func classifyError(err error) FailureReason {
+	var parseErr *ParseError
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		return ReasonCommandNotFound
+	case errors.Is(err, context.DeadlineExceeded):
+		return ReasonTimeout
+	case errors.Is(err, ErrNotRegistered):
+		return ReasonNotRegistered
+	case errors.As(err, &parseErr):
+		return ReasonParseFailure
+	}
+	return ReasonOther
+}
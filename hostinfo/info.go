@@ -1,57 +1,176 @@
 package hostinfo
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/RedHatInsights/host-metering/logger"
 )
 
 type HostInfo struct {
-	CpuCount             uint
-	HostId               string
-	HostName             string
-	ExternalOrganization string
-	SocketCount          string
-	Product              []string
-	Support              string
-	Usage                string
-	ConversionsSuccess   string
-	Billing              BillingInfo
+	CpuCount             uint        `json:"cpu_count"`
+	CpuCountMode         string      `json:"cpu_count_mode"`
+	HostId               string      `json:"host_id"`
+	HostName             string      `json:"host_name"`
+	ExternalOrganization string      `json:"external_organization"`
+	SocketCount          string      `json:"socket_count"`
+	Product              []string    `json:"product"`
+	Support              string      `json:"support"`
+	Usage                string      `json:"usage"`
+	Role                 string      `json:"role"`
+	Addons               []string    `json:"addons"`
+	ConversionsSuccess   string      `json:"conversions_success"`
+	Billing              BillingInfo `json:"billing"`
+	Virt                 VirtInfo    `json:"virt"`
+	CloudProvider        string      `json:"cloud_provider"`
+}
+
+// Fields are names of the HostInfo fields loaded by a provider, they are
+// used by LoadError and MergeHostInfo.
+var Fields = []string{
+	"HostId",
+	"HostName",
+	"ExternalOrganization",
+	"SocketCount",
+	"Product",
+	"Support",
+	"Usage",
+	"Role",
+	"Addons",
+	"ConversionsSuccess",
+	"Billing",
+	"Virt",
+	"CloudProvider",
 }
 
 type BillingInfo struct {
-	Model                 string
-	Marketplace           string
-	MarketplaceAccount    string
-	MarketplaceInstanceId string
+	Model                 string `json:"model"`
+	Marketplace           string `json:"marketplace"`
+	MarketplaceAccount    string `json:"marketplace_account"`
+	MarketplaceInstanceId string `json:"marketplace_instance_id"`
 }
 
 type HostInfoProvider interface {
-	Load() (*HostInfo, error)
+	// Load gathers information about the host, it fails when the context
+	// is done before all information is gathered. Values which failed to
+	// load are listed by a *LoadError returned with the partial host info.
+	Load(ctx context.Context) (*HostInfo, error)
 	RefreshCpuCount(*HostInfo) error
 }
 
-type SubManInfoProvider struct{}
+// FieldsLoader is a provider which can load only some fields of the host
+// info, e.g. to fill values missing in another source.
+type FieldsLoader interface {
+	// LoadFields is like Load, but other fields than the named ones are
+	// left empty.
+	LoadFields(ctx context.Context, fields []string) (*HostInfo, error)
+}
+
+// SubManInfoProvider gets information about the host by running
+// subscription-manager. The zero value runs commands without a timeout and
+// doesn't reuse their outputs.
+type SubManInfoProvider struct {
+	CPU      *CPUCounter
+	Platform *Platform
+	Billing  *BillingRules
+	Timeout  time.Duration // timeout of each command, 0 for no timeout
+	CacheTTL time.Duration // how long an output is reused when the command fails
 
-func (smip *SubManInfoProvider) Load() (*HostInfo, error) {
-	return LoadHostInfo()
+	mu    sync.Mutex
+	cache map[string]cachedOutput
 }
 
-func (smip *SubManInfoProvider) RefreshCpuCount(hi *HostInfo) error {
-	return RefreshCpuCount(hi)
+type cachedOutput struct {
+	output string
+	at     time.Time
+}
+
+func NewSubManInfoProvider(cpu *CPUCounter, billing *BillingRules, timeout time.Duration, cacheTTL time.Duration) *SubManInfoProvider {
+	return &SubManInfoProvider{
+		CPU:      cpu,
+		Billing:  billing,
+		Timeout:  timeout,
+		CacheTTL: cacheTTL,
+	}
 }
 
-func LoadHostInfo() (*HostInfo, error) {
-	cpuCount, err := GetCPUCount()
-	if err != nil {
+func (smip *SubManInfoProvider) Load(ctx context.Context) (*HostInfo, error) {
+	return smip.LoadFields(ctx, Fields)
+}
+
+// LoadFields runs only the commands of subscription-manager which load
+// the named fields.
+func (smip *SubManInfoProvider) LoadFields(ctx context.Context, fields []string) (*HostInfo, error) {
+	hi := &HostInfo{}
+	if err := smip.RefreshCpuCount(hi); err != nil {
+		return nil, err
+	}
+
+	err := loadSubManInformation(ctx, hi, billingRules(smip.Billing), smip.exec, fields)
+	platform(smip.Platform).Detect(hi)
+
+	// Information of an interrupted load is incomplete
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	hi := &HostInfo{
-		CpuCount: cpuCount,
+	return hi, err
+}
+
+// exec runs subscription-manager with the timeout. The last output of the
+// command is returned instead of a failure, unless it is older than the
+// cache TTL, the host is not registered anymore or the load is interrupted.
+func (smip *SubManInfoProvider) exec(ctx context.Context, command ...string) (string, error) {
+	cmdCtx := ctx
+	if smip.Timeout > 0 {
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithTimeout(ctx, smip.Timeout)
+		defer cancel()
+	}
+	output, err := execSubManCommand(cmdCtx, command...)
+
+	key := strings.Join(command, " ")
+	smip.mu.Lock()
+	defer smip.mu.Unlock()
+	if smip.cache == nil {
+		smip.cache = map[string]cachedOutput{}
 	}
-	LoadSubManInformation(hi)
 
-	return hi, nil
+	if err == nil {
+		smip.cache[key] = cachedOutput{output: output, at: time.Now()}
+		return output, nil
+	}
+	if errors.Is(err, ErrNotRegistered) {
+		delete(smip.cache, key)
+		return "", err
+	}
+	if ctx.Err() != nil {
+		return "", err
+	}
+
+	cached, ok := smip.cache[key]
+	if !ok || time.Since(cached.at) >= smip.CacheTTL {
+		return "", err
+	}
+	logger.Warnf("Using output of `subscription-manager %s` from %s: %s\n",
+		key, cached.at.Format(time.RFC3339), err.Error())
+	return cached.output, nil
+}
+
+func (smip *SubManInfoProvider) RefreshCpuCount(hi *HostInfo) error {
+	return cpuCounter(smip.CPU).Refresh(hi)
+}
+
+// LoadHostInfo gathers information about the host by running
+// subscription-manager without a timeout.
+func LoadHostInfo(ctx context.Context) (*HostInfo, error) {
+	return (&SubManInfoProvider{}).Load(ctx)
 }
 
 func (hi *HostInfo) String() string {
@@ -59,6 +178,7 @@ func (hi *HostInfo) String() string {
 		[]string{
 			"HostInfo:",
 			fmt.Sprintf("|  CpuCount: %d", hi.CpuCount),
+			fmt.Sprintf("|  CpuCountMode: %s", hi.CpuCountMode),
 			fmt.Sprintf("|  HostName: %s", hi.HostName),
 			fmt.Sprintf("|  HostId: %s", hi.HostId),
 			fmt.Sprintf("|  ExternalOrganization: %s", hi.ExternalOrganization),
@@ -66,20 +186,62 @@ func (hi *HostInfo) String() string {
 			fmt.Sprintf("|  Product: %s", hi.Product),
 			fmt.Sprintf("|  Support: %s", hi.Support),
 			fmt.Sprintf("|  Usage: %s", hi.Usage),
+			fmt.Sprintf("|  Role: %s", hi.Role),
+			fmt.Sprintf("|  Addons: %s", hi.Addons),
 			fmt.Sprintf("|  ConversionsSuccess: %s", hi.ConversionsSuccess),
 			fmt.Sprintf("|  Billing.Model: %s", hi.Billing.Model),
 			fmt.Sprintf("|  Billing.Marketplace: %s", hi.Billing.Marketplace),
 			fmt.Sprintf("|  Billing.MarketplaceAccount: %s", hi.Billing.MarketplaceAccount),
 			fmt.Sprintf("|  Billing.MarketplaceInstanceId: %s", hi.Billing.MarketplaceInstanceId),
+			fmt.Sprintf("|  Virt.IsGuest: %s", hi.Virt.IsGuest),
+			fmt.Sprintf("|  Virt.HostType: %s", hi.Virt.HostType),
+			fmt.Sprintf("|  Virt.UUID: %s", hi.Virt.UUID),
+			fmt.Sprintf("|  CloudProvider: %s", hi.CloudProvider),
 		}, "\n")
 }
 
-func RefreshCpuCount(hi *HostInfo) error {
-	cpuCount, err := GetCPUCount()
-	if err != nil {
-		return err
+// MergeHostInfo copies values of the named fields from the other host info.
+func MergeHostInfo(hi *HostInfo, other *HostInfo, names []string) {
+	for _, name := range names {
+		switch name {
+		case "HostId":
+			hi.HostId = other.HostId
+		case "HostName":
+			hi.HostName = other.HostName
+		case "ExternalOrganization":
+			hi.ExternalOrganization = other.ExternalOrganization
+		case "SocketCount":
+			hi.SocketCount = other.SocketCount
+		case "Product":
+			hi.Product = other.Product
+		case "Support":
+			hi.Support = other.Support
+		case "Usage":
+			hi.Usage = other.Usage
+		case "Role":
+			hi.Role = other.Role
+		case "Addons":
+			hi.Addons = other.Addons
+		case "ConversionsSuccess":
+			hi.ConversionsSuccess = other.ConversionsSuccess
+		case "Billing":
+			hi.Billing = other.Billing
+		case "Virt":
+			hi.Virt = other.Virt
+		case "CloudProvider":
+			hi.CloudProvider = other.CloudProvider
+		}
 	}
+}
+
+// Fingerprint identifies the host, it changes when the host is registered
+// again or moved to another organization.
+func (hi *HostInfo) Fingerprint() string {
+	hash := sha256.Sum256([]byte(hi.HostId + "\x00" + hi.ExternalOrganization))
+	return hex.EncodeToString(hash[:])
+}
 
-	hi.CpuCount = cpuCount
-	return nil
+// RefreshCpuCount sets the CPU count of the host info by the default counter.
+func RefreshCpuCount(hi *HostInfo) error {
+	return DefaultCPUCounter.Refresh(hi)
 }
@@ -1,15 +1,16 @@
 package hostinfo
 
 import (
+	"context"
 	"testing"
 )
 
 func TestHostInfo(t *testing.T) {
-	hi, err := LoadHostInfo()
+	hi, err := LoadHostInfo(context.Background())
 	checkError(t, err, "failed to load host info")
 
 	// Check the CPU count.
-	cpuCount, err := GetCPUCount()
+	cpuCount, err := DefaultCPUCounter.Count()
 	checkError(t, err, "failed to get CPU count")
 
 	if hi.CpuCount != cpuCount {
@@ -22,6 +23,7 @@ func TestHostInfo(t *testing.T) {
 	// Define the expected defaults.
 	expectedString := "HostInfo:\n" +
 		"|  CpuCount: 64\n" +
+		"|  CpuCountMode: online\n" +
 		"|  HostName: host.mock.test\n" +
 		"|  HostId: 01234567-89ab-cdef-0123-456789abcdef\n" +
 		"|  ExternalOrganization: 12345678\n" +
@@ -29,11 +31,17 @@ func TestHostInfo(t *testing.T) {
 		"|  Product: [394 69]\n" +
 		"|  Support: Premium\n" +
 		"|  Usage: Production\n" +
+		"|  Role: Red Hat Enterprise Linux Server\n" +
+		"|  Addons: [High Availability RHEL for SAP]\n" +
 		"|  ConversionsSuccess: true\n" +
 		"|  Billing.Model: marketplace\n" +
 		"|  Billing.Marketplace: aws\n" +
 		"|  Billing.MarketplaceAccount: 000000000000\n" +
-		"|  Billing.MarketplaceInstanceId: 1-11111111111111111"
+		"|  Billing.MarketplaceInstanceId: 1-11111111111111111\n" +
+		"|  Virt.IsGuest: true\n" +
+		"|  Virt.HostType: kvm\n" +
+		"|  Virt.UUID: ec2a1b2c-3d4e-5f60-7182-93a4b5c6d7e8\n" +
+		"|  CloudProvider: aws"
 
 	if hi.String() != expectedString {
 		t.Fatalf("unexpected string:\n%s\n!=\n%s", hi.String(), expectedString)
@@ -55,6 +63,39 @@ func TestHostInfo(t *testing.T) {
 	}
 }
 
+func TestHostInfoFingerprint(t *testing.T) {
+	hi := &HostInfo{HostId: "host-id", ExternalOrganization: "org", CpuCount: 4}
+	fingerprint := hi.Fingerprint()
+
+	// Other information does not change the identity of the host
+	hi.CpuCount = 8
+	hi.Usage = "Production"
+	if hi.Fingerprint() != fingerprint {
+		t.Fatalf("expected fingerprint to be stable")
+	}
+
+	hi.HostId = "other-host-id"
+	if hi.Fingerprint() == fingerprint {
+		t.Fatalf("expected fingerprint to change with HostId")
+	}
+	hi.HostId = "host-id"
+	hi.ExternalOrganization = "other-org"
+	if hi.Fingerprint() == fingerprint {
+		t.Fatalf("expected fingerprint to change with organization")
+	}
+}
+
+// Test that incomplete information is not returned when loading is interrupted
+func TestHostInfoInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	hi, err := LoadHostInfo(ctx)
+	if err != context.Canceled || hi != nil {
+		t.Fatalf("expected interrupted load to fail, got: %v, %v", hi, err)
+	}
+}
+
 func checkError(t *testing.T, err error, message string) {
 	if err != nil {
 		t.Fatalf("%s: %v", message, err)
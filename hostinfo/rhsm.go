@@ -0,0 +1,425 @@
+package hostinfo
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/RedHatInsights/host-metering/logger"
+)
+
+// RHSMPaths are locations of files maintained by subscription-manager.
+type RHSMPaths struct {
+	ConsumerCert string
+	// ProductCerts and Facts are glob patterns
+	ProductCerts []string
+	Facts        []string
+	Syspurpose   string
+}
+
+var DefaultRHSMPaths = RHSMPaths{
+	ConsumerCert: "/etc/pki/consumer/cert.pem",
+	ProductCerts: []string{"/etc/pki/product/*.pem", "/etc/pki/product-default/*.pem"},
+	// Facts collected by rhsmcertd and custom facts, which take precedence
+	Facts:      []string{"/var/lib/rhsm/facts/facts.json", "/etc/rhsm/facts/*.facts"},
+	Syspurpose: "/etc/rhsm/syspurpose/syspurpose.json",
+}
+
+// Product certificates carry the product ID in OIDs of their extensions,
+// e.g. 1.3.6.1.4.1.2312.9.1.69.1 is the name of the product 69.
+var productOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 2312, 9, 1}
+
+// Consumer certificates carry the consumer name in the subject alternative
+// name, as a directory name or as an URI of older certificates.
+var subjectAltNameOID = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+const (
+	generalNameDirectoryName = 4
+	generalNameURI           = 6
+)
+
+// NativeInfoProvider reads information about the host from the files of
+// subscription-manager instead of running it. Values which can't be read
+// from the files are loaded by the fallback provider.
+type NativeInfoProvider struct {
+	CPU      *CPUCounter
+	Paths    RHSMPaths
+	Fallback HostInfoProvider
+	Platform *Platform
+	Billing  *BillingRules
+}
+
+// NewNativeInfoProvider creates a provider reading the consumer certificate
+// at the given path.
+func NewNativeInfoProvider(cpu *CPUCounter, billing *BillingRules, certPath string, fallback HostInfoProvider) *NativeInfoProvider {
+	paths := DefaultRHSMPaths
+	paths.ConsumerCert = certPath
+	return &NativeInfoProvider{
+		CPU:      cpu,
+		Billing:  billing,
+		Paths:    paths,
+		Fallback: fallback,
+	}
+}
+
+func (nip *NativeInfoProvider) Load(ctx context.Context) (*HostInfo, error) {
+	hi := &HostInfo{}
+	if err := nip.RefreshCpuCount(hi); err != nil {
+		return nil, err
+	}
+	loadErr := nip.loadRHSMFiles(hi)
+
+	if len(loadErr.Fields) > 0 && nip.Fallback != nil {
+		missing := make([]string, 0, len(loadErr.Fields))
+		for _, fe := range loadErr.Fields {
+			missing = append(missing, fe.Field)
+		}
+		logger.Debugf("Loading %s by fallback provider...\n", strings.Join(missing, ", "))
+
+		var fallback *HostInfo
+		var err error
+		if loader, ok := nip.Fallback.(FieldsLoader); ok {
+			fallback, err = loader.LoadFields(ctx, missing)
+		} else {
+			fallback, err = nip.Fallback.Load(ctx)
+		}
+		var fallbackErr *LoadError
+		if fallback == nil || (err != nil && !errors.As(err, &fallbackErr)) {
+			return nil, err
+		}
+		MergeHostInfo(hi, fallback, missing)
+
+		// Only values missing in both sources failed
+		loadErr = &LoadError{}
+		if fallbackErr != nil {
+			for _, fe := range fallbackErr.Fields {
+				if contains(missing, fe.Field) {
+					loadErr.Fields = append(loadErr.Fields, fe)
+				}
+			}
+		}
+	}
+
+	// Information of an interrupted load is incomplete
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	platform(nip.Platform).Detect(hi)
+	return hi, loadErr.ErrorOrNil()
+}
+
+func (nip *NativeInfoProvider) RefreshCpuCount(hi *HostInfo) error {
+	return cpuCounter(nip.CPU).Refresh(hi)
+}
+
+// loadRHSMFiles fills the host info from the files, values which are
+// missing are listed by the returned error.
+func (nip *NativeInfoProvider) loadRHSMFiles(hi *HostInfo) *LoadError {
+	loadErr := &LoadError{}
+
+	consumer, err := ReadConsumerCert(nip.Paths.ConsumerCert)
+	if err != nil {
+		logger.Debugf("Unable to read consumer certificate: %s\n", err.Error())
+		loadErr.Add(err, "HostId", "HostName", "ExternalOrganization")
+	} else {
+		hi.HostId, hi.ExternalOrganization = consumer.Uuid, consumer.Org
+		if hi.HostName, err = consumer.name(); err != nil {
+			loadErr.Add(err, "HostName")
+		}
+	}
+
+	facts, err := ReadFacts(nip.Paths.Facts)
+	if err != nil {
+		logger.Debugf("Unable to read facts: %s\n", err.Error())
+		loadErr.Add(err, factsFields...)
+	} else {
+		loadFacts(hi, facts, billingRules(nip.Billing), loadErr)
+	}
+
+	hi.Product, err = ReadProductCerts(nip.Paths.ProductCerts)
+	if err != nil {
+		logger.Debugf("Unable to read product certificates: %s\n", err.Error())
+		loadErr.Add(err, "Product")
+	}
+
+	syspurpose, err := ReadSyspurpose(nip.Paths.Syspurpose)
+	if err != nil {
+		logger.Debugf("Unable to read syspurpose: %s\n", err.Error())
+		loadErr.Add(err, syspurposeFields...)
+	} else {
+		syspurpose.update(hi)
+	}
+
+	return loadErr
+}
+
+// Fields of the host info loaded from the facts.
+var factsFields = []string{"SocketCount", "ConversionsSuccess", "Billing", "Virt", "CloudProvider"}
+
+// loadFacts fills the host info from the facts, values which are missing
+// are added to the error.
+func loadFacts(hi *HostInfo, facts SubManValues, billing *BillingRules, loadErr *LoadError) {
+	if facts.has("cpu.cpu_socket(s)") {
+		hi.SocketCount, _ = GetSocketCount(facts)
+	} else {
+		loadErr.Add(&ParseError{fmt.Errorf("`cpu.cpu_socket(s)` not found")}, "SocketCount")
+	}
+	// Only converted hosts and hosts of a marketplace have these
+	if facts.has("conversions.success") {
+		hi.ConversionsSuccess, _ = GetConversionsSuccess(facts)
+	}
+	hi.Billing, _ = billing.BillingInfo(facts)
+	hi.Virt = GetVirtInfo(facts)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ConsumerIdentity is the identity of the host registered by
+// subscription-manager.
+type ConsumerIdentity struct {
+	Uuid string
+	Name string
+	Org  string
+}
+
+// ReadConsumerCert returns the system identity, the consumer name and the
+// organization of the consumer certificate. The name is empty if the
+// certificate doesn't carry it.
+func ReadConsumerCert(path string) (*ConsumerIdentity, error) {
+	cert, err := readCert(path)
+	if os.IsNotExist(err) {
+		return nil, &notRegisteredError{err}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cert.Subject.CommonName == "" || len(cert.Subject.Organization) == 0 {
+		return nil, &ParseError{fmt.Errorf("%s is not a consumer certificate", path)}
+	}
+
+	return &ConsumerIdentity{
+		Uuid: cert.Subject.CommonName,
+		Name: consumerName(cert),
+		Org:  cert.Subject.Organization[0],
+	}, nil
+}
+
+// ReadConsumerName returns the consumer name of the consumer certificate,
+// which is printed as the name by `subscription-manager identity`.
+func ReadConsumerName(path string) (string, error) {
+	consumer, err := ReadConsumerCert(path)
+	if err != nil {
+		return "", err
+	}
+	return consumer.name()
+}
+
+func (c *ConsumerIdentity) name() (string, error) {
+	if c.Name == "" {
+		return "", &ParseError{fmt.Errorf("consumer name not found")}
+	}
+	return c.Name, nil
+}
+
+// consumerName returns the common name of the last directory name or URI
+// in the subject alternative name, like subscription-manager does.
+func consumerName(cert *x509.Certificate) string {
+	var name string
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(subjectAltNameOID) {
+			continue
+		}
+		var altNames asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &altNames); err != nil {
+			return ""
+		}
+		for rest := altNames.Bytes; len(rest) > 0; {
+			var altName asn1.RawValue
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &altName); err != nil {
+				return ""
+			}
+			if altName.Class != asn1.ClassContextSpecific {
+				continue
+			}
+			switch altName.Tag {
+			case generalNameDirectoryName:
+				var rdns pkix.RDNSequence
+				if _, err := asn1.Unmarshal(altName.Bytes, &rdns); err == nil {
+					var dirName pkix.Name
+					dirName.FillFromRDNSequence(&rdns)
+					name = dirName.CommonName
+				}
+			case generalNameURI:
+				name = strings.TrimPrefix(string(altName.Bytes), "CN=")
+			}
+		}
+	}
+	return name
+}
+
+// ReadProductCerts returns IDs of the installed products. It fails when no
+// product certificate is found.
+func ReadProductCerts(patterns []string) ([]string, error) {
+	ids := map[string]bool{}
+	for _, pattern := range patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			cert, err := readCert(path)
+			if err != nil {
+				logger.Warnf("Skipping product certificate: %s\n", err.Error())
+				continue
+			}
+			for _, ext := range cert.Extensions {
+				if len(ext.Id) > len(productOID) && ext.Id[:len(productOID)].Equal(productOID) {
+					ids[strconv.Itoa(ext.Id[len(productOID)])] = true
+				}
+			}
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no product certificate found")
+	}
+
+	product := make([]string, 0, len(ids))
+	for id := range ids {
+		product = append(product, id)
+	}
+	sort.Strings(product)
+	return product, nil
+}
+
+// ReadFacts returns facts of all files matching the patterns, values of
+// later files take precedence.
+func ReadFacts(patterns []string) (SubManValues, error) {
+	var paths []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no facts file found")
+	}
+
+	facts := SubManValues{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		// Keep numbers as written, e.g. long IDs
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var values map[string]interface{}
+		if err := decoder.Decode(&values); err != nil {
+			return nil, &ParseError{fmt.Errorf("%s: %s", path, err.Error())}
+		}
+		for key, value := range values {
+			if value == nil {
+				continue
+			}
+			// Unify the letter case of keys, like for the command output.
+			facts[strings.ToLower(key)] = fmt.Sprint(value)
+		}
+	}
+
+	return facts, nil
+}
+
+// Syspurpose is the system purpose of the host.
+type Syspurpose struct {
+	Usage                 string   `json:"usage"`
+	ServiceLevelAgreement string   `json:"service_level_agreement"`
+	Role                  string   `json:"role"`
+	Addons                []string `json:"addons"`
+}
+
+// Fields of the host info loaded from the system purpose.
+var syspurposeFields = []string{"Usage", "Support", "Role", "Addons"}
+
+// update sets values of the system purpose to the host info.
+func (s *Syspurpose) update(hi *HostInfo) {
+	hi.Usage = s.Usage
+	hi.Support = s.ServiceLevelAgreement
+	hi.Role = s.Role
+	hi.Addons = s.Addons
+}
+
+// ReadSyspurpose returns the system purpose, its values are empty when
+// the system purpose is not set.
+func ReadSyspurpose(path string) (*Syspurpose, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Syspurpose{Addons: []string{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	syspurpose, err := parseSyspurpose(data)
+	if err != nil {
+		return nil, &ParseError{fmt.Errorf("%s: %s", path, err.Error())}
+	}
+
+	return syspurpose, nil
+}
+
+// parseSyspurpose returns the system purpose in JSON, addons are sorted.
+func parseSyspurpose(data []byte) (*Syspurpose, error) {
+	syspurpose := &Syspurpose{}
+	if err := json.Unmarshal(data, syspurpose); err != nil {
+		return nil, err
+	}
+	if syspurpose.Addons == nil {
+		syspurpose.Addons = []string{}
+	}
+	sort.Strings(syspurpose.Addons)
+
+	return syspurpose, nil
+}
+
+func readCert(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, &ParseError{fmt.Errorf("%s: no PEM certificate found", path)}
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, &ParseError{fmt.Errorf("%s: %s", path, err.Error())}
+	}
+	return cert, nil
+}
@@ -0,0 +1,321 @@
+package hostinfo
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNativeInfoProvider(t *testing.T) {
+	paths := createRHSMFiles(t)
+	fallback := &staticInfoProvider{hi: &HostInfo{HostId: "fallback"}}
+	provider := &NativeInfoProvider{Paths: paths, Fallback: fallback}
+
+	hi, err := provider.Load(context.Background())
+	checkError(t, err, "failed to load host info")
+
+	expected := &HostInfo{
+		HostId:               "01234567-89ab-cdef-0123-456789abcdef",
+		HostName:             "host.mock.test",
+		ExternalOrganization: "12345678",
+		SocketCount:          "3",
+		Product:              []string{"394", "69"},
+		Support:              "Premium",
+		Usage:                "Production",
+		Role:                 "Red Hat Enterprise Linux Server",
+		Addons:               []string{"High Availability", "RHEL for SAP"},
+		ConversionsSuccess:   "true",
+		Billing: BillingInfo{
+			Model:                 "marketplace",
+			Marketplace:           "aws",
+			MarketplaceAccount:    "000000000000",
+			MarketplaceInstanceId: "1-11111111111111111",
+		},
+		Virt: VirtInfo{
+			IsGuest:  "true",
+			HostType: "kvm",
+			UUID:     "ec2a1b2c-3d4e-5f60-7182-93a4b5c6d7e8",
+		},
+	}
+	compareHostInfo(t, hi, expected)
+	if hi.CloudProvider != "aws" {
+		t.Fatalf("unexpected cloud provider: %s", hi.CloudProvider)
+	}
+	if hi.HostName != expected.HostName || hi.ExternalOrganization != expected.ExternalOrganization {
+		t.Fatalf("unexpected identity: %s, %s", hi.HostName, hi.ExternalOrganization)
+	}
+	if fallback.called != 0 {
+		t.Fatalf("expected no fallback when all files are present")
+	}
+}
+
+// Test that the files give the same host info as the mocked subscription-manager.
+func TestNativeInfoProviderMatchesSubMan(t *testing.T) {
+	// WARNING: This function requires ./mocks in the PATH environment
+	// variable to run the mocked subscription manager.
+	t.Setenv("CLOUD_PROVIDER", "aws")
+	paths := createRHSMFiles(t)
+
+	native, err := (&NativeInfoProvider{Paths: paths}).Load(context.Background())
+	checkError(t, err, "failed to load host info from files")
+	subMan, err := (&SubManInfoProvider{}).Load(context.Background())
+	checkError(t, err, "failed to load host info from subscription-manager")
+	if !reflect.DeepEqual(native, subMan) {
+		t.Fatalf("expected the same host info, got from files:\n%s\nfrom subscription-manager:\n%s",
+			native.String(), subMan.String())
+	}
+}
+
+func TestNativeInfoProviderFallback(t *testing.T) {
+	paths := createRHSMFiles(t)
+	fallback := &staticInfoProvider{hi: &HostInfo{
+		HostId:               "fallback-id",
+		ExternalOrganization: "fallback-org",
+		SocketCount:          "8",
+		Product:              []string{"479"},
+		Usage:                "Development",
+	}}
+	provider := &NativeInfoProvider{Paths: paths, Fallback: fallback}
+
+	// Only values of missing files are loaded by the fallback
+	os.Remove(paths.ConsumerCert)
+	hi, err := provider.Load(context.Background())
+	checkError(t, err, "failed to load host info")
+	if hi.HostId != "fallback-id" || hi.ExternalOrganization != "fallback-org" {
+		t.Fatalf("expected identity of fallback, got: %s, %s", hi.HostId, hi.ExternalOrganization)
+	}
+	if !reflect.DeepEqual(fallback.fields, []string{"HostId", "HostName", "ExternalOrganization"}) {
+		t.Fatalf("expected fallback to load only the identity, got: %v", fallback.fields)
+	}
+	if hi.SocketCount != "3" || !reflect.DeepEqual(hi.Product, []string{"394", "69"}) || hi.Usage != "Production" {
+		t.Fatalf("expected other values from files, got:\n%s", hi.String())
+	}
+
+	// Missing products are loaded by the fallback
+	paths.ProductCerts = []string{filepath.Join(t.TempDir(), "*.pem")}
+	provider.Paths = paths
+	hi, err = provider.Load(context.Background())
+	checkError(t, err, "failed to load host info")
+	if !reflect.DeepEqual(hi.Product, []string{"479"}) {
+		t.Fatalf("expected products of fallback, got: %v", hi.Product)
+	}
+	if !reflect.DeepEqual(fallback.fields, []string{"HostId", "HostName", "ExternalOrganization", "Product"}) {
+		t.Fatalf("expected fallback to load only missing values, got: %v", fallback.fields)
+	}
+
+	// Values missing in both sources fail with the reason of the fallback
+	fallback.err = &LoadError{Fields: []*FieldError{
+		NewFieldError("Product", &ParseError{fmt.Errorf("`Product ID` not found")}),
+		NewFieldError("SocketCount", &ParseError{fmt.Errorf("`cpu.cpu_socket(s)` not found")}),
+	}}
+	hi, err = provider.Load(context.Background())
+	var loadErr *LoadError
+	if hi == nil || !errors.As(err, &loadErr) {
+		t.Fatalf("expected partial host info with load error, got: %v, %v", hi, err)
+	}
+	if len(loadErr.Fields) != 1 || loadErr.Fields[0].Field != "Product" || loadErr.Fields[0].Reason != ReasonParseFailure {
+		t.Fatalf("expected only products to fail, got: %v", loadErr)
+	}
+	fallback.err = nil
+
+	// Missing syspurpose means it is not set
+	os.Remove(paths.Syspurpose)
+	hi, err = provider.Load(context.Background())
+	checkError(t, err, "failed to load host info")
+	if hi.Usage != "" || hi.Support != "" || hi.Role != "" || len(hi.Addons) != 0 {
+		t.Fatalf("expected no syspurpose, got: %s, %s, %s, %v", hi.Usage, hi.Support, hi.Role, hi.Addons)
+	}
+}
+
+func TestNativeInfoProviderInterrupted(t *testing.T) {
+	paths := createRHSMFiles(t)
+	provider := &NativeInfoProvider{Paths: paths}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	hi, err := provider.Load(ctx)
+	if err != context.Canceled || hi != nil {
+		t.Fatalf("expected interrupted load to fail, got: %v, %v", hi, err)
+	}
+}
+
+func TestReadConsumerCert(t *testing.T) {
+	dir := t.TempDir()
+	subject := pkix.Name{CommonName: "01234567-89ab-cdef-0123-456789abcdef", Organization: []string{"12345678"}}
+
+	// The name is the last directory name of the subject alternative name
+	path := filepath.Join(dir, "cert.pem")
+	writeCert(t, path, subject, []pkix.Extension{consumerNameExtension(t, "old.mock.test", "host.mock.test")})
+	consumer, err := ReadConsumerCert(path)
+	checkError(t, err, "failed to read consumer certificate")
+	expected := &ConsumerIdentity{Uuid: "01234567-89ab-cdef-0123-456789abcdef", Name: "host.mock.test", Org: "12345678"}
+	if !reflect.DeepEqual(consumer, expected) {
+		t.Fatalf("unexpected consumer: %+v", consumer)
+	}
+
+	// Older certificates have the name as an URI
+	uri, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 6, Bytes: []byte("CN=uri.mock.test")})
+	altName, _ := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: uri})
+	writeCert(t, path, subject, []pkix.Extension{{Id: asn1.ObjectIdentifier{2, 5, 29, 17}, Value: altName}})
+	consumer, err = ReadConsumerCert(path)
+	checkError(t, err, "failed to read consumer certificate")
+	if consumer.Name != "uri.mock.test" {
+		t.Fatalf("unexpected consumer name: %s", consumer.Name)
+	}
+
+	// Certificates without the name are read, the name is loaded by the fallback
+	writeCert(t, path, subject, nil)
+	consumer, err = ReadConsumerCert(path)
+	checkError(t, err, "failed to read consumer certificate")
+	if consumer.Name != "" || consumer.Uuid != expected.Uuid {
+		t.Fatalf("unexpected consumer: %+v", consumer)
+	}
+
+	// Missing certificate means the host is not registered
+	_, err = ReadConsumerCert(filepath.Join(dir, "missing.pem"))
+	if !errors.Is(err, ErrNotRegistered) {
+		t.Fatalf("expected not registered, got: %v", err)
+	}
+}
+
+func TestReadFacts(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.facts"), `{"Cpu.Cpu_Socket(s)": 2, "aws_account_id": "000000000000"}`)
+	writeFile(t, filepath.Join(dir, "b.facts"), `{"cpu.cpu_socket(s)": 4, "uname.machine": null}`)
+
+	facts, err := ReadFacts([]string{filepath.Join(dir, "*.facts")})
+	checkError(t, err, "failed to read facts")
+	expected := SubManValues{"cpu.cpu_socket(s)": "4", "aws_account_id": "000000000000"}
+	if !reflect.DeepEqual(facts, expected) {
+		t.Fatalf("unexpected facts: %v", facts)
+	}
+
+	writeFile(t, filepath.Join(dir, "c.facts"), `not json`)
+	if _, err := ReadFacts([]string{filepath.Join(dir, "*.facts")}); err == nil {
+		t.Fatalf("expected invalid facts to fail")
+	}
+}
+
+// createRHSMFiles creates files of subscription-manager with the values of
+// the mocked subscription-manager for AWS.
+func createRHSMFiles(t *testing.T) RHSMPaths {
+	dir := t.TempDir()
+	for _, name := range []string{"consumer", "product", "product-default", "facts", "custom-facts", "syspurpose"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0700); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+	}
+	paths := RHSMPaths{
+		ConsumerCert: filepath.Join(dir, "consumer", "cert.pem"),
+		ProductCerts: []string{filepath.Join(dir, "product", "*.pem"), filepath.Join(dir, "product-default", "*.pem")},
+		Facts:        []string{filepath.Join(dir, "facts", "facts.json"), filepath.Join(dir, "custom-facts", "*.facts")},
+		Syspurpose:   filepath.Join(dir, "syspurpose", "syspurpose.json"),
+	}
+
+	writeCert(t, paths.ConsumerCert, pkix.Name{
+		CommonName:   "01234567-89ab-cdef-0123-456789abcdef",
+		Organization: []string{"12345678"},
+	}, []pkix.Extension{consumerNameExtension(t, "host.mock.test")})
+	writeCert(t, filepath.Join(dir, "product", "69.pem"), pkix.Name{CommonName: "product"}, productExtensions(69))
+	writeCert(t, filepath.Join(dir, "product", "394.pem"), pkix.Name{CommonName: "product"}, productExtensions(394))
+	writeCert(t, filepath.Join(dir, "product-default", "69.pem"), pkix.Name{CommonName: "product"}, productExtensions(69))
+	// The host name differs from the consumer name, like in the mock
+	writeFile(t, filepath.Join(dir, "facts", "facts.json"), `{
+		"network.fqdn": "hostname",
+		"cpu.cpu_socket(s)": "1",
+		"conversions.success": true,
+		"virt.host_type": "kvm",
+		"virt.is_guest": true,
+		"virt.uuid": "EC2A1B2C-3D4E-5F60-7182-93A4B5C6D7E8"
+	}`)
+	writeFile(t, filepath.Join(dir, "custom-facts", "aws.facts"), `{
+		"cpu.cpu_socket(s)": "3",
+		"aws_account_id": "000000000000",
+		"aws_instance_id": "1-11111111111111111"
+	}`)
+	writeFile(t, paths.Syspurpose, `{"usage": "Production", "service_level_agreement": "Premium",
+		"role": "Red Hat Enterprise Linux Server", "addons": ["RHEL for SAP", "High Availability"]}`)
+
+	return paths
+}
+
+// consumerNameExtension returns the subject alternative name of a consumer
+// certificate with directory names of the names.
+func consumerNameExtension(t *testing.T, names ...string) pkix.Extension {
+	var dirNames []byte
+	for _, name := range names {
+		rdns, err := asn1.Marshal(pkix.Name{CommonName: name}.ToRDNSequence())
+		checkError(t, err, "failed to marshal name")
+		dirName, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 4, IsCompound: true, Bytes: rdns})
+		checkError(t, err, "failed to marshal directory name")
+		dirNames = append(dirNames, dirName...)
+	}
+	value, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: dirNames})
+	checkError(t, err, "failed to marshal subject alternative name")
+	return pkix.Extension{Id: asn1.ObjectIdentifier{2, 5, 29, 17}, Value: value}
+}
+
+func productExtensions(id int) []pkix.Extension {
+	name, _ := asn1.Marshal("Red Hat Enterprise Linux")
+	version, _ := asn1.Marshal("9.2")
+	return []pkix.Extension{
+		{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 2312, 9, 1, id, 1}, Value: name},
+		{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 2312, 9, 1, id, 2}, Value: version},
+	}
+}
+
+func writeCert(t *testing.T, path string, subject pkix.Name, extensions []pkix.Extension) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	checkError(t, err, "failed to generate key")
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         subject,
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: extensions,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	checkError(t, err, "failed to create certificate")
+	writeFile(t, path, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+type staticInfoProvider struct {
+	hi     *HostInfo
+	err    error
+	called int
+	fields []string // fields of the last LoadFields
+}
+
+func (sip *staticInfoProvider) Load(ctx context.Context) (*HostInfo, error) {
+	sip.called++
+	hi := *sip.hi
+	return &hi, sip.err
+}
+
+func (sip *staticInfoProvider) LoadFields(ctx context.Context, fields []string) (*HostInfo, error) {
+	sip.fields = fields
+	return sip.Load(ctx)
+}
+
+func (sip *staticInfoProvider) RefreshCpuCount(hi *HostInfo) error {
+	return nil
+}
@@ -3,32 +3,141 @@ package hostinfo
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"os/exec"
 	"strings"
+	"sync"
 
 	"github.com/RedHatInsights/host-metering/logger"
 )
 
-func LoadSubManInformation(hi *HostInfo) {
-	identity := GetSubManIdentity()
-	hi.HostId, _ = GetHostId(identity)
-	hi.HostName, _ = GetHostName(identity)
-	hi.ExternalOrganization, _ = GetExternalOrganization(identity)
+// LoadSubManInformation fills the host info from the output of
+// subscription-manager, values which failed to load are listed by the
+// returned *LoadError.
+func LoadSubManInformation(ctx context.Context, hi *HostInfo) error {
+	return loadSubManInformation(ctx, hi, DefaultBillingRules, execSubManCommand, Fields)
+}
+
+// subManCommand is an independent query of subscription-manager which loads
+// the fields of the host info from its output.
+type subManCommand struct {
+	args   []string
+	fields []string
+	parse  func(output string, hi *HostInfo, billing *BillingRules, loadErr *LoadError)
+}
+
+var subManCommands = []subManCommand{
+	{[]string{"identity"}, []string{"HostId", "HostName", "ExternalOrganization"}, parseIdentityOutput},
+	{[]string{"usage"}, []string{"Usage"}, parseUsageOutput},
+	{[]string{"service-level"}, []string{"Support"}, parseServiceLevelOutput},
+	{[]string{"facts"}, factsFields, parseFactsOutput},
+	{[]string{"list", "--installed"}, []string{"Product"}, parseProductOutput},
+	// Usage and service level have their own commands, also in older versions
+	{[]string{"syspurpose"}, []string{"Role", "Addons"}, parseSyspurposeCommandOutput},
+}
+
+// loadSubManInformation runs only the commands which load the named fields.
+func loadSubManInformation(ctx context.Context, hi *HostInfo, billing *BillingRules, exec subManExec, fields []string) error {
+	var commands []subManCommand
+	for _, command := range subManCommands {
+		for _, field := range command.fields {
+			if contains(fields, field) {
+				commands = append(commands, command)
+				break
+			}
+		}
+	}
+
+	outputs := make([]string, len(commands))
+	errs := make([]error, len(commands))
+	var wg sync.WaitGroup
+	for idx, command := range commands {
+		wg.Add(1)
+		go func(idx int, args []string) {
+			defer wg.Done()
+			outputs[idx], errs[idx] = exec(ctx, args...)
+		}(idx, command.args)
+	}
+	wg.Wait()
 
-	hi.Usage, _ = GetUsage()
-	hi.Support, _ = GetServiceLevel()
+	loadErr := &LoadError{}
+	for idx, command := range commands {
+		if errs[idx] != nil {
+			loadErr.Add(errs[idx], command.fields...)
+			continue
+		}
+		command.parse(outputs[idx], hi, billing, loadErr)
+	}
+	if hi.Product == nil && contains(fields, "Product") {
+		hi.Product = []string{}
+	}
+
+	return loadErr.ErrorOrNil()
+}
 
-	facts, _ := GetSubManFacts()
-	hi.SocketCount, _ = GetSocketCount(facts)
-	hi.Product, _ = GetProduct(facts)
+func parseIdentityOutput(output string, hi *HostInfo, billing *BillingRules, loadErr *LoadError) {
+	var err error
+	identity := parseSubManOutput(output)
+	if hi.HostId, err = GetHostId(identity); err != nil {
+		loadErr.Add(err, "HostId")
+	}
+	if hi.HostName, err = GetHostName(identity); err != nil {
+		loadErr.Add(err, "HostName")
+	}
+	if hi.ExternalOrganization, err = GetExternalOrganization(identity); err != nil {
+		loadErr.Add(err, "ExternalOrganization")
+	}
+}
+
+func parseUsageOutput(output string, hi *HostInfo, billing *BillingRules, loadErr *LoadError) {
+	var err error
+	if hi.Usage, err = parseUsage(output); err != nil {
+		loadErr.Add(err, "Usage")
+	}
+}
+
+func parseServiceLevelOutput(output string, hi *HostInfo, billing *BillingRules, loadErr *LoadError) {
+	var err error
+	if hi.Support, err = parseServiceLevel(output); err != nil {
+		loadErr.Add(err, "Support")
+	}
+}
+
+func parseFactsOutput(output string, hi *HostInfo, billing *BillingRules, loadErr *LoadError) {
+	var err error
+	facts := parseSubManOutput(output)
+	if hi.SocketCount, err = GetSocketCount(facts); err != nil {
+		loadErr.Add(err, "SocketCount")
+	}
+	// Only converted hosts and hosts of a marketplace have these
 	hi.ConversionsSuccess, _ = GetConversionsSuccess(facts)
-	hi.Billing, _ = GetBillingInfo(facts)
+	hi.Billing, _ = billing.BillingInfo(facts)
+	hi.Virt = GetVirtInfo(facts)
 }
 
-func GetSubManIdentity() SubManValues {
-	output, _ := execSubManCommand("identity")
-	return parseSubManOutput(output)
+func parseProductOutput(output string, hi *HostInfo, billing *BillingRules, loadErr *LoadError) {
+	var err error
+	if hi.Product, err = parseProduct(output); err != nil {
+		loadErr.Add(err, "Product")
+	}
+}
+
+func parseSyspurposeCommandOutput(output string, hi *HostInfo, billing *BillingRules, loadErr *LoadError) {
+	syspurpose, err := parseSyspurposeOutput(output)
+	if err != nil {
+		loadErr.Add(err, "Role", "Addons")
+		return
+	}
+	hi.Role, hi.Addons = syspurpose.Role, syspurpose.Addons
+}
+
+func GetSubManIdentity(ctx context.Context) (SubManValues, error) {
+	output, err := execSubManCommand(ctx, "identity")
+	if err != nil {
+		return SubManValues{}, err
+	}
+	return parseSubManOutput(output), nil
 }
 
 func GetHostId(identity SubManValues) (string, error) {
@@ -43,20 +152,43 @@ func GetExternalOrganization(identity SubManValues) (string, error) {
 	return identity.get("org ID")
 }
 
-func GetUsage() (string, error) {
-	output, _ := execSubManCommand("usage")
+func GetUsage(ctx context.Context) (string, error) {
+	output, err := execSubManCommand(ctx, "usage")
+	if err != nil {
+		return "", err
+	}
+	return parseUsage(output)
+}
+
+func parseUsage(output string) (string, error) {
 	values := parseSubManOutput(output)
+	if !values.has("Current Usage") && strings.Contains(output, "not set") {
+		return "", nil
+	}
 	return values.get("Current Usage")
 }
 
-func GetServiceLevel() (string, error) {
-	output, _ := execSubManCommand("service-level")
+func GetServiceLevel(ctx context.Context) (string, error) {
+	output, err := execSubManCommand(ctx, "service-level")
+	if err != nil {
+		return "", err
+	}
+	return parseServiceLevel(output)
+}
+
+func parseServiceLevel(output string) (string, error) {
 	values := parseSubManOutput(output)
+	if !values.has("Current service level") && strings.Contains(output, "not set") {
+		return "", nil
+	}
 	return values.get("Current service level")
 }
 
-func GetSubManFacts() (SubManValues, error) {
-	output, _ := execSubManCommand("facts")
+func GetSubManFacts(ctx context.Context) (SubManValues, error) {
+	output, err := execSubManCommand(ctx, "facts")
+	if err != nil {
+		return SubManValues{}, err
+	}
 	return parseSubManOutput(output), nil
 }
 
@@ -64,53 +196,55 @@ func GetSocketCount(facts SubManValues) (string, error) {
 	return facts.get("cpu.cpu_socket(s)")
 }
 
-func GetProduct(facts SubManValues) ([]string, error) {
-	output, _ := execSubManCommand("list", "--installed")
+func GetProduct(ctx context.Context, facts SubManValues) ([]string, error) {
+	output, err := execSubManCommand(ctx, "list", "--installed")
+	if err != nil {
+		return []string{}, err
+	}
+	return parseProduct(output)
+}
+
+func parseProduct(output string) ([]string, error) {
 	values := parseSubManOutputMultiVal(output)
 	return values.get("Product ID")
 }
 
-func GetConversionsSuccess(facts SubManValues) (string, error) {
-	value, err := facts.get("conversions.success")
-	if err == nil {
-		value = strings.ToLower(value)
+func GetSyspurpose(ctx context.Context) (*Syspurpose, error) {
+	output, err := execSubManCommand(ctx, "syspurpose")
+	if err != nil {
+		return nil, err
 	}
-	return value, err
+	return parseSyspurposeOutput(output)
 }
 
-func GetBillingInfo(facts SubManValues) (BillingInfo, error) {
-	bi := BillingInfo{
-		Model: "marketplace",
+// parseSyspurposeOutput parses the system purpose in JSON printed by
+// `subscription-manager syspurpose`.
+func parseSyspurposeOutput(output string) (*Syspurpose, error) {
+	start, end := strings.Index(output, "{"), strings.LastIndex(output, "}")
+	if start < 0 || end < start {
+		return nil, &ParseError{fmt.Errorf("syspurpose not found")}
 	}
-
-	if facts.has("aws_instance_id") {
-		bi.Marketplace = "aws"
-		bi.MarketplaceAccount, _ = facts.get("aws_account_id")
-		bi.MarketplaceInstanceId, _ = facts.get("aws_instance_id")
-		return bi, nil
-	}
-
-	if facts.has("azure_instance_id") {
-		bi.Marketplace = "azure"
-		bi.MarketplaceAccount, _ = facts.get("azure_subscription_id")
-		bi.MarketplaceInstanceId, _ = facts.get("azure_instance_id")
-		return bi, nil
+	syspurpose, err := parseSyspurpose([]byte(output[start : end+1]))
+	if err != nil {
+		return nil, &ParseError{fmt.Errorf("unable to parse syspurpose: %s", err.Error())}
 	}
+	return syspurpose, nil
+}
 
-	if facts.has("gcp_instance_id") {
-		bi.Marketplace = "gcp"
-		bi.MarketplaceAccount, _ = facts.get("gcp_project_number")
-		bi.MarketplaceInstanceId, _ = facts.get("gcp_instance_id")
-		return bi, nil
+func GetConversionsSuccess(facts SubManValues) (string, error) {
+	value, err := facts.get("conversions.success")
+	if err == nil {
+		value = strings.ToLower(value)
 	}
-
-	err := fmt.Errorf("unsupported or missing marketplace values")
-	logger.Errorf("Error getting billing info: %s", err.Error())
-	return BillingInfo{}, err
+	return value, err
 }
 
-func execSubManCommand(command ...string) (string, error) {
-	cmd := exec.Command("subscription-manager", command...)
+// subManExec runs subscription-manager with the arguments and returns its output.
+type subManExec func(ctx context.Context, command ...string) (string, error)
+
+// execSubManCommand runs subscription-manager, it is killed when the context is done.
+func execSubManCommand(ctx context.Context, command ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "subscription-manager", command...)
 	logger.Debugf("Executing `subscription-manager %s`...\n", command)
 
 	var stdout, stderr bytes.Buffer
@@ -118,7 +252,14 @@ func execSubManCommand(command ...string) (string, error) {
 	err := cmd.Run()
 
 	if err != nil {
-		err = fmt.Errorf("`subscription-manager %s` has failed: %s", command, err.Error())
+		// The command is killed when the context is done
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		err = fmt.Errorf("`subscription-manager %s` has failed: %w", command, err)
+		if strings.Contains(stdout.String()+stderr.String(), "not yet registered") {
+			err = &notRegisteredError{err}
+		}
 		logger.Debugf("Stdout: %s\n", strings.TrimSpace(stdout.String()))
 		logger.Debugf("Stderr: %s\n", strings.TrimSpace(stderr.String()))
 		logger.Errorf("Error executing subscription manager: %s", err.Error())
@@ -170,7 +311,7 @@ func (values SubManValues) get(name string) (string, error) {
 	v, ok := values[strings.ToLower(name)]
 
 	if !ok {
-		err := fmt.Errorf("`%s` not found", name)
+		err := &ParseError{fmt.Errorf("`%s` not found", name)}
 		logger.Warnf("Unable to get subscription info: %s", err.Error())
 		return "", err
 	}
@@ -224,7 +365,7 @@ func (values SubManMultiValues) get(name string) ([]string, error) {
 	v, ok := values[strings.ToLower(name)]
 
 	if !ok {
-		err := fmt.Errorf("`%s` not found", name)
+		err := &ParseError{fmt.Errorf("`%s` not found", name)}
 		logger.Warnf("Unable to get subscription info: %s", err.Error())
 		return []string{}, err
 	}
@@ -1,8 +1,14 @@
 package hostinfo
 
 import (
+	"context"
+	"errors"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestLoadSubManInformation(t *testing.T) {
@@ -15,7 +21,14 @@ func TestLoadSubManInformation(t *testing.T) {
 		Product:              []string{"394", "69"},
 		Support:              "Premium",
 		Usage:                "Production",
+		Role:                 "Red Hat Enterprise Linux Server",
+		Addons:               []string{"High Availability", "RHEL for SAP"},
 		ConversionsSuccess:   "true",
+		Virt: VirtInfo{
+			IsGuest:  "true",
+			HostType: "kvm",
+			UUID:     "ec2a1b2c-3d4e-5f60-7182-93a4b5c6d7e8",
+		},
 	}
 
 	// Test the host info for AWS.
@@ -57,7 +70,7 @@ func getHostInfo(t *testing.T, cloudProvider string) *HostInfo {
 	t.Setenv("CLOUD_PROVIDER", cloudProvider)
 
 	hostInfo := &HostInfo{}
-	LoadSubManInformation(hostInfo)
+	LoadSubManInformation(context.Background(), hostInfo)
 	t.Log(hostInfo.String())
 	return hostInfo
 }
@@ -83,6 +96,14 @@ func compareHostInfo(t *testing.T, hi *HostInfo, expected *HostInfo) {
 		t.Fatalf("an unexpected value of Usage: %v", hi.Usage)
 	}
 
+	if hi.Role != expected.Role {
+		t.Fatalf("an unexpected value of Role: %v", hi.Role)
+	}
+
+	if !reflect.DeepEqual(hi.Addons, expected.Addons) {
+		t.Fatalf("an unexpected value of Addons: %v", hi.Addons)
+	}
+
 	if hi.ConversionsSuccess != expected.ConversionsSuccess {
 		t.Fatalf("an unexpected value of ConversionsSuccess: %v", hi.ConversionsSuccess)
 	}
@@ -103,4 +124,189 @@ func compareHostInfo(t *testing.T, hi *HostInfo, expected *HostInfo) {
 		t.Fatalf("an unexpected value of MarketplaceInstanceId: %v", hi.Billing.MarketplaceInstanceId)
 	}
 
+	if hi.Virt != expected.Virt {
+		t.Fatalf("an unexpected value of Virt: %+v", hi.Virt)
+	}
+
+}
+
+// Test that only commands of the requested fields are run.
+func TestLoadSubManInformationFields(t *testing.T) {
+	var mu sync.Mutex
+	var commands []string
+	exec := func(ctx context.Context, command ...string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		commands = append(commands, strings.Join(command, " "))
+		return execSubManCommand(ctx, command...)
+	}
+
+	hi := &HostInfo{}
+	err := loadSubManInformation(context.Background(), hi, DefaultBillingRules, exec, []string{"HostName", "Product"})
+	checkError(t, err, "failed to load host info")
+	sort.Strings(commands)
+	if !reflect.DeepEqual(commands, []string{"identity", "list --installed"}) {
+		t.Fatalf("unexpected commands: %v", commands)
+	}
+	if hi.HostName != "host.mock.test" || len(hi.Product) != 2 || hi.SocketCount != "" {
+		t.Fatalf("expected only identity and products, got:\n%s", hi.String())
+	}
+}
+
+// Test that all values of the facts fail together with the command.
+func TestLoadSubManInformationFactsFailed(t *testing.T) {
+	exec := func(ctx context.Context, command ...string) (string, error) {
+		if command[0] == "facts" {
+			return "", context.DeadlineExceeded
+		}
+		return execSubManCommand(ctx, command...)
+	}
+
+	hi := &HostInfo{}
+	err := loadSubManInformation(context.Background(), hi, DefaultBillingRules, exec, Fields)
+	var loadErr *LoadError
+	if !errors.As(err, &loadErr) {
+		t.Fatalf("expected load error, got: %v", err)
+	}
+	for _, field := range []string{"SocketCount", "ConversionsSuccess", "Billing", "Virt", "CloudProvider"} {
+		if fe := loadErr.Field(field); fe == nil || fe.Reason != ReasonTimeout {
+			t.Fatalf("expected %s to time out, got: %v", field, fe)
+		}
+	}
+	if loadErr.Field("HostId") != nil {
+		t.Fatalf("unexpected failure of HostId: %v", loadErr)
+	}
+}
+
+func TestLoadSubManInformationNotRegistered(t *testing.T) {
+	// WARNING: This function requires ./test/bin in the PATH environment
+	// variable to run the mocked subscription manager.
+	t.Setenv("NOT_REGISTERED", "1")
+
+	hostInfo := &HostInfo{}
+	err := LoadSubManInformation(context.Background(), hostInfo)
+	var loadErr *LoadError
+	if !errors.As(err, &loadErr) {
+		t.Fatalf("expected load error, got: %v", err)
+	}
+
+	// Facts and products are available without registration
+	if hostInfo.SocketCount != "3" || len(hostInfo.Product) != 2 {
+		t.Fatalf("expected facts and products to be loaded:\n%s", hostInfo.String())
+	}
+	for _, field := range []string{"HostId", "HostName", "ExternalOrganization", "Usage", "Support"} {
+		fe := loadErr.Field(field)
+		if fe == nil || fe.Reason != ReasonNotRegistered {
+			t.Fatalf("expected %s to fail as not registered, got: %v", field, fe)
+		}
+	}
+	if len(loadErr.Fields) != 5 || !loadErr.Required() {
+		t.Fatalf("unexpected failures: %s", loadErr.Error())
+	}
+}
+
+func TestLoadSubManInformationCommandNotFound(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	err := LoadSubManInformation(context.Background(), &HostInfo{})
+	var loadErr *LoadError
+	if !errors.As(err, &loadErr) {
+		t.Fatalf("expected load error, got: %v", err)
+	}
+	for _, fe := range loadErr.Fields {
+		if fe.Reason != ReasonCommandNotFound {
+			t.Fatalf("expected command not found, got: %s", fe.Error())
+		}
+	}
+	if loadErr.Remediation() != "install subscription-manager" {
+		t.Fatalf("unexpected remediation: %s", loadErr.Remediation())
+	}
+}
+
+func TestSubManInfoProviderTimeout(t *testing.T) {
+	// WARNING: This function requires ./test/bin in the PATH environment
+	// variable to run the mocked subscription manager.
+	t.Setenv("HANG", "1")
+	provider := NewSubManInfoProvider(nil, nil, 200*time.Millisecond, 0)
+
+	// Commands run in parallel, so the load takes a single timeout
+	start := time.Now()
+	hi, err := provider.Load(context.Background())
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected hung commands to be killed, load took %s", elapsed)
+	}
+	var loadErr *LoadError
+	if hi == nil || !errors.As(err, &loadErr) {
+		t.Fatalf("expected partial host info with load error, got: %v, %v", hi, err)
+	}
+	for _, field := range []string{"HostId", "Usage", "Support", "SocketCount", "Product"} {
+		fe := loadErr.Field(field)
+		if fe == nil || fe.Reason != ReasonTimeout {
+			t.Fatalf("expected %s to time out, got: %v", field, fe)
+		}
+	}
+}
+
+func TestSubManInfoProviderCache(t *testing.T) {
+	// WARNING: This function requires ./test/bin in the PATH environment
+	// variable to run the mocked subscription manager.
+	provider := NewSubManInfoProvider(nil, nil, 200*time.Millisecond, time.Hour)
+	expected, err := provider.Load(context.Background())
+	checkError(t, err, "failed to load host info")
+
+	// Outputs of the previous load are used for failed commands
+	t.Setenv("HANG", "1")
+	hi, err := provider.Load(context.Background())
+	checkError(t, err, "failed to load host info from cache")
+	if !reflect.DeepEqual(hi, expected) {
+		t.Fatalf("expected cached host info, got:\n%s", hi.String())
+	}
+
+	// Outputs older than the TTL are not used
+	provider.CacheTTL = 0
+	if _, err := provider.Load(context.Background()); err == nil {
+		t.Fatalf("expected expired outputs not to be used")
+	}
+
+	// The identity of an unregistered host is dropped
+	provider.CacheTTL = time.Hour
+	t.Setenv("HANG", "")
+	_, err = provider.Load(context.Background())
+	checkError(t, err, "failed to load host info")
+	t.Setenv("NOT_REGISTERED", "1")
+	_, err = provider.Load(context.Background())
+	var loadErr *LoadError
+	if !errors.As(err, &loadErr) || loadErr.Field("HostId") == nil {
+		t.Fatalf("expected identity to fail as not registered, got: %v", err)
+	}
+	t.Setenv("NOT_REGISTERED", "")
+	t.Setenv("HANG", "1")
+	_, err = provider.Load(context.Background())
+	if !errors.As(err, &loadErr) || loadErr.Field("HostId") == nil || loadErr.Field("SocketCount") != nil {
+		t.Fatalf("expected only identity to fail, got: %v", err)
+	}
+}
+
+func TestParseSyspurposeOutput(t *testing.T) {
+	// Unset system purpose
+	syspurpose, err := parseSyspurposeOutput("{}\n")
+	checkError(t, err, "failed to parse syspurpose")
+	if syspurpose.Role != "" || !reflect.DeepEqual(syspurpose.Addons, []string{}) {
+		t.Fatalf("expected no role and addons, got: %v", syspurpose)
+	}
+
+	// Addons are sorted
+	syspurpose, err = parseSyspurposeOutput(`{"role": "Red Hat Enterprise Linux Server", "addons": ["RHEL for SAP", "High Availability"]}`)
+	checkError(t, err, "failed to parse syspurpose")
+	if syspurpose.Role != "Red Hat Enterprise Linux Server" ||
+		!reflect.DeepEqual(syspurpose.Addons, []string{"High Availability", "RHEL for SAP"}) {
+		t.Fatalf("unexpected syspurpose: %v", syspurpose)
+	}
+
+	// Older versions don't have the command
+	_, err = parseSyspurposeOutput("Unsupported command: syspurpose")
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("expected parse error, got: %v", err)
+	}
 }
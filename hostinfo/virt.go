@@ -0,0 +1,183 @@
+package hostinfo
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type VirtInfo struct {
+	IsGuest  string `json:"is_guest"`  // "true" or "false"
+	HostType string `json:"host_type"` // type of the hypervisor, e.g. kvm, vmware, hyperv
+	// UUID of the guest, by which virt-who maps it to its hypervisor. The
+	// guest has no identifier of the hypervisor itself.
+	UUID string `json:"uuid"`
+}
+
+// GetVirtInfo returns the virtualization of the host reported by the facts
+// of subscription-manager. Values are empty when the facts don't have them.
+func GetVirtInfo(facts SubManValues) VirtInfo {
+	vi := VirtInfo{}
+	if value, err := facts.get("virt.is_guest"); err == nil {
+		vi.IsGuest = strings.ToLower(value)
+	}
+	// Physical hosts have "Not Applicable"
+	if value, err := facts.get("virt.host_type"); err == nil && value != "Not Applicable" {
+		vi.HostType = strings.ToLower(value)
+	}
+	if value, err := facts.get("virt.uuid"); err == nil && value != "Unknown" {
+		vi.UUID = strings.ToLower(value)
+	}
+	return vi
+}
+
+// Platform detects the virtualization and the cloud provider of the host
+// from its DMI data and CPU flags, e.g. when subscription-manager doesn't
+// report them.
+type Platform struct {
+	DMIPath     string
+	CPUInfoPath string
+}
+
+// DefaultPlatform is used by providers without a platform.
+var DefaultPlatform = &Platform{
+	DMIPath:     "/sys/class/dmi/id",
+	CPUInfoPath: "/proc/cpuinfo",
+}
+
+// dmiRule matches a DMI attribute containing the value.
+type dmiRule struct {
+	attribute string
+	value     string
+	result    string
+}
+
+// dmiFacts are names of the facts of subscription-manager with the values
+// of DMI attributes.
+var dmiFacts = map[string]string{
+	"sys_vendor":        "dmi.system.manufacturer",
+	"product_name":      "dmi.system.product_name",
+	"product_uuid":      "dmi.system.uuid",
+	"bios_vendor":       "dmi.bios.vendor",
+	"bios_version":      "dmi.bios.version",
+	"chassis_asset_tag": "dmi.chassis.asset_tag",
+}
+
+// Hypervisors by DMI attributes, the first match wins.
+var hypervisorRules = []dmiRule{
+	{"sys_vendor", "QEMU", "kvm"},
+	{"product_name", "KVM", "kvm"},
+	{"sys_vendor", "Amazon EC2", "kvm"},
+	{"sys_vendor", "Google", "kvm"},
+	{"sys_vendor", "Alibaba Cloud", "kvm"},
+	{"sys_vendor", "Red Hat", "kvm"},
+	{"sys_vendor", "oVirt", "kvm"},
+	{"sys_vendor", "OpenStack", "kvm"},
+	{"sys_vendor", "Nutanix", "ahv"},
+	{"sys_vendor", "VMware", "vmware"},
+	{"product_name", "VirtualBox", "virtualbox"},
+	{"sys_vendor", "Parallels", "parallels"},
+	{"bios_vendor", "Xen", "xen"},
+	{"sys_vendor", "Xen", "xen"},
+	{"product_name", "Virtual Machine", "hyperv"},
+}
+
+// Cloud providers by DMI attributes, the first match wins.
+var cloudProviderRules = []dmiRule{
+	{"sys_vendor", "Amazon EC2", "aws"},
+	{"bios_version", "amazon", "aws"},
+	{"chassis_asset_tag", "7783-7084-3265-9085-8269-3286-77", "azure"},
+	{"product_name", "Google Compute Engine", "gcp"},
+	{"sys_vendor", "Alibaba Cloud", "alibaba"},
+	{"chassis_asset_tag", "OracleCloud.com", "oracle"},
+	{"chassis_asset_tag", "ibmcloud", "ibm"},
+}
+
+// Detect fills values of the virtualization which subscription-manager
+// didn't report and the cloud provider of the host. The cloud provider is
+// the marketplace of the billing info when the host has one.
+func (p *Platform) Detect(hi *HostInfo) {
+	dmi := readDMI(p.DMIPath)
+
+	if hi.Virt.HostType == "" {
+		hi.Virt.HostType = matchDMI(dmi, hypervisorRules)
+	}
+	if hi.Virt.IsGuest == "" {
+		hasFlag, err := hasHypervisorFlag(p.CPUInfoPath)
+		switch {
+		case hi.Virt.HostType != "" || hasFlag:
+			hi.Virt.IsGuest = "true"
+		case err == nil:
+			hi.Virt.IsGuest = "false"
+		}
+	}
+	if hi.Virt.UUID == "" && hi.Virt.IsGuest == "true" {
+		// Readable only by root
+		hi.Virt.UUID = strings.ToLower(dmi["product_uuid"])
+	}
+
+	hi.CloudProvider = hi.Billing.Marketplace
+	if hi.CloudProvider == "" {
+		hi.CloudProvider = matchDMI(dmi, cloudProviderRules)
+	}
+}
+
+// platform returns the platform of a provider, the default one if it has none.
+func platform(p *Platform) *Platform {
+	if p == nil {
+		return DefaultPlatform
+	}
+	return p
+}
+
+// readDMI returns DMI attributes which are readable.
+func readDMI(path string) map[string]string {
+	dmi := map[string]string{}
+	for _, attribute := range []string{
+		"sys_vendor", "product_name", "product_uuid", "bios_vendor", "bios_version", "chassis_asset_tag",
+	} {
+		data, err := os.ReadFile(filepath.Join(path, attribute))
+		if err == nil {
+			dmi[attribute] = strings.TrimSpace(string(data))
+		}
+	}
+	return dmi
+}
+
+func matchDMI(dmi map[string]string, rules []dmiRule) string {
+	for _, rule := range rules {
+		if strings.Contains(dmi[rule.attribute], rule.value) {
+			return rule.result
+		}
+	}
+	return ""
+}
+
+// hasHypervisorFlag tells whether the CPU has the hypervisor flag of cpuid,
+// which is set in virtual machines.
+func hasHypervisorFlag(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		name, value, found := strings.Cut(scanner.Text(), ":")
+		if found && strings.TrimSpace(name) == "flags" {
+			for _, flag := range strings.Fields(value) {
+				if flag == "hypervisor" {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+	return false, fmt.Errorf("%s: no CPU flags found", path)
+}
@@ -0,0 +1,68 @@
+package hostinfo
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPlatformDetect(t *testing.T) {
+	root := t.TempDir()
+	p := &Platform{DMIPath: filepath.Join(root, "dmi"), CPUInfoPath: filepath.Join(root, "cpuinfo")}
+	writeTree(t, root, map[string]string{
+		"dmi/sys_vendor":        "Microsoft Corporation\n",
+		"dmi/product_name":      "Virtual Machine\n",
+		"dmi/product_uuid":      "7A1B2C3D-0000-0000-0000-000000000000\n",
+		"dmi/chassis_asset_tag": "7783-7084-3265-9085-8269-3286-77\n",
+		"cpuinfo":               "processor\t: 0\nflags\t\t: fpu vme hypervisor\n",
+	})
+
+	// Values are detected when subscription-manager doesn't report them
+	hi := &HostInfo{}
+	p.Detect(hi)
+	expected := VirtInfo{IsGuest: "true", HostType: "hyperv", UUID: "7a1b2c3d-0000-0000-0000-000000000000"}
+	if hi.Virt != expected || hi.CloudProvider != "azure" {
+		t.Fatalf("unexpected platform: %+v, %s", hi.Virt, hi.CloudProvider)
+	}
+
+	// Values of subscription-manager and the marketplace take precedence
+	hi = &HostInfo{
+		Virt:    VirtInfo{IsGuest: "true", HostType: "xen, xen-hvm", UUID: "guest"},
+		Billing: BillingInfo{Marketplace: "aws"},
+	}
+	p.Detect(hi)
+	if hi.Virt.HostType != "xen, xen-hvm" || hi.Virt.UUID != "guest" || hi.CloudProvider != "aws" {
+		t.Fatalf("unexpected platform: %+v, %s", hi.Virt, hi.CloudProvider)
+	}
+}
+
+func TestPlatformDetectPhysical(t *testing.T) {
+	root := t.TempDir()
+	p := &Platform{DMIPath: filepath.Join(root, "dmi"), CPUInfoPath: filepath.Join(root, "cpuinfo")}
+	writeTree(t, root, map[string]string{
+		"dmi/sys_vendor":   "Dell Inc.\n",
+		"dmi/product_name": "PowerEdge R750\n",
+		"dmi/product_uuid": "4c4c4544-0000-0000-0000-000000000000\n",
+		"cpuinfo":          "processor\t: 0\nflags\t\t: fpu vme\n",
+	})
+
+	hi := &HostInfo{}
+	p.Detect(hi)
+	if hi.Virt != (VirtInfo{IsGuest: "false"}) || hi.CloudProvider != "" {
+		t.Fatalf("unexpected platform: %+v, %s", hi.Virt, hi.CloudProvider)
+	}
+
+	// Without CPU flags it is unknown whether the host is virtual
+	writeTree(t, root, map[string]string{"cpuinfo": "processor\t: 0\nFeatures\t: fp asimd\n"})
+	hi = &HostInfo{}
+	p.Detect(hi)
+	if hi.Virt.IsGuest != "" {
+		t.Fatalf("expected unknown virtualization, got: %+v", hi.Virt)
+	}
+}
+
+func TestGetVirtInfo(t *testing.T) {
+	vi := GetVirtInfo(SubManValues{"virt.host_type": "Not Applicable", "virt.is_guest": "False"})
+	if vi != (VirtInfo{IsGuest: "false"}) {
+		t.Fatalf("unexpected virtualization of physical host: %+v", vi)
+	}
+}
@@ -51,16 +51,25 @@ func InitLogger(file string, level string, instanceID string) error {
 		return err
 	}
 
-	logFile := os.Stderr
+	out := os.Stderr
 	if file != "" {
-		logFile, err = os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		out, err = os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
 	}
 	if err != nil {
 		return err
 	}
 
+	// Close the file of the previous logger when re-initialized
+	if logFile != nil {
+		logFile.Close()
+		logFile = nil
+	}
+	if file != "" {
+		logFile = out
+	}
+
 	log = &logrus.Logger{
-		Out:       logFile,
+		Out:       out,
 		Formatter: &CustomFormatter{},
 		Level:     logLevel,
 	}
@@ -79,6 +88,9 @@ func OverrideLogger(newInstance Logger) {
 
 var log Logger = nil
 
+// File opened by InitLogger, nil when logging to stderr.
+var logFile *os.File = nil
+
 func getLogger() Logger {
 	if log == nil {
 		log = InitDefaultLogger()
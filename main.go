@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
@@ -17,6 +19,13 @@ func main() {
 	flag.NewFlagSet("help", flag.ExitOnError)
 	flag.NewFlagSet("daemon", flag.ExitOnError)
 	flag.NewFlagSet("once", flag.ExitOnError)
+	flag.NewFlagSet("status", flag.ExitOnError)
+	labelsFlags := flag.NewFlagSet("labels", flag.ExitOnError)
+	explain := labelsFlags.Bool("explain", false, "Show values and modes of all labels of the host")
+	flag.NewFlagSet(daemon.ControlCommandFlush, flag.ExitOnError)
+	flag.NewFlagSet(daemon.ControlCommandReloadHostInfo, flag.ExitOnError)
+	flag.NewFlagSet(daemon.ControlCommandReloadConfig, flag.ExitOnError)
+	flag.NewFlagSet(daemon.ControlCommandDump, flag.ExitOnError)
 	flag.Parse()
 	args := flag.Args()
 
@@ -31,64 +40,125 @@ func main() {
 	case "help":
 		printUsage()
 	case "daemon", "once":
-		cfg := config.NewConfig()
-		var logMessages strings.Builder
+		cfg := loadConfig(*configPath)
 
-		logMessages.WriteString("Updating config from config file...\n")
-		err := cfg.UpdateFromConfigFile(*configPath)
+		d, err := daemon.NewDaemon(cfg)
 		if err != nil {
-			logMessages.WriteString(fmt.Sprintf("Failed to process file: %v\n", err.Error()))
+			logger.Errorf("Failed to create daemon: %v\n", err.Error())
+			os.Exit(1)
 		}
 
-		logMessages.WriteString("Updating config from environment variables...\n")
-		err = cfg.UpdateFromEnvVars()
-		if err != nil {
-			logMessages.WriteString(fmt.Sprintf("Failed to process variables: %v\n", err.Error()))
+		if command == "once" {
+			d.RunOnce()
+			return
 		}
+		d.SetConfigPath(*configPath)
+		d.Run()
+	case "status":
+		cfg := loadConfig(*configPath)
 
-		// initialize the logger according to the given configuration
-		err = logger.InitLogger(cfg.LogPath, cfg.LogLevel, cfg.InstanceID)
-
-		if err != nil {
-			logger.Debugf("Error initializing logger: %s\n", err.Error())
+		status := daemon.GetStatus(cfg)
+		fmt.Println(status.String())
+		if !status.Healthy() {
+			os.Exit(1)
 		}
+	case "labels":
+		if err := labelsFlags.Parse(args[1:]); err != nil {
+			os.Exit(1)
+		}
+		cfg := loadConfig(*configPath)
 
-		//Now that the logger is configured, we can report configuration state.
-		logger.Infoln(logMessages.String())
-
-		//print out the configuration
-		logger.Infoln(cfg.String())
-
-		cv := config.NewConfigValidator(cfg)
-		err = cv.Validate()
-		if err != nil {
-			logger.Errorf("Invalid configuration: %v\n", err.Error())
-			os.Exit(2)
+		labels := daemon.GetLabels(cfg)
+		fmt.Println(labels.String(*explain))
+		if labels.HostInfo == nil {
+			os.Exit(1)
 		}
+	case daemon.ControlCommandFlush, daemon.ControlCommandReloadHostInfo,
+		daemon.ControlCommandReloadConfig, daemon.ControlCommandDump:
+		cfg := loadConfig(*configPath)
 
-		d, err := daemon.NewDaemon(cfg)
+		if cfg.ControlSocketPath == "" {
+			fmt.Println("Error: control socket is disabled")
+			os.Exit(1)
+		}
+		response, err := daemon.SendControlCommand(cfg.ControlSocketPath, command)
 		if err != nil {
-			logger.Errorf("Failed to create daemon: %v\n", err.Error())
+			fmt.Printf("Error: %s\n", err.Error())
 			os.Exit(1)
 		}
-
-		if command == "once" {
-			d.RunOnce()
-			return
+		if len(response.Data) > 0 {
+			var data bytes.Buffer
+			if err := json.Indent(&data, response.Data, "", "  "); err == nil {
+				fmt.Println(data.String())
+			}
+		}
+		if response.Error != "" {
+			fmt.Printf("Error: %s\n", response.Error)
+			os.Exit(1)
 		}
-		d.Run()
 	default:
 		fmt.Println("Error: unknown subcommand", command)
 		printUsage()
 	}
 }
 
+// loadConfig loads, reports and validates the configuration and initializes
+// the logger accordingly. It exits the program on invalid configuration.
+func loadConfig(configPath string) *config.Config {
+	cfg := config.NewConfig()
+	var logMessages strings.Builder
+
+	logMessages.WriteString("Updating config from config file...\n")
+	err := cfg.UpdateFromConfigFile(configPath)
+	if err != nil {
+		logMessages.WriteString(fmt.Sprintf("Failed to process file: %v\n", err.Error()))
+	}
+
+	logMessages.WriteString("Updating config from environment variables...\n")
+	err = cfg.UpdateFromEnvVars()
+	if err != nil {
+		logMessages.WriteString(fmt.Sprintf("Failed to process variables: %v\n", err.Error()))
+	}
+
+	// initialize the logger according to the given configuration
+	err = logger.InitLogger(cfg.LogPath, cfg.LogLevel, cfg.InstanceID)
+
+	if err != nil {
+		logger.Debugf("Error initializing logger: %s\n", err.Error())
+	}
+
+	//Now that the logger is configured, we can report configuration state.
+	logger.Infoln(logMessages.String())
+
+	//print out the configuration
+	logger.Infoln(cfg.String())
+
+	cv := config.NewConfigValidator(cfg)
+	err = cv.Validate()
+	if err != nil {
+		logger.Errorf("Invalid configuration: %v\n", err.Error())
+		os.Exit(2)
+	}
+
+	return cfg
+}
+
 func printUsage() {
 	fmt.Println("Usage: host-metering [OPTIONS] SUBCOMMAND")
 	fmt.Println("Options:")
 	flag.PrintDefaults()
 	fmt.Println("Subcommands:")
-	fmt.Println("  daemon    Run in daemon mode")
-	fmt.Println("  once      Execute once")
-	fmt.Println("  help      Print this help message")
+	fmt.Println("  daemon            Run in daemon mode")
+	fmt.Println("  once              Execute once")
+	fmt.Println("  status            Print status of host-metering")
+	fmt.Println("  labels [--explain]")
+	fmt.Println("                    Print labels sent to every endpoint, --explain shows")
+	fmt.Println("                    values and modes of all labels of the host")
+	fmt.Println("  flush             Collect and send metrics immediately")
+	fmt.Println("  reload-hostinfo   Reload host information")
+	fmt.Println("  reload-config     Reload configuration")
+	fmt.Println("  dump              Print configuration, host information and metrics log statistics")
+	fmt.Println("  help              Print this help message")
+	fmt.Println("The flush, reload-hostinfo, reload-config and dump subcommands")
+	fmt.Println("are sent to the running daemon over its control socket.")
 }
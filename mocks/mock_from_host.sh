@@ -11,6 +11,8 @@ echo running subscription-manager service-level
 sudo subscription-manager service-level > subscription-manager-service-level
 echo running subscription-manager facts
 sudo subscription-manager facts > subscription-manager-facts
+echo running subscription-manager syspurpose
+sudo subscription-manager syspurpose > subscription-manager-syspurpose
 
 echo preparing /etc/pki/consumer
 sudo cp -r /etc/pki/consumer ./
@@ -0,0 +1,230 @@
+package notify
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/RedHatInsights/host-metering/config"
+	"github.com/RedHatInsights/host-metering/logger"
+)
+
+// Should be used only for testing
+var tlsInsecureSkipVerify = false
+
+// newHostHttpClient creates HTTP client authenticated by the host certificate.
+func newHostHttpClient(cfg *config.Config) (*http.Client, error) {
+	keypair, err := LoadHostCert(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMTLSHttpClient(keypair, cfg.WriteTimeout)
+}
+
+// httpClientHolder holds the HTTP client of a notifier. The client is
+// authenticated by the certificate, or by the host certificate of the
+// configuration if it is nil, and it is created again after the host changed.
+type httpClientHolder struct {
+	cfg  *config.Config
+	cert *tls.Certificate
+	// mu guards the client, HostChanged may be called while notifying.
+	mu     sync.Mutex
+	valid  bool
+	client *http.Client
+}
+
+func newHttpClientHolder(cfg *config.Config, cert *tls.Certificate) *httpClientHolder {
+	return &httpClientHolder{cfg: cfg, cert: cert}
+}
+
+// get returns the client, it is created again if the host changed.
+func (h *httpClientHolder) get() (*http.Client, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.valid || h.client == nil {
+		var client *http.Client
+		var err error
+		if h.cert != nil {
+			client, err = newMTLSHttpClient(*h.cert, h.cfg.WriteTimeout)
+		} else {
+			client, err = newHostHttpClient(h.cfg)
+		}
+		if err != nil {
+			return nil, err
+		}
+		h.client = client
+		h.valid = true
+	}
+	return h.client, nil
+}
+
+func (h *httpClientHolder) HostChanged() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.valid = false
+}
+
+// LoadHostCert loads the host certificate and its key.
+func LoadHostCert(cfg *config.Config) (tls.Certificate, error) {
+	return tls.LoadX509KeyPair(cfg.HostCertPath, cfg.HostCertKeyPath)
+}
+
+func newMTLSHttpClient(keypair tls.Certificate, timeout time.Duration) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		Certificates:       []tls.Certificate{keypair},
+		InsecureSkipVerify: tlsInsecureSkipVerify,
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			TLSClientConfig:       tlsConfig,
+			MaxIdleConns:          2,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}, nil
+}
+
+// writeWithRetries sends the request and retries it on server errors and
+// throttling. The response of a successful request is returned together
+// with its body. Waiting between retries ends when the context is done.
+func writeWithRetries(ctx context.Context, httpClient *http.Client, cfg *config.Config, httpRequest *http.Request, name string) (
+	*http.Response, []byte, error) {
+	var attempt uint = 0
+
+	for attempt < cfg.WriteRetryAttempts {
+		request, err := newAttemptRequest(ctx, httpRequest)
+		if err != nil {
+			return nil, nil, RecoverableError(err)
+		}
+		resp, err := httpClient.Do(request)
+
+		if err != nil {
+			return nil, nil, RecoverableError(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode/100 == 2 {
+			return resp, body, nil // success
+		}
+		if err == nil {
+			logger.Debugf("%s: Response body: %s\n", name, string(body))
+		}
+
+		if resp.StatusCode/100 == 5 || resp.StatusCode == 429 {
+			attempt++
+			retryWait, ok := retryAfter(resp, cfg.WriteRetryMaxInt)
+			if !ok {
+				retryWait = retryBackoff(attempt, cfg.WriteRetryMinInt, cfg.WriteRetryMaxInt)
+			}
+
+			logger.Infof("%s: Http Error: %d, retrying in %s\n", name, resp.StatusCode, retryWait)
+			if err := sleep(ctx, retryWait); err != nil {
+				return nil, nil, RecoverableError(err)
+			}
+			continue
+		}
+		if resp.StatusCode/100 == 4 {
+			return nil, nil, NonRecoverableError(fmt.Errorf("http Error: %d", resp.StatusCode))
+		}
+		return nil, nil, NonRecoverableError(fmt.Errorf("unexpected Http Status: %d", resp.StatusCode))
+	}
+
+	return nil, nil, RecoverableError(fmt.Errorf("failed after %d attempts", attempt))
+}
+
+// newAttemptRequest returns a copy of the request with the context and
+// with a new body, as the body of a previous attempt was already read.
+func newAttemptRequest(ctx context.Context, httpRequest *http.Request) (*http.Request, error) {
+	request := httpRequest.WithContext(ctx)
+	if httpRequest.GetBody != nil {
+		body, err := httpRequest.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		request.Body = body
+	}
+	return request, nil
+}
+
+// retryAfter returns the wait requested by the Retry-After header of the
+// response, limited by maxWait. The header is either a number of seconds
+// or an HTTP date.
+func retryAfter(resp *http.Response, maxWait time.Duration) (time.Duration, bool) {
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+
+	var wait time.Duration
+	if seconds, err := strconv.ParseUint(header, 10, 32); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		wait = time.Until(date)
+	} else {
+		logger.Debugf("Invalid Retry-After header: %s\n", header)
+		return 0, false
+	}
+
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+	return wait, true
+}
+
+// retryBackoff returns a random wait before the attempt (counted from 1).
+// The wait is jittered over the whole range between minWait and an exponential
+// backoff limited by maxWait, so that hosts failing at the same time don't
+// retry at the same time.
+func retryBackoff(attempt uint, minWait time.Duration, maxWait time.Duration) time.Duration {
+	backoff := minWait
+	for i := uint(0); i < attempt && backoff < maxWait; i++ {
+		backoff *= 2
+	}
+	if backoff > maxWait {
+		backoff = maxWait
+	}
+	if backoff <= minWait {
+		return minWait
+	}
+	return minWait + RandomDuration(backoff-minWait)
+}
+
+var (
+	randomMu sync.Mutex
+	random   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// RandomDuration returns a random duration in the interval [0, max).
+func RandomDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	randomMu.Lock()
+	defer randomMu.Unlock()
+	return time.Duration(random.Int63n(int64(max)))
+}
+
+// sleep waits for the duration or until the context is done.
+func sleep(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,173 @@
+package notify
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RedHatInsights/host-metering/config"
+)
+
+// Test that http client follows the environment Proxy settings
+//
+//   - this test is fragile as it is influenced by the environment as ProxyFromEnvironment
+//     is initialized only once, thus if any test before uses it without the env vars set then
+//     this will fail.
+func TestHttpClientProxy(t *testing.T) {
+	// Init
+	keypair, _, _, _ := createTestKeypair(t)
+	httpProxy := "http://proxy.example.com"
+	httpsProxy := "https://proxy.example.com"
+
+	t.Setenv("HTTP_PROXY", httpProxy)
+	t.Setenv("HTTPS_PROXY", httpsProxy)
+	client, err := newMTLSHttpClient(keypair, 1*time.Second)
+	checkError(t, err, "Failed to create http client")
+	proxyF := client.Transport.(*http.Transport).Proxy
+	if proxyF == nil {
+		t.Fatalf("Expected proxy function to be set")
+	}
+
+	// Test https proxy
+	httpsRequest, _ := http.NewRequest("GET", "https://example.com", nil)
+	checkError(t, err, "Failed to create http request")
+	proxyUrl, _ := proxyF(httpsRequest)
+	checkError(t, err, "Failed to get proxy url")
+	if proxyUrl == nil {
+		t.Fatalf("Expected proxy url to be set")
+	}
+	if proxyUrl.String() != httpsProxy {
+		t.Fatalf("Expected https proxy to be %s, got %s", httpsProxy, proxyUrl.String())
+	}
+
+	// Test http proxy
+	httpRequest, _ := http.NewRequest("GET", "http://example.com", nil)
+	proxyUrl, _ = proxyF(httpRequest)
+	if proxyUrl.String() != httpProxy {
+		t.Fatalf("Expected http proxy to be %s, got %s", httpProxy, proxyUrl.String())
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	maxWait := 10 * time.Second
+	testCases := []struct {
+		header   string
+		expected time.Duration
+		ok       bool
+	}{
+		{"", 0, false},
+		{"invalid", 0, false},
+		{"-1", 0, false},
+		{"3", 3 * time.Second, true},
+		{"120", maxWait, true},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, true},
+		{time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), maxWait, true},
+	}
+
+	for _, tc := range testCases {
+		resp := &http.Response{Header: http.Header{}}
+		if tc.header != "" {
+			resp.Header.Set("Retry-After", tc.header)
+		}
+		wait, ok := retryAfter(resp, maxWait)
+		if wait != tc.expected || ok != tc.ok {
+			t.Fatalf("Expected wait %s (%t) for Retry-After: %s, got %s (%t)",
+				tc.expected, tc.ok, tc.header, wait, ok)
+		}
+	}
+
+	// HTTP date in the near future
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("Retry-After", time.Now().Add(5*time.Second).UTC().Format(http.TimeFormat))
+	wait, ok := retryAfter(resp, maxWait)
+	if !ok || wait <= 3*time.Second || wait > 5*time.Second {
+		t.Fatalf("Expected wait about 5s, got %s", wait)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	minWait := 1 * time.Second
+	maxWait := 10 * time.Second
+	testCases := []struct {
+		attempt uint
+		backoff time.Duration
+	}{
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+		{4, maxWait},
+		{100, maxWait},
+	}
+
+	for _, tc := range testCases {
+		for i := 0; i < 100; i++ {
+			wait := retryBackoff(tc.attempt, minWait, maxWait)
+			if wait < minWait || wait > tc.backoff {
+				t.Fatalf("Expected wait of attempt %d between %s and %s, got %s",
+					tc.attempt, minWait, tc.backoff, wait)
+			}
+		}
+	}
+
+	// No jitter without a range
+	if wait := retryBackoff(1, maxWait, maxWait); wait != maxWait {
+		t.Fatalf("Expected wait %s, got %s", maxWait, wait)
+	}
+}
+
+// Test that the request body is sent again on retries and that the server
+// is asked again after the time requested by Retry-After
+func TestWriteRetries(t *testing.T) {
+	var bodies []string
+	var times []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		times = append(times, time.Now())
+		if len(bodies) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+	cfg := &config.Config{
+		WriteRetryAttempts: 2,
+		WriteRetryMinInt:   1 * time.Millisecond,
+		WriteRetryMaxInt:   50 * time.Millisecond,
+	}
+	request, _ := http.NewRequest("POST", server.URL, strings.NewReader("data"))
+
+	_, _, err := writeWithRetries(context.Background(), server.Client(), cfg, request, "Test")
+	checkError(t, err, "Failed to send request")
+	if len(bodies) != 2 || bodies[0] != "data" || bodies[1] != "data" {
+		t.Fatalf("Expected the body to be sent twice, got %v", bodies)
+	}
+	if times[1].Sub(times[0]) < cfg.WriteRetryMaxInt {
+		t.Fatalf("Expected Retry-After limited to %s to be honored, got %s",
+			cfg.WriteRetryMaxInt, times[1].Sub(times[0]))
+	}
+}
+
+// Test that waiting for a retry is interrupted when the context is done
+func TestWriteRetriesInterrupted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	cfg := &config.Config{
+		WriteRetryAttempts: 2,
+		WriteRetryMinInt:   1 * time.Hour,
+		WriteRetryMaxInt:   1 * time.Hour,
+	}
+	request, _ := http.NewRequest("POST", server.URL, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err := writeWithRetries(ctx, server.Client(), cfg, request, "Test")
+	checkExpectedErrorContains(t, err, context.DeadlineExceeded.Error())
+	checkRecoverable(t, err)
+}
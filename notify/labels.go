@@ -0,0 +1,368 @@
+package notify
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/RedHatInsights/host-metering/config"
+	"github.com/RedHatInsights/host-metering/hostinfo"
+	"github.com/RedHatInsights/host-metering/logger"
+)
+
+// HostInfoLabels returns labels describing the host sorted by name.
+func HostInfoLabels(hostinfo *hostinfo.HostInfo) []prompb.Label {
+	if hostinfo == nil {
+		return nil
+	}
+
+	// Labels must be sorted by name
+	return []prompb.Label{
+		{
+			Name:  "_id",
+			Value: hostinfo.HostId,
+		},
+		{
+			Name:  "addons",
+			Value: strings.Join(hostinfo.Addons, ","),
+		},
+		{
+			Name:  "billing_marketplace",
+			Value: hostinfo.Billing.Marketplace,
+		},
+		{
+			Name:  "billing_marketplace_account",
+			Value: hostinfo.Billing.MarketplaceAccount,
+		},
+		{
+			Name:  "billing_marketplace_instance_id",
+			Value: hostinfo.Billing.MarketplaceInstanceId,
+		},
+		{
+			Name:  "billing_model",
+			Value: hostinfo.Billing.Model,
+		},
+		{
+			Name:  "cloud_provider",
+			Value: hostinfo.CloudProvider,
+		},
+		{
+			Name:  "conversions_success",
+			Value: hostinfo.ConversionsSuccess,
+		},
+		{
+			Name:  "cpu_count_mode",
+			Value: cpuCountModeLabel(hostinfo.CpuCountMode),
+		},
+		{
+			Name:  "display_name",
+			Value: hostinfo.HostName,
+		},
+		{
+			Name:  "external_organization",
+			Value: hostinfo.ExternalOrganization,
+		},
+		{
+			Name:  "product",
+			Value: strings.Join(hostinfo.Product, ","),
+		},
+		{
+			Name:  "role",
+			Value: hostinfo.Role,
+		},
+		{
+			Name:  "socket_count",
+			Value: hostinfo.SocketCount,
+		},
+		{
+			Name:  "support",
+			Value: hostinfo.Support,
+		},
+		{
+			Name:  "usage",
+			Value: hostinfo.Usage,
+		},
+		{
+			Name:  "virt_host_type",
+			Value: hostinfo.Virt.HostType,
+		},
+		{
+			Name:  "virt_is_guest",
+			Value: hostinfo.Virt.IsGuest,
+		},
+		{
+			Name:  "virt_uuid",
+			Value: hostinfo.Virt.UUID,
+		},
+	}
+}
+
+// cpuCountModeLabel returns the value of the cpu_count_mode label, empty for
+// the default mode so that series of hosts counting online CPUs continue the
+// ones sent before the label existed.
+func cpuCountModeLabel(mode string) string {
+	if mode == string(hostinfo.CPUCountModeOnline) {
+		return ""
+	}
+	return mode
+}
+
+// MergeLabels merges two lists of labels sorted by name into one sorted list.
+// Labels of the series take precedence over labels with the same name
+// from the other list.
+func MergeLabels(seriesLabels []prompb.Label, labels []prompb.Label) []prompb.Label {
+	result := make([]prompb.Label, 0, len(seriesLabels)+len(labels))
+	i, j := 0, 0
+	for i < len(seriesLabels) || j < len(labels) {
+		switch {
+		case j >= len(labels) || (i < len(seriesLabels) && seriesLabels[i].Name < labels[j].Name):
+			result = append(result, seriesLabels[i])
+			i++
+		case i >= len(seriesLabels) || labels[j].Name < seriesLabels[i].Name:
+			result = append(result, labels[j])
+			j++
+		default:
+			result = append(result, seriesLabels[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// labelProcessor prepares labels of series for sending to an endpoint.
+type labelProcessor struct {
+	static   []prompb.Label // sorted by name
+	relabels []*relabel.Config
+	allow    []string
+	deny     []string
+	// labels of the drop and hash modes, they are applied before relabeling
+	// so that rules don't copy values which must not be sent
+	dropped []string
+	hashed  map[string]bool
+	// key of hashed labels, nil if it failed to load
+	hashKey []byte
+	// invalid names which were already reported
+	invalid map[string]bool
+}
+
+func newLabelProcessor(cfg *config.Config) *labelProcessor {
+	p := &labelProcessor{
+		allow:   cfg.LabelsAllow,
+		hashed:  make(map[string]bool),
+		invalid: make(map[string]bool),
+	}
+	for _, name := range sortedNames(cfg.LabelModes) {
+		switch cfg.LabelModes[name] {
+		case config.LabelModeDrop:
+			p.dropped = append(p.dropped, name)
+		case config.LabelModeHash:
+			p.hashed[name] = true
+		}
+	}
+	for _, name := range cfg.LabelsDeny {
+		if name != "__name__" {
+			p.deny = append(p.deny, name)
+		}
+	}
+	for name, value := range cfg.Labels {
+		p.static = append(p.static, prompb.Label{Name: name, Value: value})
+	}
+	sortLabels(p.static)
+	for _, r := range cfg.Relabels {
+		relabelConfig, err := r.RelabelConfig()
+		if err != nil {
+			logger.Warnf("Skipping %s\n", err.Error())
+			continue
+		}
+		p.relabels = append(p.relabels, relabelConfig)
+	}
+	if cfg.SendHostname == config.SendHostnameNo {
+		p.deny = append(p.deny, "display_name")
+	}
+	if len(p.hashed) > 0 {
+		var err error
+		p.hashKey, err = LoadLabelHashKey(cfg.LabelHashKeyPath)
+		if err != nil {
+			// Values of hashed labels must not be sent in clear
+			logger.Warnf("Dropping hashed labels: %s\n", err.Error())
+		}
+	}
+	return p
+}
+
+// labelProcessorHolder holds the label processor of a notifier, it is
+// created again after the host or the configuration changed, e.g. to load
+// the hash key or relabel rules of a reloaded configuration.
+type labelProcessorHolder struct {
+	cfg *config.Config
+	// mu guards the processor, HostChanged may be called while notifying.
+	mu        sync.Mutex
+	processor *labelProcessor
+}
+
+func newLabelProcessorHolder(cfg *config.Config) *labelProcessorHolder {
+	return &labelProcessorHolder{cfg: cfg}
+}
+
+// get returns the processor, it is created again if the host changed.
+func (h *labelProcessorHolder) get() *labelProcessor {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.processor == nil {
+		h.processor = newLabelProcessor(h.cfg)
+	}
+	return h.processor
+}
+
+func (h *labelProcessorHolder) HostChanged() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.processor = nil
+}
+
+// process returns labels of a series to send. Empty labels are dropped,
+// static labels are added, labels of the drop mode are dropped, values of
+// hashed labels are replaced by their digests, labels are relabeled,
+// filtered by the allow and deny lists, sorted and labels with invalid
+// names are dropped. The metric name is always kept.
+func (p *labelProcessor) process(seriesLabels []prompb.Label) []prompb.Label {
+	result := filterEmptyLabels(seriesLabels)
+	result = MergeLabels(result, p.static)
+	result = filterOutLabelsByName(result, p.dropped)
+	if len(p.hashed) > 0 {
+		result = p.hash(result)
+	}
+	if len(p.relabels) > 0 {
+		result = p.relabel(result)
+	}
+	if len(p.allow) > 0 {
+		result = filterLabelsByName(result, append([]string{"__name__"}, p.allow...))
+	}
+	result = filterOutLabelsByName(result, p.deny)
+	sortLabels(result)
+
+	valid := result[:0]
+	for _, label := range result {
+		if label.Name != "__name__" && !config.IsValidLabelName(label.Name) {
+			if !p.invalid[label.Name] {
+				logger.Warnf("Dropping label with invalid name: %s\n", label.Name)
+				p.invalid[label.Name] = true
+			}
+			continue
+		}
+		valid = append(valid, label)
+	}
+	return valid
+}
+
+func (p *labelProcessor) relabel(seriesLabels []prompb.Label) []prompb.Label {
+	builder := labels.NewScratchBuilder(len(seriesLabels))
+	var name string
+	for _, label := range seriesLabels {
+		if label.Name == "__name__" {
+			name = label.Value
+		}
+		builder.Add(label.Name, label.Value)
+	}
+	builder.Sort()
+
+	relabeled, _ := relabel.Process(builder.Labels(), p.relabels...)
+	// Relabeling must not change the metric
+	result := make([]prompb.Label, 0, relabeled.Len()+1)
+	if name != "" {
+		result = append(result, prompb.Label{Name: "__name__", Value: name})
+	}
+	relabeled.Range(func(label labels.Label) {
+		if label.Name != "__name__" {
+			result = append(result, prompb.Label{Name: label.Name, Value: label.Value})
+		}
+	})
+	return result
+}
+
+// hash replaces values of hashed labels by their digests, the labels
+// are dropped when there is no key.
+func (p *labelProcessor) hash(seriesLabels []prompb.Label) []prompb.Label {
+	result := make([]prompb.Label, 0, len(seriesLabels))
+	for _, label := range seriesLabels {
+		if p.hashed[label.Name] && label.Name != "__name__" {
+			if p.hashKey == nil {
+				continue
+			}
+			label.Value = hashLabelValue(p.hashKey, label.Value)
+		}
+		result = append(result, label)
+	}
+	return result
+}
+
+// isStaticLabel tells whether the name is of a static label.
+func (p *labelProcessor) isStaticLabel(name string) bool {
+	for _, label := range p.static {
+		if label.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func sortLabels(labels []prompb.Label) {
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+}
+
+func sortedNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LabelExplanation describes how a label of a series is sent.
+type LabelExplanation struct {
+	Name  string
+	Value string // value of the series, empty for added labels
+	// Mode is one of config.LabelModeSend, config.LabelModeDrop and
+	// config.LabelModeHash, or "add" for labels added to the series.
+	Mode      string
+	SentValue string
+}
+
+// ExplainLabels tells how labels of the series are sent to the endpoint
+// of the configuration, sorted by name.
+func ExplainLabels(cfg *config.Config, seriesLabels []prompb.Label) []LabelExplanation {
+	p := newLabelProcessor(cfg)
+	sent := make(map[string]string)
+	for _, label := range p.process(seriesLabels) {
+		sent[label.Name] = label.Value
+	}
+
+	var explanations []LabelExplanation
+	for _, label := range seriesLabels {
+		explanation := LabelExplanation{Name: label.Name, Value: label.Value, Mode: config.LabelModeDrop}
+		if value, ok := sent[label.Name]; ok {
+			explanation.Mode = config.LabelModeSend
+			if p.hashed[label.Name] && label.Name != "__name__" {
+				explanation.Mode = config.LabelModeHash
+			}
+			explanation.SentValue = value
+			delete(sent, label.Name)
+		}
+		explanations = append(explanations, explanation)
+	}
+	for name, value := range sent {
+		explanations = append(explanations, LabelExplanation{Name: name, Mode: "add", SentValue: value})
+	}
+	sort.Slice(explanations, func(i, j int) bool {
+		return explanations[i].Name < explanations[j].Name
+	})
+	return explanations
+}
@@ -2,9 +2,14 @@ package notify
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/tidwall/wal"
 )
@@ -31,47 +36,101 @@ func NewMetricsLog(path string) (*MetricsLog, error) {
 	}, nil
 }
 
+// WAL record formats. Records written before series were stored contain
+// only a marshalled prompb.Sample of system_cpu_logical_count, they are
+// recognized by a missing version prefix.
+const (
+	recordVersionSeries byte = 0x01
+)
+
+// Name of the series stored in records without a version prefix.
+const legacyMetricName = "system_cpu_logical_count"
+
 func (log *MetricsLog) WriteSampleNow(cpuCount uint) error {
 	return log.WriteSample(cpuCount, time.Now().UnixMilli())
 }
 
+// WriteSample writes a sample of the logical CPU count.
 func (log *MetricsLog) WriteSample(cpuCount uint, timestamp int64) error {
+	return log.WriteSeries([]prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: legacyMetricName}},
+			Samples: []prompb.Sample{{Value: float64(cpuCount), Timestamp: timestamp}},
+		},
+	})
+}
+
+// WriteSeries writes every sample of the series as a separate record
+// together with the series labels.
+func (log *MetricsLog) WriteSeries(series []prompb.TimeSeries) error {
 	log.mu.Lock()
 	defer log.mu.Unlock()
 
-	sample := &prompb.Sample{
-		Value:     float64(cpuCount),
-		Timestamp: timestamp,
+	index, err := log.wal.LastIndex()
+	if err != nil {
+		return err
+	}
+
+	batch := &wal.Batch{}
+	for _, ts := range series {
+		for _, sample := range ts.Samples {
+			record := &prompb.TimeSeries{
+				Labels:  ts.Labels,
+				Samples: []prompb.Sample{sample},
+			}
+			data, err := record.Marshal()
+			if err != nil {
+				return err
+			}
+			index++
+			batch.Write(index, append([]byte{recordVersionSeries}, data...))
+		}
 	}
 
-	return log.writeSample(sample)
+	return log.wal.WriteBatch(batch)
 }
 
-func (log *MetricsLog) writeSample(sample *prompb.Sample) error {
-	// Serialize the sample to get data.
-	data, err := sample.Marshal()
-	if err != nil {
-		return err
-	}
+// GetSamples returns samples up to a newly created checkpoint grouped
+// by series. Series are ordered by their first sample. Default labels
+// are added to records which were written without them, e.g. labels of
+// the host to records written by older versions.
+func (log *MetricsLog) GetSamples(defaultLabels []prompb.Label) (series []prompb.TimeSeries, checkpoint uint64, err error) {
+	return log.GetSamplesFrom(0, defaultLabels)
+}
 
-	// Write data at the end of the log.
-	index, err := log.wal.LastIndex()
+// GetSamplesFrom is like GetSamples, but returns only samples at or after
+// the cursor, i.e. a checkpoint previously returned to the reader. Cursors
+// which are not within the log (e.g. the log was recreated) are ignored.
+func (log *MetricsLog) GetSamplesFrom(cursor uint64, defaultLabels []prompb.Label) (series []prompb.TimeSeries, checkpoint uint64, err error) {
+	chunks, err := log.GetChunksFrom(cursor, defaultLabels, 0, 0)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
+	return chunks[0].Series, chunks[0].Checkpoint, nil
+}
 
-	return log.wal.Write(index+1, data)
+// Chunk is a part of the samples in the log. Checkpoint is the cursor
+// following the samples of the chunk.
+type Chunk struct {
+	Series     []prompb.TimeSeries
+	Checkpoint uint64
 }
 
-func (log *MetricsLog) GetSamples() (samples []prompb.Sample, checkpoint uint64, err error) {
+// GetChunksFrom is like GetSamplesFrom, but splits the samples into chunks
+// in the order of the log. A chunk has at most maxSamples samples and its
+// series take at most maxBytes when encoded in a write request, but it has
+// always at least one sample. Zero limit means no limit. There is always
+// at least one chunk and the checkpoint of the last one is the newly
+// created checkpoint.
+func (log *MetricsLog) GetChunksFrom(cursor uint64, defaultLabels []prompb.Label, maxSamples uint, maxBytes uint) ([]Chunk, error) {
 	log.mu.Lock()
 	defer log.mu.Unlock()
 
 	// Mark the end of the sample series and
 	// make sure that the log is not empty.
-	checkpoint, err = log.getCheckpoint()
+	checkpoint, err := log.getCheckpoint()
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
 	// Get the beginning of the sample series.
@@ -79,27 +138,217 @@ func (log *MetricsLog) GetSamples() (samples []prompb.Sample, checkpoint uint64,
 	// so the first index will be a valid value.
 	index, err := log.wal.FirstIndex()
 	if err != nil {
-		return nil, 0, err
+		return nil, err
+	}
+	if cursor > index && cursor <= checkpoint {
+		index = cursor
 	}
 
 	// Re-create the sample series.
-	for i := index; i < checkpoint; i++ {
-		// Read a sample.
-		sample, err := log.readSample(i)
+	return log.readChunks(index, checkpoint-1, defaultLabels, maxSamples, maxBytes)
+}
+
+// PeekSamples returns all samples in the log without creating a checkpoint,
+// thus it doesn't modify the log and can be used for inspection.
+func (log *MetricsLog) PeekSamples(defaultLabels []prompb.Label) (series []prompb.TimeSeries, err error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	firstIndex, err := log.wal.FirstIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	lastIndex, err := log.wal.LastIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	// Empty log has both indexes set to 0.
+	if lastIndex == 0 {
+		return series, nil
+	}
+
+	return log.readSeries(firstIndex, lastIndex, defaultLabels)
+}
+
+// PeekMetricsLog returns all samples of the log at path without opening it
+// in place, opening a log would create, repair or truncate its segments.
+// The segments are read from a temporary copy, so that a log written by
+// a running daemon is never modified.
+func PeekMetricsLog(path string, defaultLabels []prompb.Label) ([]prompb.TimeSeries, error) {
+	dir, err := os.MkdirTemp("", "host-metering-metrics-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if err := copyFile(filepath.Join(path, entry.Name()), filepath.Join(dir, entry.Name())); err != nil {
+			return nil, err
+		}
+	}
+
+	log, err := NewMetricsLog(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer log.Close()
+	return log.PeekSamples(defaultLabels)
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// readSeries reads records in the inclusive range and groups
+// the samples by series. Labels of the records take precedence
+// over the default labels.
+func (log *MetricsLog) readSeries(firstIndex uint64, lastIndex uint64, defaultLabels []prompb.Label) ([]prompb.TimeSeries, error) {
+	chunks, err := log.readChunks(firstIndex, lastIndex, defaultLabels, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return chunks[0].Series, nil
+}
+
+// readChunks reads records in the inclusive range and groups the samples
+// by series within chunks limited by the number of samples and by their
+// size.
+func (log *MetricsLog) readChunks(firstIndex uint64, lastIndex uint64, defaultLabels []prompb.Label, maxSamples uint, maxBytes uint) ([]Chunk, error) {
+	var chunks []Chunk
+	var chunk Chunk
+	var chunkSamples, chunkBytes uint
+	seriesIndex := make(map[string]int)
+
+	for i := firstIndex; i <= lastIndex; i++ {
+		record, err := log.readRecord(i)
 		if err != nil {
-			return nil, 0, err
+			return nil, err
 		}
 
 		// Skip checkpoints.
-		if sample == nil {
+		if record == nil {
 			continue
 		}
 
-		// Append samples.
-		samples = append(samples, *sample)
+		labels := MergeLabels(record.Labels, defaultLabels)
+		key := labelsKey(labels)
+		idx, ok := seriesIndex[key]
+
+		// Estimate growth of the write request by the sample.
+		var size uint
+		if ok {
+			size = fieldSize(record.Samples[0].Size())
+		} else {
+			size = fieldSize((&prompb.TimeSeries{Labels: labels, Samples: record.Samples}).Size())
+		}
+
+		// Start a new chunk if the sample doesn't fit into the current one.
+		if chunkSamples > 0 && ((maxSamples > 0 && chunkSamples+1 > maxSamples) ||
+			(maxBytes > 0 && chunkBytes+size > maxBytes)) {
+			chunk.Checkpoint = i
+			chunks = append(chunks, chunk)
+			chunk = Chunk{}
+			chunkSamples, chunkBytes = 0, 0
+			seriesIndex = make(map[string]int)
+			ok = false
+			size = fieldSize((&prompb.TimeSeries{Labels: labels, Samples: record.Samples}).Size())
+		}
+
+		if !ok {
+			idx = len(chunk.Series)
+			seriesIndex[key] = idx
+			chunk.Series = append(chunk.Series, prompb.TimeSeries{Labels: labels})
+		}
+		chunk.Series[idx].Samples = append(chunk.Series[idx].Samples, record.Samples...)
+		chunkSamples++
+		chunkBytes += size
+	}
+
+	chunk.Checkpoint = lastIndex + 1
+	return append(chunks, chunk), nil
+}
+
+// fieldSize returns size of an encoded protobuf field of the given length.
+func fieldSize(length int) uint {
+	return uint(1 + proto.SizeVarint(uint64(length)) + length)
+}
+
+func labelsKey(labels []prompb.Label) string {
+	var key strings.Builder
+	for _, label := range labels {
+		key.WriteString(label.Name)
+		key.WriteByte(0)
+		key.WriteString(label.Value)
+		key.WriteByte(0)
+	}
+	return key.String()
+}
+
+type MetricsLogStats struct {
+	Count  int       `json:"count"`
+	Oldest time.Time `json:"oldest"`
+	Newest time.Time `json:"newest"`
+}
+
+func (s *MetricsLogStats) String() string {
+	if s.Count == 0 {
+		return "0 sample(s)"
+	}
+	return fmt.Sprintf("%d sample(s), oldest: %s, newest: %s",
+		s.Count, s.Oldest.Format(time.RFC3339), s.Newest.Format(time.RFC3339))
+}
+
+// Stats returns number of pending samples and their time range.
+func (log *MetricsLog) Stats() (*MetricsLogStats, error) {
+	series, err := log.PeekSamples(nil)
+	if err != nil {
+		return nil, err
 	}
+	return NewMetricsLogStats(series), nil
+}
 
-	return samples, checkpoint, nil
+func NewMetricsLogStats(series []prompb.TimeSeries) *MetricsLogStats {
+	stats := &MetricsLogStats{}
+	var oldest, newest int64
+	for _, ts := range series {
+		for _, sample := range ts.Samples {
+			if stats.Count == 0 || sample.Timestamp < oldest {
+				oldest = sample.Timestamp
+			}
+			if stats.Count == 0 || sample.Timestamp > newest {
+				newest = sample.Timestamp
+			}
+			stats.Count++
+		}
+	}
+	if stats.Count > 0 {
+		stats.Oldest = time.UnixMilli(oldest)
+		stats.Newest = time.UnixMilli(newest)
+	}
+	return stats
 }
 
 func (log *MetricsLog) getCheckpoint() (index uint64, err error) {
@@ -144,7 +393,8 @@ func (log *MetricsLog) createCheckpoint() (index uint64, err error) {
 	return index + 1, nil
 }
 
-func (log *MetricsLog) readSample(index uint64) (*prompb.Sample, error) {
+// readRecord returns a series with a single sample, or nil for a checkpoint.
+func (log *MetricsLog) readRecord(index uint64) (*prompb.TimeSeries, error) {
 	// Get data from the specified index.
 	data, err := log.wal.Read(index)
 	if err != nil {
@@ -156,14 +406,27 @@ func (log *MetricsLog) readSample(index uint64) (*prompb.Sample, error) {
 		return nil, nil
 	}
 
-	// Deserialize the data to get a sample.
-	sample := &prompb.Sample{}
+	// A marshalled prompb.Sample starts with a field tag, never with
+	// a version byte.
+	if data[0] == recordVersionSeries {
+		record := &prompb.TimeSeries{}
+		if err := record.Unmarshal(data[1:]); err != nil {
+			return nil, err
+		}
+		return record, nil
+	}
+
+	// Deserialize the data to get a legacy sample.
+	sample := prompb.Sample{}
 	err = sample.Unmarshal(data)
 	if err != nil {
 		return nil, err
 	}
 
-	return sample, nil
+	return &prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: "__name__", Value: legacyMetricName}},
+		Samples: []prompb.Sample{sample},
+	}, nil
 }
 
 func (log *MetricsLog) RemoveSamples(checkpoint uint64) error {
@@ -174,6 +437,83 @@ func (log *MetricsLog) RemoveSamples(checkpoint uint64) error {
 	return log.wal.TruncateFront(checkpoint)
 }
 
+// RemoveSamplesBefore removes all entries before the cursor, i.e. a checkpoint
+// acknowledged by all readers. Cursors which are not within the log are ignored.
+func (log *MetricsLog) RemoveSamplesBefore(cursor uint64) error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	firstIndex, err := log.wal.FirstIndex()
+	if err != nil {
+		return err
+	}
+
+	lastIndex, err := log.wal.LastIndex()
+	if err != nil {
+		return err
+	}
+
+	if cursor <= firstIndex || cursor > lastIndex {
+		return nil
+	}
+	return log.wal.TruncateFront(cursor)
+}
+
+// RemoveExpiredSamples removes samples older than maxAge from the beginning
+// of the log and returns the number of removed samples. Samples are written
+// in the order of collection, so removing stops at the first sample which
+// is not expired.
+func (log *MetricsLog) RemoveExpiredSamples(maxAge time.Duration) (int, error) {
+	treshold := time.Now().UnixMilli() - int64(maxAge.Milliseconds())
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	firstIndex, err := log.wal.FirstIndex()
+	if err != nil {
+		return 0, err
+	}
+
+	lastIndex, err := log.wal.LastIndex()
+	if err != nil {
+		return 0, err
+	}
+
+	// Empty log has both indexes set to 0.
+	if lastIndex == 0 {
+		return 0, nil
+	}
+
+	// Find index of the first sample which is not expired. The last entry
+	// is always kept, so that indexes of the log continue.
+	removed := 0
+	truncateIndex := lastIndex
+	for i := firstIndex; i <= lastIndex; i++ {
+		record, err := log.readRecord(i)
+		if err != nil {
+			return 0, err
+		}
+
+		// Skip checkpoints.
+		if record == nil {
+			continue
+		}
+
+		if record.Samples[0].Timestamp >= treshold {
+			truncateIndex = i
+			break
+		}
+		if i < lastIndex {
+			removed++
+		}
+	}
+
+	if truncateIndex <= firstIndex {
+		return 0, nil
+	}
+	return removed, log.wal.TruncateFront(truncateIndex)
+}
+
 func (log *MetricsLog) RemoveOldestSamples(numSamples int) error {
 	if numSamples <= 0 {
 		return nil
@@ -196,13 +536,13 @@ func (log *MetricsLog) RemoveOldestSamples(numSamples int) error {
 	samplesRead := 0
 	truncateIndex := firstIndex
 	for i := firstIndex; i <= lastIndex; i++ {
-		sample, err := log.readSample(i)
+		record, err := log.readRecord(i)
 		if err != nil {
 			return err
 		}
 
 		// Skip checkpoints.
-		if sample == nil {
+		if record == nil {
 			continue
 		}
 
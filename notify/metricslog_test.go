@@ -3,6 +3,7 @@ package notify
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/tidwall/wal"
@@ -37,7 +38,7 @@ func TestMetricsLogFailures(t *testing.T) {
 	checkExpectedError(t, err, "log closed")
 
 	// Test an invalid read operation.
-	_, _, err = log.GetSamples()
+	_, _, err = log.GetSamples(nil)
 	checkExpectedError(t, err, "log closed")
 
 	// Test an invalid delete operation.
@@ -57,13 +58,13 @@ func TestMetricsLogCheckpoints(t *testing.T) {
 	defer log.Close()
 
 	// Get samples from an empty log.
-	samples, checkpoint, err := log.GetSamples()
+	samples, checkpoint, err := log.GetSamples(nil)
 	checkError(t, err, "failed to get samples from MetricsLog")
 	checkSamples(t, samples)
 	checkIndex(t, checkpoint, 1)
 
 	// Get samples from an empty log again.
-	samples, checkpoint, err = log.GetSamples()
+	samples, checkpoint, err = log.GetSamples(nil)
 	checkError(t, err, "failed to get samples from MetricsLog")
 	checkSamples(t, samples)
 	checkIndex(t, checkpoint, 1)
@@ -82,13 +83,13 @@ func TestMetricsLogCheckpoints(t *testing.T) {
 	_ = log.WriteSampleNow(3)
 
 	// Get samples from the log.
-	samples, checkpoint, err = log.GetSamples()
+	samples, checkpoint, err = log.GetSamples(nil)
 	checkError(t, err, "failed to get samples from MetricsLog")
 	checkSamples(t, samples, 1, 2, 3)
 	checkIndex(t, checkpoint, 5)
 
 	// Get samples from the log again.
-	samples, checkpoint, err = log.GetSamples()
+	samples, checkpoint, err = log.GetSamples(nil)
 	checkError(t, err, "failed to get samples from MetricsLog")
 	checkSamples(t, samples, 1, 2, 3)
 	checkIndex(t, checkpoint, 5)
@@ -106,13 +107,13 @@ func TestMetricsLogCheckpoints(t *testing.T) {
 	_ = log.WriteSampleNow(5)
 
 	// Get samples from the log.
-	samples, checkpoint, err = log.GetSamples()
+	samples, checkpoint, err = log.GetSamples(nil)
 	checkError(t, err, "failed to get samples from MetricsLog")
 	checkSamples(t, samples, 4, 5)
 	checkIndex(t, checkpoint, 8)
 
 	// Get samples from the log again.
-	samples, checkpoint, err = log.GetSamples()
+	samples, checkpoint, err = log.GetSamples(nil)
 	checkError(t, err, "failed to get samples from MetricsLog")
 	checkSamples(t, samples, 4, 5)
 	checkIndex(t, checkpoint, 8)
@@ -142,7 +143,7 @@ func TestMetricsLogBasics(t *testing.T) {
 	checkError(t, err, "failed to write sample data to MetricsLog")
 
 	// Get all samples from the log
-	samples, checkpoint, err := log.GetSamples()
+	samples, checkpoint, err := log.GetSamples(nil)
 	checkError(t, err, "failed to get samples from MetricsLog")
 	checkSamples(t, samples, 4, 6)
 	checkIndex(t, checkpoint, 3)
@@ -152,7 +153,7 @@ func TestMetricsLogBasics(t *testing.T) {
 	checkError(t, err, "failed to truncate MetricsLog")
 
 	// Get all samples from the log again, to check that the truncation worked
-	samples, checkpoint, err = log.GetSamples()
+	samples, checkpoint, err = log.GetSamples(nil)
 	checkError(t, err, "failed to get samples from MetricsLog")
 	checkSamples(t, samples)
 	checkIndex(t, checkpoint, 3)
@@ -165,7 +166,7 @@ func TestMetricsLogBasics(t *testing.T) {
 	err = log.WriteSampleNow(8)
 	checkError(t, err, "failed to write sample data to MetricsLog")
 
-	samples, checkpoint, err = log.GetSamples()
+	samples, checkpoint, err = log.GetSamples(nil)
 	checkError(t, err, "failed to get samples from MetricsLog")
 	checkSamples(t, samples, 8)
 	checkIndex(t, checkpoint, 5)
@@ -174,6 +175,314 @@ func TestMetricsLogBasics(t *testing.T) {
 	checkError(t, err, "failed to truncate MetricsLog")
 }
 
+// Test that samples can be inspected without modifying the log.
+func TestMetricsLogPeekAndStats(t *testing.T) {
+	log, err := NewMetricsLog(createMetricsPath(t))
+	checkError(t, err, "failed to create MetricsLog")
+	defer log.Close()
+
+	// Inspect an empty log.
+	samples, err := log.PeekSamples(nil)
+	checkError(t, err, "failed to peek samples")
+	checkSamples(t, samples)
+	stats, err := log.Stats()
+	checkError(t, err, "failed to get stats")
+	if stats.Count != 0 || stats.String() != "0 sample(s)" {
+		t.Fatalf("unexpected stats of empty log: %s", stats.String())
+	}
+
+	// Inspect the log with samples.
+	_ = log.WriteSample(1, 1000)
+	_ = log.WriteSample(2, 2000)
+	samples, err = log.PeekSamples(nil)
+	checkError(t, err, "failed to peek samples")
+	checkSamples(t, samples, 1, 2)
+	stats, err = log.Stats()
+	checkError(t, err, "failed to get stats")
+	if stats.Count != 2 || stats.Oldest.UnixMilli() != 1000 || stats.Newest.UnixMilli() != 2000 {
+		t.Fatalf("unexpected stats: %s", stats.String())
+	}
+
+	// Peeking doesn't create a checkpoint.
+	_, checkpoint, err := log.GetSamples(nil)
+	checkError(t, err, "failed to get samples")
+	checkIndex(t, checkpoint, 3)
+
+	// Samples are still visible until the log is truncated.
+	samples, _ = log.PeekSamples(nil)
+	checkSamples(t, samples, 1, 2)
+	_ = log.RemoveSamples(checkpoint)
+	samples, _ = log.PeekSamples(nil)
+	checkSamples(t, samples)
+}
+
+// Test that a log is peeked from a copy, without modifying the log in place.
+func TestPeekMetricsLog(t *testing.T) {
+	path := createMetricsPath(t)
+	log, err := NewMetricsLog(path)
+	checkError(t, err, "failed to create MetricsLog")
+	defer log.Close()
+	_ = log.WriteSample(1, 1000)
+	_ = log.WriteSample(2, 2000)
+
+	before, err := os.ReadDir(path)
+	checkError(t, err, "failed to list log")
+	samples, err := PeekMetricsLog(path, nil)
+	checkError(t, err, "failed to peek log")
+	checkSamples(t, samples, 1, 2)
+
+	// The segments are neither created nor renamed, and the log is still writable.
+	after, err := os.ReadDir(path)
+	checkError(t, err, "failed to list log")
+	if len(before) != len(after) || before[0].Name() != after[0].Name() {
+		t.Fatalf("expected segments to be kept, got %v, was %v", after, before)
+	}
+	checkError(t, log.WriteSample(3, 3000), "failed to write after peek")
+	samples, _ = log.PeekSamples(nil)
+	checkSamples(t, samples, 1, 2, 3)
+
+	// Peeking a missing log fails without creating it.
+	missing := createMetricsPath(t)
+	_, err = PeekMetricsLog(missing, nil)
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected missing log error, got %v", err)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatalf("expected missing log not to be created")
+	}
+}
+
+// Test that samples keep their series and are grouped by them.
+func TestMetricsLogSeries(t *testing.T) {
+	log, err := NewMetricsLog(createMetricsPath(t))
+	checkError(t, err, "failed to create MetricsLog")
+	defer log.Close()
+
+	cpu := []prompb.Label{{Name: "__name__", Value: "system_cpu_logical_count"}}
+	memory := []prompb.Label{{Name: "__name__", Value: "system_memory_total_bytes"}}
+
+	err = log.WriteSeries([]prompb.TimeSeries{
+		{Labels: cpu, Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}}},
+		{Labels: memory, Samples: []prompb.Sample{{Value: 1024, Timestamp: 1000}}},
+	})
+	checkError(t, err, "failed to write series")
+	err = log.WriteSample(2, 2000)
+	checkError(t, err, "failed to write sample")
+
+	series, checkpoint, err := log.GetSamples(nil)
+	checkError(t, err, "failed to get samples")
+	checkIndex(t, checkpoint, 4)
+	if len(series) != 2 {
+		t.Fatalf("expected 2 series, got %d", len(series))
+	}
+	checkSeries(t, series[0], "system_cpu_logical_count", 1, 2)
+	checkSeries(t, series[1], "system_memory_total_bytes", 1024)
+
+	// Oldest samples are removed in the order they were written
+	err = log.RemoveOldestSamples(2)
+	checkError(t, err, "failed to remove oldest samples")
+	series, err = log.PeekSamples(nil)
+	checkError(t, err, "failed to peek samples")
+	if len(series) != 1 {
+		t.Fatalf("expected 1 series, got %d", len(series))
+	}
+	checkSeries(t, series[0], "system_cpu_logical_count", 2)
+}
+
+// Test that records written before series were stored can be read.
+func TestMetricsLogLegacyRecords(t *testing.T) {
+	log, err := NewMetricsLog(createMetricsPath(t))
+	checkError(t, err, "failed to create MetricsLog")
+	defer log.Close()
+
+	legacySample := &prompb.Sample{Value: 3, Timestamp: 1000}
+	data, err := legacySample.Marshal()
+	checkError(t, err, "failed to marshal sample")
+	err = log.wal.Write(1, data)
+	checkError(t, err, "failed to write legacy record")
+	err = log.WriteSample(4, 2000)
+	checkError(t, err, "failed to write sample")
+
+	series, _, err := log.GetSamples(nil)
+	checkError(t, err, "failed to get samples")
+	if len(series) != 1 {
+		t.Fatalf("expected 1 series, got %d", len(series))
+	}
+	checkSeries(t, series[0], "system_cpu_logical_count", 3, 4)
+}
+
+// Test that labels stored with the samples are kept and default labels
+// are added only to records written without them.
+func TestMetricsLogDefaultLabels(t *testing.T) {
+	log, err := NewMetricsLog(createMetricsPath(t))
+	checkError(t, err, "failed to create MetricsLog")
+	defer log.Close()
+
+	err = log.WriteSample(1, 1000)
+	checkError(t, err, "failed to write sample")
+	err = log.WriteSeries([]prompb.TimeSeries{
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "system_cpu_logical_count"},
+				{Name: "external_organization", Value: "old"},
+			},
+			Samples: []prompb.Sample{{Value: 2, Timestamp: 2000}},
+		},
+	})
+	checkError(t, err, "failed to write series")
+
+	defaultLabels := []prompb.Label{{Name: "external_organization", Value: "new"}}
+	series, _, err := log.GetSamples(defaultLabels)
+	checkError(t, err, "failed to get samples")
+	if len(series) != 2 {
+		t.Fatalf("expected 2 series, got %d", len(series))
+	}
+	checkSamples(t, series[:1], 1)
+	checkLabelValue(t, series[0], "external_organization", "new")
+	checkSamples(t, series[1:], 2)
+	checkLabelValue(t, series[1], "external_organization", "old")
+}
+
+// Test that readers with their own cursors read the log independently
+// and only samples read by all of them are removed.
+func TestMetricsLogCursors(t *testing.T) {
+	log, err := NewMetricsLog(createMetricsPath(t))
+	checkError(t, err, "failed to create MetricsLog")
+	defer log.Close()
+
+	log.WriteSampleNow(1) // index 1
+	log.WriteSampleNow(2) // index 2
+
+	// The first reader acknowledges the samples
+	samples, first, err := log.GetSamplesFrom(0, nil)
+	checkError(t, err, "failed to get samples")
+	checkSamples(t, samples, 1, 2)
+	checkIndex(t, first, 3)
+
+	log.WriteSampleNow(3) // index 4
+
+	// The first reader gets only new samples
+	samples, first, err = log.GetSamplesFrom(first, nil)
+	checkError(t, err, "failed to get samples")
+	checkSamples(t, samples, 3)
+	checkIndex(t, first, 5)
+
+	// The second reader didn't acknowledge anything yet
+	samples, second, err := log.GetSamplesFrom(0, nil)
+	checkError(t, err, "failed to get samples")
+	checkSamples(t, samples, 1, 2, 3)
+	checkIndex(t, second, 5)
+
+	// Nothing is removed before the oldest cursor
+	err = log.RemoveSamplesBefore(0)
+	checkError(t, err, "failed to remove samples")
+	checkSamples(t, peekSamples(t, log), 1, 2, 3)
+
+	// A cursor out of the log reads the whole log
+	samples, _, err = log.GetSamplesFrom(100, nil)
+	checkError(t, err, "failed to get samples")
+	checkSamples(t, samples, 1, 2, 3)
+	err = log.RemoveSamplesBefore(100)
+	checkError(t, err, "failed to remove samples")
+	checkSamples(t, peekSamples(t, log), 1, 2, 3)
+
+	err = log.RemoveSamplesBefore(second)
+	checkError(t, err, "failed to remove samples")
+	checkSamples(t, peekSamples(t, log))
+}
+
+func TestMetricsLogChunks(t *testing.T) {
+	log, err := NewMetricsLog(createMetricsPath(t))
+	checkError(t, err, "failed to create MetricsLog")
+	defer log.Close()
+
+	// Only an empty chunk in an empty log
+	chunks, err := log.GetChunksFrom(0, nil, 2, 0)
+	checkError(t, err, "failed to get chunks")
+	if len(chunks) != 1 || len(chunks[0].Series) != 0 {
+		t.Fatalf("expected one empty chunk, got %v", chunks)
+	}
+	checkIndex(t, chunks[0].Checkpoint, 1)
+
+	log.WriteSampleNow(1) // index 2
+	log.WriteSampleNow(2) // index 3
+	log.WriteSampleNow(3) // index 4
+	log.WriteSampleNow(4) // index 5
+	log.WriteSampleNow(5) // index 6
+
+	// Chunks limited by number of samples
+	chunks, err = log.GetChunksFrom(0, nil, 2, 0)
+	checkError(t, err, "failed to get chunks")
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(chunks))
+	}
+	checkSamples(t, chunks[0].Series, 1, 2)
+	checkIndex(t, chunks[0].Checkpoint, 4)
+	checkSamples(t, chunks[1].Series, 3, 4)
+	checkIndex(t, chunks[1].Checkpoint, 6)
+	checkSamples(t, chunks[2].Series, 5)
+	checkIndex(t, chunks[2].Checkpoint, 7)
+
+	// Chunks continue from the cursor
+	chunks, err = log.GetChunksFrom(4, nil, 2, 0)
+	checkError(t, err, "failed to get chunks")
+	if len(chunks) != 2 {
+		t.Fatalf("expected 2 chunks, got %d", len(chunks))
+	}
+	checkSamples(t, chunks[0].Series, 3, 4)
+
+	// Chunks limited by size have at least one sample
+	chunks, err = log.GetChunksFrom(0, nil, 0, 1)
+	checkError(t, err, "failed to get chunks")
+	if len(chunks) != 5 {
+		t.Fatalf("expected 5 chunks, got %d", len(chunks))
+	}
+
+	// Size of a chunk is the size of its series in a write request
+	request := prompb.WriteRequest{Timeseries: chunks[0].Series}
+	chunks, err = log.GetChunksFrom(0, nil, 0, uint(request.Size()))
+	checkError(t, err, "failed to get chunks")
+	if len(chunks) != 5 {
+		t.Fatalf("expected 5 chunks, got %d", len(chunks))
+	}
+	chunks, err = log.GetChunksFrom(0, nil, 0, uint(request.Size())+fieldSize(chunks[1].Series[0].Samples[0].Size()))
+	checkError(t, err, "failed to get chunks")
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(chunks))
+	}
+}
+
+func TestRemoveExpiredSamples(t *testing.T) {
+	log, err := NewMetricsLog(createMetricsPath(t))
+	checkError(t, err, "failed to create MetricsLog")
+	defer log.Close()
+
+	// Empty log
+	removed, err := log.RemoveExpiredSamples(time.Minute)
+	checkError(t, err, "failed to remove expired samples")
+	if removed != 0 {
+		t.Fatalf("expected no sample to be removed, got %d", removed)
+	}
+
+	expired := time.Now().Add(-2 * time.Minute).UnixMilli()
+	log.WriteSample(1, expired)
+	_, _, _ = log.GetSamples(nil)
+	log.WriteSample(2, expired)
+	log.WriteSampleNow(3)
+	log.WriteSample(4, expired)
+
+	// Only samples at the beginning of the log are removed
+	removed, err = log.RemoveExpiredSamples(time.Minute)
+	checkError(t, err, "failed to remove expired samples")
+	if removed != 2 {
+		t.Fatalf("expected 2 samples to be removed, got %d", removed)
+	}
+	samples := peekSamples(t, log)
+	if len(samples) != 1 || len(samples[0].Samples) != 2 || samples[0].Samples[0].Value != 3 {
+		t.Fatalf("expected samples after the first non-expired sample to be kept, got %v", samples)
+	}
+}
+
 // Test scenario where Prometheus server is not initially reachable
 // (log is not truncated). And host-metering is restarted in the meantime.
 func TestRestart(t *testing.T) {
@@ -190,7 +499,7 @@ func TestRestart(t *testing.T) {
 	log.WriteSampleNow(4) // index 4
 	log.WriteSampleNow(5) // index 5
 
-	samples, checkpoint, err := log.GetSamples()
+	samples, checkpoint, err := log.GetSamples(nil)
 	checkError(t, err, "failed to get samples from MetricsLog")
 	checkSamples(t, samples, 1, 2, 3, 4, 5)
 	checkIndex(t, checkpoint, 6)
@@ -201,7 +510,7 @@ func TestRestart(t *testing.T) {
 	// Second run of host-metering
 	log, _ = NewMetricsLog(logPath)
 
-	samples, checkpoint, err = log.GetSamples()
+	samples, checkpoint, err = log.GetSamples(nil)
 	checkError(t, err, "failed to get samples from MetricsLog")
 	checkSamples(t, samples, 1, 2, 3, 4, 5)
 	checkIndex(t, checkpoint, 6)
@@ -217,7 +526,7 @@ func TestRestart(t *testing.T) {
 	checkError(t, err, "failed to create MetricsLog")
 	defer log.Close()
 
-	samples, checkpoint, err = log.GetSamples()
+	samples, checkpoint, err = log.GetSamples(nil)
 	checkError(t, err, "failed to get samples from MetricsLog")
 	checkSamples(t, samples)
 	checkIndex(t, checkpoint, 6)
@@ -309,7 +618,7 @@ func TestRemoveOldestSamples(t *testing.T) {
 			}
 
 			// Retrieve the remaining samples
-			samples, checkpoint, err := log.GetSamples()
+			samples, checkpoint, err := log.GetSamples(nil)
 			checkError(t, err, "failed to get samples")
 
 			// Check remaining samples match expected samples
@@ -354,13 +663,25 @@ func checkExpectedError(t *testing.T, err error, message string) {
 	}
 }
 
+func peekSamples(t *testing.T, log *MetricsLog) []prompb.TimeSeries {
+	series, err := log.PeekSamples(nil)
+	checkError(t, err, "failed to peek samples")
+	return series
+}
+
 func checkIndex(t *testing.T, index uint64, expected uint64) {
 	if index != expected {
 		t.Fatalf("unexpected index: %d != %d", index, expected)
 	}
 }
 
-func checkSamples(t *testing.T, samples []prompb.Sample, expected ...float64) {
+func checkSamples(t *testing.T, series []prompb.TimeSeries, expected ...float64) {
+	t.Helper()
+	var samples []prompb.Sample
+	for _, ts := range series {
+		samples = append(samples, ts.Samples...)
+	}
+
 	// Check the expected number of samples.
 	if len(samples) != len(expected) {
 		t.Fatalf("unexpected number of samples: %d != %d", len(samples), len(expected))
@@ -381,3 +702,24 @@ func checkSamples(t *testing.T, samples []prompb.Sample, expected ...float64) {
 		}
 	}
 }
+
+func checkSeries(t *testing.T, series prompb.TimeSeries, name string, expected ...float64) {
+	t.Helper()
+	if len(series.Labels) != 1 || series.Labels[0].Name != "__name__" || series.Labels[0].Value != name {
+		t.Fatalf("unexpected labels of series %s: %v", name, series.Labels)
+	}
+	checkSamples(t, []prompb.TimeSeries{series}, expected...)
+}
+
+func checkLabelValue(t *testing.T, series prompb.TimeSeries, name string, expected string) {
+	t.Helper()
+	for _, label := range series.Labels {
+		if label.Name == name {
+			if label.Value != expected {
+				t.Fatalf("expected label %s=%s, got %s", name, expected, label.Value)
+			}
+			return
+		}
+	}
+	t.Fatalf("expected label %s in %v", name, series.Labels)
+}
@@ -1,9 +1,12 @@
 package notify
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"time"
 
+	"github.com/RedHatInsights/host-metering/config"
 	"github.com/RedHatInsights/host-metering/hostinfo"
 	"github.com/prometheus/prometheus/prompb"
 )
@@ -41,18 +44,74 @@ func NonRecoverableError(err error) *NotifyError {
 }
 
 type Notifier interface {
-	Notify(samples []prompb.Sample, hostinfo *hostinfo.HostInfo) error
+	// Notify sends the series, it gives up with a recoverable error
+	// when the context is done.
+	Notify(ctx context.Context, series []prompb.TimeSeries, hostinfo *hostinfo.HostInfo) error
 
-	// HostChanged tells notifier that related information on host has changed
+	// HostChanged tells notifier that related information on host has changed,
+	// it may be called while notifying.
 	HostChanged()
 }
 
-func FilterSamplesByAge(samples []prompb.Sample, maxAge time.Duration) []prompb.Sample {
+// NewNotifier creates the notifier of the configured write protocol.
+func NewNotifier(cfg *config.Config) Notifier {
+	if cfg.WriteProtocol == config.WriteProtocolOTLP {
+		return NewOTLPNotifier(cfg)
+	}
+	return NewPrometheusNotifier(cfg)
+}
+
+// NewNotifierWithCert creates the notifier of the configured write protocol
+// which is authenticated by the certificate instead of the host certificate,
+// e.g. to send samples of a previous identity of the host.
+func NewNotifierWithCert(cfg *config.Config, cert tls.Certificate) Notifier {
+	if cfg.WriteProtocol == config.WriteProtocolOTLP {
+		return &OTLPNotifier{cfg: cfg, client: newHttpClientHolder(cfg, &cert), labels: newLabelProcessorHolder(cfg)}
+	}
+	return &PrometheusNotifier{cfg: cfg, client: newHttpClientHolder(cfg, &cert), labels: newLabelProcessorHolder(cfg)}
+}
+
+// FilterSamplesByAge drops samples older than maxAge and series
+// which have no samples left.
+func FilterSamplesByAge(series []prompb.TimeSeries, maxAge time.Duration) []prompb.TimeSeries {
 	treshold := time.Now().UnixMilli() - int64(maxAge.Milliseconds())
-	for idx, sample := range samples {
-		if sample.Timestamp >= treshold {
-			return samples[idx:]
+	result := []prompb.TimeSeries{}
+	for _, ts := range series {
+		for idx, sample := range ts.Samples {
+			if sample.Timestamp >= treshold {
+				result = append(result, prompb.TimeSeries{
+					Labels:  ts.Labels,
+					Samples: ts.Samples[idx:],
+				})
+				break
+			}
+		}
+	}
+	return result
+}
+
+// NewestSampleTime returns time of the newest sample in all series, it is
+// zero if there are no samples.
+func NewestSampleTime(series []prompb.TimeSeries) time.Time {
+	var newest int64
+	for _, ts := range series {
+		for _, sample := range ts.Samples {
+			if sample.Timestamp > newest {
+				newest = sample.Timestamp
+			}
 		}
 	}
-	return []prompb.Sample{}
+	if newest == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(newest)
+}
+
+// SamplesCount returns the total number of samples in all series.
+func SamplesCount(series []prompb.TimeSeries) int {
+	count := 0
+	for _, ts := range series {
+		count += len(ts.Samples)
+	}
+	return count
 }
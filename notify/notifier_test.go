@@ -6,42 +6,85 @@ import (
 	"testing"
 	"time"
 
+	"github.com/RedHatInsights/host-metering/config"
 	"github.com/prometheus/prometheus/prompb"
 )
 
+func TestNewNotifier(t *testing.T) {
+	cfg := config.NewConfig()
+	if _, ok := NewNotifier(cfg).(*PrometheusNotifier); !ok {
+		t.Fatalf("Expected Prometheus notifier by default")
+	}
+
+	cfg.WriteProtocol = config.WriteProtocolPrometheusV2
+	if _, ok := NewNotifier(cfg).(*PrometheusNotifier); !ok {
+		t.Fatalf("Expected Prometheus notifier for %s", cfg.WriteProtocol)
+	}
+
+	cfg.WriteProtocol = config.WriteProtocolOTLP
+	if _, ok := NewNotifier(cfg).(*OTLPNotifier); !ok {
+		t.Fatalf("Expected OTLP notifier for %s", cfg.WriteProtocol)
+	}
+}
+
 func TestFilterSamplesByAge(t *testing.T) {
 	now := time.Now().UnixMilli()
-	samples := []prompb.Sample{
-		{Value: 1, Timestamp: now - 10000},
-		{Value: 2, Timestamp: now - 8000},
-		{Value: 3, Timestamp: now - 6000},
-		{Value: 4, Timestamp: now - 4000},
-		{Value: 5, Timestamp: now - 2000},
-		{Value: 6, Timestamp: now - 1},
+	samples := []prompb.TimeSeries{
+		{
+			Labels: []prompb.Label{{Name: "__name__", Value: "a"}},
+			Samples: []prompb.Sample{
+				{Value: 1, Timestamp: now - 10000},
+				{Value: 2, Timestamp: now - 8000},
+				{Value: 3, Timestamp: now - 6000},
+				{Value: 4, Timestamp: now - 4000},
+				{Value: 5, Timestamp: now - 2000},
+				{Value: 6, Timestamp: now - 1},
+			},
+		},
+		{
+			Labels: []prompb.Label{{Name: "__name__", Value: "b"}},
+			Samples: []prompb.Sample{
+				{Value: 7, Timestamp: now - 9000},
+			},
+		},
 	}
-	// set maxAge to 5s, thus expect 3 samples
+	// set maxAge to 5s, thus expect 3 samples of the first series
 	filtered := FilterSamplesByAge(samples, 5*time.Second)
-	if len(filtered) != 3 {
-		t.Errorf("Expected 3 samples, got %d", len(filtered))
+	if len(filtered) != 1 || SamplesCount(filtered) != 3 {
+		t.Errorf("Expected 3 samples in 1 series, got %v", filtered)
 	}
-	if filtered[0].Value != 4 || filtered[1].Value != 5 || filtered[2].Value != 6 {
+	values := filtered[0].Samples
+	if values[0].Value != 4 || values[1].Value != 5 || values[2].Value != 6 {
 		t.Errorf("Expected samples with values 4, 5, 6, got %v", filtered)
 	}
 
 	// set maxAge to 11s, thus expect all samples
 	filtered = FilterSamplesByAge(samples, 11*time.Second)
-	if len(filtered) != len(samples) {
-		t.Errorf("Expected %d samples, got %d", len(samples), len(filtered))
+	if len(filtered) != 2 || SamplesCount(filtered) != SamplesCount(samples) {
+		t.Errorf("Expected %d samples, got %d", SamplesCount(samples), SamplesCount(filtered))
 	}
 
 	// set maxAge to 0s, thus expect no samples
 	filtered = FilterSamplesByAge(samples, 0)
 	if len(filtered) != 0 {
-		t.Errorf("Expected 0 samples, got %d", len(filtered))
+		t.Errorf("Expected 0 samples, got %d", SamplesCount(filtered))
 	}
 
 }
 
+func TestNewestSampleTime(t *testing.T) {
+	series := []prompb.TimeSeries{
+		{Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 2, Timestamp: 3000}}},
+		{Samples: []prompb.Sample{{Value: 3, Timestamp: 2000}}},
+	}
+	if newest := NewestSampleTime(series); !newest.Equal(time.UnixMilli(3000)) {
+		t.Errorf("Expected newest sample at 3000, got %v", newest)
+	}
+	if newest := NewestSampleTime(nil); !newest.IsZero() {
+		t.Errorf("Expected zero time without samples, got %v", newest)
+	}
+}
+
 func TestNotifyError(t *testing.T) {
 	wrappedErr := RecoverableError(fmt.Errorf("wrapped"))
 
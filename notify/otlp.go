@@ -0,0 +1,271 @@
+package notify
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/RedHatInsights/host-metering/collector"
+	"github.com/RedHatInsights/host-metering/config"
+	"github.com/RedHatInsights/host-metering/hostinfo"
+	"github.com/RedHatInsights/host-metering/logger"
+	"github.com/RedHatInsights/host-metering/version"
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// See https://opentelemetry.io/docs/specs/otlp/#otlphttp for specification of OTLP/HTTP
+// and opentelemetry/proto/metrics/v1/metrics.proto for the encoded messages.
+
+const otlpInstrumentationScope = "host-metering"
+
+type OTLPNotifier struct {
+	cfg    *config.Config
+	client *httpClientHolder
+	labels *labelProcessorHolder
+}
+
+func NewOTLPNotifier(cfg *config.Config) *OTLPNotifier {
+	return &OTLPNotifier{
+		cfg:    cfg,
+		client: newHttpClientHolder(cfg, nil),
+		labels: newLabelProcessorHolder(cfg),
+	}
+}
+
+func (n *OTLPNotifier) Notify(ctx context.Context, series []prompb.TimeSeries, hostinfo *hostinfo.HostInfo) error {
+	client, err := n.client.get()
+	if err != nil {
+		return RecoverableError(err)
+	}
+	request, err := newOTLPRequest(n.cfg, n.labels.get(), series)
+	if err != nil {
+		return RecoverableError(err)
+	}
+	return otlpExport(ctx, client, n.cfg, request)
+}
+
+func (n *OTLPNotifier) HostChanged() {
+	n.client.HostChanged()
+	n.labels.HostChanged()
+}
+
+func otlpExport(ctx context.Context, httpClient *http.Client, cfg *config.Config, httpRequest *http.Request) error {
+	_, body, err := writeWithRetries(ctx, httpClient, cfg, httpRequest, "OTLPExport")
+	if err != nil {
+		return err
+	}
+	return checkOTLPPartialSuccess(body)
+}
+
+func newOTLPRequest(cfg *config.Config, labelProcessor *labelProcessor, series []prompb.TimeSeries) (*http.Request, error) {
+	data := series2OTLPRequest(series, labelProcessor)
+	logger.Debugf("ExportMetricsServiceRequest: %d byte(s), %d series\n", len(data), len(series))
+
+	var compressedData bytes.Buffer
+	writer := gzip.NewWriter(&compressedData)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", cfg.WriteUrl, &compressedData)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Encoding", "gzip")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "host-metering/"+version.Version)
+
+	return req, nil
+}
+
+// checkOTLPPartialSuccess checks ExportMetricsServiceResponse for rejected
+// data points. Retrying a partial success would not help, the receiver
+// rejected the data points.
+func checkOTLPPartialSuccess(body []byte) error {
+	fields, err := decodeFields(body)
+	if err != nil {
+		logger.Warnf("OTLPExport: Invalid response: %s\n", err.Error())
+		return nil
+	}
+	for _, field := range fields {
+		if field.number != 1 {
+			continue
+		}
+		partialSuccess, err := decodeFields(field.bytes)
+		if err != nil {
+			logger.Warnf("OTLPExport: Invalid partial success: %s\n", err.Error())
+			return nil
+		}
+		var rejected uint64
+		var message string
+		for _, f := range partialSuccess {
+			switch f.number {
+			case 1:
+				rejected = f.value
+			case 2:
+				message = string(f.bytes)
+			}
+		}
+		if rejected > 0 {
+			return NonRecoverableError(fmt.Errorf("%d data point(s) rejected: %s", rejected, message))
+		}
+		if message != "" {
+			logger.Warnf("OTLPExport: %s\n", message)
+		}
+	}
+	return nil
+}
+
+type otlpResource struct {
+	attributes []prompb.Label
+	metrics    []*otlpMetric
+}
+
+type otlpMetric struct {
+	name       string
+	dataPoints []otlpDataPoint
+}
+
+type otlpDataPoint struct {
+	attributes []prompb.Label
+	sample     prompb.Sample
+}
+
+// series2OTLPRequest encodes the series as ExportMetricsServiceRequest.
+// Labels of the host and static labels become attributes of the resource,
+// the other labels become attributes of the data points. Series with the same
+// labels of the host share a resource.
+func series2OTLPRequest(series []prompb.TimeSeries, labelProcessor *labelProcessor) []byte {
+	hostLabelNames := make(map[string]bool)
+	for _, label := range HostInfoLabels(&hostinfo.HostInfo{}) {
+		hostLabelNames[label.Name] = true
+	}
+
+	var resources []*otlpResource
+	resourceIndex := make(map[string]*otlpResource)
+	for _, ts := range series {
+		labels := labelProcessor.process(ts.Labels)
+
+		var name string
+		var resourceAttributes, attributes []prompb.Label
+		for _, label := range labels {
+			switch {
+			case label.Name == "__name__":
+				name = label.Value
+			case hostLabelNames[label.Name] || labelProcessor.isStaticLabel(label.Name):
+				resourceAttributes = append(resourceAttributes, label)
+			default:
+				attributes = append(attributes, label)
+			}
+		}
+
+		key := labelsKey(resourceAttributes)
+		resource, ok := resourceIndex[key]
+		if !ok {
+			resource = &otlpResource{attributes: resourceAttributes}
+			resourceIndex[key] = resource
+			resources = append(resources, resource)
+		}
+		metric := resource.metric(name)
+		for _, sample := range ts.Samples {
+			metric.dataPoints = append(metric.dataPoints, otlpDataPoint{attributes, sample})
+		}
+	}
+
+	buf := proto.NewBuffer(nil)
+	for _, resource := range resources {
+		encodeBytesField(buf, 1, resource.marshal())
+	}
+	return buf.Bytes()
+}
+
+func (r *otlpResource) metric(name string) *otlpMetric {
+	for _, metric := range r.metrics {
+		if metric.name == name {
+			return metric
+		}
+	}
+	metric := &otlpMetric{name: name}
+	r.metrics = append(r.metrics, metric)
+	return metric
+}
+
+// marshal encodes ResourceMetrics.
+func (r *otlpResource) marshal() []byte {
+	resource := proto.NewBuffer(nil)
+	for _, attribute := range r.attributes {
+		encodeBytesField(resource, 1, marshalOTLPAttribute(attribute))
+	}
+
+	scope := proto.NewBuffer(nil)
+	encodeStringField(scope, 1, otlpInstrumentationScope)
+	encodeStringField(scope, 2, version.Version)
+
+	scopeMetrics := proto.NewBuffer(nil)
+	encodeBytesField(scopeMetrics, 1, scope.Bytes())
+	for _, metric := range r.metrics {
+		encodeBytesField(scopeMetrics, 2, metric.marshal())
+	}
+
+	buf := proto.NewBuffer(nil)
+	encodeBytesField(buf, 1, resource.Bytes())
+	encodeBytesField(buf, 2, scopeMetrics.Bytes())
+	return buf.Bytes()
+}
+
+// marshal encodes Metric. Counters are encoded as a monotonic cumulative
+// sum, other metrics as a gauge.
+func (m *otlpMetric) marshal() []byte {
+	metadata, _ := collector.MetadataOf(m.name)
+
+	dataPoints := proto.NewBuffer(nil)
+	for _, dataPoint := range m.dataPoints {
+		encodeBytesField(dataPoints, 1, dataPoint.marshal())
+	}
+
+	buf := proto.NewBuffer(nil)
+	encodeStringField(buf, 1, m.name)
+	if metadata.Help != "" {
+		encodeStringField(buf, 2, metadata.Help)
+	}
+	if metadata.Unit != "" {
+		encodeStringField(buf, 3, metadata.Unit)
+	}
+	if metadata.Type == collector.MetricTypeCounter {
+		// AGGREGATION_TEMPORALITY_CUMULATIVE
+		encodeVarintField(dataPoints, 2, 2)
+		encodeVarintField(dataPoints, 3, 1)
+		encodeBytesField(buf, 7, dataPoints.Bytes())
+	} else {
+		encodeBytesField(buf, 5, dataPoints.Bytes())
+	}
+	return buf.Bytes()
+}
+
+// marshal encodes NumberDataPoint.
+func (p *otlpDataPoint) marshal() []byte {
+	buf := proto.NewBuffer(nil)
+	encodeFixed64Field(buf, 3, uint64(p.sample.Timestamp)*1000000)
+	encodeDoubleField(buf, 4, p.sample.Value)
+	for _, attribute := range p.attributes {
+		encodeBytesField(buf, 7, marshalOTLPAttribute(attribute))
+	}
+	return buf.Bytes()
+}
+
+// marshalOTLPAttribute encodes the label as KeyValue with a string value.
+func marshalOTLPAttribute(label prompb.Label) []byte {
+	value := proto.NewBuffer(nil)
+	encodeStringField(value, 1, label.Value)
+
+	buf := proto.NewBuffer(nil)
+	encodeStringField(buf, 1, label.Name)
+	encodeBytesField(buf, 2, value.Bytes())
+	return buf.Bytes()
+}
@@ -0,0 +1,323 @@
+package notify
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RedHatInsights/host-metering/config"
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Test that labels of the host are sent as attributes of the resource
+func TestOTLPRequest(t *testing.T) {
+	// given
+	hi := createHostInfo()
+	series := withHostLabels(createSamples(), hi)
+	hi.ExternalOrganization = "neworg"
+	series = append(series, withHostLabels([]prompb.TimeSeries{
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "system_cpu_logical_count"},
+				{Name: "mode", Value: "online"},
+			},
+			Samples: []prompb.Sample{{Value: 3, Timestamp: 1000}},
+		},
+	}, hi)...)
+
+	// when
+	cfg := &config.Config{
+		LabelsDeny: []string{"display_name"},
+		Labels:     map[string]string{"environment": "prod"},
+	}
+	data := series2OTLPRequest(series, newLabelProcessor(cfg))
+
+	// then
+	resources, err := decodeOTLPRequest(data)
+	checkError(t, err, "Failed to decode request")
+	if len(resources) != 2 {
+		t.Fatalf("Expected 2 resources, got %d", len(resources))
+	}
+	checkAttribute(t, resources[0].attributes, "external_organization", "test external organization")
+	checkAttribute(t, resources[1].attributes, "external_organization", "neworg")
+	checkLabelsNotPresent(t, resources[0].attributes, []string{"__name__", "display_name"})
+	// Static labels describe the host too
+	checkAttribute(t, resources[0].attributes, "environment", "prod")
+
+	metric := resources[0].metrics[0]
+	if metric.name != "system_cpu_logical_count" || metric.description != "Number of logical CPUs of the host." {
+		t.Fatalf("Unexpected metric: %s: %s", metric.name, metric.description)
+	}
+	if len(metric.dataPoints) != 2 {
+		t.Fatalf("Expected 2 data points, got %d", len(metric.dataPoints))
+	}
+	for idx, dataPoint := range metric.dataPoints {
+		expected := series[0].Samples[idx]
+		if dataPoint.sample.Value != expected.Value || dataPoint.sample.Timestamp != expected.Timestamp*1000000 {
+			t.Fatalf("Expected data point %v, got %v", expected, dataPoint.sample)
+		}
+		if len(dataPoint.attributes) != 0 {
+			t.Fatalf("Expected no attributes of data point, got %v", dataPoint.attributes)
+		}
+	}
+
+	// Labels of the series are sent as attributes of the data point
+	checkAttribute(t, resources[1].metrics[0].dataPoints[0].attributes, "mode", "online")
+}
+
+func TestNotifyOTLP(t *testing.T) {
+	// Initialize notifier and data
+	useInsecureTLS(t)
+	_, certPath, keyPath, _ := createTestKeypair(t)
+	cfg := &config.Config{
+		WriteProtocol:      config.WriteProtocolOTLP,
+		HostCertPath:       certPath,
+		HostCertKeyPath:    keyPath,
+		WriteRetryAttempts: 1,
+	}
+	n := NewOTLPNotifier(cfg)
+	samples := withHostLabels(createSamples(), createHostInfo())
+	hostinfo := createHostInfo()
+
+	// Initialize mock server
+	called := 0
+	var response []byte
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called += 1
+		if r.URL.Path != otlpUrlPath {
+			t.Errorf("Expected to request '%s', got: %s", otlpUrlPath, r.URL.Path)
+		}
+
+		// Test that request is in OTLP/HTTP format
+		checkOTLPHeaders(t, r)
+		checkOTLPRequestBody(t, r)
+		checkRequestUsesHostCert(t, r)
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+		w.Write(response)
+	}))
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAnyClientCert,
+	}
+	server.StartTLS()
+	defer server.Close()
+	cfg.WriteUrl = server.URL + otlpUrlPath
+
+	// Test that notify returns no error
+	err := n.Notify(context.Background(), samples, hostinfo)
+	checkError(t, err, "Failed to notify")
+	checkCalled(t, called, 1)
+
+	// Test that http client and label processor are recreated when host info changes
+	httpClient := n.client.client
+	labelProcessor := n.labels.processor
+	n.HostChanged()
+	err = n.Notify(context.Background(), samples, hostinfo)
+	checkError(t, err, "Failed to notify")
+	if httpClient == n.client.client {
+		t.Fatalf("Expected client to be recreated")
+	}
+	if labelProcessor == nil || labelProcessor == n.labels.processor {
+		t.Fatalf("Expected label processor to be recreated")
+	}
+	checkCalled(t, called, 2)
+
+	// Test that rejected data points are not retried
+	response = createOTLPPartialSuccess(1, "invalid data point")
+	err = n.Notify(context.Background(), samples, hostinfo)
+	checkExpectedErrorContains(t, err, "1 data point(s) rejected: invalid data point")
+	checkNonRecoverable(t, err)
+	checkCalled(t, called, 3)
+}
+
+func TestNotifyOTLPNoCert(t *testing.T) {
+	cfg := &config.Config{
+		WriteProtocol: config.WriteProtocolOTLP,
+	}
+	n := NewOTLPNotifier(cfg)
+
+	err := n.Notify(context.Background(), createSamples(), createHostInfo())
+	checkRecoverable(t, err)
+}
+
+// Helper checks
+
+const otlpUrlPath = "/v1/metrics"
+
+func checkOTLPHeaders(t *testing.T, r *http.Request) {
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf(
+			"Expected: `Content-Encoding: gzip` header, got: `%s`",
+			r.Header.Get("Content-Encoding"))
+	}
+	if r.Header.Get("Content-Type") != "application/x-protobuf" {
+		t.Errorf(
+			"Expected: `Content-Type: application/x-protobuf` header, got: `%s`",
+			r.Header.Get("Content-Type"))
+	}
+	if r.Header.Get("User-Agent") == "" {
+		t.Errorf("Expected: `User-Agent` header to be set")
+	}
+}
+
+func checkOTLPRequestBody(t *testing.T, r *http.Request) {
+	reader, err := gzip.NewReader(r.Body)
+	if err != nil {
+		t.Errorf("Failed to decode body with gzip %s", err)
+		return
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		t.Errorf("Failed to decode body with gzip %s", err)
+	}
+	if _, err := decodeOTLPRequest(body); err != nil {
+		t.Errorf("Failed to unmarshal as protobuf message %s", err)
+	}
+}
+
+func checkAttribute(t *testing.T, attributes []prompb.Label, name string, expected string) {
+	for _, attribute := range attributes {
+		if attribute.Name == name {
+			if attribute.Value != expected {
+				t.Fatalf("Expected attribute %s=%s, got %s", name, expected, attribute.Value)
+			}
+			return
+		}
+	}
+	t.Fatalf("Expected attribute %s in %v", name, attributes)
+}
+
+func createOTLPPartialSuccess(rejected uint64, message string) []byte {
+	partialSuccess := proto.NewBuffer(nil)
+	encodeVarintField(partialSuccess, 1, rejected)
+	encodeStringField(partialSuccess, 2, message)
+
+	buf := proto.NewBuffer(nil)
+	encodeBytesField(buf, 1, partialSuccess.Bytes())
+	return buf.Bytes()
+}
+
+// Minimal protobuf decoder of OTLP metrics messages.
+
+type decodedOTLPMetric struct {
+	name        string
+	description string
+	dataPoints  []otlpDataPoint
+}
+
+type decodedOTLPResource struct {
+	attributes []prompb.Label
+	metrics    []decodedOTLPMetric
+}
+
+func decodeOTLPRequest(data []byte) ([]decodedOTLPResource, error) {
+	var resources []decodedOTLPResource
+	err := forEachField(data, func(field protoField) error {
+		if field.number != 1 {
+			return fmt.Errorf("unexpected field %d of ExportMetricsServiceRequest", field.number)
+		}
+		resource := decodedOTLPResource{}
+		err := forEachField(field.bytes, func(field protoField) error {
+			switch field.number {
+			case 1: // Resource
+				return forEachField(field.bytes, func(field protoField) error {
+					attribute, err := decodeOTLPAttribute(field.bytes)
+					resource.attributes = append(resource.attributes, attribute)
+					return err
+				})
+			case 2: // ScopeMetrics
+				return forEachField(field.bytes, func(field protoField) error {
+					if field.number != 2 {
+						return nil
+					}
+					metric, err := decodeOTLPMetric(field.bytes)
+					resource.metrics = append(resource.metrics, metric)
+					return err
+				})
+			}
+			return fmt.Errorf("unexpected field %d of ResourceMetrics", field.number)
+		})
+		resources = append(resources, resource)
+		return err
+	})
+	return resources, err
+}
+
+func decodeOTLPMetric(data []byte) (decodedOTLPMetric, error) {
+	metric := decodedOTLPMetric{}
+	err := forEachField(data, func(field protoField) error {
+		switch field.number {
+		case 1:
+			metric.name = string(field.bytes)
+		case 2:
+			metric.description = string(field.bytes)
+		case 5: // Gauge
+			return forEachField(field.bytes, func(field protoField) error {
+				dataPoint, err := decodeOTLPDataPoint(field.bytes)
+				metric.dataPoints = append(metric.dataPoints, dataPoint)
+				return err
+			})
+		}
+		return nil
+	})
+	return metric, err
+}
+
+func decodeOTLPDataPoint(data []byte) (otlpDataPoint, error) {
+	dataPoint := otlpDataPoint{}
+	err := forEachField(data, func(field protoField) error {
+		switch field.number {
+		case 3:
+			dataPoint.sample.Timestamp = int64(field.value)
+		case 4:
+			dataPoint.sample.Value = math.Float64frombits(field.value)
+		case 7:
+			attribute, err := decodeOTLPAttribute(field.bytes)
+			dataPoint.attributes = append(dataPoint.attributes, attribute)
+			return err
+		}
+		return nil
+	})
+	return dataPoint, err
+}
+
+func decodeOTLPAttribute(data []byte) (prompb.Label, error) {
+	attribute := prompb.Label{}
+	err := forEachField(data, func(field protoField) error {
+		switch field.number {
+		case 1:
+			attribute.Name = string(field.bytes)
+		case 2:
+			return forEachField(field.bytes, func(field protoField) error {
+				if field.number != 1 {
+					return fmt.Errorf("expected string value of attribute %s", attribute.Name)
+				}
+				attribute.Value = string(field.bytes)
+				return nil
+			})
+		}
+		return nil
+	})
+	return attribute, err
+}
+
+func forEachField(data []byte, fn func(field protoField) error) error {
+	fields, err := decodeFields(data)
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		if err := fn(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
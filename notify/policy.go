@@ -9,14 +9,14 @@ import (
 )
 
 type NotifyPolicy interface {
-	ShouldNotify([]prompb.Sample, *hostinfo.HostInfo) error
+	ShouldNotify([]prompb.TimeSeries, *hostinfo.HostInfo) error
 }
 
 type GeneralNotifyPolicy struct{}
 
-func (p *GeneralNotifyPolicy) ShouldNotify(samples []prompb.Sample, hostinfo *hostinfo.HostInfo) error {
+func (p *GeneralNotifyPolicy) ShouldNotify(series []prompb.TimeSeries, hostinfo *hostinfo.HostInfo) error {
 
-	count := len(samples)
+	count := SamplesCount(series)
 	if count == 0 {
 		return fmt.Errorf("no samples to send")
 	}
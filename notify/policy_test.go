@@ -10,7 +10,7 @@ import (
 
 type ShouldNotifyTestCase struct {
 	name     string
-	samples  []prompb.Sample
+	samples  []prompb.TimeSeries
 	hostInfo *hostinfo.HostInfo
 	expected string
 }
@@ -18,7 +18,7 @@ type ShouldNotifyTestCase struct {
 func TestGeneralNotifyPolicy(t *testing.T) {
 
 	p := &GeneralNotifyPolicy{}
-	correctSamples := []prompb.Sample{{}}
+	correctSamples := []prompb.TimeSeries{{Samples: []prompb.Sample{{}}}}
 	correctHostInfo := fullyDefinedMockHostInfo()
 
 	emptyHostIdHI := fullyDefinedMockHostInfo()
@@ -30,7 +30,7 @@ func TestGeneralNotifyPolicy(t *testing.T) {
 	testCases := []ShouldNotifyTestCase{
 		{
 			name:     "No samples",
-			samples:  []prompb.Sample{},
+			samples:  []prompb.TimeSeries{},
 			hostInfo: correctHostInfo,
 			expected: "no samples to send",
 		},
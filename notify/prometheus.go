@@ -2,12 +2,10 @@ package notify
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"fmt"
-	"io"
 	"net/http"
-	"strings"
-	"time"
+	"strconv"
 
 	"github.com/RedHatInsights/host-metering/config"
 	"github.com/RedHatInsights/host-metering/hostinfo"
@@ -20,114 +18,67 @@ import (
 
 // See https://prometheus.io/docs/concepts/remote_write_spec/ for specification of Prometheus remote write
 
-// Should be used only for testing
-var tlsInsecureSkipVerify = false
+const samplesWrittenHeader = "X-Prometheus-Remote-Write-Samples-Written"
 
 type PrometheusNotifier struct {
-	cfg         *config.Config
-	validClient bool
-	client      *http.Client
+	cfg    *config.Config
+	client *httpClientHolder
+	labels *labelProcessorHolder
 }
 
 func NewPrometheusNotifier(cfg *config.Config) *PrometheusNotifier {
 	return &PrometheusNotifier{
-		cfg: cfg,
+		cfg:    cfg,
+		client: newHttpClientHolder(cfg, nil),
+		labels: newLabelProcessorHolder(cfg),
 	}
 }
 
-func (n *PrometheusNotifier) Notify(samples []prompb.Sample, hostinfo *hostinfo.HostInfo) error {
-	if !n.validClient || n.client == nil {
-		if err := n.createHttpClient(); err != nil {
-			return RecoverableError(err)
-		}
-		n.validClient = true
+func (n *PrometheusNotifier) Notify(ctx context.Context, series []prompb.TimeSeries, hostinfo *hostinfo.HostInfo) error {
+	client, err := n.client.get()
+	if err != nil {
+		return RecoverableError(err)
 	}
-	request, err := newPrometheusRequest(hostinfo, n.cfg, samples)
+	request, err := newPrometheusRequest(n.cfg, n.labels.get(), series)
 	if err != nil {
 		return RecoverableError(err)
 	}
-	return prometheusRemoteWrite(n.client, n.cfg, request)
+	return prometheusRemoteWrite(ctx, client, n.cfg, request, SamplesCount(series))
 }
 
 func (n *PrometheusNotifier) HostChanged() {
-	n.validClient = false
+	n.client.HostChanged()
+	n.labels.HostChanged()
 }
 
-func (n *PrometheusNotifier) createHttpClient() error {
-	keypair, err := tls.LoadX509KeyPair(n.cfg.HostCertPath, n.cfg.HostCertKeyPath)
+func prometheusRemoteWrite(ctx context.Context, httpClient *http.Client, cfg *config.Config,
+	httpRequest *http.Request, samples int) error {
+	resp, _, err := writeWithRetries(ctx, httpClient, cfg, httpRequest, "PrometheusRemoteWrite")
 	if err != nil {
 		return err
 	}
-
-	n.client, err = newMTLSHttpClient(keypair, n.cfg.WriteTimeout)
-	return err
+	return checkSamplesWritten(resp, samples)
 }
 
-func newMTLSHttpClient(keypair tls.Certificate, timeout time.Duration) (*http.Client, error) {
-	tlsConfig := &tls.Config{
-		Certificates:       []tls.Certificate{keypair},
-		InsecureSkipVerify: tlsInsecureSkipVerify,
-	}
-	return &http.Client{
-		Timeout: timeout,
-		Transport: &http.Transport{
-			Proxy:                 http.ProxyFromEnvironment,
-			TLSClientConfig:       tlsConfig,
-			MaxIdleConns:          2,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		},
-	}, nil
-}
-
-func prometheusRemoteWrite(httpClient *http.Client, cfg *config.Config, httpRequest *http.Request) error {
-	var attempt uint = 0
-	maxRetryWait := cfg.WriteRetryMaxInt
-	retryWait := cfg.WriteRetryMinInt
-
-	for attempt < cfg.WriteRetryAttempts {
-		resp, err := httpClient.Do(httpRequest)
-
+func newPrometheusRequest(cfg *config.Config, labelProcessor *labelProcessor, series []prompb.TimeSeries) (
+	*http.Request, error) {
+	contentType := "application/x-protobuf"
+	protocolVersion := "0.1.0"
+	var compressedData []byte
+	if cfg.WriteProtocol == config.WriteProtocolPrometheusV2 {
+		writeRequest := series2WriteRequestV2(series, labelProcessor)
+		logger.Debugf("WriteRequest v2: %d symbol(s), %d series\n", len(writeRequest.Symbols), len(writeRequest.Timeseries))
+		compressedData = snappy.Encode(nil, writeRequest.Marshal())
+		contentType = remoteWriteContentTypeV2
+		protocolVersion = remoteWriteVersionV2
+	} else {
+		writeRequest := series2WriteRequest(series, labelProcessor)
+		logger.Debugf("WriteRequest: %s", writeRequest)
+		var err error
+		compressedData, err = writeRequest2Payload(writeRequest)
 		if err != nil {
-			return RecoverableError(err)
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode/100 == 2 {
-			return nil // success
+			return nil, err
 		}
-		body, err := io.ReadAll(resp.Body)
-		if err == nil {
-			logger.Debugf("PrometheusRemoteWrite: Response body: %s\n", string(body))
-		}
-
-		if resp.StatusCode/100 == 5 || resp.StatusCode == 429 {
-			attempt++
-			retryWait = retryWait * 2
-			if retryWait > maxRetryWait {
-				retryWait = maxRetryWait
-			}
-
-			logger.Infof("PrometheusRemoteWrite: Http Error: %d, retrying\n", resp.StatusCode)
-			time.Sleep(retryWait)
-			continue
-		}
-		if resp.StatusCode/100 == 4 {
-			return NonRecoverableError(fmt.Errorf("http Error: %d", resp.StatusCode))
-		}
-		return NonRecoverableError(fmt.Errorf("unexpected Http Status: %d", resp.StatusCode))
-	}
-
-	return RecoverableError(fmt.Errorf("failed after %d attempts", attempt))
-}
-
-func newPrometheusRequest(hostinfo *hostinfo.HostInfo, cfg *config.Config, samples []prompb.Sample) (
-	*http.Request, error) {
-	writeRequest := hostInfo2WriteRequest(hostinfo, samples, getLabelsToFilterOut(cfg))
-	logger.Debugf("WriteRequest: %s", writeRequest)
-	compressedData, err := writeRequest2Payload(writeRequest)
-	if err != nil {
-		return nil, err
 	}
 
 	req, err := http.NewRequest("POST", cfg.WriteUrl, bytes.NewReader(compressedData))
@@ -135,19 +86,31 @@ func newPrometheusRequest(hostinfo *hostinfo.HostInfo, cfg *config.Config, sampl
 		return nil, err
 	}
 	req.Header.Add("Content-Encoding", "snappy")
-	req.Header.Set("Content-Type", "application/x-protobuf")
-	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", protocolVersion)
 	req.Header.Set("User-Agent", "host-metering/"+version.Version)
 
 	return req, nil
 }
 
-func getLabelsToFilterOut(cfg *config.Config) []string {
-	labelsToFilterOut := make([]string, 0)
-	if cfg.SendHostname == config.SendHostnameNo {
-		labelsToFilterOut = append(labelsToFilterOut, "display_name")
+// checkSamplesWritten compares the number of samples confirmed by the server
+// with the number of sent samples. Servers which don't confirm written samples
+// are trusted to have written all of them.
+func checkSamplesWritten(resp *http.Response, samples int) error {
+	header := resp.Header.Get(samplesWrittenHeader)
+	if header == "" {
+		return nil
+	}
+	written, err := strconv.Atoi(header)
+	if err != nil {
+		logger.Warnf("PrometheusRemoteWrite: Invalid %s header: %s\n", samplesWrittenHeader, header)
+		return nil
+	}
+	if written < samples {
+		// Retrying a partial write would not help, the server rejected the rest.
+		return NonRecoverableError(fmt.Errorf("only %d of %d sample(s) written", written, samples))
 	}
-	return labelsToFilterOut
+	return nil
 }
 
 func filterEmptyLabels(labels []prompb.Label) []prompb.Label {
@@ -160,6 +123,22 @@ func filterEmptyLabels(labels []prompb.Label) []prompb.Label {
 	return result
 }
 
+func filterLabelsByName(labels []prompb.Label, toKeep []string) []prompb.Label {
+	labelSet := make(map[string]bool)
+	for _, label := range toKeep {
+		labelSet[label] = true
+	}
+
+	var result []prompb.Label
+	for _, label := range labels {
+		if labelSet[label.Name] {
+			result = append(result, label)
+		}
+	}
+
+	return result
+}
+
 func filterOutLabelsByName(labels []prompb.Label, toFilterOut []string) []prompb.Label {
 	labelSet := make(map[string]bool)
 	for _, label := range toFilterOut {
@@ -176,73 +155,19 @@ func filterOutLabelsByName(labels []prompb.Label, toFilterOut []string) []prompb
 	return result
 }
 
-func hostInfo2WriteRequest(hostinfo *hostinfo.HostInfo, samples []prompb.Sample, labelsToFilterOut []string) *prompb.WriteRequest {
-	// Labels must be sorted by name
-	labels := []prompb.Label{
-		{
-			Name:  "__name__",
-			Value: "system_cpu_logical_count",
-		},
-		{
-			Name:  "_id",
-			Value: hostinfo.HostId,
-		},
-		{
-			Name:  "billing_marketplace",
-			Value: hostinfo.Billing.Marketplace,
-		},
-		{
-			Name:  "billing_marketplace_account",
-			Value: hostinfo.Billing.MarketplaceAccount,
-		},
-		{
-			Name:  "billing_marketplace_instance_id",
-			Value: hostinfo.Billing.MarketplaceInstanceId,
-		},
-		{
-			Name:  "billing_model",
-			Value: hostinfo.Billing.Model,
-		},
-		{
-			Name:  "conversions_success",
-			Value: hostinfo.ConversionsSuccess,
-		},
-		{
-			Name:  "display_name",
-			Value: hostinfo.HostName,
-		},
-		{
-			Name:  "external_organization",
-			Value: hostinfo.ExternalOrganization,
-		},
-		{
-			Name:  "product",
-			Value: strings.Join(hostinfo.Product, ","),
-		},
-		{
-			Name:  "socket_count",
-			Value: hostinfo.SocketCount,
-		},
-		{
-			Name:  "support",
-			Value: hostinfo.Support,
-		},
-		{
-			Name:  "usage",
-			Value: hostinfo.Usage,
-		},
+// series2WriteRequest creates a request with one TimeSeries per series.
+// Series labels already include labels of the host.
+func series2WriteRequest(series []prompb.TimeSeries, labelProcessor *labelProcessor) *prompb.WriteRequest {
+	writeRequest := &prompb.WriteRequest{
+		Timeseries: make([]prompb.TimeSeries, 0, len(series)),
 	}
+	for _, ts := range series {
+		labels := labelProcessor.process(ts.Labels)
 
-	labels = filterEmptyLabels(labels)
-	labels = filterOutLabelsByName(labels, labelsToFilterOut)
-
-	writeRequest := &prompb.WriteRequest{
-		Timeseries: []prompb.TimeSeries{
-			{
-				Labels:  labels,
-				Samples: samples,
-			},
-		},
+		writeRequest.Timeseries = append(writeRequest.Timeseries, prompb.TimeSeries{
+			Labels:  labels,
+			Samples: ts.Samples,
+		})
 	}
 
 	return writeRequest
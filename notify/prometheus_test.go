@@ -1,6 +1,7 @@
 package notify
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -28,46 +29,6 @@ const (
 	testHostname = "host.example.test"
 )
 
-// Test that http client follows the environment Proxy settings
-//
-//   - this test is fragile as it is influenced by the environment as ProxyFromEnvironment
-//     is initialized only once, thus if any test before uses it without the env vars set then
-//     this will fail.
-func TestHttpClientProxy(t *testing.T) {
-	// Init
-	keypair, _, _, _ := createTestKeypair(t)
-	httpProxy := "http://proxy.example.com"
-	httpsProxy := "https://proxy.example.com"
-
-	t.Setenv("HTTP_PROXY", httpProxy)
-	t.Setenv("HTTPS_PROXY", httpsProxy)
-	client, err := newMTLSHttpClient(keypair, 1*time.Second)
-	checkError(t, err, "Failed to create http client")
-	proxyF := client.Transport.(*http.Transport).Proxy
-	if proxyF == nil {
-		t.Fatalf("Expected proxy function to be set")
-	}
-
-	// Test https proxy
-	httpsRequest, _ := http.NewRequest("GET", "https://example.com", nil)
-	checkError(t, err, "Failed to create http request")
-	proxyUrl, _ := proxyF(httpsRequest)
-	checkError(t, err, "Failed to get proxy url")
-	if proxyUrl == nil {
-		t.Fatalf("Expected proxy url to be set")
-	}
-	if proxyUrl.String() != httpsProxy {
-		t.Fatalf("Expected https proxy to be %s, got %s", httpsProxy, proxyUrl.String())
-	}
-
-	// Test http proxy
-	httpRequest, _ := http.NewRequest("GET", "http://example.com", nil)
-	proxyUrl, _ = proxyF(httpRequest)
-	if proxyUrl.String() != httpProxy {
-		t.Fatalf("Expected http proxy to be %s, got %s", httpProxy, proxyUrl.String())
-	}
-}
-
 // Test happy path of prometheus notifier
 func TestNotify(t *testing.T) {
 	// Initialize notifier and data
@@ -106,27 +67,35 @@ func TestNotify(t *testing.T) {
 	cfg.WriteUrl = server.URL + writeUrlPath
 
 	// Test that notify returns no error
-	err := n.Notify(samples, hostinfo)
+	err := n.Notify(context.Background(), samples, hostinfo)
 	checkError(t, err, "Failed to notify")
 	checkCalled(t, called, 1)
 
-	// Test that http client is still the same after next request
-	httpClient := n.client
-	err = n.Notify(samples, hostinfo)
+	// Test that http client and label processor are still the same after next request
+	httpClient := n.client.client
+	labelProcessor := n.labels.processor
+	err = n.Notify(context.Background(), samples, hostinfo)
 	checkError(t, err, "Failed to notify")
-	if httpClient != n.client {
+	if httpClient != n.client.client {
 		t.Fatalf("Expected client to be reused")
 	}
+	if labelProcessor == nil || labelProcessor != n.labels.processor {
+		t.Fatalf("Expected label processor to be reused")
+	}
 	checkCalled(t, called, 2)
 
-	// Test that http client is recreated when host info changes
+	// Test that http client and label processor are recreated when host info
+	// or configuration changes
 	n.HostChanged()
-	err = n.Notify(samples, hostinfo)
+	err = n.Notify(context.Background(), samples, hostinfo)
 	checkError(t, err, "Failed to notify")
 
-	if httpClient == n.client {
+	if httpClient == n.client.client {
 		t.Fatalf("Expected client to be recreated")
 	}
+	if labelProcessor == n.labels.processor {
+		t.Fatalf("Expected label processor to be recreated")
+	}
 	checkCalled(t, called, 3)
 }
 
@@ -141,13 +110,42 @@ func TestNotifyNoCert(t *testing.T) {
 	samples := createSamples()
 	hostinfo := createHostInfo()
 
-	err := n.Notify(samples, hostinfo)
+	err := n.Notify(context.Background(), samples, hostinfo)
 
 	if !strings.Contains(err.Error(), "no such file or directory") {
 		t.Fatal("Expected error on not finding certificate")
 	}
 }
 
+// Test that notifier with a certificate is authenticated by it instead of the host cert
+func TestNotifyWithCert(t *testing.T) {
+	useInsecureTLS(t)
+	cert, _, _, _ := createTestKeypair(t)
+	cfg := &config.Config{
+		HostCertPath:       "notfound",
+		HostCertKeyPath:    "notfound",
+		WriteRetryAttempts: 1,
+	}
+	n := NewNotifierWithCert(cfg, cert)
+
+	called := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called += 1
+		checkRequestUsesHostCert(t, r)
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAnyClientCert,
+	}
+	server.StartTLS()
+	defer server.Close()
+	cfg.WriteUrl = server.URL + writeUrlPath
+
+	err := n.Notify(context.Background(), createSamples(), createHostInfo())
+	checkError(t, err, "Failed to notify")
+	checkCalled(t, called, 1)
+}
+
 // Test that notify returns error when request fails
 func TestNotifyRequestError(t *testing.T) {
 	useInsecureTLS(t)
@@ -170,7 +168,7 @@ func TestNotifyRequestError(t *testing.T) {
 	defer server.Close()
 	cfg.WriteUrl = server.URL + writeUrlPath
 
-	err := n.Notify(samples, hostinfo)
+	err := n.Notify(context.Background(), samples, hostinfo)
 	if err == nil {
 		t.Fatal("Expected error on request failure")
 	}
@@ -211,7 +209,7 @@ func TestRetriesAndBackoff(t *testing.T) {
 	request, _ := http.NewRequest("POST", cfg.WriteUrl, nil)
 
 	// Test that retries are done as expected and it will fail
-	err := prometheusRemoteWrite(client, cfg, request)
+	err := prometheusRemoteWrite(context.Background(), client, cfg, request, 0)
 	if err == nil {
 		t.Fatal("Expected error on request failure")
 	}
@@ -221,7 +219,7 @@ func TestRetriesAndBackoff(t *testing.T) {
 	// Test that retries are done as expected and it will succeed
 	called = 0
 	cfg.WriteRetryAttempts = 3
-	err = prometheusRemoteWrite(client, cfg, request)
+	err = prometheusRemoteWrite(context.Background(), client, cfg, request, 0)
 	checkError(t, err, "Failed to send request")
 }
 
@@ -260,19 +258,19 @@ func TestNoRetriesOn4xx(t *testing.T) {
 	request, _ := http.NewRequest("POST", cfg.WriteUrl, nil)
 
 	// Test that retries are done as expected and it will fail
-	err := prometheusRemoteWrite(client, cfg, request)
+	err := prometheusRemoteWrite(context.Background(), client, cfg, request, 0)
 	checkExpectedErrorContains(t, err, "http Error: 400")
 	checkNonRecoverable(t, err)
 	checkCalled(t, called, 1)
 
 	// Test that retries are done on 429 but not on subsequent 404
-	err = prometheusRemoteWrite(client, cfg, request)
+	err = prometheusRemoteWrite(context.Background(), client, cfg, request, 0)
 	checkExpectedErrorContains(t, err, "http Error: 404")
 	checkNonRecoverable(t, err)
 	checkCalled(t, called, 1+2)
 
 	// Last request is 200 and that should succeed without retries
-	err = prometheusRemoteWrite(client, cfg, request)
+	err = prometheusRemoteWrite(context.Background(), client, cfg, request, 0)
 	checkError(t, err, "failed to send request")
 	checkCalled(t, called, 1+2+1)
 }
@@ -284,21 +282,28 @@ func TestLabels(t *testing.T) {
 	// With full host info
 	hi := createHostInfo()
 	createRequestAndCheckLabels(t, samples, hi)
-	writeRequest := hostInfo2WriteRequest(hi, samples, []string{})
+	writeRequest := series2WriteRequest(withHostLabels(samples, hi), newLabelProcessor(&config.Config{}))
 	checkLabelsPresence(t, writeRequest.Timeseries[0].Labels, []string{
 		"__name__",
 		"_id",
+		"addons",
 		"billing_marketplace",
 		"billing_marketplace_account",
 		"billing_marketplace_instance_id",
 		"billing_model",
+		"cloud_provider",
 		"conversions_success",
+		"cpu_count_mode",
 		"display_name",
 		"external_organization",
 		"product",
+		"role",
 		"socket_count",
 		"support",
 		"usage",
+		"virt_host_type",
+		"virt_is_guest",
+		"virt_uuid",
 	})
 
 	// With host info that is missing some values
@@ -319,6 +324,13 @@ func TestLabels(t *testing.T) {
 
 	hi.ConversionsSuccess = ""
 	createRequestAndCheckLabels(t, samples, hi)
+
+	// The default CPU count mode is not sent to continue series sent
+	// before the cpu_count_mode label existed
+	hi.CpuCountMode = "online"
+	createRequestAndCheckLabels(t, samples, hi)
+	writeRequest = series2WriteRequest(withHostLabels(samples, hi), newLabelProcessor(&config.Config{}))
+	checkLabelsNotPresent(t, writeRequest.Timeseries[0].Labels, []string{"cpu_count_mode"})
 }
 
 func TestLabelFiltering(t *testing.T) {
@@ -327,12 +339,56 @@ func TestLabelFiltering(t *testing.T) {
 	hi := createHostInfo()
 
 	// when
-	writeRequest := hostInfo2WriteRequest(hi, samples, []string{"display_name", "socket_count"})
+	writeRequest := series2WriteRequest(withHostLabels(samples, hi),
+		newLabelProcessor(&config.Config{LabelsDeny: []string{"display_name", "socket_count"}}))
 
 	// then
 	checkLabelsNotPresent(t, writeRequest.Timeseries[0].Labels, []string{"display_name", "socket_count"})
 }
 
+// Test that each series is sent as a separate TimeSeries with host labels
+func TestMultipleSeries(t *testing.T) {
+	// given
+	hi := createHostInfo()
+	series := []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "system_cpu_logical_count"}},
+			Samples: []prompb.Sample{{Value: 2, Timestamp: 1000}},
+		},
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "system_memory_total_bytes"},
+				{Name: "socket_count", Value: "2"},
+			},
+			Samples: []prompb.Sample{{Value: 1024, Timestamp: 1000}},
+		},
+	}
+
+	// when
+	writeRequest := series2WriteRequest(withHostLabels(series, hi), newLabelProcessor(&config.Config{}))
+
+	// then
+	if len(writeRequest.Timeseries) != 2 {
+		t.Fatalf("Expected 2 time series, got %d", len(writeRequest.Timeseries))
+	}
+	for idx, ts := range writeRequest.Timeseries {
+		checkLabels(t, ts.Labels)
+		if ts.Labels[0].Value != series[idx].Labels[0].Value {
+			t.Fatalf("Expected series %s, got %s", series[idx].Labels[0].Value, ts.Labels[0].Value)
+		}
+		if len(ts.Samples) != 1 || ts.Samples[0].Value != series[idx].Samples[0].Value {
+			t.Fatalf("Unexpected samples of series %s: %v", ts.Labels[0].Value, ts.Samples)
+		}
+	}
+
+	// Labels of the series take precedence over host labels
+	for _, label := range writeRequest.Timeseries[1].Labels {
+		if label.Name == "socket_count" && label.Value != "2" {
+			t.Fatalf("Expected socket_count label of the series, got %s", label.Value)
+		}
+	}
+}
+
 func TestFilterOutLabelsByName(t *testing.T) {
 	// given
 	labels := []prompb.Label{
@@ -353,63 +409,151 @@ func TestFilterOutLabelsByName(t *testing.T) {
 	}
 }
 
-type GetLabelsToFilterOutTestCase struct {
+type LabelProcessorTestCase struct {
 	name     string
 	cfg      *config.Config
 	expected []string
 }
 
-func TestGetLabelsToFilterOut(t *testing.T) {
-
-	testCases := []GetLabelsToFilterOutTestCase{
+func TestLabelProcessorSendHostname(t *testing.T) {
+	testCases := []LabelProcessorTestCase{
 		{
-			name:     "No labels to filter out - Default",
+			name:     "Send display name - Default",
 			cfg:      &config.Config{},
-			expected: []string{},
+			expected: []string{"__name__", "_id", "display_name"},
 		},
 		{
 			name: "Filter out display name, send_hostname set to no",
 			cfg: &config.Config{
 				SendHostname: config.SendHostnameNo,
 			},
-			expected: []string{"display_name"},
+			expected: []string{"__name__", "_id"},
 		},
 		{
 			name: "Nothing to filter out, send_hostname set to yes",
 			cfg: &config.Config{
 				SendHostname: config.SendHostnameYes,
 			},
-			expected: []string{},
+			expected: []string{"__name__", "_id", "display_name"},
 		},
 		{
 			name: "Nothing to filter out, send_hostname set unexpected value",
 			cfg: &config.Config{
 				SendHostname: "unexpected",
 			},
-			expected: []string{},
+			expected: []string{"__name__", "_id", "display_name"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// when
+			labels := newLabelProcessor(tc.cfg).process([]prompb.Label{
+				{Name: "__name__", Value: "system_cpu_logical_count"},
+				{Name: "_id", Value: "test"},
+				{Name: "display_name", Value: "host"},
+			})
+
+			// then
+			checkLabelNames(t, labels, tc.expected)
+		})
+	}
+}
+
+// Test that the label processor is created once and again after the
+// configuration is reloaded in place.
+func TestLabelProcessorHolder(t *testing.T) {
+	cfg := &config.Config{Labels: map[string]string{"environment": "prod"}}
+	holder := newLabelProcessorHolder(cfg)
+	series := []prompb.Label{{Name: "__name__", Value: "system_cpu_logical_count"}}
+
+	p := holder.get()
+	checkLabelNames(t, p.process(series), []string{"__name__", "environment"})
+	if holder.get() != p {
+		t.Fatalf("Expected label processor to be reused")
+	}
+
+	*cfg = config.Config{Labels: map[string]string{"cluster": "east"}}
+	holder.HostChanged()
+	checkLabelNames(t, holder.get().process(series), []string{"__name__", "cluster"})
+}
+
+func TestLabelProcessor(t *testing.T) {
+	series := []prompb.Label{
+		{Name: "__name__", Value: "system_cpu_logical_count"},
+		{Name: "_id", Value: "01234567-89ab-cdef-0123-456789abcdef"},
+		{Name: "billing_model", Value: ""},
+		{Name: "display_name", Value: "host.example.com"},
+		{Name: "usage", Value: "Production"},
+	}
+
+	testCases := []LabelProcessorTestCase{
+		{
+			name:     "Static labels are added, labels of the series take precedence",
+			cfg:      &config.Config{Labels: map[string]string{"environment": "prod", "usage": "static"}},
+			expected: []string{"__name__=system_cpu_logical_count", "_id=01234567-89ab-cdef-0123-456789abcdef", "display_name=host.example.com", "environment=prod", "usage=Production"},
+		},
+		{
+			name:     "Only allowed labels and the metric name are sent",
+			cfg:      &config.Config{LabelsAllow: []string{"_id", "billing_model"}},
+			expected: []string{"__name__=system_cpu_logical_count", "_id=01234567-89ab-cdef-0123-456789abcdef"},
+		},
+		{
+			name:     "Denied labels are not sent",
+			cfg:      &config.Config{LabelsDeny: []string{"__name__", "usage"}},
+			expected: []string{"__name__=system_cpu_logical_count", "_id=01234567-89ab-cdef-0123-456789abcdef", "display_name=host.example.com"},
+		},
+		{
+			name: "Labels are relabeled in order",
+			cfg: &config.Config{
+				LabelsDeny: []string{"display_name"},
+				Relabels: []config.Relabel{
+					{Name: "1-shard", Action: "hashmod", SourceLabels: []string{"display_name"}, TargetLabel: "shard", Modulus: 1, Regex: "(.*)"},
+					{Name: "2-usage", Action: "lowercase", SourceLabels: []string{"usage"}, TargetLabel: "usage", Regex: "(.*)", Replacement: "$1"},
+					{Name: "3-domain", Action: "replace", SourceLabels: []string{"display_name"}, Regex: "[^.]*\\.(.*)", TargetLabel: "domain", Replacement: "$1"},
+					{Name: "4-name", Action: "labeldrop", Regex: "__name__|_id", Separator: ";", Replacement: "$1"},
+				},
+			},
+			expected: []string{"__name__=system_cpu_logical_count", "domain=example.com", "shard=0", "usage=production"},
+		},
+		{
+			name:     "Labels with invalid names are dropped",
+			cfg:      &config.Config{Labels: map[string]string{"cost-center": "1234"}},
+			expected: []string{"__name__=system_cpu_logical_count", "_id=01234567-89ab-cdef-0123-456789abcdef", "display_name=host.example.com", "usage=Production"},
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			// when
-			labels := getLabelsToFilterOut(tc.cfg)
+			labels := newLabelProcessor(tc.cfg).process(series)
 
 			// then
-			if len(labels) != len(tc.expected) {
-				t.Fatalf("Expected %d labels, got %d: %s", len(tc.expected), len(labels), labels)
+			var actual []string
+			for _, label := range labels {
+				actual = append(actual, label.Name+"="+label.Value)
 			}
-			for i := range labels {
-				if labels[i] != tc.expected[i] {
-					t.Fatalf("Expected labels to be equal")
-				}
+			if strings.Join(actual, " ") != strings.Join(tc.expected, " ") {
+				t.Fatalf("Expected labels %v, got %v", tc.expected, actual)
 			}
 		})
 	}
 }
 
-func createRequestAndCheckLabels(t *testing.T, samples []prompb.Sample, hostinfo *hostinfo.HostInfo) {
-	writeRequest := hostInfo2WriteRequest(hostinfo, samples, []string{})
+func checkLabelNames(t *testing.T, labels []prompb.Label, expected []string) {
+	t.Helper()
+	if len(labels) != len(expected) {
+		t.Fatalf("Expected %d labels, got %d: %v", len(expected), len(labels), labels)
+	}
+	for i := range labels {
+		if labels[i].Name != expected[i] {
+			t.Fatalf("Expected label %s, got %s", expected[i], labels[i].Name)
+		}
+	}
+}
+
+func createRequestAndCheckLabels(t *testing.T, samples []prompb.TimeSeries, hostinfo *hostinfo.HostInfo) {
+	writeRequest := series2WriteRequest(withHostLabels(samples, hostinfo), newLabelProcessor(&config.Config{}))
 	for _, ts := range writeRequest.Timeseries {
 		checkLabels(t, ts.Labels)
 	}
@@ -576,11 +720,29 @@ func useInsecureTLS(t *testing.T) {
 	})
 }
 
-// Some Samples ordered by timestamp
-func createSamples() []prompb.Sample {
-	return []prompb.Sample{
-		{Value: 1, Timestamp: time.Now().UnixMilli()},
-		{Value: 2, Timestamp: time.Now().UnixMilli() + 1},
+// Some Samples of a single series ordered by timestamp
+// withHostLabels adds labels of the host to the series as done
+// by the daemon when the samples are collected.
+func withHostLabels(series []prompb.TimeSeries, hostinfo *hostinfo.HostInfo) []prompb.TimeSeries {
+	result := make([]prompb.TimeSeries, 0, len(series))
+	for _, ts := range series {
+		result = append(result, prompb.TimeSeries{
+			Labels:  MergeLabels(ts.Labels, HostInfoLabels(hostinfo)),
+			Samples: ts.Samples,
+		})
+	}
+	return result
+}
+
+func createSamples() []prompb.TimeSeries {
+	return []prompb.TimeSeries{
+		{
+			Labels: []prompb.Label{{Name: "__name__", Value: "system_cpu_logical_count"}},
+			Samples: []prompb.Sample{
+				{Value: 1, Timestamp: time.Now().UnixMilli()},
+				{Value: 2, Timestamp: time.Now().UnixMilli() + 1},
+			},
+		},
 	}
 }
 
@@ -588,12 +750,15 @@ func createSamples() []prompb.Sample {
 func createHostInfo() *hostinfo.HostInfo {
 	return &hostinfo.HostInfo{
 		CpuCount:             1,
+		CpuCountMode:         "present",
 		HostId:               "test",
 		HostName:             testHostname,
 		SocketCount:          "1",
 		Product:              []string{"123", "456"},
 		Support:              "test support",
 		Usage:                "test usage",
+		Role:                 "test role",
+		Addons:               []string{"test addon", "test other addon"},
 		ConversionsSuccess:   "true",
 		ExternalOrganization: "test external organization",
 		Billing: hostinfo.BillingInfo{
@@ -602,6 +767,12 @@ func createHostInfo() *hostinfo.HostInfo {
 			MarketplaceAccount:    "test marketplace account",
 			MarketplaceInstanceId: "test marketplace instance id",
 		},
+		Virt: hostinfo.VirtInfo{
+			IsGuest:  "true",
+			HostType: "kvm",
+			UUID:     "test uuid",
+		},
+		CloudProvider: "test cloud provider",
 	}
 }
 
@@ -0,0 +1,159 @@
+package notify
+
+import (
+	"github.com/RedHatInsights/host-metering/collector"
+	"github.com/gogo/protobuf/proto"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// See https://prometheus.io/docs/specs/prw/remote_write_spec_2_0/ for specification of Prometheus remote write 2.0
+
+const (
+	remoteWriteContentTypeV2 = "application/x-protobuf;proto=io.prometheus.write.v2.Request"
+	remoteWriteVersionV2     = "2.0.0"
+)
+
+// Values of io.prometheus.write.v2.Metadata.MetricType.
+const (
+	metricTypeUnspecified uint64 = 0
+	metricTypeCounter     uint64 = 1
+	metricTypeGauge       uint64 = 2
+)
+
+// writeRequestV2 represents io.prometheus.write.v2.Request. It is encoded
+// by hand as prompb supports only remote write 1.0 messages. Strings are
+// interned in the symbols table and referenced by their index.
+type writeRequestV2 struct {
+	Symbols    []string
+	Timeseries []timeSeriesV2
+
+	symbolRefs map[string]uint32
+}
+
+type timeSeriesV2 struct {
+	LabelsRefs []uint32
+	Samples    []prompb.Sample
+	Metadata   metadataV2
+}
+
+type metadataV2 struct {
+	Type    uint64
+	HelpRef uint32
+	UnitRef uint32
+}
+
+func newWriteRequestV2() *writeRequestV2 {
+	// The first symbol must be an empty string.
+	return &writeRequestV2{
+		Symbols:    []string{""},
+		symbolRefs: map[string]uint32{"": 0},
+	}
+}
+
+// symbolRef returns the index of the string in the symbols table.
+func (r *writeRequestV2) symbolRef(s string) uint32 {
+	ref, ok := r.symbolRefs[s]
+	if !ok {
+		ref = uint32(len(r.Symbols))
+		r.Symbols = append(r.Symbols, s)
+		r.symbolRefs[s] = ref
+	}
+	return ref
+}
+
+// series2WriteRequestV2 creates a remote write 2.0 request with one TimeSeries
+// per series and metadata of the known metrics.
+func series2WriteRequestV2(series []prompb.TimeSeries, labelProcessor *labelProcessor) *writeRequestV2 {
+	writeRequest := newWriteRequestV2()
+	for _, ts := range series {
+		labels := labelProcessor.process(ts.Labels)
+
+		timeSeries := timeSeriesV2{
+			LabelsRefs: make([]uint32, 0, 2*len(labels)),
+			Samples:    ts.Samples,
+		}
+		for _, label := range labels {
+			timeSeries.LabelsRefs = append(timeSeries.LabelsRefs,
+				writeRequest.symbolRef(label.Name), writeRequest.symbolRef(label.Value))
+			if label.Name == "__name__" {
+				timeSeries.Metadata = writeRequest.metadata(label.Value)
+			}
+		}
+		writeRequest.Timeseries = append(writeRequest.Timeseries, timeSeries)
+	}
+	return writeRequest
+}
+
+func (r *writeRequestV2) metadata(name string) metadataV2 {
+	m, ok := collector.MetadataOf(name)
+	if !ok {
+		return metadataV2{}
+	}
+
+	metadata := metadataV2{Type: metricTypeUnspecified}
+	switch m.Type {
+	case collector.MetricTypeGauge:
+		metadata.Type = metricTypeGauge
+	case collector.MetricTypeCounter:
+		metadata.Type = metricTypeCounter
+	}
+	if m.Help != "" {
+		metadata.HelpRef = r.symbolRef(m.Help)
+	}
+	if m.Unit != "" {
+		metadata.UnitRef = r.symbolRef(m.Unit)
+	}
+	return metadata
+}
+
+// Marshal encodes the request in the protobuf wire format. Fields with
+// default values are omitted as required by proto3.
+func (r *writeRequestV2) Marshal() []byte {
+	buf := proto.NewBuffer(nil)
+	for _, symbol := range r.Symbols {
+		encodeStringField(buf, 4, symbol)
+	}
+	for _, ts := range r.Timeseries {
+		encodeBytesField(buf, 5, ts.marshal())
+	}
+	return buf.Bytes()
+}
+
+func (ts *timeSeriesV2) marshal() []byte {
+	buf := proto.NewBuffer(nil)
+	if len(ts.LabelsRefs) > 0 {
+		refs := proto.NewBuffer(nil)
+		for _, ref := range ts.LabelsRefs {
+			_ = refs.EncodeVarint(uint64(ref))
+		}
+		encodeBytesField(buf, 1, refs.Bytes())
+	}
+	for _, sample := range ts.Samples {
+		s := proto.NewBuffer(nil)
+		if sample.Value != 0 {
+			encodeDoubleField(s, 1, sample.Value)
+		}
+		if sample.Timestamp != 0 {
+			encodeVarintField(s, 2, uint64(sample.Timestamp))
+		}
+		encodeBytesField(buf, 2, s.Bytes())
+	}
+	if metadata := ts.Metadata.marshal(); len(metadata) > 0 {
+		encodeBytesField(buf, 5, metadata)
+	}
+	return buf.Bytes()
+}
+
+func (m *metadataV2) marshal() []byte {
+	buf := proto.NewBuffer(nil)
+	if m.Type != 0 {
+		encodeVarintField(buf, 1, m.Type)
+	}
+	if m.HelpRef != 0 {
+		encodeVarintField(buf, 3, uint64(m.HelpRef))
+	}
+	if m.UnitRef != 0 {
+		encodeVarintField(buf, 4, uint64(m.UnitRef))
+	}
+	return buf.Bytes()
+}
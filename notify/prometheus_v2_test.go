@@ -0,0 +1,277 @@
+package notify
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RedHatInsights/host-metering/config"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Test that remote write 2.0 request contains the same series as 1.0 request
+func TestWriteRequestV2(t *testing.T) {
+	// given
+	series := withHostLabels(createSamples(), createHostInfo())
+
+	// when
+	cfg := &config.Config{LabelsDeny: []string{"display_name"}}
+	data := series2WriteRequestV2(series, newLabelProcessor(cfg)).Marshal()
+
+	// then
+	writeRequest, err := decodeWriteRequestV2(data)
+	checkError(t, err, "Failed to decode request")
+	expected := series2WriteRequest(series, newLabelProcessor(cfg))
+	if writeRequest.Symbols[0] != "" {
+		t.Fatalf("Expected first symbol to be empty, got: %s", writeRequest.Symbols[0])
+	}
+	checkUniqueSymbols(t, writeRequest.Symbols)
+	if len(writeRequest.Timeseries) != len(expected.Timeseries) {
+		t.Fatalf("Expected %d time series, got %d", len(expected.Timeseries), len(writeRequest.Timeseries))
+	}
+	for idx, ts := range writeRequest.Timeseries {
+		labels := resolveLabels(t, writeRequest.Symbols, ts.LabelsRefs)
+		checkLabels(t, labels)
+		checkLabelsEqual(t, labels, expected.Timeseries[idx].Labels)
+		checkSamplesEqual(t, ts.Samples, expected.Timeseries[idx].Samples)
+	}
+
+	// Metadata of known metrics are sent
+	metadata := writeRequest.Timeseries[0].Metadata
+	if metadata.Type != metricTypeGauge {
+		t.Fatalf("Expected gauge metric type, got %d", metadata.Type)
+	}
+	if writeRequest.Symbols[metadata.HelpRef] != "Number of logical CPUs of the host." {
+		t.Fatalf("Unexpected help: %s", writeRequest.Symbols[metadata.HelpRef])
+	}
+	if metadata.UnitRef != 0 {
+		t.Fatalf("Expected no unit, got %s", writeRequest.Symbols[metadata.UnitRef])
+	}
+}
+
+func TestNotifyPrometheusV2(t *testing.T) {
+	// Initialize notifier and data
+	useInsecureTLS(t)
+	_, certPath, keyPath, _ := createTestKeypair(t)
+	cfg := &config.Config{
+		WriteProtocol:      config.WriteProtocolPrometheusV2,
+		HostCertPath:       certPath,
+		HostCertKeyPath:    keyPath,
+		WriteRetryAttempts: 1,
+	}
+	n := NewPrometheusNotifier(cfg)
+	samples := createSamples()
+	hostinfo := createHostInfo()
+
+	// Initialize mock server
+	called := 0
+	samplesWritten := ""
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called += 1
+
+		// Test that request is in prometheus remote write 2.0 format
+		checkPrometheusRemoteWriteV2Headers(t, r)
+		checkRequestBodyV2(t, r)
+
+		if samplesWritten != "" {
+			w.Header().Set(samplesWrittenHeader, samplesWritten)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAnyClientCert,
+	}
+	server.StartTLS()
+	defer server.Close()
+	cfg.WriteUrl = server.URL + writeUrlPath
+
+	// Test that all samples are confirmed
+	samplesWritten = "2"
+	err := n.Notify(context.Background(), samples, hostinfo)
+	checkError(t, err, "Failed to notify")
+	checkCalled(t, called, 1)
+
+	// Test that server without confirmation is trusted
+	samplesWritten = ""
+	err = n.Notify(context.Background(), samples, hostinfo)
+	checkError(t, err, "Failed to notify")
+	checkCalled(t, called, 2)
+
+	// Test that partial write is not retried
+	samplesWritten = "1"
+	err = n.Notify(context.Background(), samples, hostinfo)
+	checkExpectedErrorContains(t, err, "only 1 of 2 sample(s) written")
+	checkNonRecoverable(t, err)
+	checkCalled(t, called, 3)
+}
+
+// Helper checks
+
+func checkPrometheusRemoteWriteV2Headers(t *testing.T, r *http.Request) {
+	if r.Header.Get("Content-Encoding") != "snappy" {
+		t.Errorf(
+			"Expected: `Content-Encoding: snappy` header, got: `%s`",
+			r.Header.Get("Content-Encoding"))
+	}
+	if r.Header.Get("Content-Type") != "application/x-protobuf;proto=io.prometheus.write.v2.Request" {
+		t.Errorf(
+			"Expected: `Content-Type: application/x-protobuf;proto=io.prometheus.write.v2.Request` header, got: `%s`",
+			r.Header.Get("Content-Type"))
+	}
+	if r.Header.Get("X-Prometheus-Remote-Write-Version") != "2.0.0" {
+		t.Errorf(
+			"Expected: `X-Prometheus-Remote-Write-Version: 2.0.0` header, got: `%s`",
+			r.Header.Get("X-Prometheus-Remote-Write-Version"))
+	}
+}
+
+func checkRequestBodyV2(t *testing.T, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Errorf("Failed to decode body with snappy %s", err)
+	}
+	if _, err := decodeWriteRequestV2(decoded); err != nil {
+		t.Errorf("Failed to unmarshal as protobuf message %s", err)
+	}
+}
+
+func checkUniqueSymbols(t *testing.T, symbols []string) {
+	seen := make(map[string]bool)
+	for _, symbol := range symbols {
+		if seen[symbol] {
+			t.Fatalf("Expected interned symbols, got duplicate: %s", symbol)
+		}
+		seen[symbol] = true
+	}
+}
+
+func resolveLabels(t *testing.T, symbols []string, refs []uint32) []prompb.Label {
+	if len(refs)%2 != 0 {
+		t.Fatalf("Expected pairs of label references, got %v", refs)
+	}
+	labels := make([]prompb.Label, 0, len(refs)/2)
+	for i := 0; i < len(refs); i += 2 {
+		if int(refs[i+1]) >= len(symbols) {
+			t.Fatalf("Label reference out of range: %d", refs[i+1])
+		}
+		labels = append(labels, prompb.Label{Name: symbols[refs[i]], Value: symbols[refs[i+1]]})
+	}
+	return labels
+}
+
+func checkLabelsEqual(t *testing.T, labels []prompb.Label, expected []prompb.Label) {
+	if len(labels) != len(expected) {
+		t.Fatalf("Expected labels %v, got %v", expected, labels)
+	}
+	for idx := range labels {
+		if labels[idx].Name != expected[idx].Name || labels[idx].Value != expected[idx].Value {
+			t.Fatalf("Expected labels %v, got %v", expected, labels)
+		}
+	}
+}
+
+func checkSamplesEqual(t *testing.T, samples []prompb.Sample, expected []prompb.Sample) {
+	if len(samples) != len(expected) {
+		t.Fatalf("Expected samples %v, got %v", expected, samples)
+	}
+	for idx := range samples {
+		if samples[idx].Value != expected[idx].Value || samples[idx].Timestamp != expected[idx].Timestamp {
+			t.Fatalf("Expected samples %v, got %v", expected, samples)
+		}
+	}
+}
+
+// Minimal protobuf decoder of remote write 2.0 messages.
+
+func decodeWriteRequestV2(data []byte) (*writeRequestV2, error) {
+	fields, err := decodeFields(data)
+	if err != nil {
+		return nil, err
+	}
+	writeRequest := &writeRequestV2{}
+	for _, field := range fields {
+		switch field.number {
+		case 4:
+			writeRequest.Symbols = append(writeRequest.Symbols, string(field.bytes))
+		case 5:
+			ts, err := decodeTimeSeriesV2(field.bytes)
+			if err != nil {
+				return nil, err
+			}
+			writeRequest.Timeseries = append(writeRequest.Timeseries, *ts)
+		default:
+			return nil, fmt.Errorf("unexpected field %d of Request", field.number)
+		}
+	}
+	for _, ts := range writeRequest.Timeseries {
+		for _, ref := range ts.LabelsRefs {
+			if int(ref) >= len(writeRequest.Symbols) {
+				return nil, fmt.Errorf("label reference out of range: %d", ref)
+			}
+		}
+	}
+	return writeRequest, nil
+}
+
+func decodeTimeSeriesV2(data []byte) (*timeSeriesV2, error) {
+	fields, err := decodeFields(data)
+	if err != nil {
+		return nil, err
+	}
+	ts := &timeSeriesV2{}
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			refs := field.bytes
+			for len(refs) > 0 {
+				ref, n := binary.Uvarint(refs)
+				if n <= 0 {
+					return nil, fmt.Errorf("invalid label reference")
+				}
+				ts.LabelsRefs = append(ts.LabelsRefs, uint32(ref))
+				refs = refs[n:]
+			}
+		case 2:
+			sampleFields, err := decodeFields(field.bytes)
+			if err != nil {
+				return nil, err
+			}
+			sample := prompb.Sample{}
+			for _, f := range sampleFields {
+				switch f.number {
+				case 1:
+					sample.Value = math.Float64frombits(f.value)
+				case 2:
+					sample.Timestamp = int64(f.value)
+				}
+			}
+			ts.Samples = append(ts.Samples, sample)
+		case 5:
+			metadataFields, err := decodeFields(field.bytes)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range metadataFields {
+				switch f.number {
+				case 1:
+					ts.Metadata.Type = f.value
+				case 3:
+					ts.Metadata.HelpRef = uint32(f.value)
+				case 4:
+					ts.Metadata.UnitRef = uint32(f.value)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unexpected field %d of TimeSeries", field.number)
+		}
+	}
+	return ts, nil
+}
@@ -0,0 +1,94 @@
+package notify
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+// Helpers for encoding protobuf messages which have no generated Go types
+// in the dependencies. Fields with default values are omitted by the callers
+// as required by proto3.
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+func encodeTag(buf *proto.Buffer, field uint64, wireType uint64) {
+	_ = buf.EncodeVarint(field<<3 | wireType)
+}
+
+func encodeVarintField(buf *proto.Buffer, field uint64, value uint64) {
+	encodeTag(buf, field, wireVarint)
+	_ = buf.EncodeVarint(value)
+}
+
+func encodeFixed64Field(buf *proto.Buffer, field uint64, value uint64) {
+	encodeTag(buf, field, wireFixed64)
+	_ = buf.EncodeFixed64(value)
+}
+
+func encodeDoubleField(buf *proto.Buffer, field uint64, value float64) {
+	encodeFixed64Field(buf, field, math.Float64bits(value))
+}
+
+func encodeStringField(buf *proto.Buffer, field uint64, value string) {
+	encodeTag(buf, field, wireBytes)
+	_ = buf.EncodeStringBytes(value)
+}
+
+func encodeBytesField(buf *proto.Buffer, field uint64, value []byte) {
+	encodeTag(buf, field, wireBytes)
+	_ = buf.EncodeRawBytes(value)
+}
+
+// protoField is a decoded field, value holds varint and fixed64 values
+// and bytes holds length-delimited values.
+type protoField struct {
+	number uint64
+	value  uint64
+	bytes  []byte
+}
+
+// decodeFields decodes fields of a message without knowing its schema.
+func decodeFields(data []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid field key")
+		}
+		data = data[n:]
+		field := protoField{number: key >> 3}
+		switch key & 7 {
+		case wireVarint:
+			field.value, n = binary.Uvarint(data)
+			if n <= 0 {
+				return nil, fmt.Errorf("invalid varint of field %d", field.number)
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return nil, fmt.Errorf("invalid fixed64 of field %d", field.number)
+			}
+			field.value = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return nil, fmt.Errorf("invalid length of field %d", field.number)
+			}
+			field.bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			return nil, fmt.Errorf("unexpected wire type of field %d", field.number)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
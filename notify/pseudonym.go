@@ -0,0 +1,98 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Size of a generated key of hashed labels.
+const labelHashKeySize = 32
+
+// LoadLabelHashKey reads the key of hashed labels. A new random key is
+// generated when the file doesn't exist, so that digests are stable across
+// restarts. The key must be readable only by its owner, the user running
+// host-metering.
+func LoadLabelHashKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no label hash key path")
+	}
+	key, err := readLabelHashKey(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := generateLabelHashKey(path); err != nil && !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed to generate label hash key: %w", err)
+		}
+		key, err = readLabelHashKey(path)
+	}
+	return key, err
+}
+
+func readLabelHashKey(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("label hash key %s must not be accessible by group or others, has mode %s",
+			path, info.Mode().Perm())
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Geteuid() {
+		return nil, fmt.Errorf("label hash key %s must be owned by uid %d, is owned by uid %d",
+			path, os.Geteuid(), stat.Uid)
+	}
+
+	key, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("label hash key %s is empty", path)
+	}
+	return key, nil
+}
+
+func generateLabelHashKey(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	key := make([]byte, labelHashKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(key); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+// hashLabelValue returns the hex encoded HMAC-SHA256 digest of the value.
+func hashLabelValue(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// LabelHashKeyFingerprint identifies the key without revealing it,
+// a changed fingerprint means that digests of hashed labels changed.
+func LabelHashKeyFingerprint(key []byte) string {
+	return hashLabelValue(key, "host-metering label hash key")[:16]
+}
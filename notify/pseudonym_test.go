@@ -0,0 +1,156 @@
+package notify
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/RedHatInsights/host-metering/config"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestLoadLabelHashKey(t *testing.T) {
+	path := t.TempDir() + "/keys/label-hash.key"
+
+	// A missing key is generated
+	key, err := LoadLabelHashKey(path)
+	checkError(t, err, "Failed to generate key")
+	if len(key) != labelHashKeySize {
+		t.Fatalf("Expected key of %d bytes, got %d", labelHashKeySize, len(key))
+	}
+	info, err := os.Stat(path)
+	checkError(t, err, "Key not written")
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("Expected key readable only by owner, got mode %s", info.Mode().Perm())
+	}
+
+	// The same key is loaded again
+	loaded, err := LoadLabelHashKey(path)
+	checkError(t, err, "Failed to load key")
+	if string(loaded) != string(key) {
+		t.Fatalf("Expected the generated key to be loaded")
+	}
+
+	// Missing keys which cannot be created fail, procfs doesn't allow
+	// creating directories even to root
+	_, err = LoadLabelHashKey("/proc/host-metering-test/label-hash.key")
+	if err == nil || !strings.Contains(err.Error(), "failed to generate label hash key") {
+		t.Fatalf("Expected error of key generation, got: %v", err)
+	}
+
+	// Keys accessible by others are rejected
+	os.Chmod(path, 0o644)
+	_, err = LoadLabelHashKey(path)
+	if err == nil || !strings.Contains(err.Error(), "must not be accessible by group or others") {
+		t.Fatalf("Expected error of key permissions, got: %v", err)
+	}
+}
+
+func TestHashedLabels(t *testing.T) {
+	path := t.TempDir() + "/label-hash.key"
+	if err := os.WriteFile(path, []byte("secret"), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	cfg := &config.Config{
+		LabelModes: map[string]string{
+			"__name__":                    config.LabelModeHash,
+			"billing_marketplace_account": config.LabelModeHash,
+			"display_name":                config.LabelModeHash,
+			"_id":                         config.LabelModeDrop,
+			"usage":                       config.LabelModeSend,
+		},
+		LabelHashKeyPath: path,
+	}
+	series := []prompb.Label{
+		{Name: "__name__", Value: "system_cpu_logical_count"},
+		{Name: "_id", Value: "test"},
+		{Name: "billing_marketplace_account", Value: "000000000000"},
+		{Name: "display_name", Value: "host.example.com"},
+		{Name: "usage", Value: "Production"},
+	}
+
+	// when
+	labels := newLabelProcessor(cfg).process(series)
+
+	// then the digests are HMAC-SHA256 of the values, the metric name is kept
+	checkLabelNames(t, labels, []string{"__name__", "billing_marketplace_account", "display_name", "usage"})
+	checkString(t, labels[0].Value, "system_cpu_logical_count")
+	checkString(t, labels[1].Value, "4dae911f1d82778b10b49e9188ab4f15568fad45307c8b231014a267e47c8a5f")
+	checkString(t, labels[2].Value, hashLabelValue([]byte("secret"), "host.example.com"))
+	checkString(t, labels[3].Value, "Production")
+
+	// Hashed labels are not sent in clear without a key
+	os.Chmod(path, 0o644)
+	labels = newLabelProcessor(cfg).process(series)
+	checkLabelNames(t, labels, []string{"__name__", "usage"})
+}
+
+// Test that relabeling doesn't send values of hashed or dropped labels in clear.
+func TestHashedLabelsRelabeled(t *testing.T) {
+	path := t.TempDir() + "/label-hash.key"
+	if err := os.WriteFile(path, []byte("secret"), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	cfg := &config.Config{
+		LabelModes: map[string]string{
+			"display_name": config.LabelModeHash,
+			"_id":          config.LabelModeDrop,
+		},
+		LabelHashKeyPath: path,
+		Relabels: []config.Relabel{
+			{Name: "1-host", Action: "replace", SourceLabels: []string{"display_name"}, TargetLabel: "host",
+				Regex: "(.*)", Separator: ";", Replacement: "$1"},
+			{Name: "2-id", Action: "replace", SourceLabels: []string{"_id"}, TargetLabel: "id",
+				Regex: "(.+)", Separator: ";", Replacement: "$1"},
+		},
+	}
+	series := []prompb.Label{
+		{Name: "__name__", Value: "system_cpu_logical_count"},
+		{Name: "_id", Value: "test"},
+		{Name: "display_name", Value: "host.example.com"},
+	}
+
+	// when
+	labels := newLabelProcessor(cfg).process(series)
+
+	// then the copy has the digest and the dropped label is not copied
+	digest := hashLabelValue([]byte("secret"), "host.example.com")
+	checkLabelNames(t, labels, []string{"__name__", "display_name", "host"})
+	checkString(t, labels[1].Value, digest)
+	checkString(t, labels[2].Value, digest)
+}
+
+func TestExplainLabels(t *testing.T) {
+	cfg := &config.Config{
+		LabelModes: map[string]string{"_id": config.LabelModeDrop},
+		Labels:     map[string]string{"environment": "prod"},
+		Relabels: []config.Relabel{
+			{Name: "usage", Action: "lowercase", SourceLabels: []string{"usage"}, TargetLabel: "usage",
+				Regex: "(.*)", Separator: ";", Replacement: "$1"},
+		},
+	}
+	series := []prompb.Label{
+		{Name: "__name__", Value: "system_cpu_logical_count"},
+		{Name: "_id", Value: "test"},
+		{Name: "usage", Value: "Production"},
+	}
+
+	// when
+	explanations := ExplainLabels(cfg, series)
+
+	// then
+	var actual []string
+	for _, e := range explanations {
+		actual = append(actual, e.Name+":"+e.Mode+":"+e.Value+":"+e.SentValue)
+	}
+	checkString(t, strings.Join(actual, " "),
+		"__name__:send:system_cpu_logical_count:system_cpu_logical_count _id:drop:test: "+
+			"environment:add::prod usage:send:Production:production")
+}
+
+func checkString(t *testing.T, actual string, expected string) {
+	t.Helper()
+	if actual != expected {
+		t.Fatalf("Expected %q, got %q", expected, actual)
+	}
+}